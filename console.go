@@ -13,10 +13,11 @@ import (
 var ConsoleLogger = consoleLogger{}
 
 type consoleLogger struct {
-	info, warn, err *log.Logger
+	debug, info, warn, err *log.Logger
 }
 
 func init() {
+	ConsoleLogger.debug = log.New(os.Stderr, "D: ", log.Ltime)
 	ConsoleLogger.info = log.New(os.Stderr, "I: ", log.Ltime)
 	ConsoleLogger.warn = log.New(os.Stderr, "W: ", log.Ltime)
 	ConsoleLogger.err = log.New(os.Stderr, "E: ", log.Ltime)
@@ -46,3 +47,16 @@ func (c consoleLogger) Infof(format string, a ...interface{}) error {
 	c.info.Printf(format, a...)
 	return nil
 }
+func (c consoleLogger) Log(level Level, msg string, kv ...interface{}) error {
+	l := c.info
+	switch level {
+	case LevelDebug:
+		l = c.debug
+	case LevelWarning:
+		l = c.warn
+	case LevelError:
+		l = c.err
+	}
+	l.Print(formatFields(msg, kv))
+	return nil
+}
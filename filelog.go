@@ -0,0 +1,160 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileLogger appends log lines to a file the program writes itself. After
+// logrotate moved the file away, ReopenLogs opens the path again; call it
+// from the ReopenLogs of a LogReopener, which Run calls on SIGUSR1.
+type FileLogger struct {
+	name string
+	path string
+	errs chan<- error
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileLogger opens path for appending, creating it if missing. Lines are
+// prefixed with the time, the name and the level. If errs is non-nil errors
+// are sent on errs as well as returned from the Logger's functions.
+func NewFileLogger(name, path string, errs chan<- error) (*FileLogger, error) {
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLogger{name: name, path: path, errs: errs, f: f}, nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// ReopenLogs opens the path again and closes the file written so far. If the
+// path can't be opened the logger keeps writing to the old file.
+func (l *FileLogger) ReopenLogs() error {
+	f, err := openLogFile(l.path)
+	if err != nil {
+		return l.send(err)
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	return l.send(old.Close())
+}
+
+// Close closes the file. Later messages fail.
+func (l *FileLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+func (l *FileLogger) send(err error) error {
+	if err != nil && l.errs != nil {
+		l.errs <- err
+	}
+	return err
+}
+
+func (l *FileLogger) write(level, message string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := fmt.Fprintf(l.f, "%s %s %s: %s\n", time.Now().Format(time.RFC3339), l.name, level, message)
+	return l.send(err)
+}
+
+func (l *FileLogger) Error(v ...interface{}) error {
+	return l.write("E", fmt.Sprint(v...))
+}
+func (l *FileLogger) Warning(v ...interface{}) error {
+	return l.write("W", fmt.Sprint(v...))
+}
+func (l *FileLogger) Info(v ...interface{}) error {
+	return l.write("I", fmt.Sprint(v...))
+}
+func (l *FileLogger) Errorf(format string, a ...interface{}) error {
+	return l.write("E", fmt.Sprintf(format, a...))
+}
+func (l *FileLogger) Warningf(format string, a ...interface{}) error {
+	return l.write("W", fmt.Sprintf(format, a...))
+}
+func (l *FileLogger) Infof(format string, a ...interface{}) error {
+	return l.write("I", fmt.Sprintf(format, a...))
+}
+func (l *FileLogger) Log(level Level, msg string, kv ...interface{}) error {
+	return l.write(levelLetter(level), formatFields(msg, kv))
+}
+
+// TeeLogger logs each message to all of its Loggers, such as to a FileLogger
+// and the Logger of the Service. It returns the first error.
+type TeeLogger []Logger
+
+func (t TeeLogger) each(log func(l Logger) error) error {
+	var first error
+	for _, l := range t {
+		if err := log(l); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ReopenLogs calls ReopenLogs of the Loggers that have it, such as
+// FileLoggers.
+func (t TeeLogger) ReopenLogs() error {
+	return t.each(func(l Logger) error {
+		if r, ok := l.(interface {
+			ReopenLogs() error
+		}); ok {
+			return r.ReopenLogs()
+		}
+		return nil
+	})
+}
+
+func (t TeeLogger) Error(v ...interface{}) error {
+	return t.each(func(l Logger) error { return l.Error(v...) })
+}
+func (t TeeLogger) Warning(v ...interface{}) error {
+	return t.each(func(l Logger) error { return l.Warning(v...) })
+}
+func (t TeeLogger) Info(v ...interface{}) error {
+	return t.each(func(l Logger) error { return l.Info(v...) })
+}
+func (t TeeLogger) Errorf(format string, a ...interface{}) error {
+	return t.each(func(l Logger) error { return l.Errorf(format, a...) })
+}
+func (t TeeLogger) Warningf(format string, a ...interface{}) error {
+	return t.each(func(l Logger) error { return l.Warningf(format, a...) })
+}
+func (t TeeLogger) Infof(format string, a ...interface{}) error {
+	return t.each(func(l Logger) error { return l.Infof(format, a...) })
+}
+
+// Log passes the message to the StructuredLoggers and logs it with the fields
+// formatted into it to the others.
+func (t TeeLogger) Log(level Level, msg string, kv ...interface{}) error {
+	return t.each(func(l Logger) error {
+		if s, ok := l.(StructuredLogger); ok {
+			return s.Log(level, msg, kv...)
+		}
+		line := formatFields(msg, kv)
+		switch level {
+		case LevelWarning:
+			return l.Warning(line)
+		case LevelError:
+			return l.Error(line)
+		}
+		return l.Info(line)
+	})
+}
@@ -5,9 +5,29 @@
 package service
 
 import (
+	"runtime"
+	"strings"
 	"testing"
 )
 
 func TestPlatformName(t *testing.T) {
 	t.Logf("Platform is %v", Platform())
+	want := map[string]string{
+		"linux":   "linux-systemd linux-upstart linux-openrc linux-s6 linux-runit linux-sysv",
+		"darwin":  "darwin-launchd",
+		"freebsd": "freebsd-rcd",
+		"aix":     "aix-src",
+		"solaris": "solaris-smf",
+		"windows": "windows-service",
+	}[runtime.GOOS]
+	var names []string
+	for _, system := range AvailableSystems() {
+		names = append(names, system.String())
+	}
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("systems %q, want %q", got, want)
+	}
+	if p := Platform(); len(p) != 0 && !strings.Contains(" "+want+" ", " "+p+" ") {
+		t.Errorf("Platform %q is none of %q", p, want)
+	}
 }
@@ -0,0 +1,101 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// notify sends a state string such as "READY=1" to the service manager on
+// $NOTIFY_SOCKET. It reports false without error if no socket is set,
+// which is the case when not running under systemd.
+func notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return false, nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ready tells the service manager that the service finished starting. Call it
+// at the end of Interface.Start when the Notify option is set; systemd starts
+// the units ordered after the service only then. On s6 it writes a newline to
+// the notification-fd and closes it. It does nothing when not running under
+// systemd or s6.
+func Ready() error {
+	if fd, err := strconv.Atoi(os.Getenv("S6_NOTIFICATION_FD")); err == nil && fd > 2 {
+		// The descriptor is closed after the first call.
+		os.Unsetenv("S6_NOTIFICATION_FD")
+		f := os.NewFile(uintptr(fd), "notification-fd")
+		_, err = f.Write([]byte("\n"))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	_, err := notify("READY=1")
+	return err
+}
+
+// watchdogInterval returns the watchdog timeout the service manager set for
+// this process. It reports false if the watchdog is not enabled.
+func watchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) != 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// NotifyWatchdog tells the service manager watchdog that the service is
+// alive. Call it from the code that does the work, more often than the
+// WatchdogSec option, so a hung service gets restarted. It does nothing if
+// the watchdog is not enabled for this process, such as when not running
+// under systemd.
+func NotifyWatchdog() error {
+	if _, enabled := watchdogInterval(); !enabled {
+		return nil
+	}
+	_, err := notify("WATCHDOG=1")
+	return err
+}
+
+// RunWatchdog pings the service manager watchdog at half of the configured
+// interval from a new goroutine until ctx is done. If the watchdog is not
+// enabled for this process it returns immediately without doing anything.
+func RunWatchdog(ctx context.Context) {
+	interval, enabled := watchdogInterval()
+	if !enabled {
+		return
+	}
+	go func() {
+		tick := time.NewTicker(interval / 2)
+		defer tick.Stop()
+		for {
+			notify("WATCHDOG=1")
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -3,7 +3,8 @@
 // license that can be found in the LICENSE file.
 
 // Package service provides a simple way to create a system service.
-// Currently supports Windows, Linux/(systemd | Upstart | SysV), and OSX/Launchd.
+// Currently supports Windows, Linux/(systemd | Upstart | OpenRC | runit | s6 | SysV), OSX/Launchd
+// FreeBSD/rc.d, AIX/SRC and Solaris/SMF.
 //
 // Windows controls services by setting up callbacks that is non-trivial. This
 // is very different then other systems. This package provides the same API
@@ -62,11 +63,24 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
 	"path/filepath"
-
-	"github.com/kardianos/osext"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
@@ -78,10 +92,119 @@ const (
 	optionUserServiceDefault   = false
 	optionSessionCreate        = "SessionCreate"
 	optionSessionCreateDefault = false
+	optionConsoleUser          = "ConsoleUser"
+	optionPlistFormat          = "PlistFormat"
+	optionOneShot              = "OneShot"
+	optionOneShotDefault       = false
+	optionRemainAfterExit      = "RemainAfterExit"
+	optionIPAccounting         = "IPAccounting"
+	optionRestartBackoff       = "RestartBackoff"
+	optionRestartWindow        = "RestartWindow"
+	optionRestart              = "Restart"
+	optionRestartSec           = "RestartSec"
+	optionRuntimeMaxSec        = "RuntimeMaxSec"
+	optionLimitNOFILE          = "LimitNOFILE"
+	optionMemoryLimit          = "MemoryLimit"
+	optionCPUQuota             = "CPUQuota"
+	optionNice                 = "Nice"
+	optionOOMScoreAdjust       = "OOMScoreAdjust"
+	optionGroupName            = "GroupName"
+	optionLogOutput            = "LogOutput"
+	optionStdOutPath           = "StdOutPath"
+	optionStdErrPath           = "StdErrPath"
+	optionBindPaths            = "BindPaths"
+	optionBindReadOnlyPaths    = "BindReadOnlyPaths"
+
+	optionAfter                      = "After"
+	optionBefore                     = "Before"
+	optionConflicts                  = "Conflicts"
+	optionPartOf                     = "PartOf"
+	optionBindsTo                    = "BindsTo"
+	optionListenStream               = "ListenStream"
+	optionTarget                     = "Target"
+	optionWantedBy                   = "WantedBy"
+	optionDefaultDependencies        = "DefaultDependencies"
+	optionDefaultDependenciesDefault = true
+
+	optionMemoryMax      = "MemoryMax"
+	optionMemoryLow      = "MemoryLow"
+	optionMemoryHigh     = "MemoryHigh"
+	optionMemorySwapMax  = "MemorySwapMax"
+	optionMemoryZSwapMax = "MemoryZSwapMax"
+
+	optionStandardOutput    = "StandardOutput"
+	optionStandardError     = "StandardError"
+	optionSyslogIdentifier  = "SyslogIdentifier"
+	optionSyslogLevel       = "SyslogLevel"
+	optionSyslogLevelPrefix = "SyslogLevelPrefix"
+	optionWatchdogSec       = "WatchdogSec"
+	optionNotify            = "Notify"
+
+	optionPrivateUsers  = "PrivateUsers"
+	optionPrivateMounts = "PrivateMounts"
+	optionProtectProc   = "ProtectProc"
+	optionProcSubset    = "ProcSubset"
+
+	optionSystemdUnitExtra   = "SystemdUnitExtra"
+	optionSystemdUnitSection = "SystemdUnitSection"
 
 	optionRunWait      = "RunWait"
+	optionStopTimeout  = "StopTimeout"
+	optionSignalMap    = "SignalMap"
 	optionReloadSignal = "ReloadSignal"
 	optionPIDFile      = "PIDFile"
+
+	optionExecStartPost   = "ExecStartPost"
+	optionCommandTimeout  = "CommandTimeout"
+	optionStartRetries    = "StartRetries"
+	optionStartRetryDelay = "StartRetryDelay"
+
+	optionGenerateAppArmor = "GenerateAppArmorProfile"
+	optionSkipRestorecon   = "SkipRestorecon"
+
+	optionLogRotate      = "LogRotate"
+	optionLogRotatePaths = "LogRotatePaths"
+
+	optionCreateWorkingDirectory = "CreateWorkingDirectory"
+	optionWorkingDirectoryMode   = "WorkingDirectoryMode"
+	optionWorkingDirectoryOwner  = "WorkingDirectoryOwner"
+
+	optionInstallChecksum        = "InstallChecksum"
+	optionVerifyDefinition       = "VerifyDefinition"
+	optionVerifyDefinitionStrict = "VerifyDefinitionStrict"
+	optionLogSocket              = "LogSocket"
+	optionPassEnv                = "PassEnv"
+	optionSelfTestProbe          = "SelfTestProbe"
+	optionStopOnUninstall        = "StopOnUninstall"
+	optionRestartStopTimeout     = "RestartStopTimeout"
+	optionHealthCommand          = "HealthCommand"
+	optionHealthExitCodes        = "HealthExitCodes"
+
+	optionStopKillDelay = "StopKillDelay"
+	optionUpstartExpect = "UpstartExpect"
+	optionRequiredStart = "RequiredStart"
+	optionRequiredStop  = "RequiredStop"
+	optionShouldStart   = "ShouldStart"
+
+	optionS6ScanDir = "S6ScanDir"
+
+	optionRcPriorityWidth = "RcPriorityWidth"
+	optionRcStartPriority = "RcStartPriority"
+	optionRcStopPriority  = "RcStopPriority"
+	optionRcStartPrefix   = "RcStartPrefix"
+	optionRcStopPrefix    = "RcStopPrefix"
+	optionSysVStartLevels = "SysVStartLevels"
+	optionSysVStopLevels  = "SysVStopLevels"
+	optionSysVScript      = "SysVScript"
+	optionPreserveLSB     = "PreserveLSBHeader"
+
+	optionDisplayNameResource = "DisplayNameResource"
+	optionDescriptionResource = "DescriptionResource"
+	optionRunInUserSession    = "RunInUserSession"
+	optionPreStopCommand      = "PreStopCommand"
+	optionStartType           = "StartType"
+	optionDelayedAutoStart    = "DelayedAutoStart"
+	optionFailureResetPeriod  = "FailureResetPeriod"
 )
 
 // Config provides the setup for a Service. The Name field is required.
@@ -92,28 +215,370 @@ type Config struct {
 	UserName    string   // Run as username.
 	Arguments   []string // Run with arguments.
 
-	// Optional field to specify the executable for service.
-	// If empty the current executable is used.
+	// Optional field to specify the executable for service, such as when an
+	// installer sets up a service for another binary. Every system installs
+	// it, made absolute, instead of the current executable, which is used if
+	// empty, see ResolveExecutable.
 	Executable string
 
-	// Array of service dependencies.
-	// Not yet implemented on Linux or OS X.
+	// Environment variables of the service, written into the service
+	// definition sorted by name. As with the PassEnv option, the values are
+	// readable by all users on POSIX, so don't pass secrets this way.
+	EnvVars map[string]string
+
+	// Array of service dependencies, started before the service.
+	// systemd requires and orders after them, adding .service to names without
+	// a unit suffix. SystemV adds them to Required-Start and Required-Stop,
+	// Upstart starts on their start and stops when they stop, OpenRC
+	// needs them in depend, runit waits for them with sv check and s6 with
+	// s6-svwait. Not implemented on OS X, as launchd has no dependencies.
 	Dependencies []string
 
 	// The following fields are not supported on Windows.
-	WorkingDirectory string // Initial working directory.
-	ChRoot           string
+	WorkingDirectory string // Initial working directory, an absolute path.
+	// Directory the service is chrooted to, an absolute path. Sets
+	// RootDirectory on systemd and OS X, chroot on Upstart and OpenRC,
+	// chpst -/ on runit and --chroot of start-stop-daemon in the Debian
+	// SystemV script; the other SystemV scripts and the Debian one with
+	// Restart run the program with chroot(8) and can't also set the
+	// WorkingDirectory. FreeBSD, AIX, Solaris, s6 and Windows refuse it.
+	ChRoot string
 
 	// System specific options.
 	//  * OS X
 	//    - KeepAlive     bool (true)
 	//    - RunAtLoad     bool (false)
-	//    - UserService   bool (false) - Install as a current user service.
+	//    - UserService   bool (false) - Install as an agent in ~/Library/LaunchAgents of the
+	//                    current user. Start, Stop and Uninstall bootstrap it into and out
+	//                    of the GUI domain of that user instead of the system domain.
 	//    - SessionCreate bool (false) - Create a full user session.
+	//    - ConsoleUser   bool (false) - Install as an agent in /Library/LaunchAgents that runs
+	//                    as the user logged in to the console. Start and Stop bootstrap it into
+	//                    the GUI domain of that user, resolved when called; launchd loads it
+	//                    for each later login by itself. Install, Start and Stop require root.
+	//                    Start fails if no user is logged in, Install still succeeds.
+	//    - PlistFormat   string (xml) [binary] - Format of the plist Install writes. A binary
+	//                    plist is converted with plutil, as are the installed plist and the
+	//                    Config's for Diff. Other systems fail to install with binary.
+	//    - RestartBackoff time.Duration () [5s] - Delay before restarting after a crash, doubled on
+	//                       each consecutive crash up to 32 times the value. launchd has no
+	//                       native backoff: it sets ThrottleInterval and Run, when started by
+	//                       launchd, sleeps before starting the program if the previous start
+	//                       was recent. launchd still counts the sleeping process as running
+	//                       and the start history is kept in /var/run for root, otherwise
+	//                       in the cache directory of the user.
+	//    - RestartWindow string () [08:00-20:00] - Local time of day the service may be
+	//                      (re)started in. Outside of it Run, when started by launchd, logs a
+	//                      warning and sleeps until the window opens. Also for Upstart,
+	//                      and for SystemV, where the respawn loop of a service with Restart
+	//                      waits for the window before each start.
 	//  * POSIX
 	//    - RunWait      func() (wait for SIGNAL) - Do not install signal but wait for this function to return.
+	//    - SignalMap    SignalMap (SIGTERM, SIGINT: ActionStop) - Actions Run takes on signals.
+	//    - StopTimeout  time.Duration (30s) - How long Run waits for Interface.Stop to return
+	//                     after a stop signal. Run then logs an error and returns it without
+	//                     waiting for Stop; 0 waits for as long as Stop takes.
+	//    - CommandTimeout time.Duration (2m) - Deadline for each command Install and Uninstall run.
+	//    - CreateWorkingDirectory bool (false) - Install creates the WorkingDirectory and its
+	//                               parents if missing. Install fails if it cannot.
+	//    - WorkingDirectoryMode   int (0755) - Permissions of a WorkingDirectory Install created.
+	//    - WorkingDirectoryOwner  string (UserName) - Owner of a WorkingDirectory Install created.
+	//                               On systemd a WorkingDirectory in /var/lib is also made the
+	//                               StateDirectory, so systemd recreates it before each start.
+	//    - StartRetries    int (0) - Times Start and Restart retry the start command when its
+	//                        output says the address is already in use, as when the previous
+	//                        instance has not released its port yet. Init scripts may pass
+	//                        the program's error on; systemctl and launchctl rarely do as they
+	//                        don't wait for the program, so prefer RestartBackoff with those.
+	//    - StartRetryDelay time.Duration (1s) - Delay before the first retry, doubled after each.
+	//    - Restart string (always, no for OneShot) [on-failure, no] - When the service is started
+	//                again after its process exits: always, only after an exit with an error
+	//                or a signal, or never. Sets Restart on systemd, respawn on Upstart and
+	//                KeepAlive on OS X instead of the KeepAlive option. SystemV defaults to no
+	//                and otherwise runs the program from a respawn loop in the init script.
+	//                OpenRC defaults to no and runs it under supervise-daemon for always.
+	//                runit and s6 keep the service down from a finish script for no and
+	//                on-failure.
+	//    - RuntimeMaxSec time.Duration () [24h, "24h"] - Restart the service after it ran this
+	//                      long, as for a program that leaks memory. Sets RuntimeMaxSec on
+	//                      systemd, which stops the service and restarts it by Restart, so
+	//                      Restart can't be no then. On the other systems Run approximates it:
+	//                      when started by the service system it stops the program after this
+	//                      time and starts it again with ReExec, keeping the process ID. The
+	//                      time counts from the start of Run, and not with RunWait.
+	//    - LimitNOFILE int () [65536, "65536"] - Maximum number of open files. Sets LimitNOFILE
+	//                    on systemd, NumberOfFiles on OS X, limit nofile on Upstart, chpst -o
+	//                    on runit and s6-softlimit -o on s6; SystemV and OpenRC scripts call
+	//                    ulimit -n.
+	//    - MemoryLimit string () [512M, 2G, ...] - Maximum memory, a size as for MemoryMax. Sets
+	//                    MemoryMax on systemd, where it can't be combined with MemoryMax. Other
+	//                    Linux systems limit the address space instead, with ulimit -v, limit as
+	//                    chpst -m or s6-softlimit -m, and ignore a percentage. Ignored on OS X.
+	//    - CPUQuota    string () [50%, 200%] - CPU time of the service relative to one CPU.
+	//                    Only systemd can limit it, other systems ignore it.
+	//    - Nice        int () [-20 to 19, "10"] - Scheduling priority, higher is lower. Sets Nice
+	//                    on systemd; SystemV scripts start the program with nice -n, --nicelevel
+	//                    of start-stop-daemon or the priority argument of daemon.
+	//    - OOMScoreAdjust int () [-1000 to 1000, "500"] - How readily the kernel kills the
+	//                       service when out of memory, higher is sooner. Sets OOMScoreAdjust on
+	//                       systemd; SystemV scripts write it to their oom_score_adj before
+	//                       starting the program, which inherits it. Other systems ignore
+	//                       Nice and OOMScoreAdjust.
+	//    - GroupName   string () [www-data] - Group the service runs as instead of the primary
+	//                    group of UserName. Sets Group on systemd and GroupName on OS X, and
+	//                    user:group for start-stop-daemon, OpenRC and chpst. The generic and
+	//                    Red Hat SystemV scripts ignore it, s6 refuses it.
+	//    - LogOutput   bool (false) - Append the output of the service to <name>.out and the
+	//                    error output to <name>.err in /var/log; ~/Library/Logs for an OS X
+	//                    UserService and ~/.local/state for a systemd one.
+	//    - StdOutPath  string () [/var/log/web.log] - File the output is appended to, also
+	//                    without LogOutput. Sets StandardOutput=append: on systemd, where it
+	//                    can't be combined with StandardOutput, and StandardOutPath on OS X.
+	//                    The init scripts redirect the output, otherwise /var/log/<name>.log
+	//                    for the SystemV generic script and OpenRC and /dev/null for the
+	//                    other SystemV scripts. Upstart keeps its console log.
+	//    - StdErrPath  string () [/var/log/web.err] - As StdOutPath, for the error output.
 	//    - ReloadSignal string () [USR1, ...] - Signal to send on reaload.
 	//    - PIDFile     string () [/run/prog.pid] - Location of the PID file.
+	//    - OneShot      bool (false) - The service is a task that runs to completion
+	//                     rather than a long-running daemon. Run calls Start, which should
+	//                     do the work synchronously, then Stop, and returns without
+	//                     waiting for a signal. The service is not restarted on exit.
+	//    - RestartSec  time.Duration (2m) - Delay before the service is restarted, see Restart.
+	//                    On systemd it can't be combined with RestartBackoff.
+	//  * Linux
+	//    - GenerateAppArmorProfile bool (false) - Install writes a profile to /etc/apparmor.d/<name>
+	//                                attached to the executable and loads it with apparmor_parser.
+	//                                The executable may read itself, the WorkingDirectory and
+	//                                BindReadOnlyPaths, and write the WorkingDirectory and BindPaths.
+	//                                Nothing is written if AppArmor is not enabled.
+	//    - SkipRestorecon bool (false) - When SELinux is enforcing, Install runs restorecon on
+	//                       the files it wrote so they get the file context of the policy, as
+	//                       systemd may refuse to load a mislabeled unit. Set to skip it.
+	//  * Linux (systemd, SystemV)
+	//    - ExecStartPost []string () - Commands run after the service started; a failing
+	//                      command fails the start. See WaitTCPCommand and WaitHTTPCommand.
+	//                      systemd requires commands to start with an absolute path, and
+	//                      does not expand % specifiers in them.
+	//  * systemd
+	//    - UserService     bool (false) - Install to ~/.config/systemd/user for the user manager of
+	//                        the current user. It runs with a login session of the user, or from
+	//                        boot with lingering enabled by loginctl enable-linger. Without a
+	//                        reachable user manager Install, Start and Stop fail saying so.
+	//                        On NixOS, whose /etc/systemd/system is read-only, Install only
+	//                        supports user services; declare system services in configuration.nix.
+	//    - RemainAfterExit bool (false) - With OneShot, consider the service active after it exits.
+	//    - IPAccounting    bool (false) - Account network traffic of the service, see NetworkStats.
+	//    - LogRotate       bool (false) - Install writes /etc/logrotate.d/<name> rotating the files
+	//                        of LogOutput, StdOutPath and StdErrPath weekly with copytruncate,
+	//                        as systemd holds them open, and the LogRotatePaths.
+	//    - LogRotatePaths  []string () [/var/log/web/app.log] - Files the program writes itself,
+	//                        as with a FileLogger. After rotating them logrotate sends the signal
+	//                        the SignalMap maps to ActionReopenLogs, SIGUSR1 by default, so the
+	//                        program must implement LogReopener. Not for user services.
+	//    - RestartBackoff  time.Duration () [5s] - Sets RestartSec, and RestartSteps with
+	//                        RestartMaxDelaySec of 32 times the value on systemd 254 and later.
+	//    - RestartWindow   string () [08:00-20:00] - Local time of day the service may be
+	//                        (re)started in, may wrap past midnight. An ExecStartPre check fails
+	//                        starts outside of it, which systemd retries every RestartSec, so a
+	//                        start is delayed until the first retry inside the window. The
+	//                        check also blocks manual starts and can't stop a running service.
+	//    - After     []string () [local-fs.target, ...] - Units to start after, besides syslog and network.
+	//    - Before    []string () [shutdown.target, ...] - Units to start before.
+	//    - Conflicts []string () [reboot.target, ...] - Units that stop this service when started.
+	//    - PartOf    []string () [app.target, ...] - Units whose stop and restart also stop and
+	//                  restart this service, to control a group of services together.
+	//    - BindsTo   []string () [app-db.service, ...] - As PartOf, and also stop this service
+	//                  when one of these units stops or fails. Usually listed in After too.
+	//                  Unit names are validated. Other systems ignore PartOf and BindsTo.
+	//    - WantedBy  []string ([multi-user.target]) - Targets that pull in the service when enabled.
+	//    - ListenStream []string () [0.0.0.0:80, /run/app.sock, ...] - Install also writes and
+	//                     enables a name.socket unit listening on these for socket activation.
+	//                     The service requires the socket and is started after it. Entries
+	//                     of the form fdname=address [http=0.0.0.0:80, metrics=:9100] go to a
+	//                     name-fdname.socket unit instead, with that FileDescriptorName, so
+	//                     the program can tell them apart in the result of Listeners.
+	//                     ListenFDs returns the sockets in order instead.
+	//    - Target       string () [app.target] - Install also writes and enables this target,
+	//                     which then pulls in the service and socket instead of
+	//                     multi-user.target, and stops and restarts them with it. Several
+	//                     services may share a target; Uninstall removes it with the last.
+	//                     If a step of Install fails, the units it wrote are removed again.
+	//    - DefaultDependencies bool (true) - Set to false to drop the implicit basic.target
+	//                            and shutdown.target dependencies, for early-boot services
+	//                            that must start before basic.target. Such a service may start
+	//                            before file systems are mounted and is not stopped before
+	//                            shutdown unless ordered so; an After or Before option is
+	//                            required to order it explicitly.
+	//    - BindPaths         []string () [/var/lib/app:/data, ...] - Bind mount src[:dst] into
+	//                          the service's mount namespace. Not supported by other systems.
+	//    - BindReadOnlyPaths []string () [/etc/app, ...] - As BindPaths, mounted read-only.
+	//    - MemoryMax      string () [1G, ...] - Hard limit, the service is killed above it.
+	//    - MemoryLow      string () [512M, 2G, 10%, infinity] - Memory protected from reclaim.
+	//    - MemoryHigh     string () [512M, ...] - Throttle and reclaim aggressively above this.
+	//    - MemorySwapMax  string () [0, 1G, ...] - Swap the service may use.
+	//    - MemoryZSwapMax string () [256M, ...] - Compressed swap the service may use.
+	//                       Sizes are bytes or have a K, M, G or T suffix, base 1024. Other
+	//                       systems fail to install a service setting any Memory option.
+	//                       With cgroup v1, detected when the definition is rendered, MemoryMax
+	//                       is written as MemoryLimit and the others, which v1 can't honor, are
+	//                       left out with a comment in the unit saying so.
+	//    - StandardOutput    string () [journal, null, file:/var/log/app.log, append:...] - Where
+	//                          systemd sends the output of the service. Files need an absolute path.
+	//    - StandardError     string () [journal, ...] - As StandardOutput, for the error output.
+	//    - SyslogIdentifier  string () [web] - Identifier of the output in the journal, the
+	//                          name of the executable by default.
+	//    - SyslogLevel       string () [info, warning, ...] - Log level of output lines.
+	//    - SyslogLevelPrefix bool (true) - Read a level from a <N> prefix of each output line,
+	//                          as used by sd-daemon(3).
+	//    - WatchdogSec     time.Duration () [30s] - systemd restarts the service, as set by
+	//                        Restart, if it does not call NotifyWatchdog within this time.
+	//                        RunWatchdog calls it from a goroutine at half the interval.
+	//    - Notify          bool (false) - Sets Type=notify: systemd considers the service started,
+	//                        and starts the units ordered after it, once it calls Ready.
+	//                        Can't be combined with OneShot. On s6 it writes notification-fd
+	//                        for Ready to write to instead. Other systems ignore it.
+	//    - PrivateUsers  bool () [true, self, identity, full] - Run the service in its own user
+	//                      namespace. The strings need systemd 257 or later.
+	//    - PrivateMounts bool () - Run the service in its own mount namespace.
+	//    - ProtectProc   string () [noaccess, invisible, ptraceable, default] - Hide the
+	//                      processes of other users in /proc.
+	//    - ProcSubset    string () [pid, all] - Hide the /proc files not about processes.
+	//                      Other systems can't isolate a service and fail to install one
+	//                      setting any of these namespace options.
+	//    - SystemdUnitExtra   string () [ProtectSystem=full\nPrivateTmp=yes] - Lines appended to
+	//                           the [Service] section of the unit as they are, for directives
+	//                           without an option.
+	//    - SystemdUnitSection string () [[X-Backup]\nPaths=/srv] - Sections appended to the end
+	//                           of the unit as they are. Neither is validated, systemd reports
+	//                           mistakes when it loads the unit. Other systems ignore both.
+	//  * SystemV, Upstart, OpenRC
+	//    - StopKillDelay time.Duration () [10s] - Wait after SIGTERM before sending SIGKILL on stop.
+	//                      Upstart uses the kill signal instead of SIGTERM. Sets kill timeout.
+	//    OpenRC also honors ExecStartPost and RestartSec, and refuses OneShot.
+	//  * runit
+	//    Install writes /etc/sv/<name>/run, which execs the program with chpst, and links
+	//    the directory into /var/service, /etc/service or /service, whichever exists;
+	//    runsvdir starts the service within seconds of the link appearing. RestartSec has
+	//    no default and delays restarts from the finish script. StopKillDelay makes Stop
+	//    use sv force-stop, which sends KILL after the delay.
+	//  * s6
+	//    Install writes /etc/s6/sv/<name>/run, which execs the program with s6-softlimit
+	//    and s6-setuidgid, links the directory into the scandir and has s6-svscan rescan
+	//    it, which starts the service. s6 is only detected if /etc/s6 exists or s6-svscan
+	//    runs on one of the scandirs; pick it from AvailableSystems with ChooseSystem
+	//    otherwise. RestartSec and Restart other than always add a finish script, and
+	//    StopKillDelay sets timeout-kill. ChRoot and GroupName are refused.
+	//    - S6ScanDir string (scandir of s6-svscan, /run/service) [/etc/s6/scandir] - Scandir
+	//                  Install links the service into. The scandir in /run of s6-linux-init
+	//                  is created on each boot, use the one it is copied from to keep the
+	//                  service after a reboot.
+	//  * FreeBSD
+	//    Install writes /usr/local/etc/rc.d/<name>, which runs the program under daemon(8),
+	//    and enables it in /etc/rc.conf with sysrc. The Name may only contain letters,
+	//    digits and _. Restart always and RestartSec (2m) restart the program from
+	//    daemon(8), which writes StdOutPath or StdErrPath to a single file. LimitNOFILE
+	//    sets <name>_limits. OneShot, Restart on-failure and ChRoot are refused.
+	//  * AIX
+	//    Install defines a System Resource Controller subsystem with mkssys and adds an
+	//    inittab entry that starts it at boot. The Name may have at most 14 letters, digits,
+	//    ., - or _. SRC respawns the program unless Restart is no or OneShot is set, and
+	//    StopKillDelay (20s) is the wait between SIGTERM and SIGKILL on stop. StdOutPath
+	//    and StdErrPath default to /dev/console. WorkingDirectory, EnvVars, PassEnv,
+	//    Dependencies, GroupName, ChRoot and Restart on-failure are refused.
+	//  * Solaris, illumos
+	//    Install writes the SMF manifest /var/svc/manifest/site/<name>.xml and imports it
+	//    with svccfg as svc:/application/<name>. Start enables the default instance, which
+	//    then also starts at boot, and Stop disables it until the next boot. svc.startd
+	//    restarts the program after any exit, OneShot runs it as a transient service.
+	//    Dependencies are FMRIs or names of other services in application/. StopKillDelay
+	//    (10s) is the timeout of the stop method. ChRoot and Restart other than always
+	//    are refused.
+	//  * SystemV
+	//    - RequiredStart []string ([$local_fs, $remote_fs, $network, $syslog]) - LSB header
+	//                      Required-Start, read by insserv and the systemd sysv generator.
+	//                      Entries are LSB facilities such as $time or names of other scripts.
+	//    - RequiredStop  []string ([$local_fs, $remote_fs, $network, $syslog]) - Required-Stop.
+	//    - ShouldStart   []string () [$named, ...] - Should-Start, optional dependencies.
+	//    - RcStartPriority int (50) - Priority in the /etc/rcN.d start link names.
+	//    - RcStopPriority  int (2)  - Priority in the stop link names.
+	//    - RcPriorityWidth int (2)  [1, 3] - Digits of the priorities, zero padded.
+	//    - RcStartPrefix   string (S) - Start link name prefix, followed by priority and name.
+	//    - RcStopPrefix    string (K) - Stop link name prefix.
+	//    - SysVStartLevels string (2345) [3, 2 3 5, ...] - Runlevels the service starts in, the
+	//                        Default-Start header and the start links.
+	//    - SysVStopLevels  string (016) - Runlevels the service stops in, Default-Stop.
+	//    - PreserveLSBHeader bool (false) - Install replaces an existing init script instead of
+	//                          failing. Its Required-Start, Required-Stop, Should-Start,
+	//                          Default-Start and Default-Stop header fields, which an
+	//                          administrator may have edited, are kept over the options and
+	//                          the old script is saved next to it with a .bak suffix.
+	//    - SysVScript string () - text/template of the init script, used instead of the built-in
+	//                   ones for any distribution. It gets the same data, such as .Name, .Path,
+	//                   .Arguments, .UserName and .Env, and functions, such as join, cmd and
+	//                   shellQuote. Install fails without writing anything if it doesn't parse.
+	//                   Otherwise Debian gets a start-stop-daemon script, Red Hat one using
+	//                   /etc/rc.d/init.d/functions and other distributions the generic script.
+	//  * Upstart
+	//    - UpstartExpect string (none) [fork, daemon, stop] - The expect stanza, for programs
+	//                      that fork or daemonize. Programs using Run stay in the foreground.
+	//    The kill signal is the first of INT, TERM, QUIT and HUP the SignalMap stops on.
+	//    OneShot services are installed as a task instead of respawning.
+	//  * Windows
+	//    - Password            string () - Password of the UserName account.
+	//    - DisplayNameResource string () [@%SystemRoot%\app.dll,-101] - Localized display name.
+	//    - DescriptionResource string () [@%SystemRoot%\app.dll,-102] - Localized description.
+	//    - RunInUserSession    []string () [C:\app\ui.exe, -tray] - Command started on the desktop
+	//                            of the user logged on to the console while the service runs,
+	//                            for UI the service itself cannot show from session 0. It is
+	//                            started when a user logs on or connects to the console, also
+	//                            after a boot without anyone logged on, moves to the new console
+	//                            session and is started again 5s after it exited. Requires
+	//                            the service to run as LocalSystem. The command runs with the
+	//                            user's token, so it must not trust input it did not create
+	//                            and should be installed where only administrators can write.
+	//    - PreStopCommand      []string () [C:\app\drain.exe, -wait] - Command Stop and Restart run
+	//                            before asking the SCM to stop the service, for example to
+	//                            drain connections. It is limited by CommandTimeout; if it fails
+	//                            the service is still stopped and Stop returns the failure.
+	//                            The program's Stop may take its time: Run reports to the SCM
+	//                            that the stop is in progress until Stop returns.
+	//    - StartType           string (automatic) [automatic, manual, disabled] - Start type
+	//                            of the service in the SCM.
+	//    - DelayedAutoStart    bool (false) - Automatic (Delayed Start): the SCM starts the
+	//                            service shortly after the other automatic services, so it
+	//                            doesn't slow down the boot. Only with StartType automatic.
+	//    - Restart             string (no) [always, on-failure] - With always or on-failure the
+	//                            SCM restarts the service RestartSec (2m) after it crashes or
+	//                            exits with an error, for the first, second and later failures.
+	//                            The SCM never restarts a service that stopped cleanly.
+	//    - FailureResetPeriod  time.Duration (24h) - Time without failures after which the SCM
+	//                            counts the next failure as the first again.
+	//  * All
+	//    - InstallChecksum func(string) () - Called by Install with the SHA-256 of the written definition.
+	//    - VerifyDefinition       bool (false) - Start compares the installed definition to the Config
+	//                               and logs a warning if they differ.
+	//    - VerifyDefinitionStrict bool (false) - With VerifyDefinition, Start returns ErrDefinitionDrift instead.
+	//    - LogSocket string () [/run/logs.sock, \\.\pipe\logs] - SystemLogger writes to this Unix
+	//                  socket, or named pipe on Windows, instead of the system log.
+	//    - PassEnv   []string () [HTTP_PROXY, APP_REGION, ...] - Environment variables copied from
+	//                  the process calling Install into the service definition; unset ones
+	//                  are skipped. The values are stored in plain text in a file readable
+	//                  by all users, so don't pass secrets this way. EnvVars take precedence.
+	//    - SelfTestProbe func(context.Context) error () - Health check SelfTest runs once the
+	//                      service is running, for example an HTTP request to it.
+	//    - StopOnUninstall bool (true) - Uninstall stops a running service first. When false the
+	//                        process keeps running, without a definition, until it exits or the
+	//                        next boot, and Uninstall logs a warning saying so.
+	//    - RestartStopTimeout time.Duration (5s) - How long Restart waits after Stop for the
+	//                           status to be stopped before it starts the service again, on
+	//                           SystemV, Upstart, OpenRC and OS X. Restart fails if it does not stop.
+	//    - HealthCommand   []string () [/usr/bin/web, -check] - Probe Health runs, as the calling
+	//                        user, while the service is running. By default exit code 0 is
+	//                        Healthy and any other Unhealthy.
+	//    - HealthExitCodes HealthExitCodes () [0: Healthy, 1: Degraded, 2: Starting] - Health
+	//                        status of each exit code of the HealthCommand; unlisted exit
+	//                        codes are Unhealthy, or Healthy for 0.
 	Option KeyValue
 }
 
@@ -121,7 +586,305 @@ func (c *Config) execPath() (string, error) {
 	if len(c.Executable) != 0 {
 		return filepath.Abs(c.Executable)
 	}
-	return osext.Executable()
+	return ResolveExecutable()
+}
+
+// ResolveExecutable returns the path of the running executable, which is
+// installed as the service when Config.Executable is empty. It may be
+// replaced where the default picks a surprising path, such as the target of
+// a symlink farm. The default tries os.Executable, /proc/self/exe and then
+// looks up os.Args[0] in PATH, and resolves symbolic links, as the program
+// may have been started through one.
+var ResolveExecutable = resolveExecutable
+
+func resolveExecutable() (string, error) {
+	path, err := findExecutable()
+	if err != nil {
+		return "", err
+	}
+	// A binary replaced while running can't be resolved, keep the path then.
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		return real, nil
+	}
+	return path, nil
+}
+
+func findExecutable() (string, error) {
+	path, err := os.Executable()
+	if err == nil {
+		return path, nil
+	}
+	tried := []string{fmt.Sprintf("os.Executable: %v", err)}
+
+	if path, err = os.Readlink("/proc/self/exe"); err == nil {
+		return path, nil
+	}
+	tried = append(tried, fmt.Sprintf("/proc/self/exe: %v", err))
+
+	if path, err = exec.LookPath(os.Args[0]); err == nil {
+		return filepath.Abs(path)
+	}
+	tried = append(tried, fmt.Sprintf("PATH lookup of %q: %v", os.Args[0], err))
+	return "", fmt.Errorf("Failed to find the executable, tried %s.", strings.Join(tried, "; "))
+}
+
+// notifyChecksum passes the checksum of a freshly written definition to the
+// InstallChecksum option, if one is set.
+func (c *Config) notifyChecksum(definition []byte) {
+	if fn := c.Option.funcString(optionInstallChecksum, nil); fn != nil {
+		fn(checksum(definition))
+	}
+}
+
+// checksum returns the hex encoded SHA-256 of a service definition.
+func checksum(definition []byte) string {
+	sum := sha256.Sum256(definition)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileChecksum returns the checksum of an installed definition file.
+func fileChecksum(path string) (string, error) {
+	definition, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrServiceIsNotInstalled
+		}
+		return "", err
+	}
+	return checksum(definition), nil
+}
+
+// maxBackoffSteps limits backoffDelay to 32 times its base.
+const maxBackoffSteps = 5
+
+// backoffDelay returns the delay before the given restart attempt, doubling
+// base with each attempt.
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	if attempt > maxBackoffSteps {
+		attempt = maxBackoffSteps
+	}
+	return base << uint(attempt)
+}
+
+// recordedPath returns the executable path following the first line of
+// definition starting with one of prefixes, ignoring indentation, up to one
+// of terminators. A quote right after the prefix is skipped. A path in
+// single quotes, as shellWord writes one with blanks, ends at the closing
+// quote instead.
+func recordedPath(definition []byte, terminators string, prefixes ...string) string {
+	for _, line := range strings.Split(string(definition), "\n") {
+		line = strings.TrimSpace(line)
+		for _, prefix := range prefixes {
+			if !strings.HasPrefix(line, prefix) {
+				continue
+			}
+			path := line[len(prefix):]
+			if strings.HasPrefix(path, "'") {
+				if end := strings.Index(path[1:], "'"); end >= 0 {
+					return path[1 : 1+end]
+				}
+			}
+			path = strings.TrimPrefix(path, `"`)
+			if end := strings.IndexAny(path, terminators); end >= 0 {
+				path = path[:end]
+			}
+			return path
+		}
+	}
+	return ""
+}
+
+// pathDrift implements PathDrift given the installed executable path.
+// Paths naming the same file through symbolic links have not drifted.
+func pathDrift(c *Config, installed string) (string, string, bool, error) {
+	current, err := c.execPath()
+	if err != nil {
+		return installed, "", false, err
+	}
+	if len(installed) == 0 {
+		return "", current, false, errors.New("Executable not found in the installed service definition.")
+	}
+	if installed == current {
+		return installed, current, false, nil
+	}
+	a, aerr := filepath.EvalSymlinks(installed)
+	b, berr := filepath.EvalSymlinks(current)
+	return installed, current, aerr != nil || berr != nil || a != b, nil
+}
+
+// envVar is an environment variable set in the service definition.
+type envVar struct {
+	Name, Value string
+}
+
+// envName matches a portable environment variable name.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// environment returns the EnvVars sorted by name, followed by the variables
+// named by the PassEnv option that are set in the environment of the calling
+// process and not in EnvVars.
+func (c *Config) environment() ([]envVar, error) {
+	names := make([]string, 0, len(c.EnvVars))
+	for name := range c.EnvVars {
+		if !envName.MatchString(name) {
+			return nil, fmt.Errorf("EnvVars entry is not a variable name: %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var env []envVar
+	for _, name := range names {
+		env = append(env, envVar{name, c.EnvVars[name]})
+	}
+	for _, name := range c.Option.strings(optionPassEnv, nil) {
+		if !envName.MatchString(name) {
+			return nil, fmt.Errorf("Option PassEnv entry is not a variable name: %q", name)
+		}
+		if _, ok := c.EnvVars[name]; ok {
+			continue
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, envVar{name, value})
+		}
+	}
+	return env, nil
+}
+
+// window is a daily time range in minutes after midnight, local time. It
+// wraps past midnight if end is before start.
+type window struct {
+	start, end int
+}
+
+// restartWindow parses the RestartWindow option, "HH:MM-HH:MM". It
+// returns nil if the option is not set.
+func (c *Config) restartWindow() (*window, error) {
+	v := c.Option.string(optionRestartWindow, "")
+	if len(v) == 0 {
+		return nil, nil
+	}
+	var h1, m1, h2, m2 int
+	_, err := fmt.Sscanf(v, "%d:%d-%d:%d", &h1, &m1, &h2, &m2)
+	w := &window{h1*60 + m1, h2*60 + m2}
+	if err != nil || h1 < 0 || h1 > 23 || h2 < 0 || h2 > 23 || m1 < 0 || m1 > 59 || m2 < 0 || m2 > 59 || w.start == w.end {
+		return nil, fmt.Errorf("Invalid RestartWindow %q, expected HH:MM-HH:MM.", v)
+	}
+	return w, nil
+}
+
+func (w window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+func (w window) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// wait returns how long it is from t until the window opens, zero if t is
+// inside the window.
+func (w window) wait(t time.Time) time.Duration {
+	if w.contains(t) {
+		return 0
+	}
+	open := time.Date(t.Year(), t.Month(), t.Day(), w.start/60, w.start%60, 0, 0, t.Location())
+	if !open.After(t) {
+		open = open.AddDate(0, 0, 1)
+	}
+	return open.Sub(t)
+}
+
+// diff returns a line based difference between the installed and desired
+// definitions, or an empty string if they are identical. Removed lines are
+// prefixed with "-" and added lines with "+".
+func diff(installed, desired string) string {
+	if installed == desired {
+		return ""
+	}
+	a := strings.Split(installed, "\n")
+	b := strings.Split(desired, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&out, "-%s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+%s\n", b[j])
+			j++
+		}
+	}
+	return out.String()
+}
+
+// appliedOptions returns the sorted keys of c.Option that affect the
+// definition rendered for a Config. Each key is tested by rendering the
+// definition without it and comparing the result.
+func appliedOptions(c *Config, definition func(c *Config) ([]byte, error)) ([]string, error) {
+	full, err := definition(c)
+	if err != nil {
+		return nil, err
+	}
+	var applied []string
+	for name := range c.Option {
+		without := *c
+		without.Option = make(KeyValue, len(c.Option)-1)
+		for k, v := range c.Option {
+			if k != name {
+				without.Option[k] = v
+			}
+		}
+		d, err := definition(&without)
+		if err != nil || !bytes.Equal(d, full) {
+			applied = append(applied, name)
+		}
+	}
+	sort.Strings(applied)
+	return applied, nil
+}
+
+// verifyDefinition checks the installed definition against the Config before
+// a start when the VerifyDefinition option is set.
+func verifyDefinition(s Service, c *Config) error {
+	if !c.Option.bool(optionVerifyDefinition, false) {
+		return nil
+	}
+	d, err := s.Diff()
+	if err != nil || len(d) == 0 {
+		return err
+	}
+	if c.Option.bool(optionVerifyDefinitionStrict, false) {
+		return ErrDefinitionDrift
+	}
+	if l, err := s.Logger(nil); err == nil {
+		l.Warningf("Installed definition of %v differs from its Config:\n%s", s, d)
+	}
+	return nil
 }
 
 var (
@@ -138,6 +901,11 @@ var (
 	ErrServiceIsNotInstalled = errors.New("Service is not installed.")
 	// ErrServiceIsNotRunning is returned when the service is not running
 	ErrServiceIsNotRunning = errors.New("Service is not running.")
+	// ErrNotSupported is returned when the service system does not support an operation.
+	ErrNotSupported = errors.New("Not supported by this service system.")
+	// ErrDefinitionDrift is returned by Start when the installed definition
+	// differs from the Config and VerifyDefinitionStrict is set.
+	ErrDefinitionDrift = errors.New("Installed service definition differs from Config.")
 )
 
 // New creates a new service based on a service interface and configuration.
@@ -188,6 +956,17 @@ func (kv KeyValue) string(name string, defaultValue string) string {
 	return defaultValue
 }
 
+// strings returns the value of the given name, assuming the value is a []string.
+// If the value isn't found or is not of the type, the defaultValue is returned.
+func (kv KeyValue) strings(name string, defaultValue []string) []string {
+	if v, found := kv[name]; found {
+		if castValue, is := v.([]string); is {
+			return castValue
+		}
+	}
+	return defaultValue
+}
+
 // float64 returns the value of the given name, assuming the value is a float64.
 // If the value isn't found or is not of the type, the defaultValue is returned.
 func (kv KeyValue) float64(name string, defaultValue float64) float64 {
@@ -199,6 +978,23 @@ func (kv KeyValue) float64(name string, defaultValue float64) float64 {
 	return defaultValue
 }
 
+// duration returns the value of the given name, assuming the value is a
+// time.Duration or a string accepted by time.ParseDuration.
+// If the value isn't found or is not of the type, the defaultValue is returned.
+func (kv KeyValue) duration(name string, defaultValue time.Duration) time.Duration {
+	if v, found := kv[name]; found {
+		switch castValue := v.(type) {
+		case time.Duration:
+			return castValue
+		case string:
+			if d, err := time.ParseDuration(castValue); err == nil {
+				return d
+			}
+		}
+	}
+	return defaultValue
+}
+
 // funcSingle returns the value of the given name, assuming the value is a float64.
 // If the value isn't found or is not of the type, the defaultValue is returned.
 func (kv KeyValue) funcSingle(name string, defaultValue func()) func() {
@@ -210,7 +1006,545 @@ func (kv KeyValue) funcSingle(name string, defaultValue func()) func() {
 	return defaultValue
 }
 
-// Platform returns a description of the system service.
+// funcString returns the value of the given name, assuming the value is a func(string).
+// If the value isn't found or is not of the type, the defaultValue is returned.
+func (kv KeyValue) funcString(name string, defaultValue func(string)) func(string) {
+	if v, found := kv[name]; found {
+		if castValue, is := v.(func(string)); is {
+			return castValue
+		}
+	}
+	return defaultValue
+}
+
+// funcContext returns the value of the given name, assuming the value is a
+// func(context.Context) error.
+// If the value isn't found or is not of the type, the defaultValue is returned.
+func (kv KeyValue) funcContext(name string, defaultValue func(context.Context) error) func(context.Context) error {
+	if v, found := kv[name]; found {
+		if castValue, is := v.(func(context.Context) error); is {
+			return castValue
+		}
+	}
+	return defaultValue
+}
+
+// WaitTCPCommand returns a command for ExecStartPost that waits up to timeout
+// for address, in host:port form, to accept TCP connections.
+func WaitTCPCommand(address string, timeout time.Duration) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, ""
+	}
+	return fmt.Sprintf(`/bin/bash -c 'for i in $(seq %d); do (exec 3<>"/dev/tcp/$1/$2") 2>/dev/null && exit 0; sleep 1; done; exit 1' wait %s %s`,
+		int(timeout/time.Second)+1, shellQuote(host), shellQuote(port))
+}
+
+// WaitHTTPCommand returns a command for ExecStartPost that waits up to timeout
+// for url to answer with a successful HTTP status. It requires curl.
+func WaitHTTPCommand(url string, timeout time.Duration) string {
+	return fmt.Sprintf(`/usr/bin/curl -sf -o /dev/null --retry %d --retry-delay 1 --retry-connrefused %s`,
+		int(timeout/time.Second)+1, shellQuote(url))
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
+
+// Status is a state of the service as reported by Service.Status.
+type Status int
+
+const (
+	// StatusUnknown is any Status error other than the ones below.
+	StatusUnknown Status = iota
+	// StatusRunning is a nil Status.
+	StatusRunning
+	// StatusStopped is ErrServiceIsNotRunning.
+	StatusStopped
+	// StatusNotInstalled is ErrServiceIsNotInstalled.
+	StatusNotInstalled
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusRunning:
+		return "running"
+	case StatusStopped:
+		return "stopped"
+	case StatusNotInstalled:
+		return "not installed"
+	}
+	return "unknown"
+}
+
+// restart returns the Restart option, which defaults to no for OneShot
+// services and to defaultValue otherwise.
+func (c *Config) restart(defaultValue string) (string, error) {
+	if c.Option.bool(optionOneShot, optionOneShotDefault) {
+		defaultValue = "no"
+	}
+	v := c.Option.string(optionRestart, defaultValue)
+	switch v {
+	case "always", "on-failure", "no":
+		return v, nil
+	}
+	return "", fmt.Errorf("Option Restart must be always, on-failure or no: %q", v)
+}
+
+// HealthStatus is the health of a running service as reported by Service.Health.
+type HealthStatus int
+
+const (
+	// HealthUnknown is returned together with an error.
+	HealthUnknown HealthStatus = iota
+	// Healthy means the service works as intended.
+	Healthy
+	// Degraded means the service works with reduced capacity or features.
+	Degraded
+	// Starting means the service is not ready yet.
+	Starting
+	// Unhealthy means the service runs but does not work.
+	Unhealthy
+)
+
+func (h HealthStatus) String() string {
+	switch h {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case Starting:
+		return "starting"
+	case Unhealthy:
+		return "unhealthy"
+	}
+	return "unknown"
+}
+
+// ResourceUsage is a snapshot of the resources a running service uses, as
+// reported by Service.ResourceUsage.
+type ResourceUsage struct {
+	CPUTime   time.Duration // User and system CPU time used so far.
+	Memory    uint64        // Resident memory in bytes.
+	OpenFiles int           // Open files or handles, -1 if unknown.
+}
+
+// limitNOFILE returns the LimitNOFILE option, an int or a string of one, or
+// zero if it is not set.
+func (c *Config) limitNOFILE() (int, error) {
+	v, found := c.Option[optionLimitNOFILE]
+	if !found {
+		return 0, nil
+	}
+	var n int
+	var err error
+	switch limit := v.(type) {
+	case int:
+		n = limit
+	case string:
+		n, err = strconv.Atoi(strings.TrimSpace(limit))
+	}
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Option %s must be a positive number of files: %#v", optionLimitNOFILE, v)
+	}
+	return n, nil
+}
+
+// logPaths returns the files the LogOutput, StdOutPath and StdErrPath options
+// append the output and error output of the service to, "" for output that
+// is not redirected. LogOutput puts them in dir by default. The paths can be
+// put in double quotes in scripts, they don't contain quotes or expansions.
+func (c *Config) logPaths(dir string) (stdout, stderr string, err error) {
+	stdout = c.Option.string(optionStdOutPath, "")
+	stderr = c.Option.string(optionStdErrPath, "")
+	if c.Option.bool(optionLogOutput, false) {
+		if len(stdout) == 0 {
+			stdout = filepath.Join(dir, c.Name+".out")
+		}
+		if len(stderr) == 0 {
+			stderr = filepath.Join(dir, c.Name+".err")
+		}
+	}
+	for _, p := range []struct{ key, path string }{{optionStdOutPath, stdout}, {optionStdErrPath, stderr}} {
+		if len(p.path) != 0 && (!filepath.IsAbs(p.path) || strings.ContainsAny(p.path, "\n\"'`$\\%")) {
+			return "", "", fmt.Errorf("Option %s must be an absolute path without quotes, $ or %%: %q", p.key, p.path)
+		}
+	}
+	return stdout, stderr, nil
+}
+
+// groupNamePattern matches a group name or numeric group ID.
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// groupName returns the GroupName option, or "" if it is not set.
+func (c *Config) groupName() (string, error) {
+	v := c.Option.string(optionGroupName, "")
+	if len(v) != 0 && !groupNamePattern.MatchString(v) {
+		return "", fmt.Errorf("Option %s must be a group name or ID: %q", optionGroupName, v)
+	}
+	return v, nil
+}
+
+// StartType is whether a service starts at boot, as set by
+// Service.SetStartType. The values match the StartType option of Windows.
+type StartType string
+
+const (
+	// StartAutomatic starts the service at boot, as Install sets it up.
+	StartAutomatic StartType = "automatic"
+	// StartManual starts the service only with Start.
+	StartManual StartType = "manual"
+	// StartDisabled keeps the service from starting at boot and, on Windows
+	// and OS X, from starting with Start.
+	StartDisabled StartType = "disabled"
+)
+
+// ReconcileSpec is the state Service.Reconcile brings a service to.
+type ReconcileSpec struct {
+	// Installed is whether the service is installed, and so enabled to start
+	// at boot: Install enables the service and Uninstall disables it.
+	Installed bool
+	// Running is whether the service runs. It is ignored if not Installed.
+	Running bool
+}
+
+// HealthExitCodes maps the exit codes of the HealthCommand option to the
+// HealthStatus they stand for. It is set with the HealthExitCodes option.
+type HealthExitCodes map[int]HealthStatus
+
+// healthExitCodes returns the HealthExitCodes option.
+func (c *Config) healthExitCodes() HealthExitCodes {
+	switch codes := c.Option[optionHealthExitCodes].(type) {
+	case HealthExitCodes:
+		return codes
+	case map[int]HealthStatus:
+		return codes
+	}
+	return nil
+}
+
+// statusOf calls s.Status and classifies the result.
+func statusOf(s Service) Status {
+	switch s.Status() {
+	case nil:
+		return StatusRunning
+	case ErrServiceIsNotRunning:
+		return StatusStopped
+	case ErrServiceIsNotInstalled:
+		return StatusNotInstalled
+	}
+	return StatusUnknown
+}
+
+// waitFor implements WaitFor by polling Status, starting every 50ms and
+// backing off to once a second.
+func waitFor(ctx context.Context, s Service, desired Status) error {
+	delay := 50 * time.Millisecond
+	for {
+		last := statusOf(s)
+		if last == desired {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Service is %v, not %v: %v", last, desired, ctx.Err())
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+	}
+}
+
+// health implements Health by running the HealthCommand option and mapping its
+// exit code with the HealthExitCodes option.
+func health(s Service, c *Config) (HealthStatus, error) {
+	if err := s.Status(); err != nil {
+		return HealthUnknown, err
+	}
+	command := c.Option.strings(optionHealthCommand, nil)
+	if len(command) == 0 {
+		return Healthy, nil
+	}
+	out, err := Runner.Run(c.commandTimeout(), command[0], command[1:]...)
+	code, err := exitCode(err)
+	if err != nil {
+		return HealthUnknown, fmt.Errorf("HealthCommand failed to run: %v %s", err, out)
+	}
+	if h, ok := c.healthExitCodes()[code]; ok {
+		return h, nil
+	}
+	if code == 0 {
+		return Healthy, nil
+	}
+	return Unhealthy, nil
+}
+
+// stopBeforeUninstall stops the service for Uninstall if it is running,
+// unless the StopOnUninstall option is false.
+func stopBeforeUninstall(s Service, c *Config) error {
+	if statusOf(s) != StatusRunning {
+		return nil
+	}
+	if c.Option.bool(optionStopOnUninstall, true) {
+		return s.Stop()
+	}
+	if l, err := s.Logger(nil); err == nil {
+		l.Warningf("Uninstalling %v without stopping it, it keeps running until it exits or the next boot.", s)
+	}
+	return nil
+}
+
+// checkStartType returns an error for SetStartType if startType is unknown,
+// and ErrServiceIsNotInstalled if s is not installed.
+func checkStartType(s Service, startType StartType) error {
+	switch startType {
+	case StartAutomatic, StartManual, StartDisabled:
+	default:
+		return fmt.Errorf("StartType must be automatic, manual or disabled: %q", startType)
+	}
+	installed, err := s.Installed()
+	if err != nil {
+		return err
+	}
+	if !installed {
+		return ErrServiceIsNotInstalled
+	}
+	return nil
+}
+
+// stopThenStart implements Restart for systems without a restart command. It
+// waits until Status reports the service stopped so Start does not race the
+// exiting process.
+func stopThenStart(s Service, c *Config) error {
+	if err := s.Stop(); err != nil {
+		return err
+	}
+	timeout := c.Option.duration(optionRestartStopTimeout, 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := waitFor(ctx, s, StatusStopped); err != nil {
+		return fmt.Errorf("Service did not stop within %v to be restarted: %v", timeout, err)
+	}
+	return s.Start()
+}
+
+// selfTest implements SelfTest with the Service methods, undoing the steps
+// it took in reverse order.
+func selfTest(ctx context.Context, s Service, c *Config) (err error) {
+	prior := statusOf(s)
+	if prior == StatusUnknown {
+		return errors.New("Self-test failed: the status of the service is unknown.")
+	}
+	var undo []func() error
+	defer func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if uerr := undo[i](); uerr != nil && err == nil {
+				err = fmt.Errorf("Self-test passed but restoring the prior state failed: %v", uerr)
+			}
+		}
+	}()
+
+	if prior == StatusNotInstalled {
+		if err = s.Install(); err != nil {
+			return fmt.Errorf("Self-test failed to install the service: %v", err)
+		}
+		undo = append(undo, s.Uninstall)
+	}
+	if prior != StatusRunning {
+		if err = s.Start(); err != nil {
+			return fmt.Errorf("Self-test failed to start the service: %v", err)
+		}
+		undo = append(undo, s.Stop)
+	}
+	if err = s.WaitFor(ctx, StatusRunning); err != nil {
+		return fmt.Errorf("Self-test failed waiting for the service to run: %v", err)
+	}
+	if probe := c.Option.funcContext(optionSelfTestProbe, nil); probe != nil {
+		if err = probe(ctx); err != nil {
+			return fmt.Errorf("Self-test failed the SelfTestProbe: %v", err)
+		}
+	}
+	return nil
+}
+
+// reinstall implements Reinstall.
+func reinstall(s Service) error {
+	installed, err := s.Installed()
+	if err != nil {
+		return fmt.Errorf("Reinstall failed to check the installation: %v", err)
+	}
+	running := false
+	if installed {
+		running = statusOf(s) == StatusRunning
+		if err = s.Uninstall(); err != nil && err != ErrServiceIsNotInstalled {
+			return fmt.Errorf("Reinstall failed to uninstall the service: %v", err)
+		}
+	}
+	if err = s.Install(); err != nil {
+		return fmt.Errorf("Reinstall failed to install the service: %v", err)
+	}
+	if running {
+		if err = s.Start(); err != nil {
+			return fmt.Errorf("Reinstall failed to start the service: %v", err)
+		}
+	}
+	return nil
+}
+
+// reconcile implements Reconcile. The definition has drifted if Diff reports
+// a difference, which also accounts for binary plists and preserved LSB
+// headers that make the checksums differ.
+func reconcile(s Service, desired ReconcileSpec) (changed bool, err error) {
+	installed, err := s.Installed()
+	if err != nil {
+		return false, fmt.Errorf("Reconcile failed to check the installation: %v", err)
+	}
+	if !desired.Installed {
+		if !installed {
+			return false, nil
+		}
+		if err = s.Uninstall(); err != nil {
+			return false, fmt.Errorf("Reconcile failed to uninstall the service: %v", err)
+		}
+		return true, nil
+	}
+
+	if installed {
+		d, err := s.Diff()
+		if err != nil {
+			return false, fmt.Errorf("Reconcile failed to compare the definition: %v", err)
+		}
+		if len(d) != 0 {
+			// Uninstall stops the service, which Start below restarts.
+			if err = s.Uninstall(); err != nil {
+				return false, fmt.Errorf("Reconcile failed to uninstall the drifted service: %v", err)
+			}
+			installed, changed = false, true
+		}
+	}
+	if !installed {
+		if err = s.Install(); err != nil {
+			return changed, fmt.Errorf("Reconcile failed to install the service: %v", err)
+		}
+		changed = true
+	}
+
+	switch status := statusOf(s); {
+	case status == StatusUnknown:
+		return changed, errors.New("Reconcile failed: the status of the service is unknown.")
+	case desired.Running && status != StatusRunning:
+		if err = s.Start(); err != nil {
+			return changed, fmt.Errorf("Reconcile failed to start the service: %v", err)
+		}
+		changed = true
+	case !desired.Running && status == StatusRunning:
+		if err = s.Stop(); err != nil {
+			return changed, fmt.Errorf("Reconcile failed to stop the service: %v", err)
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// describe implements Describe from the Config and the live status of s.
+func describe(s Service, c *Config) ([]byte, error) {
+	path, err := c.execPath()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.AppliedOptions()
+	if err != nil {
+		return nil, err
+	}
+	status := statusOf(s)
+	var healthStatus string
+	if status == StatusRunning {
+		h, _ := health(s, c)
+		healthStatus = h.String()
+	}
+	arguments := c.Arguments
+	if arguments == nil {
+		arguments = []string{}
+	}
+	return json.MarshalIndent(&struct {
+		Name           string   `json:"name"`
+		DisplayName    string   `json:"displayName"`
+		Description    string   `json:"description"`
+		Platform       string   `json:"platform"`
+		Executable     string   `json:"executable"`
+		Arguments      []string `json:"arguments"`
+		UserName       string   `json:"userName"`
+		Installed      bool     `json:"installed"`
+		Status         string   `json:"status"`
+		Health         string   `json:"health"`
+		AppliedOptions []string `json:"appliedOptions"`
+	}{
+		c.Name, c.DisplayName, c.Description, Platform(), path, arguments, c.UserName,
+		status != StatusNotInstalled, status.String(), healthStatus, applied,
+	}, "", "\t")
+}
+
+// systemdOnlyOptions can't be approximated by other service systems, which
+// refuse to install a service setting them.
+var systemdOnlyOptions = []string{
+	optionMemoryMax, optionMemoryLow, optionMemoryHigh, optionMemorySwapMax, optionMemoryZSwapMax,
+	optionPrivateUsers, optionPrivateMounts, optionProtectProc, optionProcSubset,
+	optionLogRotate, optionLogRotatePaths,
+}
+
+// checkSystemdOnly returns an error if c sets one of systemdOnlyOptions.
+func (c *Config) checkSystemdOnly() error {
+	for _, key := range systemdOnlyOptions {
+		if _, ok := c.Option[key]; ok {
+			return fmt.Errorf("Option %s is only supported by systemd.", key)
+		}
+	}
+	return nil
+}
+
+// checkLaunchdOnly returns an error if c sets an option only launchd honors.
+func (c *Config) checkLaunchdOnly() error {
+	if format := c.Option.string(optionPlistFormat, "xml"); format != "xml" {
+		return fmt.Errorf("Option %s %s is only supported by launchd.", optionPlistFormat, format)
+	}
+	return nil
+}
+
+// checkDirectories returns an error if the WorkingDirectory or ChRoot is set
+// but not absolute, which the service systems would resolve against /.
+func (c *Config) checkDirectories() error {
+	for _, d := range []struct{ field, path string }{{"WorkingDirectory", c.WorkingDirectory}, {"ChRoot", c.ChRoot}} {
+		if len(d.path) != 0 && (!filepath.IsAbs(d.path) || strings.ContainsAny(d.path, "\n")) {
+			return fmt.Errorf("%s must be an absolute path: %q", d.field, d.path)
+		}
+	}
+	return nil
+}
+
+// The values Platform returns for the system services of this package.
+const (
+	PlatformLinuxSystemd  = "linux-systemd"
+	PlatformLinuxUpstart  = "linux-upstart"
+	PlatformLinuxOpenRC   = "linux-openrc"
+	PlatformLinuxRunit    = "linux-runit"
+	PlatformLinuxS6       = "linux-s6"
+	PlatformLinuxSysV     = "linux-sysv"
+	PlatformDarwinLaunchd = "darwin-launchd"
+	PlatformFreeBSDRcd    = "freebsd-rcd"
+	PlatformAIXSRC        = "aix-src"
+	PlatformSolarisSMF    = "solaris-smf"
+	PlatformWindows       = "windows-service"
+
+	// Deprecated: Use PlatformLinuxSysV. Platform returned "unix-systemv"
+	// for SystemV before it was renamed to match the other Linux systems.
+	PlatformLinuxSystemV = PlatformLinuxSysV
+)
+
+// Platform returns a description of the system service New uses, one of the
+// Platform constants unless ChooseSystem was given another System. It
+// returns "" if no system service was found.
 func Platform() string {
 	if system == nil {
 		return ""
@@ -227,6 +1561,30 @@ func Interactive() bool {
 	return system.Interactive()
 }
 
+// Launcher describes what started the current process, see LaunchContext.
+type Launcher int
+
+const (
+	// ByUnknown is returned when the launcher could not be determined.
+	ByUnknown Launcher = iota
+	// ByServiceManager means the process runs as a managed service.
+	ByServiceManager
+	// ByShell means the process was started from a shell or terminal.
+	ByShell
+	// ByCron means the process was started by cron or a similar scheduler.
+	ByCron
+)
+
+// LaunchContext returns what started the current process. Unlike Interactive
+// it tells a managed service apart from other non-interactive starts, such as
+// scheduled jobs. It relies on the environment the service manager sets
+// (JOURNAL_STREAM, INVOCATION_ID, UPSTART_JOB, XPC_SERVICE_NAME, SMF_FMRI)
+// and on the names of the ancestor processes, skipping shells. A process
+// orphaned to init is ByUnknown.
+func LaunchContext() Launcher {
+	return launchContext()
+}
+
 func newSystem() System {
 	for _, choice := range systemRegistry {
 		if choice.Detect() == false {
@@ -319,14 +1677,142 @@ type Service interface {
 	// greater rights. Will return an error if it is already installed.
 	Install() error
 
+	// Preflight checks the prerequisites of Install without changing anything:
+	// that the external tools the service system uses are in PATH and the
+	// definition can be written. The error lists every missing prerequisite.
+	Preflight() error
+
 	// Uninstall removes the given service from the OS service manager. This may require
-	// greater rights. Will return an error if the service is not present.
+	// greater rights. Whatever parts of the service are present are removed, so
+	// an interrupted Uninstall may be retried. Will return ErrServiceIsNotInstalled
+	// if nothing of the service was present.
 	Uninstall() error
 
 	// Status returns nil if the given service is running.
 	// Will return an error if the service is not running or is not present.
 	Status() error
 
+	// Installed reports whether the definition of the service is present,
+	// whether or not the service is running. systemd asks systemctl cat,
+	// OpenRC rc-service --exists, AIX lssrc and Windows the service control
+	// manager; SystemV, Upstart, runit, s6, FreeBSD, Solaris and OS X look for
+	// the definition file, as launchd only knows loaded services.
+	// It has no side effects, so it tells whether to call Install or Reinstall
+	// without matching the error of Install. A definition that can't be looked
+	// up, such as for lack of permission, is an error rather than false.
+	Installed() (bool, error)
+
+	// SetStartType sets whether the installed service starts at boot without
+	// reinstalling, starting or stopping it: systemctl enable or disable on
+	// systemd, the start links on SystemV, rc-update on OpenRC, an override
+	// file on Upstart, a down file on runit and s6, sysrc on FreeBSD, the
+	// inittab on AIX, launchctl enable or disable on OS X and the start type
+	// of the service control manager on Windows. launchd has no StartManual,
+	// use the RunAtLoad option instead; the other systems treat StartDisabled
+	// as StartManual. SMF returns ErrNotSupported, as enabling an instance
+	// starts it. On Windows Diff and Reconcile compare the start type with the
+	// StartType option. Will return ErrServiceIsNotInstalled if the service is
+	// not present.
+	SetStartType(startType StartType) error
+
+	// WaitFor polls Status until the service reaches the desired status or
+	// ctx is done, in which case the error names the status last seen. None
+	// of the service managers can wait for a state themselves, so all poll.
+	WaitFor(ctx context.Context, desired Status) error
+
+	// Health returns the health of the running service, as reported by the exit
+	// code of the HealthCommand option, mapped with the HealthExitCodes option.
+	// It is Healthy without a HealthCommand. Will return the Status error if
+	// the service is not running.
+	Health() (HealthStatus, error)
+
+	// DefinitionChecksum returns the SHA-256 of the installed service definition.
+	// Will return ErrServiceIsNotInstalled if the service is not present.
+	DefinitionChecksum() (string, error)
+
+	// Diff returns the difference between the installed service definition and
+	// the one the Config would produce, or an empty string if they match.
+	// Will return ErrServiceIsNotInstalled if the service is not present.
+	Diff() (string, error)
+
+	// Render returns the service definition Install would write for the
+	// Config without writing anything or running the service system: the
+	// unit, init script, job, run script, plist or manifest, and for AIX and
+	// Windows the settings in the key=value lines Diff compares. It is what
+	// Diff compares the installed definition to; other files Install writes,
+	// such as the socket units of systemd, are not included.
+	Render() (string, error)
+
+	// NetworkStats returns the bytes received and sent by the running service.
+	// Requires the IPAccounting option on systemd and returns ErrNotSupported
+	// on other systems.
+	NetworkStats() (in, out uint64, err error)
+
+	// ResourceUsage returns the CPU time, resident memory and open files of
+	// the running service. systemd accounts CPU time and memory for the whole
+	// unit; the other systems add up the main process and its children. AIX
+	// returns ErrNotSupported.
+	// Will return the Status error if the service is not running.
+	ResourceUsage() (ResourceUsage, error)
+
+	// PID returns the process id of the running service: the main process on
+	// systemd, the one in the pid file on SystemV, OpenRC, runit and FreeBSD,
+	// and the one launchd, Upstart, s6, AIX SRC, SMF or the Windows service manager
+	// reports.
+	// Will return the Status error if the service is not running.
+	PID() (int, error)
+
+	// AppliedOptions returns the sorted keys of Config.Option that affect the
+	// service definition Install writes. Options set but missing from the
+	// result are ignored by this service system or only used at run time.
+	AppliedOptions() ([]string, error)
+
+	// SelfTest proves the service comes up on this host: it installs the service
+	// if needed, starts it if it is not running, waits until it runs and calls
+	// the SelfTestProbe option. Then it stops and uninstalls the service again
+	// as far as needed to leave it in its prior state. The error names the
+	// step that failed; give ctx a deadline to bound the wait.
+	SelfTest(ctx context.Context) error
+
+	// Reconcile brings the service to the desired state with as few changes as
+	// possible and reports whether it changed anything. It installs the
+	// service if missing and reinstalls it if the installed definition differs
+	// from the Config, as reported by Diff, which restarts a running service.
+	// Then it starts or stops the service as desired; a service that is not
+	// desired Installed is uninstalled.
+	Reconcile(desired ReconcileSpec) (changed bool, err error)
+
+	// Reinstall replaces the installed definition with the one of the Config,
+	// as for an upgrade, and installs the service if it is missing. It
+	// uninstalls and installs again, so each run leaves the same files and
+	// links, and starts the service again if it was running. If Install fails
+	// the service stays uninstalled.
+	Reinstall() error
+
+	// Describe returns a JSON document describing the service for external
+	// tools, with the keys name, displayName, description, platform,
+	// executable, arguments, userName, installed, status, health and
+	// appliedOptions. Status is the Status string: "running", "stopped",
+	// "not installed" or "unknown". Health is the HealthStatus string of a
+	// running service, such as "degraded", and empty otherwise.
+	Describe() ([]byte, error)
+
+	// PathDrift compares the executable recorded in the installed service
+	// definition with the one the Config resolves to now, drifted if they
+	// differ, for example after the binary was moved. Reinstall to fix it.
+	// Will return ErrServiceIsNotInstalled if the service is not present.
+	PathDrift() (installed, current string, drifted bool, err error)
+
+	// RunOnce runs the executable with the Config's arguments a single time
+	// under the supervision of the service system, without installing the
+	// service, and returns its exit code. The run is killed once timeout has
+	// passed, in which case the exit code is -1 and the error reports the
+	// timeout. systemd runs it as a transient unit with systemd-run as the
+	// UserName; SystemV, Upstart and OS X run it directly as the UserName;
+	// Windows runs it as the calling user in a job object, so processes it
+	// starts are killed with it.
+	RunOnce(timeout time.Duration) (int, error)
+
 	// Opens and returns a system logger. If the user program is running
 	// interactively rather then as a service, the returned logger will write to
 	// os.Stderr. If errs is non-nil errors will be sent on errs as well as
@@ -342,6 +1828,134 @@ type Service interface {
 	String() string
 }
 
+// CommandRunner runs the external commands service systems use, such as
+// systemctl, service or launchctl.
+type CommandRunner interface {
+	// Run runs the command and returns its combined output. It should give up
+	// and return an error once timeout has passed.
+	Run(timeout time.Duration, command string, arguments ...string) ([]byte, error)
+}
+
+// Runner runs every external command of the package. Replace it to log, audit
+// or fake the commands, for example in tests. The Windows service system uses
+// the service control manager API and only runs the HealthCommand and
+// PreStopCommand through it.
+var Runner CommandRunner = execRunner{}
+
+// execRunner runs commands with os/exec.
+type execRunner struct{}
+
+func (execRunner) Run(timeout time.Duration, command string, arguments ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command, arguments...)
+	// Children that inherit the output pipe, such as a daemon started by an
+	// init script, keep CombinedOutput waiting after the command is killed.
+	killGroupOnCancel(cmd)
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out, &timeoutError{strings.Join(append([]string{command}, arguments...), " "), timeout}
+	}
+	return out, err
+}
+
+// defaultCommandTimeout bounds external commands so a hung service manager
+// cannot block the caller forever.
+const defaultCommandTimeout = 2 * time.Minute
+
+// commandTimeout returns the deadline for commands run by Install and Uninstall,
+// and on Windows for the PreStopCommand.
+func (c *Config) commandTimeout() time.Duration {
+	return c.Option.duration(optionCommandTimeout, defaultCommandTimeout)
+}
+
+// timeoutError is returned when an external command exceeds its deadline.
+type timeoutError struct {
+	command string
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%q did not finish within %v", e.command, e.timeout)
+}
+
+var errRunOnceTimeout = errors.New("RunOnce timeout must be positive.")
+
+// exitCode returns the exit code of a command that returned err. It is -1
+// with err if the command did not run to completion.
+func exitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		if status, ok := e.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus(), nil
+		}
+	}
+	return -1, err
+}
+
+// Action is what Run does when it receives a signal listed in a SignalMap.
+type Action int
+
+const (
+	// ActionStop stops the program and returns from Run.
+	ActionStop Action = iota
+	// ActionReload calls Reload if the program implements Reloader.
+	ActionReload
+	// ActionReopenLogs calls ReopenLogs if the program implements LogReopener.
+	ActionReopenLogs
+	// ActionUpgrade stops the program and then replaces the process with a
+	// fresh start of the executable using ReExec.
+	ActionUpgrade
+	// ActionCustom calls Signal if the program implements SignalHandler.
+	ActionCustom
+)
+
+// SignalMap maps the signals Run listens for to the action taken on each.
+// It is set with the SignalMap option and replaces the default of stopping on
+// SIGTERM and SIGINT. Signals not in the map are not handled by Run.
+type SignalMap map[os.Signal]Action
+
+// signalMap returns the SignalMap option or defaults if it is not set.
+func (c *Config) signalMap(defaults SignalMap) SignalMap {
+	switch signals := c.Option[optionSignalMap].(type) {
+	case SignalMap:
+		if len(signals) != 0 {
+			return signals
+		}
+	case map[os.Signal]Action:
+		if len(signals) != 0 {
+			return signals
+		}
+	}
+	return defaults
+}
+
+// Reloader is implemented by programs that reload their configuration on
+// ActionReload.
+type Reloader interface {
+	Reload(s Service) error
+}
+
+// LogReopener is implemented by programs that reopen their log files on
+// ActionReopenLogs, for example with the ReopenLogs of a FileLogger or
+// TeeLogger. Unless the SignalMap option is set, Run on Linux and OS X also
+// maps SIGUSR1 to it, the signal the postrotate script of the systemd
+// LogRotatePaths option sends.
+type LogReopener interface {
+	ReopenLogs(s Service) error
+}
+
+// SignalHandler is implemented by programs that handle signals mapped to
+// ActionCustom themselves. Unless the SignalMap option is set, Run on Linux,
+// OS X, FreeBSD, AIX and Solaris maps SIGHUP, SIGUSR1 and SIGUSR2 to it, SIGUSR1 only if
+// the program is not a LogReopener too.
+type SignalHandler interface {
+	Signal(s Service, sig os.Signal) error
+}
+
 // ControlAction list valid string texts to use in Control.
 var ControlAction = [6]string{"start", "stop", "restart", "install", "uninstall", "status"}
 
@@ -380,3 +1994,51 @@ type Logger interface {
 	Warningf(format string, a ...interface{}) error
 	Infof(format string, a ...interface{}) error
 }
+
+// Level is the severity of a message logged with StructuredLogger.
+type Level int
+
+const (
+	// LevelDebug is for details only needed when debugging.
+	LevelDebug Level = iota
+	// LevelInfo is for messages about normal operation.
+	LevelInfo
+	// LevelWarning is for problems the service recovers from.
+	LevelWarning
+	// LevelError is for failures.
+	LevelError
+)
+
+// StructuredLogger is implemented by the Loggers of this package besides
+// Logger. Log writes msg followed by the key value pairs in kv, as in
+// "request failed path=/login status=500", which keeps the fields searchable
+// in the system log. Values with spaces, quotes or = are quoted.
+//
+// The syslog logger maps the levels to the syslog priorities debug, info,
+// warning and err. The Windows event log has no debug level, LevelDebug is
+// logged as information with its own event ID.
+type StructuredLogger interface {
+	Logger
+	Log(level Level, msg string, kv ...interface{}) error
+}
+
+// formatFields returns msg with the key value pairs of kv appended. A key
+// without a value gets an empty one.
+func formatFields(msg string, kv []interface{}) string {
+	b := []byte(msg)
+	for i := 0; i < len(kv); i += 2 {
+		var v interface{} = ""
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+		value := fmt.Sprint(v)
+		if strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		b = append(b, ' ')
+		b = append(b, fmt.Sprint(kv[i])...)
+		b = append(b, '=')
+		b = append(b, value...)
+	}
+	return string(b)
+}
@@ -0,0 +1,489 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type aixSystem struct{}
+
+func (aixSystem) String() string {
+	return PlatformAIXSRC
+}
+func (aixSystem) Detect() bool {
+	return true
+}
+func (aixSystem) Interactive() bool {
+	return interactive
+}
+func (aixSystem) New(i Interface, c *Config) (Service, error) {
+	s := &aixSrcService{
+		i:      i,
+		Config: c,
+	}
+	return s, nil
+}
+
+func init() {
+	ChooseSystem(aixSystem{})
+}
+
+var interactive = isInteractive()
+
+// isInteractive reports whether the process was not started by srcmstr,
+// the System Resource Controller daemon.
+func isInteractive() bool {
+	return parentName() != "srcmstr"
+}
+
+// parentName returns the command name of the parent process, "" if unknown.
+func parentName() string {
+	out, err := runWithOutput("ps", "-o", "comm=", "-p", strconv.Itoa(os.Getppid()))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func launchContext() Launcher {
+	return ancestorLauncher(os.Getppid(), psProcess)
+}
+
+type aixSrcService struct {
+	i Interface
+	*Config
+}
+
+func (s *aixSrcService) String() string {
+	if len(s.DisplayName) > 0 {
+		return s.DisplayName
+	}
+	return s.Name
+}
+
+var errNoUserServiceAIX = errors.New("User services are not supported on AIX.")
+
+// srcName matches the names that are also inittab identifiers, which are
+// at most 14 characters.
+var srcName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,14}$`)
+
+// subsystem holds the fields of an SRC subsystem definition Install sets.
+type subsystem struct {
+	path     string
+	args     string
+	uid      string
+	stdout   string
+	stderr   string
+	action   string
+	waittime string
+}
+
+// definition serializes the subsystem. SRC keeps it in the ODM rather than
+// a file, so this stands in for the file contents on other platforms.
+func (sub subsystem) definition() []byte {
+	return []byte(fmt.Sprintf("path=%s\nargs=%s\nuid=%s\nstdout=%s\nstderr=%s\naction=%s\nwaittime=%s\n",
+		sub.path, sub.args, sub.uid, sub.stdout, sub.stderr, sub.action, sub.waittime))
+}
+
+// srcArgs joins the arguments into the string mkssys -a takes, which SRC
+// splits on blanks and double quotes.
+func srcArgs(arguments []string) (string, error) {
+	args := make([]string, len(arguments))
+	for i, arg := range arguments {
+		if strings.ContainsAny(arg, "\"\\\n") {
+			return "", fmt.Errorf("Arguments can't contain double quotes, backslashes or newlines on AIX: %q", arg)
+		}
+		if len(arg) == 0 || strings.ContainsAny(arg, " \t") {
+			arg = `"` + arg + `"`
+		}
+		args[i] = arg
+	}
+	return strings.Join(args, " "), nil
+}
+
+// subsystem returns the definition Install passes to mkssys.
+func (s *aixSrcService) subsystem() (subsystem, error) {
+	var sub subsystem
+	if s.Option.bool(optionUserService, optionUserServiceDefault) {
+		return sub, errNoUserServiceAIX
+	}
+	if err := s.checkSystemdOnly(); err != nil {
+		return sub, err
+	}
+	if err := s.checkLaunchdOnly(); err != nil {
+		return sub, err
+	}
+	if !srcName.MatchString(s.Name) {
+		return sub, fmt.Errorf("Name must be at most 14 letters, digits, ., - or _ on AIX: %q", s.Name)
+	}
+	switch {
+	case len(s.ChRoot) != 0:
+		return sub, errors.New("ChRoot is not supported by AIX SRC.")
+	case len(s.WorkingDirectory) != 0:
+		return sub, errors.New("WorkingDirectory is not supported by AIX SRC, which starts subsystems in /.")
+	case len(s.Dependencies) != 0:
+		return sub, errors.New("Dependencies are not supported by AIX SRC.")
+	case len(s.Option.string(optionGroupName, "")) != 0:
+		return sub, fmt.Errorf("Option %s is not supported by AIX SRC.", optionGroupName)
+	}
+	env, err := s.environment()
+	if err != nil {
+		return sub, err
+	}
+	if len(env) != 0 {
+		return sub, errors.New("EnvVars and PassEnv are not supported by AIX SRC.")
+	}
+	if sub.path, err = s.execPath(); err != nil {
+		return sub, err
+	}
+	if sub.args, err = srcArgs(s.Arguments); err != nil {
+		return sub, err
+	}
+	sub.uid = "0"
+	if len(s.UserName) != 0 {
+		u, err := user.Lookup(s.UserName)
+		if err != nil {
+			return sub, err
+		}
+		sub.uid = u.Uid
+	}
+	// SRC writes to the console unless told otherwise.
+	if sub.stdout, sub.stderr, err = s.logPaths("/var/log"); err != nil {
+		return sub, err
+	}
+	if len(sub.stdout) == 0 {
+		sub.stdout = "/dev/console"
+	}
+	if len(sub.stderr) == 0 {
+		sub.stderr = "/dev/console"
+	}
+	restart, err := s.restart("always")
+	if err != nil {
+		return sub, err
+	}
+	switch restart {
+	case "always":
+		sub.action = "-R"
+	case "no":
+		sub.action = "-O"
+	default:
+		return sub, errors.New("Option Restart on-failure is not supported by AIX SRC, which restarts a subsystem after any exit stopsrc did not cause.")
+	}
+	sub.waittime = strconv.Itoa(seconds(s.Option.duration(optionStopKillDelay, 20*time.Second)))
+	return sub, nil
+}
+
+// installed returns the subsystem definition lssrc -S reports. Its output
+// is a header of colon separated field names and a line of the values.
+func (s *aixSrcService) installed() (subsystem, error) {
+	out, err := runWithOutputTimeout(s.commandTimeout(), "lssrc", "-S", "-s", s.Name)
+	if strings.Contains(string(out), "not on file") {
+		return subsystem{}, ErrServiceIsNotInstalled
+	}
+	if err != nil {
+		return subsystem{}, fmt.Errorf("\"lssrc\" failed: %v, %s", err, out)
+	}
+	return parseSubsystem(out)
+}
+
+// parseSubsystem parses the output of lssrc -S.
+func parseSubsystem(out []byte) (subsystem, error) {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "#") {
+		return subsystem{}, fmt.Errorf("Unexpected lssrc output: %q", out)
+	}
+	names := strings.Split(strings.TrimPrefix(lines[0], "#"), ":")
+	values := strings.Split(lines[1], ":")
+	// Only the arguments may contain colons, put them back together.
+	extra := len(values) - len(names)
+	if extra < 0 {
+		return subsystem{}, fmt.Errorf("Unexpected lssrc output: %q", out)
+	}
+	args := -1
+	fields := make(map[string]string, len(names))
+	for i, name := range names {
+		switch {
+		case name == "cmdargs":
+			args = i
+			fields[name] = strings.Join(values[i:i+extra+1], ":")
+		case args < 0:
+			fields[name] = values[i]
+		default:
+			fields[name] = values[i+extra]
+		}
+	}
+	return subsystem{
+		path:     fields["path"],
+		args:     fields["cmdargs"],
+		uid:      fields["uid"],
+		stdout:   fields["standout"],
+		stderr:   fields["standerr"],
+		action:   fields["action"],
+		waittime: fields["waittime"],
+	}, nil
+}
+
+// Install defines the subsystem with mkssys and adds an inittab entry that
+// starts it at boot.
+func (s *aixSrcService) Install() error {
+	sub, err := s.subsystem()
+	if err != nil {
+		return err
+	}
+	installed, err := s.Installed()
+	if err != nil {
+		return err
+	}
+	if installed {
+		return fmt.Errorf("Subsystem already exists: %s", s.Name)
+	}
+	args := []string{"-s", s.Name, "-p", sub.path, "-u", sub.uid,
+		"-o", sub.stdout, "-e", sub.stderr, sub.action, "-Q", "-S", "-n", "15", "-f", "9", "-w", sub.waittime}
+	if len(sub.args) != 0 {
+		args = append(args, "-a", sub.args)
+	}
+	if err = runTimeout(s.commandTimeout(), "mkssys", args...); err != nil {
+		return err
+	}
+	if err = runTimeout(s.commandTimeout(), "mkitab", s.inittab()); err != nil {
+		run("rmssys", "-s", s.Name)
+		return err
+	}
+	s.notifyChecksum(sub.definition())
+	return nil
+}
+
+// inittab is the entry that starts the subsystem when the system boots.
+func (s *aixSrcService) inittab() string {
+	return s.Name + ":2:once:/usr/bin/startsrc -s " + s.Name + " >/dev/console 2>&1"
+}
+
+func (s *aixSrcService) Preflight() error {
+	tools := []string{"mkssys", "rmssys", "startsrc", "stopsrc", "lssrc", "mkitab", "rmitab", "lsitab"}
+	if s.Option.bool(optionUserService, optionUserServiceDefault) {
+		return preflight(tools, nil, strings.TrimSuffix(errNoUserServiceAIX.Error(), "."))
+	}
+	return preflight(tools, []string{"/etc/inittab"})
+}
+
+func (s *aixSrcService) Uninstall() error {
+	defined, err := s.Installed()
+	if err != nil {
+		return err
+	}
+	if defined {
+		if err = stopBeforeUninstall(s, s.Config); err != nil {
+			return err
+		}
+	}
+	// rmitab fails for an entry that does not exist.
+	boot, err := commandSucceeds(s.commandTimeout(), "lsitab", s.Name)
+	if err != nil {
+		return err
+	}
+	if boot {
+		if err = runTimeout(s.commandTimeout(), "rmitab", s.Name); err != nil {
+			return err
+		}
+	}
+	if !defined {
+		if !boot {
+			return ErrServiceIsNotInstalled
+		}
+		return nil
+	}
+	return runTimeout(s.commandTimeout(), "rmssys", "-s", s.Name)
+}
+
+func (s *aixSrcService) Diff() (string, error) {
+	installed, err := s.installed()
+	if err != nil {
+		return "", err
+	}
+	desired, err := s.subsystem()
+	if err != nil {
+		return "", err
+	}
+	return diff(string(installed.definition()), string(desired.definition())), nil
+}
+
+// Render returns the subsystem mkssys defines as the key=value lines Diff
+// compares.
+func (s *aixSrcService) Render() (string, error) {
+	sub, err := s.subsystem()
+	if err != nil {
+		return "", err
+	}
+	return string(sub.definition()), nil
+}
+
+func (s *aixSrcService) WaitFor(ctx context.Context, desired Status) error {
+	return waitFor(ctx, s, desired)
+}
+
+func (s *aixSrcService) Health() (HealthStatus, error) {
+	return health(s, s.Config)
+}
+
+func (s *aixSrcService) SelfTest(ctx context.Context) error {
+	return selfTest(ctx, s, s.Config)
+}
+
+func (s *aixSrcService) Reconcile(desired ReconcileSpec) (bool, error) {
+	return reconcile(s, desired)
+}
+
+func (s *aixSrcService) Reinstall() error {
+	return reinstall(s)
+}
+
+func (s *aixSrcService) Describe() ([]byte, error) {
+	return describe(s, s.Config)
+}
+
+func (s *aixSrcService) AppliedOptions() ([]string, error) {
+	return appliedOptions(s.Config, func(c *Config) ([]byte, error) {
+		sub, err := (&aixSrcService{Config: c}).subsystem()
+		if err != nil {
+			return nil, err
+		}
+		return sub.definition(), nil
+	})
+}
+
+func (s *aixSrcService) RunOnce(timeout time.Duration) (int, error) {
+	return runOnce(s.Config, timeout)
+}
+
+func (s *aixSrcService) PathDrift() (installed, current string, drifted bool, err error) {
+	sub, err := s.installed()
+	if err != nil {
+		return "", "", false, err
+	}
+	current, err = s.execPath()
+	if err != nil {
+		return "", "", false, err
+	}
+	return sub.path, current, sub.path != current, nil
+}
+
+func (s *aixSrcService) DefinitionChecksum() (string, error) {
+	sub, err := s.installed()
+	if err != nil {
+		return "", err
+	}
+	return checksum(sub.definition()), nil
+}
+
+func (s *aixSrcService) Logger(errs chan<- error) (Logger, error) {
+	if system.Interactive() {
+		return ConsoleLogger, nil
+	}
+	return s.SystemLogger(errs)
+}
+func (s *aixSrcService) SystemLogger(errs chan<- error) (Logger, error) {
+	if address := s.Option.string(optionLogSocket, ""); len(address) != 0 {
+		return newSocketLogger(s.Name, address, errs), nil
+	}
+	return newSysLogger(s.Name, errs)
+}
+
+func (s *aixSrcService) Run() error {
+	return serve(s, s.i, s.Config, defaultSignalMap, s.runtimeMax())
+}
+
+func (s *aixSrcService) Start() error {
+	if err := verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	return runStart(s.Config, "startsrc", "-s", s.Name)
+}
+
+// Stop asks SRC for a normal stop, which sends SIGTERM and SIGKILL after
+// StopKillDelay (20s).
+func (s *aixSrcService) Stop() error {
+	return run("stopsrc", "-s", s.Name)
+}
+
+func (s *aixSrcService) Status() error {
+	return checkStatus("lssrc", []string{"-s", s.Name}, "active", "not on file")
+}
+
+func (s *aixSrcService) Installed() (bool, error) {
+	out, err := runWithOutputTimeout(s.commandTimeout(), "lssrc", "-s", s.Name)
+	if strings.Contains(string(out), "not on file") {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("\"lssrc\" failed: %v, %s", err, out)
+	}
+	return true, nil
+}
+
+// SetStartType adds the inittab entry that starts the subsystem at boot for
+// StartAutomatic and removes it otherwise.
+func (s *aixSrcService) SetStartType(startType StartType) error {
+	if err := checkStartType(s, startType); err != nil {
+		return err
+	}
+	boot, err := commandSucceeds(s.commandTimeout(), "lsitab", s.Name)
+	if err != nil || boot == (startType == StartAutomatic) {
+		return err
+	}
+	if boot {
+		return runTimeout(s.commandTimeout(), "rmitab", s.Name)
+	}
+	return runTimeout(s.commandTimeout(), "mkitab", s.inittab())
+}
+
+// ResourceUsage is not supported, ps on AIX has no format for the resident
+// memory of a process.
+func (s *aixSrcService) ResourceUsage() (ResourceUsage, error) {
+	return ResourceUsage{}, ErrNotSupported
+}
+
+// PID returns the pid lssrc reports in the line of an active subsystem.
+func (s *aixSrcService) PID() (int, error) {
+	if err := s.Status(); err != nil {
+		return 0, err
+	}
+	out, err := runWithOutput("lssrc", "-s", s.Name)
+	if err != nil {
+		return 0, fmt.Errorf("\"lssrc\" failed: %v, %s", err, out)
+	}
+	return parseSRCPID(out)
+}
+
+// parseSRCPID returns the pid from lssrc -s output. The group column is
+// empty for a subsystem without one, so the pid is found from the end.
+func parseSRCPID(out []byte) (int, error) {
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[len(fields)-1] != "active" {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[len(fields)-2]); err == nil {
+			return pid, nil
+		}
+	}
+	return 0, ErrServiceIsNotRunning
+}
+
+func (s *aixSrcService) NetworkStats() (in, out uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
+
+func (s *aixSrcService) Restart() error {
+	return stopThenStart(s, s.Config)
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAIXSubsystem(t *testing.T) {
+	s := &aixSrcService{Config: &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Arguments:  []string{"-config", "/etc/web/my web.conf", ""},
+		Option:     KeyValue{"LogOutput": true, "StopKillDelay": 5 * time.Second},
+	}}
+	sub, err := s.subsystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := subsystem{
+		path:     "/usr/bin/web",
+		args:     `-config "/etc/web/my web.conf" ""`,
+		uid:      "0",
+		stdout:   "/var/log/web.out",
+		stderr:   "/var/log/web.err",
+		action:   "-R",
+		waittime: "5",
+	}
+	if sub != want {
+		t.Errorf("subsystem %+v, want %+v", sub, want)
+	}
+
+	s.Option = KeyValue{"OneShot": true}
+	if sub, err = s.subsystem(); err != nil || sub.action != "-O" || sub.stdout != "/dev/console" || sub.waittime != "20" {
+		t.Errorf("OneShot subsystem %+v %v", sub, err)
+	}
+
+	for _, c := range []*Config{
+		{Name: "web-server-daemon", Executable: "/usr/bin/web"},
+		{Name: "web", Executable: "/usr/bin/web", Arguments: []string{`-name="web"`}},
+		{Name: "web", Executable: "/usr/bin/web", Option: KeyValue{"Restart": "on-failure"}},
+		{Name: "web", Executable: "/usr/bin/web", WorkingDirectory: "/var/lib/web"},
+		{Name: "web", Executable: "/usr/bin/web", EnvVars: map[string]string{"PORT": "8080"}},
+		{Name: "web", Executable: "/usr/bin/web", Dependencies: []string{"inetd"}},
+	} {
+		if _, err := (&aixSrcService{Config: c}).subsystem(); err == nil {
+			t.Errorf("%s %v %v accepted", c.Name, c.Arguments, c.Option)
+		}
+	}
+}
+
+func TestParseSubsystem(t *testing.T) {
+	sub, err := parseSubsystem([]byte(`#subsysname:synonym:cmdargs:path:uid:auditid:standin:standout:standerr:action:multi:contact:svrkey:svrmtype:priority:signorm:sigforce:display:waittime:grpname:
+web::-listen http://:8080:/usr/bin/web:202:0:/dev/console:/var/log/web.out.log:/dev/console:-R:-Q:-S:0:0:20:15:9:-d:5::
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := subsystem{
+		path:     "/usr/bin/web",
+		args:     "-listen http://:8080",
+		uid:      "202",
+		stdout:   "/var/log/web.out.log",
+		stderr:   "/dev/console",
+		action:   "-R",
+		waittime: "5",
+	}
+	if sub != want {
+		t.Errorf("subsystem %+v, want %+v", sub, want)
+	}
+	if _, err = parseSubsystem([]byte("0513-085 The web Subsystem is not on file.\n")); err == nil {
+		t.Error("parsed an error message")
+	}
+}
+
+func TestParseSRCPID(t *testing.T) {
+	for _, test := range []struct {
+		out string
+		pid int
+	}{
+		{"Subsystem         Group            PID          Status\n web                               4391032      active\n", 4391032},
+		{"Subsystem         Group            PID          Status\n sshd             ssh              3670408      active\n", 3670408},
+		{"Subsystem         Group            PID          Status\n web                                            inoperative\n", 0},
+	} {
+		pid, err := parseSRCPID([]byte(test.out))
+		if pid != test.pid || (test.pid == 0) != (err == ErrServiceIsNotRunning) {
+			t.Errorf("%q: %d %v", test.out, pid, err)
+		}
+	}
+}
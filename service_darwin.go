@@ -5,12 +5,17 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"html"
+	"io/ioutil"
 	"os"
-	"os/signal"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"text/template"
 	"time"
@@ -18,12 +23,10 @@ import (
 
 const maxPathSize = 32 * 1024
 
-const version = "darwin-launchd"
-
 type darwinSystem struct{}
 
 func (darwinSystem) String() string {
-	return version
+	return PlatformDarwinLaunchd
 }
 func (darwinSystem) Detect() bool {
 	return true
@@ -37,6 +40,7 @@ func (darwinSystem) New(i Interface, c *Config) (Service, error) {
 		Config: c,
 
 		userService: c.Option.bool(optionUserService, optionUserServiceDefault),
+		consoleUser: c.Option.bool(optionConsoleUser, false),
 	}
 
 	return s, nil
@@ -61,11 +65,20 @@ func isInteractive() (bool, error) {
 	return os.Getppid() != 1, nil
 }
 
+func launchContext() Launcher {
+	// launchd sets the job label; terminals set "0" or an application name.
+	if name := os.Getenv("XPC_SERVICE_NAME"); len(name) != 0 && name != "0" && !strings.HasPrefix(name, "application.") {
+		return ByServiceManager
+	}
+	return ancestorLauncher(os.Getppid(), psProcess)
+}
+
 type darwinLaunchdService struct {
 	i Interface
 	*Config
 
 	userService bool
+	consoleUser bool
 }
 
 func (s *darwinLaunchdService) String() string {
@@ -90,6 +103,9 @@ func (s *darwinLaunchdService) getHomeDir() (string, error) {
 }
 
 func (s *darwinLaunchdService) getServiceFilePath() (string, error) {
+	if s.consoleUser {
+		return "/Library/LaunchAgents/" + s.Name + ".plist", nil
+	}
 	if s.userService {
 		homeDir, err := s.getHomeDir()
 		if err != nil {
@@ -100,6 +116,32 @@ func (s *darwinLaunchdService) getServiceFilePath() (string, error) {
 	return "/Library/LaunchDaemons/" + s.Name + ".plist", nil
 }
 
+// guiDomain returns the launchd domain of the user logged in to the console,
+// who owns /dev/console. It is root while the login window is shown.
+func guiDomain() (string, error) {
+	out, err := runWithOutput("stat", "-f", "%u", "/dev/console")
+	if err != nil {
+		return "", err
+	}
+	uid := strings.TrimSpace(string(out))
+	if uid == "0" || len(uid) == 0 {
+		return "", errors.New("No user is logged in to the console.")
+	}
+	return "gui/" + uid, nil
+}
+
+// domain returns the launchd domain an agent is bootstrapped into, or ""
+// for a daemon, which is loaded into the system domain.
+func (s *darwinLaunchdService) domain() (string, error) {
+	if s.consoleUser {
+		return guiDomain()
+	}
+	if s.userService {
+		return "gui/" + strconv.Itoa(os.Getuid()), nil
+	}
+	return "", nil
+}
+
 func (s *darwinLaunchdService) Install() error {
 	confPath, err := s.getServiceFilePath()
 	if err != nil {
@@ -118,15 +160,55 @@ func (s *darwinLaunchdService) Install() error {
 		}
 	}
 
-	f, err := os.Create(confPath)
+	definition, err := s.definition()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	if err = createWorkingDirectory(s.Config); err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(confPath, definition, 0644)
+	if err != nil {
+		return err
+	}
+	if s.Option.string(optionPlistFormat, "xml") == "binary" {
+		err = runTimeout(s.commandTimeout(), "plutil", "-convert", "binary1", confPath)
+		if err == nil {
+			definition, err = ioutil.ReadFile(confPath)
+		}
+		if err != nil {
+			os.Remove(confPath)
+			return err
+		}
+	}
+	s.notifyChecksum(definition)
+	return nil
+}
 
+// readPlist reads the plist at path as XML, converting a binary plist.
+func (s *darwinLaunchdService) readPlist(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.HasPrefix(b, []byte("bplist")) {
+		return b, err
+	}
+	out, err := runWithOutputTimeout(s.commandTimeout(), "plutil", "-convert", "xml1", "-o", "-", path)
+	if err != nil {
+		return nil, fmt.Errorf("\"plutil\" failed: %v, %s", err, out)
+	}
+	return out, nil
+}
+
+// definition renders the launchd plist for the service.
+func (s *darwinLaunchdService) definition() ([]byte, error) {
+	if err := s.checkSystemdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkDirectories(); err != nil {
+		return nil, err
+	}
 	path, err := s.execPath()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var to = &struct {
@@ -135,12 +217,50 @@ func (s *darwinLaunchdService) Install() error {
 
 		KeepAlive, RunAtLoad bool
 		SessionCreate        bool
+		Restart              string
+		ThrottleInterval     int
+		NumberOfFiles        int
+		GroupName            string
+		StdOut, StdErr       string
+		Env                  []envVar
 	}{
-		Config:        s.Config,
-		Path:          path,
-		KeepAlive:     s.Option.bool(optionKeepAlive, optionKeepAliveDefault),
-		RunAtLoad:     s.Option.bool(optionRunAtLoad, optionRunAtLoadDefault),
-		SessionCreate: s.Option.bool(optionSessionCreate, optionSessionCreateDefault),
+		Config:           s.Config,
+		Path:             path,
+		KeepAlive:        s.Option.bool(optionKeepAlive, optionKeepAliveDefault),
+		RunAtLoad:        s.Option.bool(optionRunAtLoad, optionRunAtLoadDefault),
+		SessionCreate:    s.Option.bool(optionSessionCreate, optionSessionCreateDefault),
+		ThrottleInterval: seconds(s.Option.duration(optionRestartBackoff, 0)),
+	}
+	if _, ok := s.Option[optionRestart]; ok {
+		if to.Restart, err = s.restart("always"); err != nil {
+			return nil, err
+		}
+		to.KeepAlive = to.Restart != "no"
+	}
+	if to.NumberOfFiles, err = s.limitNOFILE(); err != nil {
+		return nil, err
+	}
+	if to.GroupName, err = s.groupName(); err != nil {
+		return nil, err
+	}
+	logDir := "/var/log"
+	if s.userService {
+		home, err := s.getHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		logDir = home + "/Library/Logs"
+	}
+	if to.StdOut, to.StdErr, err = s.logPaths(logDir); err != nil {
+		return nil, err
+	}
+	if to.Env, err = s.environment(); err != nil {
+		return nil, err
+	}
+	switch format := s.Option.string(optionPlistFormat, "xml"); format {
+	case "xml", "binary":
+	default:
+		return nil, fmt.Errorf("Option PlistFormat must be xml or binary: %q", format)
 	}
 
 	functions := template.FuncMap{
@@ -152,35 +272,224 @@ func (s *darwinLaunchdService) Install() error {
 		},
 	}
 	t := template.Must(template.New("launchdConfig").Funcs(functions).Parse(launchdConfig))
-	return t.Execute(f, to)
+	var b bytes.Buffer
+	err = t.Execute(&b, to)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (s *darwinLaunchdService) Preflight() error {
+	tools := []string{"launchctl"}
+	if s.consoleUser {
+		tools = append(tools, "stat")
+	}
+	confPath, err := s.getServiceFilePath()
+	if err != nil {
+		return preflight(tools, nil, strings.TrimSuffix(err.Error(), "."))
+	}
+	return preflight(tools, []string{confPath})
 }
 
 func (s *darwinLaunchdService) Uninstall() error {
-	s.Stop()
+	confPath, err := s.getServiceFilePath()
+	if err != nil {
+		return err
+	}
+	if err = stopBeforeUninstall(s, s.Config); err != nil {
+		return err
+	}
+	// Unloading stops the job, one left running stays loaded until the next boot.
+	if s.Option.bool(optionStopOnUninstall, true) {
+		if domain, err := s.domain(); err == nil && len(domain) != 0 {
+			runTimeout(s.commandTimeout(), "launchctl", "bootout", domain, confPath)
+		} else if err == nil {
+			runTimeout(s.commandTimeout(), "launchctl", "unload", confPath)
+		}
+	}
+
+	found, err := remove(confPath)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrServiceIsNotInstalled
+	}
+	return nil
+}
+
+// Render returns the plist as XML, also with the PlistFormat option binary.
+func (s *darwinLaunchdService) Render() (string, error) {
+	return renderDefinition(s.definition)
+}
+
+func (s *darwinLaunchdService) Diff() (string, error) {
+	cp, err := s.getServiceFilePath()
+	if err != nil {
+		return "", err
+	}
+	if b, err := ioutil.ReadFile(cp); err != nil || !bytes.HasPrefix(b, []byte("bplist")) {
+		return diffFile(cp, s.definition)
+	}
+	installed, err := s.readPlist(cp)
+	if err != nil {
+		return "", err
+	}
+	// plutil formats the XML its own way, so pass the Config's through it too.
+	definition, err := s.definition()
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile("", s.Name)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(definition)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	desired, err := runWithOutputTimeout(s.commandTimeout(), "plutil", "-convert", "xml1", "-o", "-", f.Name())
+	if err != nil {
+		return "", fmt.Errorf("\"plutil\" failed: %v, %s", err, desired)
+	}
+	return diff(string(installed), string(desired)), nil
+}
+
+func (s *darwinLaunchdService) WaitFor(ctx context.Context, desired Status) error {
+	return waitFor(ctx, s, desired)
+}
 
+func (s *darwinLaunchdService) Health() (HealthStatus, error) {
+	return health(s, s.Config)
+}
+
+func (s *darwinLaunchdService) SelfTest(ctx context.Context) error {
+	return selfTest(ctx, s, s.Config)
+}
+
+func (s *darwinLaunchdService) Reconcile(desired ReconcileSpec) (bool, error) {
+	return reconcile(s, desired)
+}
+
+func (s *darwinLaunchdService) Reinstall() error {
+	return reinstall(s)
+}
+
+func (s *darwinLaunchdService) Describe() ([]byte, error) {
+	return describe(s, s.Config)
+}
+
+func (s *darwinLaunchdService) AppliedOptions() ([]string, error) {
+	return appliedOptions(s.Config, func(c *Config) ([]byte, error) {
+		return (&darwinLaunchdService{Config: c}).definition()
+	})
+}
+
+func (s *darwinLaunchdService) RunOnce(timeout time.Duration) (int, error) {
+	return runOnce(s.Config, timeout)
+}
+
+func (s *darwinLaunchdService) PathDrift() (installed, current string, drifted bool, err error) {
+	confPath, err := s.getServiceFilePath()
+	if err != nil {
+		return "", "", false, err
+	}
+	b, err := s.readPlist(confPath)
+	if os.IsNotExist(err) {
+		return "", "", false, ErrServiceIsNotInstalled
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+	// The first of the ProgramArguments. plutil puts the Label on two lines.
+	if i := bytes.Index(b, []byte("<key>ProgramArguments</key>")); i >= 0 {
+		b = b[i:]
+	}
+	return pathDrift(s.Config, html.UnescapeString(recordedPath(b, "<", "<string>")))
+}
+
+func (s *darwinLaunchdService) Installed() (bool, error) {
 	confPath, err := s.getServiceFilePath()
 	if err != nil {
+		return false, err
+	}
+	return fileExists(confPath)
+}
+
+// SetStartType enables or disables the job in its domain with launchctl,
+// which keeps the override across reboots. launchd doesn't load a disabled
+// job, neither at boot nor with Start.
+func (s *darwinLaunchdService) SetStartType(startType StartType) error {
+	if err := checkStartType(s, startType); err != nil {
 		return err
 	}
-	return os.Remove(confPath)
+	if startType == StartManual {
+		return fmt.Errorf("StartType manual is not supported by launchd, set the %s option instead.", optionRunAtLoad)
+	}
+	domain, err := s.domain()
+	if err != nil {
+		return err
+	}
+	if len(domain) == 0 {
+		domain = "system"
+	}
+	command := "disable"
+	if startType == StartAutomatic {
+		command = "enable"
+	}
+	return runTimeout(s.commandTimeout(), "launchctl", command, domain+"/"+s.Name)
+}
+
+func (s *darwinLaunchdService) DefinitionChecksum() (string, error) {
+	confPath, err := s.getServiceFilePath()
+	if err != nil {
+		return "", err
+	}
+	return fileChecksum(confPath)
 }
 
 func (s *darwinLaunchdService) Start() error {
+	if err := verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
 	confPath, err := s.getServiceFilePath()
 	if err != nil {
 		return err
 	}
-	return run("launchctl", "load", confPath)
+	domain, err := s.domain()
+	if err != nil {
+		return err
+	}
+	if len(domain) != 0 {
+		return runStart(s.Config, "launchctl", "bootstrap", domain, confPath)
+	}
+	return runStart(s.Config, "launchctl", "load", confPath)
 }
 func (s *darwinLaunchdService) Stop() error {
 	confPath, err := s.getServiceFilePath()
 	if err != nil {
 		return err
 	}
+	domain, err := s.domain()
+	if err != nil {
+		return err
+	}
+	if len(domain) != 0 {
+		return run("launchctl", "bootout", domain, confPath)
+	}
 	return run("launchctl", "unload", confPath)
 }
 func (s *darwinLaunchdService) Status() error {
 	err := checkStatus("launchctl", []string{"list", s.Name}, "\"PID\"", "not find service")
+	// Agents are not listed in the domain of the caller, which may be root.
+	if domain, derr := s.domain(); derr == nil && len(domain) != 0 {
+		err = checkStatus("launchctl", []string{"print", domain + "/" + s.Name}, "state = running", "Could not find service")
+	}
 
 	// Check if this is really not installed
 	if err == ErrServiceIsNotInstalled {
@@ -195,30 +504,116 @@ func (s *darwinLaunchdService) Status() error {
 	}
 	return err
 }
-func (s *darwinLaunchdService) Restart() error {
-	err := s.Stop()
+func (s *darwinLaunchdService) NetworkStats() (in, out uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
+
+// ResourceUsage finds the pid with launchctl and adds up the process and its
+// children as listed by ps, with the open files lsof reports.
+func (s *darwinLaunchdService) ResourceUsage() (ResourceUsage, error) {
+	pid, err := s.PID()
 	if err != nil {
-		return err
+		return ResourceUsage{}, err
+	}
+	return psUsage(pid)
+}
+
+// PID returns the pid launchctl reports for the job.
+func (s *darwinLaunchdService) PID() (int, error) {
+	if err := s.Status(); err != nil {
+		return 0, err
 	}
-	time.Sleep(50 * time.Millisecond)
-	return s.Start()
+	args, prefix := []string{"list", s.Name}, `"PID" = `
+	if domain, err := s.domain(); err == nil && len(domain) != 0 {
+		args, prefix = []string{"print", domain + "/" + s.Name}, "pid = "
+	}
+	out, err := runWithOutput("launchctl", args...)
+	if err != nil {
+		return 0, fmt.Errorf("\"launchctl\" failed: %v, %s", err, out)
+	}
+	var pid int
+	i := strings.Index(string(out), prefix)
+	if i < 0 {
+		return 0, fmt.Errorf("No pid in launchctl %s: %q", args[0], out)
+	}
+	if _, err = fmt.Sscanf(string(out[i:]), prefix+"%d", &pid); err != nil {
+		return 0, fmt.Errorf("No pid in launchctl %s: %q", args[0], out)
+	}
+	return pid, nil
+}
+
+func (s *darwinLaunchdService) Restart() error {
+	return stopThenStart(s, s.Config)
 }
 
 func (s *darwinLaunchdService) Run() error {
-	var err error
+	if backoff := s.Option.duration(optionRestartBackoff, 0); backoff > 0 && !interactive {
+		if err := restartBackoff(s.Name, backoff); err != nil {
+			if l, lerr := s.Logger(nil); lerr == nil {
+				l.Warningf("Restart backoff disabled: %v", err)
+			}
+		}
+	}
+	if !interactive {
+		if err := waitRestartWindow(s, s.Config); err != nil {
+			return err
+		}
+	}
+	return serve(s, s.i, s.Config, defaultSignalMap, s.runtimeMax())
+}
 
-	err = s.i.Start(s)
+// restartBackoff emulates exponential restart backoff for launchd, which
+// only knows a fixed ThrottleInterval. Each start is recorded in a file; if
+// the previous start was recent the service is assumed to be crash looping
+// and the start is delayed, doubling the delay with each attempt.
+func restartBackoff(name string, base time.Duration) error {
+	stateFile, err := backoffStateFile(name)
 	if err != nil {
 		return err
 	}
+	attempt := 0
+	if f, err := os.OpenFile(stateFile, os.O_RDONLY|syscall.O_NOFOLLOW, 0); err == nil {
+		var previous int
+		var last int64
+		if _, err := fmt.Fscan(f, &previous, &last); err == nil {
+			// A run outlasting the longest delay is not part of a crash loop.
+			if time.Since(time.Unix(last, 0)) < backoffDelay(base, previous)+backoffDelay(base, maxBackoffSteps) {
+				attempt = previous + 1
+			}
+		}
+		f.Close()
+	}
+	// Refuse to follow a link planted in place of the file.
+	f, err := os.OpenFile(stateFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d\n", attempt, time.Now().Unix())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if attempt > 0 {
+		time.Sleep(backoffDelay(base, attempt))
+	}
+	return err
+}
 
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
-
-	return s.i.Stop(s)
+// backoffStateFile returns the file restartBackoff records the starts in. It
+// is in /var/run for root and in the cache directory of any other user, so
+// other users can't tamper with it.
+func backoffStateFile(name string) (string, error) {
+	if os.Getuid() == 0 {
+		return "/var/run/" + name + ".restarts", nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, name)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "restarts"), nil
 }
 
 func (s *darwinLaunchdService) Logger(errs chan<- error) (Logger, error) {
@@ -228,6 +623,9 @@ func (s *darwinLaunchdService) Logger(errs chan<- error) (Logger, error) {
 	return s.SystemLogger(errs)
 }
 func (s *darwinLaunchdService) SystemLogger(errs chan<- error) (Logger, error) {
+	if address := s.Option.string(optionLogSocket, ""); len(address) != 0 {
+		return newSocketLogger(s.Name, address, errs), nil
+	}
 	return newSysLogger(s.Name, errs)
 }
 
@@ -245,11 +643,21 @@ var launchdConfig = `<?xml version='1.0' encoding='UTF-8'?>
 {{end}}
 </array>
 {{if .UserName}}<key>UserName</key><string>{{html .UserName}}</string>{{end}}
+{{if .GroupName}}<key>GroupName</key><string>{{html .GroupName}}</string>{{end}}
 {{if .ChRoot}}<key>RootDirectory</key><string>{{html .ChRoot}}</string>{{end}}
 {{if .WorkingDirectory}}<key>WorkingDirectory</key><string>{{html .WorkingDirectory}}</string>{{end}}
 <key>SessionCreate</key><{{bool .SessionCreate}}/>
-<key>KeepAlive</key><{{bool .KeepAlive}}/>
+<key>KeepAlive</key>{{if eq .Restart "on-failure"}}<dict><key>SuccessfulExit</key><false/></dict>{{else}}<{{bool .KeepAlive}}/>{{end}}
 <key>RunAtLoad</key><{{bool .RunAtLoad}}/>
+{{if .Env}}<key>EnvironmentVariables</key>
+<dict>
+{{range .Env}}        <key>{{html .Name}}</key><string>{{html .Value}}</string>
+{{end}}</dict>{{end}}
+{{if .StdOut}}<key>StandardOutPath</key><string>{{html .StdOut}}</string>{{end}}
+{{if .StdErr}}<key>StandardErrorPath</key><string>{{html .StdErr}}</string>{{end}}
+{{if .ThrottleInterval}}<key>ThrottleInterval</key><integer>{{.ThrottleInterval}}</integer>{{end}}
+{{if .NumberOfFiles}}<key>SoftResourceLimits</key><dict><key>NumberOfFiles</key><integer>{{.NumberOfFiles}}</integer></dict>
+<key>HardResourceLimits</key><dict><key>NumberOfFiles</key><integer>{{.NumberOfFiles}}</integer></dict>{{end}}
 <key>Disabled</key><false/>
 </dict>
 </plist>
@@ -0,0 +1,442 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type freebsdSystem struct{}
+
+func (freebsdSystem) String() string {
+	return PlatformFreeBSDRcd
+}
+func (freebsdSystem) Detect() bool {
+	return true
+}
+func (freebsdSystem) Interactive() bool {
+	return interactive
+}
+func (freebsdSystem) New(i Interface, c *Config) (Service, error) {
+	s := &freebsdRcService{
+		i:      i,
+		Config: c,
+	}
+	return s, nil
+}
+
+func init() {
+	ChooseSystem(freebsdSystem{})
+}
+
+var interactive = isInteractive()
+
+// isInteractive reports whether the process was not started by daemon(8),
+// which the rc.d script runs the program under.
+func isInteractive() bool {
+	return os.Getppid() != 1 && parentName() != "daemon"
+}
+
+// parentName returns the command name of the parent process, "" if unknown.
+func parentName() string {
+	out, err := runWithOutput("ps", "-o", "comm=", "-p", strconv.Itoa(os.Getppid()))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func launchContext() Launcher {
+	return ancestorLauncher(os.Getppid(), psProcess)
+}
+
+type freebsdRcService struct {
+	i Interface
+	*Config
+}
+
+func (s *freebsdRcService) String() string {
+	if len(s.DisplayName) > 0 {
+		return s.DisplayName
+	}
+	return s.Name
+}
+
+var errNoUserServiceFreeBSD = errors.New("User services are not supported on FreeBSD.")
+
+// rcName matches the names rc.subr accepts, as it uses them in variable names.
+var rcName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (s *freebsdRcService) configPath() (cp string, err error) {
+	if s.Option.bool(optionUserService, optionUserServiceDefault) {
+		return "", errNoUserServiceFreeBSD
+	}
+	return "/usr/local/etc/rc.d/" + s.Config.Name, nil
+}
+
+// rcVar is the rc.conf variable that enables the service.
+func (s *freebsdRcService) rcVar() string {
+	return s.Config.Name + "_enable"
+}
+
+// pidFile is where daemon(8) writes the process ID of the program, its own
+// goes to the pidfile of the script.
+func (s *freebsdRcService) pidFile() string {
+	return "/var/run/" + s.Config.Name + ".child.pid"
+}
+
+// definition renders the rc.d script for the service.
+func (s *freebsdRcService) definition() ([]byte, error) {
+	if err := s.checkSystemdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkLaunchdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkDirectories(); err != nil {
+		return nil, err
+	}
+	if !rcName.MatchString(s.Name) {
+		return nil, fmt.Errorf("Name must only contain letters, digits and _ on FreeBSD: %q", s.Name)
+	}
+	if s.Option.bool(optionOneShot, optionOneShotDefault) {
+		return nil, errors.New("Option OneShot is not supported by FreeBSD rc.d.")
+	}
+	if len(s.ChRoot) != 0 {
+		return nil, errors.New("ChRoot is not supported by FreeBSD rc.d, daemon(8) would have to be in the chroot.")
+	}
+	path, err := s.execPath()
+	if err != nil {
+		return nil, err
+	}
+
+	var to = &struct {
+		*Config
+		Path        string
+		DaemonArgs  string
+		Require     []string
+		LimitNOFILE int
+		Env         []envVar
+	}{
+		s.Config,
+		path,
+		"",
+		append([]string{"LOGIN", "NETWORKING"}, s.Dependencies...),
+		0,
+		nil,
+	}
+	if err = s.validateDependencies(); err != nil {
+		return nil, err
+	}
+	restart, err := s.restart("no")
+	if err != nil {
+		return nil, err
+	}
+	if restart == "on-failure" {
+		return nil, errors.New("Option Restart on-failure is not supported by FreeBSD rc.d, daemon(8) restarts after any exit.")
+	}
+	stdout, stderr, err := s.logPaths("/var/log")
+	if err != nil {
+		return nil, err
+	}
+	if to.LimitNOFILE, err = s.limitNOFILE(); err != nil {
+		return nil, err
+	}
+	if to.Env, err = s.environment(); err != nil {
+		return nil, err
+	}
+
+	// rc.subr evaluates command_args, so the program and its arguments are
+	// quoted, and program is expanded then.
+	args := []string{"-f", "-P", "/var/run/" + s.Name + ".pid", "-p", s.pidFile()}
+	if restart == "always" {
+		args = append(args, "-R", strconv.Itoa(seconds(s.Option.duration(optionRestartSec, 2*time.Minute))))
+	}
+	if len(s.UserName) != 0 {
+		args = append(args, "-u", shellQuote(s.UserName))
+	}
+	// daemon(8) writes both outputs to one file.
+	if output := stdout; len(output) != 0 || len(stderr) != 0 {
+		if len(output) == 0 {
+			output = stderr
+		}
+		args = append(args, "-o", shellQuote(output))
+	}
+	args = append(args, "--", `"$program"`)
+	for _, arg := range s.Arguments {
+		args = append(args, shellQuote(arg))
+	}
+	to.DaemonArgs = strings.Join(args, " ")
+
+	functions := template.FuncMap{
+		"join":       strings.Join,
+		"shellQuote": shellQuote,
+	}
+	var b bytes.Buffer
+	err = template.Must(template.New("").Funcs(functions).Parse(rcdScript)).Execute(&b, to)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Install writes the rc.d script and enables the service with sysrc, which
+// appends the rcvar set to YES to /etc/rc.conf.
+func (s *freebsdRcService) Install() error {
+	confPath, err := s.configPath()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(confPath)
+	if err == nil {
+		return fmt.Errorf("Init already exists: %s", confPath)
+	}
+
+	definition, err := s.definition()
+	if err != nil {
+		return err
+	}
+	if err = createWorkingDirectory(s.Config); err != nil {
+		return err
+	}
+	if err = os.MkdirAll("/usr/local/etc/rc.d", 0755); err != nil {
+		return err
+	}
+	err = writeFileSync(confPath, definition, 0755)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(confPath, 0755); err != nil {
+		os.Remove(confPath)
+		return err
+	}
+	if err = runTimeout(s.commandTimeout(), "sysrc", s.rcVar()+"=YES"); err != nil {
+		os.Remove(confPath)
+		return err
+	}
+	s.notifyChecksum(definition)
+	return nil
+}
+
+func (s *freebsdRcService) Preflight() error {
+	cp, err := s.configPath()
+	if err != nil {
+		return preflight([]string{"service", "sysrc", "daemon"}, nil, strings.TrimSuffix(err.Error(), "."))
+	}
+	return preflight([]string{"service", "sysrc", "daemon"}, []string{cp, "/etc/rc.conf"})
+}
+
+func (s *freebsdRcService) Uninstall() error {
+	cp, err := s.configPath()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(cp); err == nil {
+		if err = stopBeforeUninstall(s, s.Config); err != nil {
+			return err
+		}
+	}
+	// sysrc -x fails for a variable that is not set.
+	enabled, err := commandSucceeds(s.commandTimeout(), "sysrc", "-n", s.rcVar())
+	if err != nil {
+		return err
+	}
+	if enabled {
+		if err = runTimeout(s.commandTimeout(), "sysrc", "-x", s.rcVar()); err != nil {
+			return err
+		}
+	}
+	found, err := remove(cp)
+	if err != nil {
+		return err
+	}
+	if !enabled && !found {
+		return ErrServiceIsNotInstalled
+	}
+	return nil
+}
+
+func (s *freebsdRcService) Diff() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return diffFile(cp, s.definition)
+}
+
+func (s *freebsdRcService) Render() (string, error) {
+	return renderDefinition(s.definition)
+}
+
+func (s *freebsdRcService) WaitFor(ctx context.Context, desired Status) error {
+	return waitFor(ctx, s, desired)
+}
+
+func (s *freebsdRcService) Health() (HealthStatus, error) {
+	return health(s, s.Config)
+}
+
+func (s *freebsdRcService) SelfTest(ctx context.Context) error {
+	return selfTest(ctx, s, s.Config)
+}
+
+func (s *freebsdRcService) Reconcile(desired ReconcileSpec) (bool, error) {
+	return reconcile(s, desired)
+}
+
+func (s *freebsdRcService) Reinstall() error {
+	return reinstall(s)
+}
+
+func (s *freebsdRcService) Describe() ([]byte, error) {
+	return describe(s, s.Config)
+}
+
+func (s *freebsdRcService) AppliedOptions() ([]string, error) {
+	return appliedOptions(s.Config, func(c *Config) ([]byte, error) {
+		return (&freebsdRcService{Config: c}).definition()
+	})
+}
+
+func (s *freebsdRcService) RunOnce(timeout time.Duration) (int, error) {
+	return runOnce(s.Config, timeout)
+}
+
+func (s *freebsdRcService) PathDrift() (installed, current string, drifted bool, err error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", "", false, err
+	}
+	return filePathDrift(s.Config, cp, "'", "program='")
+}
+
+func (s *freebsdRcService) DefinitionChecksum() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return fileChecksum(cp)
+}
+
+func (s *freebsdRcService) Logger(errs chan<- error) (Logger, error) {
+	if system.Interactive() {
+		return ConsoleLogger, nil
+	}
+	return s.SystemLogger(errs)
+}
+func (s *freebsdRcService) SystemLogger(errs chan<- error) (Logger, error) {
+	if address := s.Option.string(optionLogSocket, ""); len(address) != 0 {
+		return newSocketLogger(s.Name, address, errs), nil
+	}
+	return newSysLogger(s.Name, errs)
+}
+
+func (s *freebsdRcService) Run() error {
+	return serve(s, s.i, s.Config, defaultSignalMap, s.runtimeMax())
+}
+
+func (s *freebsdRcService) Start() error {
+	if err := verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	return runStart(s.Config, "service", s.Name, "onestart")
+}
+
+func (s *freebsdRcService) Stop() error {
+	return run("service", s.Name, "onestop")
+}
+
+// Status uses onestatus, which also reports a service that runs while it is
+// not enabled in rc.conf.
+func (s *freebsdRcService) Status() error {
+	return checkStatus("service", []string{s.Name, "onestatus"}, "is running", "does not exist")
+}
+
+func (s *freebsdRcService) Installed() (bool, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	return fileExists(cp)
+}
+
+// SetStartType sets the rcvar in /etc/rc.conf with sysrc, to YES for
+// StartAutomatic and NO otherwise. Start uses onestart, so StartDisabled is
+// StartManual.
+func (s *freebsdRcService) SetStartType(startType StartType) error {
+	if err := checkStartType(s, startType); err != nil {
+		return err
+	}
+	value := "NO"
+	if startType == StartAutomatic {
+		value = "YES"
+	}
+	return runTimeout(s.commandTimeout(), "sysrc", s.rcVar()+"="+value)
+}
+
+func (s *freebsdRcService) ResourceUsage() (ResourceUsage, error) {
+	pid, err := s.PID()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	return psUsage(pid)
+}
+
+// PID returns the pid of the program, the child daemon(8) supervises.
+func (s *freebsdRcService) PID() (int, error) {
+	return readPIDFile(s, s.pidFile())
+}
+
+func (s *freebsdRcService) NetworkStats() (in, out uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
+
+func (s *freebsdRcService) Restart() error {
+	if err := verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	return runStart(s.Config, "service", s.Name, "onerestart")
+}
+
+// The rc.d script runs the program under daemon(8), which detaches it, writes
+// the pid files and, with Restart always, starts it again after it exits.
+// rc.subr stops daemon(8), which passes the signal on to the program.
+const rcdScript = `#!/bin/sh
+#
+# PROVIDE: {{.Name}}
+# REQUIRE: {{join .Require " "}}
+# KEYWORD: shutdown
+#
+# {{.Description}}
+
+. /etc/rc.subr
+
+name="{{.Name}}"
+rcvar="{{.Name}}_enable"
+desc={{.Description|shellQuote}}
+
+load_rc_config $name
+
+: {{printf "${%s_enable:=\"NO\"}" .Name}}
+
+{{range .Env}}export {{.Name}}={{.Value|shellQuote}}
+{{end}}{{if .WorkingDirectory}}{{.Name}}_chdir={{.WorkingDirectory|shellQuote}}
+{{end}}{{if .LimitNOFILE}}{{.Name}}_limits="-n {{.LimitNOFILE}}"
+{{end}}pidfile="/var/run/${name}.pid"
+program={{.Path|shellQuote}}
+command="/usr/sbin/daemon"
+command_args={{.DaemonArgs|shellQuote}}
+
+run_rc_command "$1"
+`
@@ -0,0 +1,61 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFreeBSDDefinition(t *testing.T) {
+	s := &freebsdRcService{Config: &Config{
+		Name:             "web",
+		Description:      "Web server",
+		Executable:       "/usr/local/bin/web",
+		Arguments:        []string{"-config", "/usr/local/etc/web/it's.conf"},
+		UserName:         "www",
+		WorkingDirectory: "/var/db/web",
+		Dependencies:     []string{"postgresql"},
+		Option:           KeyValue{"Restart": "always", "RestartSec": 5 * time.Second, "LimitNOFILE": 1024},
+	}}
+	b, err := s.definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"\n# PROVIDE: web\n",
+		"\n# REQUIRE: LOGIN NETWORKING postgresql\n",
+		"\nrcvar=\"web_enable\"\n",
+		"\nload_rc_config $name\n",
+		"\n: ${web_enable:=\"NO\"}\n",
+		"\nweb_chdir='/var/db/web'\n",
+		"\nweb_limits=\"-n 1024\"\n",
+		"\npidfile=\"/var/run/${name}.pid\"\n",
+		"\nprogram='/usr/local/bin/web'\n",
+		"\ncommand=\"/usr/sbin/daemon\"\n",
+		`
+command_args='-f -P /var/run/web.pid -p /var/run/web.child.pid -R 5 -u '\''www'\'' -- "$program" '\''-config'\'' '\''/usr/local/etc/web/it'\''\'\'''\''s.conf'\'''
+`,
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in rc.d script:\n%s", line, b)
+		}
+	}
+	if installed := recordedPath(b, "'", "program='"); installed != "/usr/local/bin/web" {
+		t.Errorf("recorded path %q", installed)
+	}
+
+	for _, c := range []*Config{
+		{Name: "web-server", Executable: "/usr/local/bin/web"},
+		{Name: "web", Executable: "/usr/local/bin/web", Option: KeyValue{"Restart": "on-failure"}},
+		{Name: "web", Executable: "/usr/local/bin/web", Option: KeyValue{"OneShot": true}},
+		{Name: "web", Executable: "/usr/local/bin/web", Dependencies: []string{"net; reboot"}},
+	} {
+		if _, err := (&freebsdRcService{Config: c}).definition(); err == nil {
+			t.Errorf("%s %v %v accepted", c.Name, c.Option, c.Dependencies)
+		}
+	}
+}
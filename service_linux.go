@@ -5,8 +5,19 @@
 package service
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
+	"time"
 )
 
 type linuxSystemService struct {
@@ -31,8 +42,10 @@ func (sc linuxSystemService) New(i Interface, c *Config) (Service, error) {
 
 func init() {
 	ChooseSystem(linuxSystemService{
-		name:   "linux-systemd",
-		detect: isSystemd,
+		name: PlatformLinuxSystemd,
+		// NixOS only boots with systemd, so it is never mistaken for SystemV
+		// without a running systemd, such as in a container.
+		detect: func() bool { return isSystemd() || isNixOS() },
 		interactive: func() bool {
 			is, _ := isInteractive()
 			return is
@@ -40,7 +53,7 @@ func init() {
 		new: newSystemdService,
 	},
 		linuxSystemService{
-			name:   "linux-upstart",
+			name:   PlatformLinuxUpstart,
 			detect: isUpstart,
 			interactive: func() bool {
 				is, _ := isInteractive()
@@ -49,7 +62,28 @@ func init() {
 			new: newUpstartService,
 		},
 		linuxSystemService{
-			name:   "unix-systemv",
+			name:   PlatformLinuxOpenRC,
+			detect: isOpenRC,
+			interactive: func() bool {
+				is, _ := isInteractive()
+				return is
+			},
+			new: newOpenRCService,
+		},
+		linuxSystemService{
+			name:        PlatformLinuxS6,
+			detect:      isS6,
+			interactive: s6Interactive,
+			new:         newS6Service,
+		},
+		linuxSystemService{
+			name:        PlatformLinuxRunit,
+			detect:      isRunit,
+			interactive: runitInteractive,
+			new:         newRunitService,
+		},
+		linuxSystemService{
+			name:   PlatformLinuxSysV,
 			detect: func() bool { return true },
 			interactive: func() bool {
 				is, _ := isInteractive()
@@ -65,11 +99,465 @@ func isInteractive() (bool, error) {
 	return os.Getppid() != 1, nil
 }
 
+func launchContext() Launcher {
+	if len(os.Getenv("UPSTART_JOB")) != 0 || journalStream() {
+		return ByServiceManager
+	}
+	// systemd sets INVOCATION_ID for a unit, but it is inherited by the
+	// shells of a terminal run as a user service, so the parent must be the
+	// service manager itself.
+	if len(os.Getenv("INVOCATION_ID")) != 0 {
+		ppid := os.Getppid()
+		if ppid == 1 {
+			return ByServiceManager
+		}
+		if _, name, err := procProcess(ppid); err == nil && name == "systemd" {
+			return ByServiceManager
+		}
+	}
+	return ancestorLauncher(os.Getppid(), procProcess)
+}
+
+// journalStream reports whether the standard error is the journal stream
+// systemd connected the service to, which it names in JOURNAL_STREAM.
+func journalStream() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if len(stream) == 0 {
+		return false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(2, &st); err != nil {
+		return false
+	}
+	return stream == fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+}
+
+// procProcess returns the parent and the command name of process pid from
+// /proc/<pid>/stat.
+func procProcess(pid int) (int, string, error) {
+	b, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0, "", err
+	}
+	// The command name is in parentheses and may contain spaces, the state
+	// and the parent pid follow.
+	open, end := bytes.IndexByte(b, '('), bytes.LastIndexByte(b, ')')
+	fields := strings.Fields(string(b[end+1:]))
+	if open < 0 || end < open || len(fields) < 2 {
+		return 0, "", fmt.Errorf("Unexpected /proc/%d/stat: %q", pid, b)
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, "", fmt.Errorf("Unexpected /proc/%d/stat: %q", pid, b)
+	}
+	return ppid, string(b[open+1 : end]), nil
+}
+
+// setDownFile writes the down file to the service directory dir of runit or
+// s6, which keeps the supervisor from starting the service when it comes up,
+// or removes it for StartAutomatic.
+func setDownFile(dir string, startType StartType) error {
+	if startType == StartAutomatic {
+		_, err := remove(dir + "/down")
+		return err
+	}
+	return ioutil.WriteFile(dir+"/down", nil, 0644)
+}
+
+// isNixOS reports whether this is NixOS, which builds /etc from its
+// configuration in the read-only Nix store.
+var isNixOS = func() bool {
+	for _, path := range []string{"/etc/NIXOS", "/run/current-system"} {
+		if _, err := os.Lstat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// appArmorEnabled reports whether the kernel enforces AppArmor profiles.
+var appArmorEnabled = func() bool {
+	b, err := ioutil.ReadFile("/sys/module/apparmor/parameters/enabled")
+	return err == nil && strings.TrimSpace(string(b)) == "Y"
+}
+
+// seLinuxEnforcing reports whether SELinux enforces its policy.
+var seLinuxEnforcing = func() bool {
+	b, err := ioutil.ReadFile("/sys/fs/selinux/enforce")
+	return err == nil && strings.TrimSpace(string(b)) == "1"
+}
+
+// restoreconNeeded reports whether Install runs restorecon.
+func restoreconNeeded(c *Config) bool {
+	return !c.Option.bool(optionSkipRestorecon, false) && seLinuxEnforcing()
+}
+
+// installTools returns the tools Install needs besides those of the service
+// system, for Preflight.
+func installTools(c *Config, tools ...string) []string {
+	if restoreconNeeded(c) {
+		tools = append(tools, "restorecon")
+	}
+	return tools
+}
+
+// restoreContext resets the SELinux file context of the files Install wrote
+// to that of the policy, unless SkipRestorecon is set or SELinux is not
+// enforcing.
+func restoreContext(c *Config, paths ...string) error {
+	if len(paths) == 0 || !restoreconNeeded(c) {
+		return nil
+	}
+	return runTimeout(c.commandTimeout(), "restorecon", paths...)
+}
+
+// memorySize returns the memory option key as a systemd size: bytes, a
+// percentage or infinity. It returns "" if the option is not set.
+func (c *Config) memorySize(key string) (string, error) {
+	var v string
+	switch size := c.Option[key].(type) {
+	case nil:
+		return "", nil
+	case int:
+		v = strconv.Itoa(size)
+	case int64:
+		v = strconv.FormatInt(size, 10)
+	case uint64:
+		v = strconv.FormatUint(size, 10)
+	case string:
+		v = strings.TrimSpace(size)
+	default:
+		return "", fmt.Errorf("Option %s must be a size string, not %T.", key, size)
+	}
+	if v == "infinity" {
+		return v, nil
+	}
+	if strings.HasSuffix(v, "%") {
+		if p, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64); err == nil && p >= 0 && p <= 100 {
+			return v, nil
+		}
+		return "", fmt.Errorf("Invalid %s %q, percentage must be between 0 and 100.", key, v)
+	}
+	multiplier := uint64(1)
+	if i := strings.IndexAny(v, "KMGT"); i >= 0 && i == len(v)-1 {
+		multiplier = 1 << (10 * uint(strings.IndexByte(" KMGT", v[i])))
+		v = v[:i]
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || n > math.MaxUint64/multiplier {
+		return "", fmt.Errorf("Invalid %s %q, expected a size such as 512M or 2G.", key, c.Option[key])
+	}
+	return strconv.FormatUint(n*multiplier, 10), nil
+}
+
+// ulimits returns the LimitNOFILE and MemoryLimit options for the service
+// systems that set them with ulimit or the like, zero if not set. A
+// MemoryLimit that is a percentage or infinity can't be set so and is ignored.
+func (c *Config) ulimits() (nofile int, memory uint64, err error) {
+	if nofile, err = c.limitNOFILE(); err != nil {
+		return 0, 0, err
+	}
+	size, err := c.memorySize(optionMemoryLimit)
+	if err != nil {
+		return 0, 0, err
+	}
+	memory, _ = strconv.ParseUint(size, 10, 64)
+	return nofile, memory, nil
+}
+
+// ulimitCommands returns the ulimit commands of an init script for ulimits.
+// ulimit -v counts KiB.
+func (c *Config) ulimitCommands() ([]string, error) {
+	nofile, memory, err := c.ulimits()
+	if err != nil {
+		return nil, err
+	}
+	var commands []string
+	if nofile > 0 {
+		commands = append(commands, "ulimit -n "+strconv.Itoa(nofile))
+	}
+	if memory > 0 {
+		commands = append(commands, "ulimit -v "+strconv.FormatUint((memory+1023)/1024, 10))
+	}
+	return commands, nil
+}
+
+// priorities returns the Nice and OOMScoreAdjust options, ints or strings of
+// one, zero if they are not set.
+func (c *Config) priorities() (nice, oomScoreAdjust int, err error) {
+	for _, p := range []struct {
+		key      string
+		min, max int
+		v        *int
+	}{
+		{optionNice, -20, 19, &nice},
+		{optionOOMScoreAdjust, -1000, 1000, &oomScoreAdjust},
+	} {
+		v, found := c.Option[p.key]
+		if !found {
+			continue
+		}
+		var n int
+		switch value := v.(type) {
+		case int:
+			n = value
+		case string:
+			n, err = strconv.Atoi(strings.TrimSpace(value))
+		default:
+			err = errors.New("not a number")
+		}
+		if err != nil || n < p.min || n > p.max {
+			return 0, 0, fmt.Errorf("Option %s must be a number from %d to %d: %#v", p.key, p.min, p.max, v)
+		}
+		*p.v = n
+	}
+	return nice, oomScoreAdjust, nil
+}
+
+// clockTicks is the unit of the CPU times in /proc/<pid>/stat, USER_HZ, which
+// is 100 on the architectures Go supports.
+const clockTicks = 100
+
+// procUsage returns the resource usage of the process pid and its children
+// from /proc. Children are only found if the kernel lists them in
+// /proc/<pid>/task/<tid>/children. OpenFiles is -1 if one of the processes
+// belongs to another user.
+func procUsage(pid int) (ResourceUsage, error) {
+	dir := "/proc/" + strconv.Itoa(pid)
+	b, err := ioutil.ReadFile(dir + "/stat")
+	if err != nil {
+		return ResourceUsage{}, fmt.Errorf("No process %d: %v", pid, err)
+	}
+	// The command name in parentheses may contain spaces, utime and stime
+	// are the 14th and 15th fields.
+	fields := strings.Fields(string(b[bytes.LastIndexByte(b, ')')+1:]))
+	if len(fields) < 13 {
+		return ResourceUsage{}, fmt.Errorf("Unexpected %s/stat: %q", dir, b)
+	}
+	var usage ResourceUsage
+	for _, f := range fields[11:13] {
+		ticks, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return ResourceUsage{}, fmt.Errorf("Unexpected %s/stat: %q", dir, b)
+		}
+		usage.CPUTime += time.Duration(ticks) * time.Second / clockTicks
+	}
+
+	// Kernel threads have no VmRSS.
+	b, err = ioutil.ReadFile(dir + "/status")
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if f := strings.Fields(line); len(f) == 3 && f[0] == "VmRSS:" && f[2] == "kB" {
+			kb, err := strconv.ParseUint(f[1], 10, 64)
+			if err != nil {
+				return ResourceUsage{}, fmt.Errorf("Unexpected %s/status: %q", dir, line)
+			}
+			usage.Memory = kb * 1024
+		}
+	}
+
+	usage.OpenFiles = -1
+	if fd, err := os.Open(dir + "/fd"); err == nil {
+		names, err := fd.Readdirnames(-1)
+		fd.Close()
+		if err == nil {
+			usage.OpenFiles = len(names)
+		}
+	}
+
+	for _, child := range procChildren(pid) {
+		// The child may have exited in the meantime.
+		u, err := procUsage(child)
+		if err != nil {
+			continue
+		}
+		usage.CPUTime += u.CPUTime
+		usage.Memory += u.Memory
+		if u.OpenFiles < 0 || usage.OpenFiles < 0 {
+			usage.OpenFiles = -1
+		} else {
+			usage.OpenFiles += u.OpenFiles
+		}
+	}
+	return usage, nil
+}
+
+// procChildren returns the children of process pid the kernel lists in
+// /proc/<pid>/task/<tid>/children.
+func procChildren(pid int) []int {
+	var children []int
+	paths, _ := filepath.Glob("/proc/" + strconv.Itoa(pid) + "/task/*/children")
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, f := range strings.Fields(string(b)) {
+			if child, err := strconv.Atoi(f); err == nil {
+				children = append(children, child)
+			}
+		}
+	}
+	return children
+}
+
+// supervisedPID returns the process a supervisor such as supervise-daemon
+// runs as its only child.
+func supervisedPID(supervisor int) (int, error) {
+	children := procChildren(supervisor)
+	if len(children) != 1 {
+		return 0, fmt.Errorf("Supervisor %d runs %d processes instead of one.", supervisor, len(children))
+	}
+	return children[0], nil
+}
+
+// pidFileUsage returns the procUsage of the process in the pid file path of
+// s, or the Status error if s is not running.
+func pidFileUsage(s Service, path string) (ResourceUsage, error) {
+	pid, err := readPIDFile(s, path)
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	return procUsage(pid)
+}
+
+func appArmorPath(name string) string {
+	return "/etc/apparmor.d/" + name
+}
+
+// bindTarget returns the path a BindPaths entry is mounted at in the service.
+func bindTarget(entry string) string {
+	parts := strings.Split(strings.TrimPrefix(entry, "-"), ":")
+	if len(parts) > 1 {
+		return parts[1]
+	}
+	return parts[0]
+}
+
+// appArmorProfile renders the profile of the GenerateAppArmorProfile option.
+func appArmorProfile(c *Config) ([]byte, error) {
+	path, err := c.execPath()
+	if err != nil {
+		return nil, err
+	}
+	var to = &struct {
+		Name, Path          string
+		ReadWrite, ReadOnly []string
+	}{
+		Name: c.Name,
+		Path: path,
+	}
+	if len(c.WorkingDirectory) != 0 {
+		to.ReadWrite = append(to.ReadWrite, c.WorkingDirectory)
+	}
+	for _, p := range c.Option.strings(optionBindPaths, nil) {
+		to.ReadWrite = append(to.ReadWrite, bindTarget(p))
+	}
+	for _, p := range c.Option.strings(optionBindReadOnlyPaths, nil) {
+		to.ReadOnly = append(to.ReadOnly, bindTarget(p))
+	}
+	for _, p := range append(append([]string{to.Path}, to.ReadWrite...), to.ReadOnly...) {
+		if strings.ContainsAny(p, "\"\n") {
+			return nil, fmt.Errorf("Path cannot be used in an AppArmor profile: %q", p)
+		}
+	}
+
+	var b bytes.Buffer
+	err = template.Must(template.New("").Parse(appArmorTemplate)).Execute(&b, to)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// installAppArmor writes and loads the profile if the GenerateAppArmorProfile
+// option is set and AppArmor is enabled.
+func installAppArmor(c *Config) error {
+	if !c.Option.bool(optionGenerateAppArmor, false) || !appArmorEnabled() {
+		return nil
+	}
+	profile, err := appArmorProfile(c)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(appArmorPath(c.Name), profile, 0644); err != nil {
+		return err
+	}
+	err = runTimeout(c.commandTimeout(), "apparmor_parser", "-r", appArmorPath(c.Name))
+	if err != nil {
+		os.Remove(appArmorPath(c.Name))
+		return err
+	}
+	return nil
+}
+
+// removeAppArmor unloads and deletes the profile written by installAppArmor.
+func removeAppArmor(c *Config) error {
+	if !c.Option.bool(optionGenerateAppArmor, false) {
+		return nil
+	}
+	if _, err := os.Stat(appArmorPath(c.Name)); os.IsNotExist(err) {
+		return nil
+	}
+	if appArmorEnabled() {
+		err := runTimeout(c.commandTimeout(), "apparmor_parser", "-R", appArmorPath(c.Name))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := remove(appArmorPath(c.Name))
+	return err
+}
+
+const appArmorTemplate = `# AppArmor profile of the {{.Name}} service, written by Install.
+#include <tunables/global>
+
+profile {{.Name}} "{{.Path}}" {
+  #include <abstractions/base>
+  #include <abstractions/nameservice>
+
+  "{{.Path}}" mr,
+{{range .ReadWrite}}  "{{.}}{,/,/**}" rwk,
+{{end}}{{range .ReadOnly}}  "{{.}}{,/,/**}" r,
+{{end}}}
+`
+
+// plainWord matches the words a shell reads as they are.
+var plainWord = regexp.MustCompile(`^[A-Za-z0-9_./+,:=@-]+$`)
+
+// shellWord quotes s for a shell like shellQuote unless it reads as a single
+// word already, so that common paths stay readable.
+func shellWord(s string) string {
+	if plainWord.MatchString(s) {
+		return s
+	}
+	return shellQuote(s)
+}
+
+// cmdEscaper escapes a path as the first word of a systemd command line,
+// which is unquoted and C-unescaped after its % specifiers are expanded.
+var cmdEscaper = strings.NewReplacer(" ", `\x20`, "%", "%%")
+
+// cmdUnescaper reverses cmdEscaper.
+var cmdUnescaper = strings.NewReplacer(`\x20`, " ", "%%", "%")
+
 var tf = map[string]interface{}{
 	"cmd": func(s string) string {
 		return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
 	},
-	"cmdEscape": func(s string) string {
-		return strings.Replace(s, " ", `\x20`, -1)
+	"cmdEscape":  cmdEscaper.Replace,
+	"join":       strings.Join,
+	"shellQuote": shellQuote,
+	"shellWord":  shellWord,
+	// specifierEscape keeps systemd from expanding % specifiers in s.
+	"specifierEscape": func(s string) string {
+		return strings.Replace(s, "%", "%%", -1)
+	},
+	// unitQuote quotes s as a single word for a systemd unit file.
+	"unitQuote": func(s string) string {
+		s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "%", "%%").Replace(s)
+		return `"` + s + `"`
 	},
 }
@@ -0,0 +1,435 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+func isOpenRC() bool {
+	for _, path := range []string{"/sbin/openrc", "/etc/init.d/functions.sh"} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+type openrc struct {
+	i Interface
+	*Config
+}
+
+func newOpenRCService(i Interface, c *Config) (Service, error) {
+	s := &openrc{
+		i:      i,
+		Config: c,
+	}
+
+	return s, nil
+}
+
+func (s *openrc) String() string {
+	if len(s.DisplayName) > 0 {
+		return s.DisplayName
+	}
+	return s.Name
+}
+
+var errNoUserServiceOpenRC = errors.New("User services are not supported on OpenRC.")
+
+func (s *openrc) configPath() (cp string, err error) {
+	if s.Option.bool(optionUserService, optionUserServiceDefault) {
+		err = errNoUserServiceOpenRC
+		return
+	}
+	cp = "/etc/init.d/" + s.Config.Name
+	return
+}
+
+// runlevelLink is the link rc-update add creates for the default runlevel.
+func (s *openrc) runlevelLink() string {
+	return "/etc/runlevels/default/" + s.Config.Name
+}
+
+// definition renders the runscript for the service.
+func (s *openrc) definition() ([]byte, error) {
+	if err := s.checkSystemdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkLaunchdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkDirectories(); err != nil {
+		return nil, err
+	}
+	if s.Option.bool(optionOneShot, optionOneShotDefault) {
+		return nil, errors.New("Option OneShot is not supported by OpenRC.")
+	}
+	path, err := s.execPath()
+	if err != nil {
+		return nil, err
+	}
+
+	var to = &struct {
+		*Config
+		Path          string
+		CommandArgs   string
+		StopKillDelay int
+		ExecStartPost []string
+		Need          []string
+		Restart       string
+		RestartSec    int
+		Env           []envVar
+		Ulimit        []string
+		CommandUser   string
+		StdOut        string
+		StdErr        string
+	}{
+		s.Config,
+		path,
+		"",
+		seconds(s.Option.duration(optionStopKillDelay, 0)),
+		s.Option.strings(optionExecStartPost, nil),
+		append([]string{"net"}, s.Dependencies...),
+		"",
+		seconds(s.Option.duration(optionRestartSec, 2*time.Minute)),
+		nil,
+		nil,
+		s.UserName,
+		"", "",
+	}
+	// openrc-run evaluates command_args, so each argument is quoted.
+	args := make([]string, len(s.Arguments))
+	for i, arg := range s.Arguments {
+		args[i] = shellQuote(arg)
+	}
+	to.CommandArgs = strings.Join(args, " ")
+	if err = s.validateDependencies(); err != nil {
+		return nil, err
+	}
+	if to.Restart, err = s.restart("no"); err != nil {
+		return nil, err
+	}
+	if to.Restart == "on-failure" {
+		return nil, errors.New("Option Restart on-failure is not supported by OpenRC, supervise-daemon restarts after any exit.")
+	}
+	if to.Env, err = s.environment(); err != nil {
+		return nil, err
+	}
+	if to.Ulimit, err = s.ulimitCommands(); err != nil {
+		return nil, err
+	}
+	if to.StdOut, to.StdErr, err = s.logPaths("/var/log"); err != nil {
+		return nil, err
+	}
+	group, err := s.groupName()
+	if err != nil {
+		return nil, err
+	}
+	if len(group) != 0 {
+		user := s.UserName
+		if len(user) == 0 {
+			user = "root"
+		}
+		to.CommandUser = user + ":" + group
+	}
+
+	var b bytes.Buffer
+	err = template.Must(template.New("").Funcs(tf).Parse(openrcScript)).Execute(&b, to)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (s *openrc) Install() error {
+	confPath, err := s.configPath()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(confPath)
+	if err == nil {
+		return fmt.Errorf("Init already exists: %s", confPath)
+	}
+
+	definition, err := s.definition()
+	if err != nil {
+		return err
+	}
+	if err = createWorkingDirectory(s.Config); err != nil {
+		return err
+	}
+	err = writeFileSync(confPath, definition, 0755)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(confPath, 0755); err != nil {
+		return err
+	}
+	if err = restoreContext(s.Config, confPath); err != nil {
+		os.Remove(confPath)
+		return err
+	}
+	if err = installAppArmor(s.Config); err != nil {
+		os.Remove(confPath)
+		return err
+	}
+	if err = s.addRunlevel(); err != nil {
+		removeAppArmor(s.Config)
+		os.Remove(confPath)
+		return err
+	}
+	s.notifyChecksum(definition)
+	return nil
+}
+
+// addRunlevel adds the service to the default runlevel with rc-update. It
+// retries a few times while rc-update does not find the runscript yet.
+func (s *openrc) addRunlevel() error {
+	delay := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := runTimeout(s.commandTimeout(), "rc-update", "add", s.Name, "default")
+		if err == nil || attempt >= 3 || !strings.Contains(err.Error(), "does not exist") {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (s *openrc) Preflight() error {
+	cp, err := s.configPath()
+	if err != nil {
+		return preflight([]string{"rc-service", "rc-update"}, nil, strings.TrimSuffix(err.Error(), "."))
+	}
+	return preflight(installTools(s.Config, "rc-service", "rc-update"), []string{cp})
+}
+
+func (s *openrc) Uninstall() error {
+	cp, err := s.configPath()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(cp); err == nil {
+		if err = stopBeforeUninstall(s, s.Config); err != nil {
+			return err
+		}
+	}
+	// rc-update del needs the runscript, a dangling link is removed directly.
+	enabled := false
+	if _, err = os.Lstat(s.runlevelLink()); err == nil {
+		enabled = true
+		if _, err = os.Stat(cp); err == nil {
+			err = runTimeout(s.commandTimeout(), "rc-update", "del", s.Name, "default")
+		} else {
+			_, err = remove(s.runlevelLink())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	found, err := remove(cp)
+	if err != nil {
+		return err
+	}
+	if err = removeAppArmor(s.Config); err != nil {
+		return err
+	}
+	if !enabled && !found {
+		return ErrServiceIsNotInstalled
+	}
+	return nil
+}
+
+func (s *openrc) Diff() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return diffFile(cp, s.definition)
+}
+
+func (s *openrc) Render() (string, error) {
+	return renderDefinition(s.definition)
+}
+
+func (s *openrc) WaitFor(ctx context.Context, desired Status) error {
+	return waitFor(ctx, s, desired)
+}
+
+func (s *openrc) Health() (HealthStatus, error) {
+	return health(s, s.Config)
+}
+
+func (s *openrc) SelfTest(ctx context.Context) error {
+	return selfTest(ctx, s, s.Config)
+}
+
+func (s *openrc) Reconcile(desired ReconcileSpec) (bool, error) {
+	return reconcile(s, desired)
+}
+
+func (s *openrc) Reinstall() error {
+	return reinstall(s)
+}
+
+func (s *openrc) Describe() ([]byte, error) {
+	return describe(s, s.Config)
+}
+
+func (s *openrc) AppliedOptions() ([]string, error) {
+	return appliedOptions(s.Config, func(c *Config) ([]byte, error) {
+		return (&openrc{Config: c}).definition()
+	})
+}
+
+func (s *openrc) RunOnce(timeout time.Duration) (int, error) {
+	return runOnce(s.Config, timeout)
+}
+
+func (s *openrc) PathDrift() (installed, current string, drifted bool, err error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", "", false, err
+	}
+	return filePathDrift(s.Config, cp, "'", "command='")
+}
+
+func (s *openrc) DefinitionChecksum() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return fileChecksum(cp)
+}
+
+func (s *openrc) Logger(errs chan<- error) (Logger, error) {
+	if system.Interactive() {
+		return ConsoleLogger, nil
+	}
+	return s.SystemLogger(errs)
+}
+func (s *openrc) SystemLogger(errs chan<- error) (Logger, error) {
+	if address := s.Option.string(optionLogSocket, ""); len(address) != 0 {
+		return newSocketLogger(s.Name, address, errs), nil
+	}
+	return newSysLogger(s.Name, errs)
+}
+
+func (s *openrc) Run() error {
+	return serve(s, s.i, s.Config, defaultSignalMap, s.runtimeMax())
+}
+
+func (s *openrc) Start() error {
+	if err := verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	return runStart(s.Config, "rc-service", s.Name, "start")
+}
+
+func (s *openrc) Stop() error {
+	return run("rc-service", s.Name, "stop")
+}
+
+func (s *openrc) Status() error {
+	return checkStatus("rc-service", []string{s.Name, "status"}, "status: started", "does not exist")
+}
+
+func (s *openrc) Installed() (bool, error) {
+	if _, err := s.configPath(); err != nil {
+		return false, err
+	}
+	return commandSucceeds(s.commandTimeout(), "rc-service", "--exists", s.Name)
+}
+
+// SetStartType adds the service to the default runlevel for StartAutomatic
+// and deletes it from there otherwise.
+func (s *openrc) SetStartType(startType StartType) error {
+	if err := checkStartType(s, startType); err != nil {
+		return err
+	}
+	_, err := os.Lstat(s.runlevelLink())
+	if linked := err == nil; linked == (startType == StartAutomatic) {
+		return nil
+	}
+	if startType == StartAutomatic {
+		return s.addRunlevel()
+	}
+	return runTimeout(s.commandTimeout(), "rc-update", "del", s.Name, "default")
+}
+
+func (s *openrc) ResourceUsage() (ResourceUsage, error) {
+	pid, err := s.PID()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	return procUsage(pid)
+}
+
+func (s *openrc) PID() (int, error) {
+	pid, err := readPIDFile(s, "/run/"+s.Name+".pid")
+	if err != nil {
+		return 0, err
+	}
+	return s.servicePID(pid)
+}
+
+// servicePID returns the pid of the program for the pid in the pid file.
+// With Restart always that is supervise-daemon, which runs the program as
+// its child.
+func (s *openrc) servicePID(pid int) (int, error) {
+	if restart, _ := s.restart("no"); restart != "always" {
+		return pid, nil
+	}
+	return supervisedPID(pid)
+}
+
+func (s *openrc) NetworkStats() (in, out uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
+
+func (s *openrc) Restart() error {
+	return stopThenStart(s, s.Config)
+}
+
+// The runscript starts the program in the background with start-stop-daemon,
+// or with Restart under supervise-daemon, which starts it again after it exits.
+const openrcScript = `#!/sbin/openrc-run
+# {{.Description}}
+
+name={{.Name|shellQuote}}
+description={{.Description|shellQuote}}
+command={{.Path|shellQuote}}
+command_args={{.CommandArgs|shellQuote}}
+{{if eq .Restart "always"}}supervisor="supervise-daemon"
+respawn_delay={{.RestartSec}}
+respawn_max=0{{else}}command_background="yes"{{end}}
+pidfile="/run/${RC_SVCNAME}.pid"
+output_log="{{or .StdOut "/var/log/${RC_SVCNAME}.log"}}"
+error_log="{{or .StdErr "/var/log/${RC_SVCNAME}.err"}}"
+{{if .CommandUser}}command_user={{.CommandUser|shellQuote}}{{end}}
+{{if .WorkingDirectory}}directory={{.WorkingDirectory|shellQuote}}{{end}}
+{{if .ChRoot}}chroot={{.ChRoot|shellQuote}}{{end}}
+{{if .StopKillDelay}}retry="TERM/{{.StopKillDelay}}/KILL/5"{{end}}
+{{range .Env}}export {{.Name}}={{.Value|shellQuote}}
+{{end}}{{range .Ulimit}}{{.}}
+{{end}}
+depend() {
+    need {{join .Need " "}}
+    use logger dns
+}
+{{if .ExecStartPost}}
+start_post() {
+{{range .ExecStartPost}}    {{.}} || return 1
+{{end}}}
+{{end}}`
@@ -0,0 +1,140 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenRCDefinition(t *testing.T) {
+	s, _ := newOpenRCService(nil, &Config{
+		Name:         "web",
+		Description:  "Web server",
+		Executable:   "/usr/bin/web",
+		Arguments:    []string{"-config", "/etc/web/it's.conf"},
+		UserName:     "www",
+		Dependencies: []string{"postgresql"},
+		Option:       KeyValue{"StopKillDelay": 30 * time.Second},
+	})
+	b, err := s.(*openrc).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"#!/sbin/openrc-run\n",
+		"\ndescription='Web server'\n",
+		"\ncommand='/usr/bin/web'\n",
+		`
+command_args=''\''-config'\'' '\''/etc/web/it'\''\'\'''\''s.conf'\'''
+`,
+		"\ncommand_background=\"yes\"\n",
+		"\ncommand_user='www'\n",
+		"\nretry=\"TERM/30/KILL/5\"\n",
+		"\n    need net postgresql\n",
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in runscript:\n%s", line, b)
+		}
+	}
+	if installed := recordedPath(b, "'", "command='"); installed != "/usr/bin/web" {
+		t.Errorf("recorded path %q", installed)
+	}
+
+	s, _ = newOpenRCService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"Restart": "always", "RestartSec": 5 * time.Second},
+	})
+	if b, err = s.(*openrc).definition(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "\nsupervisor=\"supervise-daemon\"\nrespawn_delay=5\n") {
+		t.Errorf("not supervised:\n%s", b)
+	}
+
+	for _, option := range []KeyValue{
+		{"OneShot": true},
+		{"Restart": "on-failure"},
+	} {
+		s, _ = newOpenRCService(nil, &Config{Name: "web", Executable: "/usr/bin/web", Option: option})
+		if _, err := s.(*openrc).definition(); err == nil {
+			t.Errorf("%v accepted", option)
+		}
+	}
+	for _, test := range []struct {
+		user, line string
+	}{
+		{"www", "\ncommand_user='www:www-data'\n"},
+		{"", "\ncommand_user='root:www-data'\n"},
+	} {
+		s, _ = newOpenRCService(nil, &Config{Name: "web", Executable: "/usr/bin/web", UserName: test.user, Option: KeyValue{"GroupName": "www-data"}})
+		if b, err = s.(*openrc).definition(); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), test.line) {
+			t.Errorf("missing %q in runscript:\n%s", test.line, b)
+		}
+	}
+
+	s, _ = newOpenRCService(nil, &Config{Name: "web", Executable: "/usr/bin/web", Dependencies: []string{"net; reboot"}})
+	if _, err := s.(*openrc).definition(); err == nil {
+		t.Error("invalid dependency accepted")
+	}
+}
+
+// missingRunner fails rc-update as if the runscript was missing, a number of
+// times.
+type missingRunner struct {
+	failures int
+	commands []string
+}
+
+func (r *missingRunner) Run(timeout time.Duration, command string, arguments ...string) ([]byte, error) {
+	r.commands = append(r.commands, strings.Join(append([]string{command}, arguments...), " "))
+	if len(r.commands) <= r.failures {
+		return []byte(" * rc-update: service `web' does not exist"), errors.New("exit status 1")
+	}
+	return nil, nil
+}
+
+func TestOpenRCAddRunlevel(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &missingRunner{failures: 2}
+	Runner = r
+
+	s := &openrc{Config: &Config{Name: "web"}}
+	if err := s.addRunlevel(); err != nil || len(r.commands) != 3 || r.commands[2] != "rc-update add web default" {
+		t.Fatal("unexpected retries", r.commands, err)
+	}
+	r = &missingRunner{failures: 10}
+	Runner = r
+	if err := s.addRunlevel(); err == nil || len(r.commands) != 4 {
+		t.Error("retried without bound", len(r.commands), err)
+	}
+}
+
+func TestOpenRCServicePID(t *testing.T) {
+	cmd := exec.Command("sleep", "5")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	// The test process stands in for supervise-daemon.
+	s := &openrc{Config: &Config{Name: "web", Option: KeyValue{"Restart": "always"}}}
+	if pid, err := s.servicePID(os.Getpid()); pid != cmd.Process.Pid || err != nil {
+		t.Errorf("pid %d, want child %d: %v", pid, cmd.Process.Pid, err)
+	}
+	s.Option = nil
+	if pid, err := s.servicePID(os.Getpid()); pid != os.Getpid() || err != nil {
+		t.Errorf("pid %d without supervisor: %v", pid, err)
+	}
+}
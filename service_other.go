@@ -0,0 +1,27 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+// +build !aix,!darwin,!freebsd,!linux,!solaris,!windows
+
+package service
+
+import (
+	"io"
+	"os/exec"
+)
+
+// launchContext has no way to tell what started the process on platforms
+// without a backend.
+func launchContext() Launcher {
+	return ByUnknown
+}
+
+// dialLog has no socket to connect to on platforms without a backend.
+func dialLog(address string) (io.WriteCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// killGroupOnCancel leaves cmd to be killed alone on platforms without a
+// backend.
+func killGroupOnCancel(cmd *exec.Cmd) {}
@@ -0,0 +1,492 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+func isRunit() bool {
+	for _, path := range []string{"/etc/runit", "/etc/sv"} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// runitInteractive reports whether the process was not started by runsv.
+// runsv, not init, is the parent of a runit service.
+func runitInteractive() bool {
+	comm, err := ioutil.ReadFile("/proc/" + strconv.Itoa(os.Getppid()) + "/comm")
+	return err != nil || strings.TrimSpace(string(comm)) != "runsv"
+}
+
+type runit struct {
+	i Interface
+	*Config
+}
+
+func newRunitService(i Interface, c *Config) (Service, error) {
+	s := &runit{
+		i:      i,
+		Config: c,
+	}
+
+	return s, nil
+}
+
+func (s *runit) String() string {
+	if len(s.DisplayName) > 0 {
+		return s.DisplayName
+	}
+	return s.Name
+}
+
+var errNoUserServiceRunit = errors.New("User services are not supported on runit.")
+
+// serviceDir returns the service directory holding the run script.
+func (s *runit) serviceDir() (string, error) {
+	if s.Option.bool(optionUserService, optionUserServiceDefault) {
+		return "", errNoUserServiceRunit
+	}
+	return "/etc/sv/" + s.Config.Name, nil
+}
+
+func (s *runit) configPath() (cp string, err error) {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return "", err
+	}
+	return dir + "/run", nil
+}
+
+// link returns the symlink in the directory runsvdir scans, which enables
+// the service. Void Linux scans /var/service, Debian /etc/service.
+func (s *runit) link() string {
+	for _, dir := range []string{"/var/service", "/etc/service", "/service"} {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir + "/" + s.Config.Name
+		}
+	}
+	return "/var/service/" + s.Config.Name
+}
+
+// templateData returns the values of the run and finish scripts.
+func (s *runit) templateData() (interface{}, error) {
+	if err := s.checkSystemdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkLaunchdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkDirectories(); err != nil {
+		return nil, err
+	}
+	path, err := s.execPath()
+	if err != nil {
+		return nil, err
+	}
+
+	var to = &struct {
+		*Config
+		Path       string
+		Restart    string
+		RestartSec int
+		Env        []envVar
+		OpenFiles  int
+		Memory     uint64
+		User       string
+		StdOut     string
+		StdErr     string
+	}{
+		s.Config,
+		path,
+		"",
+		seconds(s.Option.duration(optionRestartSec, 0)),
+		nil,
+		0, 0,
+		s.UserName,
+		"", "",
+	}
+	if err = s.validateDependencies(); err != nil {
+		return nil, err
+	}
+	if to.Restart, err = s.restart("always"); err != nil {
+		return nil, err
+	}
+	if to.Env, err = s.environment(); err != nil {
+		return nil, err
+	}
+	if to.OpenFiles, to.Memory, err = s.ulimits(); err != nil {
+		return nil, err
+	}
+	if to.StdOut, to.StdErr, err = s.logPaths("/var/log"); err != nil {
+		return nil, err
+	}
+	group, err := s.groupName()
+	if err != nil {
+		return nil, err
+	}
+	if len(group) != 0 {
+		// chpst -u takes the group after the user, so a group alone runs as root.
+		user := s.UserName
+		if len(user) == 0 {
+			user = "root"
+		}
+		to.User = user + ":" + group
+	}
+	return to, nil
+}
+
+func (s *runit) render(script string) ([]byte, error) {
+	to, err := s.templateData()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	err = template.Must(template.New("").Funcs(tf).Parse(script)).Execute(&b, to)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// definition renders the run script for the service.
+func (s *runit) definition() ([]byte, error) {
+	return s.render(runitRunScript)
+}
+
+// finish renders the finish script, or returns nil if runsv may restart the
+// service right away, as it does without one.
+func (s *runit) finish() ([]byte, error) {
+	if s.Option.duration(optionRestartSec, 0) <= 0 {
+		if restart, err := s.restart("always"); err != nil || restart == "always" {
+			return nil, err
+		}
+	}
+	return s.render(runitFinishScript)
+}
+
+func (s *runit) Install() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	confPath := dir + "/run"
+	_, err = os.Stat(confPath)
+	if err == nil {
+		return fmt.Errorf("Init already exists: %s", confPath)
+	}
+
+	definition, err := s.definition()
+	if err != nil {
+		return err
+	}
+	finish, err := s.finish()
+	if err != nil {
+		return err
+	}
+	if err = createWorkingDirectory(s.Config); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var written []string
+	undo := func() {
+		for _, path := range written {
+			os.Remove(path)
+		}
+		os.Remove(dir)
+	}
+	for _, script := range []struct {
+		path string
+		data []byte
+	}{
+		{confPath, definition},
+		{dir + "/finish", finish},
+	} {
+		if script.data == nil {
+			continue
+		}
+		written = append(written, script.path)
+		if err = writeFileSync(script.path, script.data, 0755); err == nil {
+			err = os.Chmod(script.path, 0755)
+		}
+		if err != nil {
+			undo()
+			return err
+		}
+	}
+	if err = restoreContext(s.Config, written...); err != nil {
+		undo()
+		return err
+	}
+	if err = installAppArmor(s.Config); err != nil {
+		undo()
+		return err
+	}
+	// runsvdir starts the service within five seconds of finding the link.
+	if err = os.Symlink(dir, s.link()); err != nil {
+		removeAppArmor(s.Config)
+		undo()
+		return err
+	}
+	s.notifyChecksum(definition)
+	return nil
+}
+
+func (s *runit) Preflight() error {
+	cp, err := s.configPath()
+	if err != nil {
+		return preflight([]string{"sv", "chpst"}, nil, strings.TrimSuffix(err.Error(), "."))
+	}
+	return preflight(installTools(s.Config, "sv", "chpst"), []string{cp, s.link()})
+}
+
+func (s *runit) Uninstall() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	cp := dir + "/run"
+	if _, err = os.Stat(cp); err == nil {
+		if err = stopBeforeUninstall(s, s.Config); err != nil {
+			return err
+		}
+	}
+	// Without the link runsvdir stops supervising the service, sv exit
+	// makes runsv quit right away so its supervise directory can go too.
+	linked, err := remove(s.link())
+	if err != nil {
+		return err
+	}
+	if linked {
+		runTimeout(s.commandTimeout(), "sv", "exit", dir)
+	}
+	found, err := remove(cp)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"finish", "down"} {
+		if _, err = remove(dir + "/" + name); err != nil {
+			return err
+		}
+	}
+	os.RemoveAll(filepath.Join(dir, "supervise"))
+	os.Remove(dir)
+	if err = removeAppArmor(s.Config); err != nil {
+		return err
+	}
+	if !linked && !found {
+		return ErrServiceIsNotInstalled
+	}
+	return nil
+}
+
+func (s *runit) Diff() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return diffFile(cp, s.definition)
+}
+
+func (s *runit) Render() (string, error) {
+	return renderDefinition(s.definition)
+}
+
+func (s *runit) WaitFor(ctx context.Context, desired Status) error {
+	return waitFor(ctx, s, desired)
+}
+
+func (s *runit) Health() (HealthStatus, error) {
+	return health(s, s.Config)
+}
+
+func (s *runit) SelfTest(ctx context.Context) error {
+	return selfTest(ctx, s, s.Config)
+}
+
+func (s *runit) Reconcile(desired ReconcileSpec) (bool, error) {
+	return reconcile(s, desired)
+}
+
+func (s *runit) Reinstall() error {
+	return reinstall(s)
+}
+
+func (s *runit) Describe() ([]byte, error) {
+	return describe(s, s.Config)
+}
+
+func (s *runit) AppliedOptions() ([]string, error) {
+	return appliedOptions(s.Config, func(c *Config) ([]byte, error) {
+		r := &runit{Config: c}
+		run, err := r.definition()
+		if err != nil {
+			return nil, err
+		}
+		finish, err := r.finish()
+		return append(run, finish...), err
+	})
+}
+
+func (s *runit) RunOnce(timeout time.Duration) (int, error) {
+	return runOnce(s.Config, timeout)
+}
+
+func (s *runit) PathDrift() (installed, current string, drifted bool, err error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", "", false, err
+	}
+	return filePathDrift(s.Config, cp, "'", "cmd='")
+}
+
+func (s *runit) DefinitionChecksum() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return fileChecksum(cp)
+}
+
+func (s *runit) Logger(errs chan<- error) (Logger, error) {
+	if system.Interactive() {
+		return ConsoleLogger, nil
+	}
+	return s.SystemLogger(errs)
+}
+func (s *runit) SystemLogger(errs chan<- error) (Logger, error) {
+	if address := s.Option.string(optionLogSocket, ""); len(address) != 0 {
+		return newSocketLogger(s.Name, address, errs), nil
+	}
+	return newSysLogger(s.Name, errs)
+}
+
+func (s *runit) Run() error {
+	return serve(s, s.i, s.Config, defaultSignalMap, s.runtimeMax())
+}
+
+func (s *runit) Start() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	if err = verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	return runStart(s.Config, "sv", "up", dir)
+}
+
+// Stop sends TERM with sv down. With StopKillDelay sv force-stop waits that
+// long and then sends KILL.
+func (s *runit) Stop() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	if delay := seconds(s.Option.duration(optionStopKillDelay, 0)); delay > 0 {
+		return run("sv", "-w", strconv.Itoa(delay), "force-stop", dir)
+	}
+	return run("sv", "down", dir)
+}
+
+func (s *runit) Status() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	return checkStatus("sv", []string{"status", dir}, "run: ", "unable to change to service directory")
+}
+
+func (s *runit) Installed() (bool, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	return fileExists(cp)
+}
+
+// SetStartType writes a down file to the service directory, so runsv doesn't
+// start the service when it comes up at boot, or removes it for
+// StartAutomatic.
+func (s *runit) SetStartType(startType StartType) error {
+	if err := checkStartType(s, startType); err != nil {
+		return err
+	}
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	return setDownFile(dir, startType)
+}
+
+func (s *runit) ResourceUsage() (ResourceUsage, error) {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	return pidFileUsage(s, dir+"/supervise/pid")
+}
+
+func (s *runit) PID() (int, error) {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return 0, err
+	}
+	return readPIDFile(s, dir+"/supervise/pid")
+}
+
+func (s *runit) NetworkStats() (in, out uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
+
+func (s *runit) Restart() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	if err = verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	return runStart(s.Config, "sv", "restart", dir)
+}
+
+// The run script waits for the Dependencies with sv check, which fails the
+// start until they are up, and runsv retries it a second later. The output
+// goes to the log service of the service directory, if any, unless redirected.
+const runitRunScript = `#!/bin/sh
+# {{.Description}}
+exec {{if .StdOut}}>> "{{.StdOut}}" {{end}}{{if .StdErr}}2>> "{{.StdErr}}"{{else}}2>&1{{end}}
+{{range .Dependencies}}sv check {{.}} >/dev/null || exit 1
+{{end}}{{range .Env}}export {{.Name}}={{.Value|shellQuote}}
+{{end}}{{if .WorkingDirectory}}cd {{.WorkingDirectory|shellQuote}} || exit 1
+{{end}}cmd={{.Path|shellQuote}}
+exec chpst{{if .User}} -u {{.User|shellQuote}}{{end}}{{if .ChRoot}} -/ {{.ChRoot|shellQuote}}{{end}}{{if .OpenFiles}} -o {{.OpenFiles}}{{end}}{{if .Memory}} -m {{.Memory}}{{end}} "$cmd"{{range .Arguments}} {{.|shellQuote}}{{end}}
+`
+
+// runsv runs the finish script after the program exits, with its exit code
+// or -1 after a signal, and restarts the program once it returns. Writing d
+// to the control pipe keeps the service down instead; a stop already wants
+// it down, or the service to exit, which supervise/stat reports.
+const runitFinishScript = `#!/bin/sh
+case "$(cat supervise/stat)" in *want*) exit 0;; esac
+{{if eq .Restart "no"}}printf d > supervise/control
+{{else}}{{if eq .Restart "on-failure"}}if [ "$1" = 0 ]; then printf d > supervise/control; exit 0; fi
+{{end}}{{if .RestartSec}}exec sleep {{.RestartSec}}
+{{end}}{{end}}`
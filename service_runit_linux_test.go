@@ -0,0 +1,98 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunitDefinition(t *testing.T) {
+	s, _ := newRunitService(nil, &Config{
+		Name:             "web",
+		Description:      "Web server",
+		Executable:       "/usr/bin/web",
+		Arguments:        []string{"-config", "/etc/web/it's.conf"},
+		UserName:         "www",
+		WorkingDirectory: "/var/lib/web",
+		Dependencies:     []string{"postgresql"},
+		EnvVars:          map[string]string{"PORT": "8080"},
+	})
+	b, err := s.(*runit).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"#!/bin/sh\n",
+		"\nexec 2>&1\n",
+		"\nsv check postgresql >/dev/null || exit 1\n",
+		"\nexport PORT='8080'\n",
+		"\ncd '/var/lib/web' || exit 1\n",
+		"\ncmd='/usr/bin/web'\n",
+		`
+exec chpst -u 'www' "$cmd" '-config' '/etc/web/it'\''s.conf'
+`,
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in run script:\n%s", line, b)
+		}
+	}
+	if installed := recordedPath(b, "'", "cmd='"); installed != "/usr/bin/web" {
+		t.Errorf("recorded path %q", installed)
+	}
+	if b, err = s.(*runit).finish(); b != nil || err != nil {
+		t.Errorf("finish script without restart options: %q %v", b, err)
+	}
+
+	for _, test := range []struct {
+		option KeyValue
+		line   string
+	}{
+		{KeyValue{"Restart": "no"}, "\nprintf d > supervise/control\n"},
+		{KeyValue{"Restart": "on-failure", "RestartSec": 5 * time.Second}, `
+if [ "$1" = 0 ]; then printf d > supervise/control; exit 0; fi
+exec sleep 5
+`},
+		{KeyValue{"RestartSec": 10 * time.Second}, "\nexec sleep 10\n"},
+	} {
+		s, _ = newRunitService(nil, &Config{Name: "web", Executable: "/usr/bin/web", Option: test.option})
+		b, err := s.(*runit).finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), test.line) || !strings.Contains(string(b), "*want*) exit 0;;") {
+			t.Errorf("%v: missing %q in finish script:\n%s", test.option, test.line, b)
+		}
+	}
+
+	s, _ = newRunitService(nil, &Config{Name: "web", Executable: "/usr/bin/web", UserName: "www", Option: KeyValue{"LimitNOFILE": 4096, "MemoryLimit": "1G", "GroupName": "www-data"}})
+	if b, err = s.(*runit).definition(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "\nexec chpst -u 'www:www-data' -o 4096 -m 1073741824 \"$cmd\"\n") {
+		t.Errorf("limits missing in run script:\n%s", b)
+	}
+
+	s, _ = newRunitService(nil, &Config{Name: "web", Executable: "/usr/bin/web", Dependencies: []string{"net; reboot"}})
+	if _, err := s.(*runit).definition(); err == nil {
+		t.Error("invalid dependency accepted")
+	}
+}
+
+func TestRunitCommands(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &recordingRunner{}
+	Runner = r
+
+	s, _ := newRunitService(nil, &Config{Name: "web", Option: KeyValue{"StopKillDelay": 30 * time.Second}})
+	s.Start()
+	s.Stop()
+	s.Restart()
+	expected := []string{"sv up /etc/sv/web", "sv -w 30 force-stop /etc/sv/web", "sv restart /etc/sv/web"}
+	if strings.Join(r.commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected commands %q", r.commands)
+	}
+}
@@ -0,0 +1,582 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// s6ScanDirs are the scandirs s6-svscan commonly runs on: s6-linux-init and
+// s6-overlay use /run/service, a hand made setup one of the others.
+var s6ScanDirs = []string{"/run/service", "/service", "/etc/service", "/var/service"}
+
+// runningScanDir returns the first of s6ScanDirs s6-svscan is running on,
+// which holds the .s6-svscan control directory, or "" if there is none.
+func runningScanDir() string {
+	for _, dir := range s6ScanDirs {
+		if fi, err := os.Stat(dir + "/.s6-svscan"); err == nil && fi.IsDir() {
+			return dir
+		}
+	}
+	return ""
+}
+
+// isS6 only detects s6 when it is set up explicitly, as /service and
+// /etc/service are also the directories runit and daemontools scan.
+func isS6() bool {
+	if _, err := os.Stat("/etc/s6"); err == nil {
+		return true
+	}
+	return len(runningScanDir()) != 0
+}
+
+// s6Interactive reports whether the process was not started by s6-supervise,
+// which is the parent of an s6 service.
+func s6Interactive() bool {
+	comm, err := ioutil.ReadFile("/proc/" + strconv.Itoa(os.Getppid()) + "/comm")
+	return err != nil || strings.TrimSpace(string(comm)) != "s6-supervise"
+}
+
+type s6 struct {
+	i Interface
+	*Config
+}
+
+func newS6Service(i Interface, c *Config) (Service, error) {
+	s := &s6{
+		i:      i,
+		Config: c,
+	}
+
+	return s, nil
+}
+
+func (s *s6) String() string {
+	if len(s.DisplayName) > 0 {
+		return s.DisplayName
+	}
+	return s.Name
+}
+
+var errNoUserServiceS6 = errors.New("User services are not supported on s6.")
+
+// serviceDir returns the service directory holding the run script.
+func (s *s6) serviceDir() (string, error) {
+	if s.Option.bool(optionUserService, optionUserServiceDefault) {
+		return "", errNoUserServiceS6
+	}
+	return "/etc/s6/sv/" + s.Config.Name, nil
+}
+
+func (s *s6) configPath() (cp string, err error) {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return "", err
+	}
+	return dir + "/run", nil
+}
+
+// scanDir returns the S6ScanDir option, or the scandir s6-svscan runs on.
+func (s *s6) scanDir() (string, error) {
+	dir := s.Option.string(optionS6ScanDir, "")
+	if len(dir) == 0 {
+		if dir = runningScanDir(); len(dir) == 0 {
+			dir = s6ScanDirs[0]
+		}
+	}
+	if !filepath.IsAbs(dir) || strings.ContainsAny(dir, "\n") {
+		return "", fmt.Errorf("Option %s must be an absolute path: %q", optionS6ScanDir, dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
+// link returns the symlink in the scandir, which enables the service.
+func (s *s6) link() (string, error) {
+	dir, err := s.scanDir()
+	if err != nil {
+		return "", err
+	}
+	return dir + "/" + s.Config.Name, nil
+}
+
+// templateData returns the values of the run and finish scripts.
+func (s *s6) templateData() (interface{}, error) {
+	if err := s.checkSystemdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkLaunchdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkDirectories(); err != nil {
+		return nil, err
+	}
+	if len(s.ChRoot) != 0 {
+		return nil, errors.New("ChRoot is not supported by s6.")
+	}
+	path, err := s.execPath()
+	if err != nil {
+		return nil, err
+	}
+
+	var to = &struct {
+		*Config
+		Path       string
+		ScanDir    string
+		Restart    string
+		RestartSec int
+		Notify     bool
+		Env        []envVar
+		OpenFiles  int
+		Memory     uint64
+		StdOut     string
+		StdErr     string
+	}{
+		s.Config,
+		path,
+		"",
+		"",
+		seconds(s.Option.duration(optionRestartSec, 0)),
+		s.Option.bool(optionNotify, false),
+		nil,
+		0, 0,
+		"", "",
+	}
+	if to.ScanDir, err = s.scanDir(); err != nil {
+		return nil, err
+	}
+	if err = s.validateDependencies(); err != nil {
+		return nil, err
+	}
+	if to.Restart, err = s.restart("always"); err != nil {
+		return nil, err
+	}
+	if to.Env, err = s.environment(); err != nil {
+		return nil, err
+	}
+	if to.OpenFiles, to.Memory, err = s.ulimits(); err != nil {
+		return nil, err
+	}
+	if to.StdOut, to.StdErr, err = s.logPaths("/var/log"); err != nil {
+		return nil, err
+	}
+	// s6-setuidgid only takes a group with a numeric uid.
+	if group, err := s.groupName(); err != nil || len(group) != 0 {
+		if err == nil {
+			err = fmt.Errorf("Option %s is not supported by s6.", optionGroupName)
+		}
+		return nil, err
+	}
+	return to, nil
+}
+
+func (s *s6) render(script string) ([]byte, error) {
+	to, err := s.templateData()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	err = template.Must(template.New("").Funcs(tf).Parse(script)).Execute(&b, to)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// definition renders the run script for the service.
+func (s *s6) definition() ([]byte, error) {
+	return s.render(s6RunScript)
+}
+
+// s6File is a file of the service directory besides the run script.
+type s6File struct {
+	name string
+	data []byte
+	mode os.FileMode
+}
+
+// files returns the finish script and the control files s6-supervise reads
+// from the service directory, those the options need.
+func (s *s6) files() ([]s6File, error) {
+	var files []s6File
+	restart, err := s.restart("always")
+	if err != nil {
+		return nil, err
+	}
+	restartSec := seconds(s.Option.duration(optionRestartSec, 0))
+	if restart != "always" || restartSec > 0 {
+		finish, err := s.render(s6FinishScript)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, s6File{"finish", finish, 0755})
+	}
+	if restartSec > 0 {
+		// s6-supervise kills a finish script running longer than 5s by default.
+		files = append(files, s6File{"timeout-finish", []byte(strconv.Itoa((restartSec+5)*1000) + "\n"), 0644})
+	}
+	if delay := seconds(s.Option.duration(optionStopKillDelay, 0)); delay > 0 {
+		files = append(files, s6File{"timeout-kill", []byte(strconv.Itoa(delay*1000) + "\n"), 0644})
+	}
+	if s.Option.bool(optionNotify, false) {
+		// The run script passes the descriptor to Ready in S6_NOTIFICATION_FD.
+		files = append(files, s6File{"notification-fd", []byte("3\n"), 0644})
+	}
+	return files, nil
+}
+
+// s6Files are the names of all files Install and SetStartType may write
+// besides the run script, which Uninstall removes.
+var s6Files = []string{"finish", "timeout-finish", "timeout-kill", "notification-fd", "down"}
+
+func (s *s6) Install() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	confPath := dir + "/run"
+	_, err = os.Stat(confPath)
+	if err == nil {
+		return fmt.Errorf("Init already exists: %s", confPath)
+	}
+
+	definition, err := s.definition()
+	if err != nil {
+		return err
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	link, err := s.link()
+	if err != nil {
+		return err
+	}
+	if err = createWorkingDirectory(s.Config); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var written []string
+	undo := func() {
+		for _, path := range written {
+			os.Remove(path)
+		}
+		os.Remove(dir)
+	}
+	for _, f := range append([]s6File{{"run", definition, 0755}}, files...) {
+		path := dir + "/" + f.name
+		written = append(written, path)
+		if err = writeFileSync(path, f.data, f.mode); err == nil {
+			err = os.Chmod(path, f.mode)
+		}
+		if err != nil {
+			undo()
+			return err
+		}
+	}
+	if err = restoreContext(s.Config, written...); err != nil {
+		undo()
+		return err
+	}
+	if err = installAppArmor(s.Config); err != nil {
+		undo()
+		return err
+	}
+	// s6-svscan only finds the link, and starts the service, when rescanning.
+	if err = os.Symlink(dir, link); err == nil {
+		if err = runTimeout(s.commandTimeout(), "s6-svscanctl", "-a", filepath.Dir(link)); err != nil {
+			os.Remove(link)
+		}
+	}
+	if err != nil {
+		removeAppArmor(s.Config)
+		undo()
+		return err
+	}
+	s.notifyChecksum(definition)
+	return nil
+}
+
+func (s *s6) Preflight() error {
+	cp, err := s.configPath()
+	if err != nil {
+		return preflight([]string{"s6-svc", "s6-svscanctl", "s6-svstat"}, nil, strings.TrimSuffix(err.Error(), "."))
+	}
+	link, err := s.link()
+	if err != nil {
+		return preflight([]string{"s6-svc", "s6-svscanctl", "s6-svstat"}, []string{cp}, strings.TrimSuffix(err.Error(), "."))
+	}
+	return preflight(installTools(s.Config, "s6-svc", "s6-svscanctl", "s6-svstat"), []string{cp, link})
+}
+
+func (s *s6) Uninstall() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	link, err := s.link()
+	if err != nil {
+		return err
+	}
+	cp := dir + "/run"
+	if _, err = os.Stat(cp); err == nil {
+		if err = stopBeforeUninstall(s, s.Config); err != nil {
+			return err
+		}
+	}
+	// After a rescan without the link s6-svscan stops supervising the service,
+	// so its supervise and event directories can go too.
+	linked, err := remove(link)
+	if err != nil {
+		return err
+	}
+	if linked {
+		runTimeout(s.commandTimeout(), "s6-svscanctl", "-an", filepath.Dir(link))
+	}
+	found, err := remove(cp)
+	if err != nil {
+		return err
+	}
+	for _, name := range s6Files {
+		if _, err = remove(dir + "/" + name); err != nil {
+			return err
+		}
+	}
+	os.RemoveAll(filepath.Join(dir, "supervise"))
+	os.RemoveAll(filepath.Join(dir, "event"))
+	os.Remove(dir)
+	if err = removeAppArmor(s.Config); err != nil {
+		return err
+	}
+	if !linked && !found {
+		return ErrServiceIsNotInstalled
+	}
+	return nil
+}
+
+func (s *s6) Diff() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return diffFile(cp, s.definition)
+}
+
+func (s *s6) Render() (string, error) {
+	return renderDefinition(s.definition)
+}
+
+func (s *s6) WaitFor(ctx context.Context, desired Status) error {
+	return waitFor(ctx, s, desired)
+}
+
+func (s *s6) Health() (HealthStatus, error) {
+	return health(s, s.Config)
+}
+
+func (s *s6) SelfTest(ctx context.Context) error {
+	return selfTest(ctx, s, s.Config)
+}
+
+func (s *s6) Reconcile(desired ReconcileSpec) (bool, error) {
+	return reconcile(s, desired)
+}
+
+func (s *s6) Reinstall() error {
+	return reinstall(s)
+}
+
+func (s *s6) Describe() ([]byte, error) {
+	return describe(s, s.Config)
+}
+
+func (s *s6) AppliedOptions() ([]string, error) {
+	return appliedOptions(s.Config, func(c *Config) ([]byte, error) {
+		r := &s6{Config: c}
+		run, err := r.definition()
+		if err != nil {
+			return nil, err
+		}
+		files, err := r.files()
+		for _, f := range files {
+			run = append(append(run, f.name...), f.data...)
+		}
+		return run, err
+	})
+}
+
+func (s *s6) RunOnce(timeout time.Duration) (int, error) {
+	return runOnce(s.Config, timeout)
+}
+
+func (s *s6) PathDrift() (installed, current string, drifted bool, err error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", "", false, err
+	}
+	return filePathDrift(s.Config, cp, "'", "cmd='")
+}
+
+func (s *s6) DefinitionChecksum() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return fileChecksum(cp)
+}
+
+func (s *s6) Logger(errs chan<- error) (Logger, error) {
+	if system.Interactive() {
+		return ConsoleLogger, nil
+	}
+	return s.SystemLogger(errs)
+}
+func (s *s6) SystemLogger(errs chan<- error) (Logger, error) {
+	if address := s.Option.string(optionLogSocket, ""); len(address) != 0 {
+		return newSocketLogger(s.Name, address, errs), nil
+	}
+	return newSysLogger(s.Name, errs)
+}
+
+func (s *s6) Run() error {
+	return serve(s, s.i, s.Config, defaultSignalMap, s.runtimeMax())
+}
+
+func (s *s6) Start() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	if err = verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	return runStart(s.Config, "s6-svc", "-u", dir)
+}
+
+// Stop sends TERM with s6-svc -d and waits until the finish script, if any,
+// is done. s6-supervise sends KILL after the timeout-kill of StopKillDelay.
+func (s *s6) Stop() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	timeout := strconv.FormatInt(int64(s.commandTimeout()/time.Millisecond), 10)
+	return run("s6-svc", "-wD", "-T", timeout, "-d", dir)
+}
+
+func (s *s6) Status() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	err = checkStatus("s6-svstat", []string{dir}, "up (pid ", "s6-svstat: fatal:")
+	// s6-svstat fails until s6-supervise created the supervise directory.
+	if err == ErrServiceIsNotInstalled {
+		if installed, _ := fileExists(dir + "/run"); installed {
+			return ErrServiceIsNotRunning
+		}
+	}
+	return err
+}
+
+func (s *s6) Installed() (bool, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	return fileExists(cp)
+}
+
+// SetStartType writes a down file to the service directory, so s6-supervise
+// doesn't start the service when it comes up at boot, or removes it for
+// StartAutomatic.
+func (s *s6) SetStartType(startType StartType) error {
+	if err := checkStartType(s, startType); err != nil {
+		return err
+	}
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	return setDownFile(dir, startType)
+}
+
+func (s *s6) ResourceUsage() (ResourceUsage, error) {
+	pid, err := s.PID()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	return procUsage(pid)
+}
+
+// PID returns the pid s6-svstat reports; s6-supervise writes no pid file.
+func (s *s6) PID() (int, error) {
+	if err := s.Status(); err != nil {
+		return 0, err
+	}
+	dir, err := s.serviceDir()
+	if err != nil {
+		return 0, err
+	}
+	out, err := runWithOutput("s6-svstat", dir)
+	if err != nil {
+		return 0, fmt.Errorf("\"s6-svstat\" failed: %v, %s", err, out)
+	}
+	var pid int
+	if _, err = fmt.Sscanf(string(out), "up (pid %d", &pid); err != nil {
+		return 0, fmt.Errorf("No pid in s6-svstat output: %q", out)
+	}
+	return pid, nil
+}
+
+func (s *s6) NetworkStats() (in, out uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
+
+// Restart stops and starts the service, as with s6-svc -r the finish script
+// would keep a service down that is not restarted after it exits.
+func (s *s6) Restart() error {
+	if err := s.Stop(); err != nil {
+		return err
+	}
+	return s.Start()
+}
+
+// The run script waits for the Dependencies with s6-svwait, which fails the
+// start until they are up, and s6-supervise retries it a second later. The
+// output goes to the log service of the service directory, if any, unless
+// redirected.
+const s6RunScript = `#!/bin/sh
+# {{.Description}}
+exec {{if .StdOut}}>> "{{.StdOut}}" {{end}}{{if .StdErr}}2>> "{{.StdErr}}"{{else}}2>&1{{end}}
+{{range .Dependencies}}s6-svwait -u -t 1000 {{printf "%s/%s" $.ScanDir .|shellQuote}} || exit 1
+{{end}}{{range .Env}}export {{.Name}}={{.Value|shellQuote}}
+{{end}}{{if .Notify}}export S6_NOTIFICATION_FD=3
+{{end}}{{if .WorkingDirectory}}cd {{.WorkingDirectory|shellQuote}} || exit 1
+{{end}}cmd={{.Path|shellQuote}}
+exec {{if or .OpenFiles .Memory}}s6-softlimit{{if .OpenFiles}} -o {{.OpenFiles}}{{end}}{{if .Memory}} -m {{.Memory}}{{end}} {{end}}{{if .UserName}}s6-setuidgid {{.UserName|shellQuote}} {{end}}"$cmd"{{range .Arguments}} {{.|shellQuote}}{{end}}
+`
+
+// s6-supervise runs the finish script in the service directory after the
+// program exits, with its exit code or 256 after a signal, and restarts the
+// program once it returns unless the service is wanted down. Exiting with
+// 125 keeps the service down instead.
+const s6FinishScript = `#!/bin/sh
+[ "$(s6-svstat -o wantedup .)" = false ] && exit 0
+{{if eq .Restart "no"}}exit 125
+{{else}}{{if eq .Restart "on-failure"}}[ "$1" = 0 ] && exit 125
+{{end}}{{if .RestartSec}}exec sleep {{.RestartSec}}
+{{end}}{{end}}`
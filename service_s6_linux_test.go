@@ -0,0 +1,95 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS6Definition(t *testing.T) {
+	s, _ := newS6Service(nil, &Config{
+		Name:             "web",
+		Description:      "Web server",
+		Executable:       "/usr/bin/web",
+		Arguments:        []string{"-config", "/etc/web/it's.conf"},
+		UserName:         "www",
+		WorkingDirectory: "/var/lib/web",
+		Dependencies:     []string{"postgresql"},
+		EnvVars:          map[string]string{"PORT": "8080"},
+		Option:           KeyValue{"S6ScanDir": "/etc/s6/scandir", "LimitNOFILE": 4096},
+	})
+	b, err := s.(*s6).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"#!/bin/sh\n",
+		"\nexec 2>&1\n",
+		"\ns6-svwait -u -t 1000 '/etc/s6/scandir/postgresql' || exit 1\n",
+		"\nexport PORT='8080'\n",
+		"\ncd '/var/lib/web' || exit 1\n",
+		"\ncmd='/usr/bin/web'\n",
+		`
+exec s6-softlimit -o 4096 s6-setuidgid 'www' "$cmd" '-config' '/etc/web/it'\''s.conf'
+`,
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in run script:\n%s", line, b)
+		}
+	}
+	if installed := recordedPath(b, "'", "cmd='"); installed != "/usr/bin/web" {
+		t.Errorf("recorded path %q", installed)
+	}
+	if link, _ := s.(*s6).link(); link != "/etc/s6/scandir/web" {
+		t.Errorf("link %q", link)
+	}
+	if files, err := s.(*s6).files(); len(files) != 0 || err != nil {
+		t.Errorf("files without restart options: %v %v", files, err)
+	}
+
+	for _, test := range []struct {
+		option KeyValue
+		file   string
+		line   string
+	}{
+		{KeyValue{"Restart": "no"}, "finish", "\nexit 125\n"},
+		{KeyValue{"Restart": "on-failure", "RestartSec": 5 * time.Second}, "finish", `
+[ "$1" = 0 ] && exit 125
+exec sleep 5
+`},
+		{KeyValue{"RestartSec": 10 * time.Second}, "timeout-finish", "15000\n"},
+		{KeyValue{"StopKillDelay": 10 * time.Second}, "timeout-kill", "10000\n"},
+		{KeyValue{"Notify": true}, "notification-fd", "3\n"},
+	} {
+		s, _ = newS6Service(nil, &Config{Name: "web", Executable: "/usr/bin/web", Option: test.option})
+		files, err := s.(*s6).files()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, f := range files {
+			if f.name == test.file {
+				found = strings.Contains(string(f.data), test.line)
+			}
+		}
+		if !found {
+			t.Errorf("%v: missing %q in %s: %v", test.option, test.line, test.file, files)
+		}
+	}
+
+	for _, c := range []*Config{
+		{Name: "web", Executable: "/usr/bin/web", Option: KeyValue{"GroupName": "www-data"}},
+		{Name: "web", Executable: "/usr/bin/web", ChRoot: "/srv/jail"},
+		{Name: "web", Executable: "/usr/bin/web", Option: KeyValue{"S6ScanDir": "scandir"}},
+		{Name: "web", Executable: "/usr/bin/web", Dependencies: []string{"net; reboot"}},
+	} {
+		s, _ = newS6Service(nil, c)
+		if _, err := s.(*s6).definition(); err == nil {
+			t.Errorf("%v %q %v accepted", c.Option, c.ChRoot, c.Dependencies)
+		}
+	}
+}
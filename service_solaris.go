@@ -0,0 +1,471 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type solarisSystem struct{}
+
+func (solarisSystem) String() string {
+	return PlatformSolarisSMF
+}
+func (solarisSystem) Detect() bool {
+	return true
+}
+func (solarisSystem) Interactive() bool {
+	return interactive
+}
+func (solarisSystem) New(i Interface, c *Config) (Service, error) {
+	s := &solarisSmfService{
+		i:      i,
+		Config: c,
+	}
+	return s, nil
+}
+
+func init() {
+	ChooseSystem(solarisSystem{})
+}
+
+var interactive = isInteractive()
+
+// isInteractive reports whether the process was not started by svc.startd,
+// which sets SMF_FMRI for the methods it runs.
+func isInteractive() bool {
+	return len(os.Getenv("SMF_FMRI")) == 0
+}
+
+func launchContext() Launcher {
+	if !interactive {
+		return ByServiceManager
+	}
+	return ancestorLauncher(os.Getppid(), psProcess)
+}
+
+type solarisSmfService struct {
+	i Interface
+	*Config
+}
+
+func (s *solarisSmfService) String() string {
+	if len(s.DisplayName) > 0 {
+		return s.DisplayName
+	}
+	return s.Name
+}
+
+var errNoUserServiceSolaris = errors.New("User services are not supported on Solaris.")
+
+// smfName matches the names SMF accepts for a service.
+var smfName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+// smfFMRI matches the FMRI of a service, with or without an instance.
+var smfFMRI = regexp.MustCompile(`^svc:/[A-Za-z][A-Za-z0-9_./-]*(:[A-Za-z][A-Za-z0-9_.-]*)?$`)
+
+// service is the FMRI of the service, instance the one of its default
+// instance, which svcadm and svcs act on.
+func (s *solarisSmfService) service() string {
+	return "svc:/application/" + s.Name
+}
+func (s *solarisSmfService) instance() string {
+	return s.service() + ":default"
+}
+
+// configPath is where Install writes the manifest. manifest-import imports
+// those in /var/svc/manifest/site again at boot.
+func (s *solarisSmfService) configPath() (cp string, err error) {
+	if s.Option.bool(optionUserService, optionUserServiceDefault) {
+		return "", errNoUserServiceSolaris
+	}
+	return "/var/svc/manifest/site/" + s.Config.Name + ".xml", nil
+}
+
+// xmlEscape escapes s for an XML attribute or text. Apostrophes are kept,
+// as they quote the shell words of the exec attribute.
+var xmlEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace
+
+// definition renders the SMF manifest for the service.
+func (s *solarisSmfService) definition() ([]byte, error) {
+	if err := s.checkSystemdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkLaunchdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkDirectories(); err != nil {
+		return nil, err
+	}
+	if !smfName.MatchString(s.Name) {
+		return nil, fmt.Errorf("Name must start with a letter and only contain letters, digits, ., - and _ on Solaris: %q", s.Name)
+	}
+	if len(s.ChRoot) != 0 {
+		return nil, errors.New("ChRoot is not supported by SMF.")
+	}
+	path, err := s.execPath()
+	if err != nil {
+		return nil, err
+	}
+
+	var to = &struct {
+		*Config
+		Exec          string
+		Duration      string
+		StartTimeout  int
+		StopTimeout   int
+		GroupName     string
+		FMRIs         []string
+		Env           []envVar
+		RunAsUserName string
+	}{
+		Config:      s.Config,
+		StopTimeout: seconds(s.Option.duration(optionStopKillDelay, 10*time.Second)),
+	}
+	restart, err := s.restart("always")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case s.Option.bool(optionOneShot, optionOneShotDefault):
+		// svc.startd waits for the start method of a transient service to
+		// exit, with no time limit, and does not restart it.
+		to.Duration = "transient"
+	case restart == "always":
+		// The start method is the program, svc.startd restarts it.
+		to.Duration = "child"
+		to.StartTimeout = 60
+	default:
+		return nil, fmt.Errorf("Option Restart %s is not supported by SMF, which restarts a service after any exit.", restart)
+	}
+	for _, d := range s.Dependencies {
+		switch {
+		case smfFMRI.MatchString(d):
+			to.FMRIs = append(to.FMRIs, d)
+		case scriptName.MatchString(d):
+			to.FMRIs = append(to.FMRIs, "svc:/application/"+d)
+		default:
+			return nil, fmt.Errorf("Dependencies entry is not a service name or FMRI: %q", d)
+		}
+	}
+	if to.GroupName, err = s.groupName(); err != nil {
+		return nil, err
+	}
+	if to.Env, err = s.environment(); err != nil {
+		return nil, err
+	}
+	stdout, stderr, err := s.logPaths("/var/log")
+	if err != nil {
+		return nil, err
+	}
+	// The DTD requires a user with the group.
+	to.RunAsUserName = s.UserName
+	if len(to.RunAsUserName) == 0 && len(to.GroupName) != 0 {
+		to.RunAsUserName = "root"
+	}
+
+	// svc.startd expands the % method tokens of the exec attribute, then runs
+	// it with sh -c. Output not redirected goes to the log of the service in
+	// /var/svc/log.
+	words := []string{"exec", shellQuote(path)}
+	for _, arg := range s.Arguments {
+		words = append(words, shellQuote(arg))
+	}
+	if len(stdout) != 0 {
+		words = append(words, ">>"+shellQuote(stdout))
+	}
+	if len(stderr) != 0 {
+		words = append(words, "2>>"+shellQuote(stderr))
+	}
+	to.Exec = strings.Replace(strings.Join(words, " "), "%", "%%", -1)
+
+	functions := template.FuncMap{
+		"xml": xmlEscape,
+	}
+	var b bytes.Buffer
+	err = template.Must(template.New("").Funcs(functions).Parse(smfManifest)).Execute(&b, to)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Install writes the manifest and imports it with svccfg. The default
+// instance stays disabled until Start enables it.
+func (s *solarisSmfService) Install() error {
+	confPath, err := s.configPath()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(confPath)
+	if err == nil {
+		return fmt.Errorf("Init already exists: %s", confPath)
+	}
+
+	definition, err := s.definition()
+	if err != nil {
+		return err
+	}
+	if err = createWorkingDirectory(s.Config); err != nil {
+		return err
+	}
+	if err = os.MkdirAll("/var/svc/manifest/site", 0755); err != nil {
+		return err
+	}
+	if err = writeFileSync(confPath, definition, 0444); err != nil {
+		return err
+	}
+	if err = runTimeout(s.commandTimeout(), "svccfg", "import", confPath); err != nil {
+		os.Remove(confPath)
+		return err
+	}
+	s.notifyChecksum(definition)
+	return nil
+}
+
+func (s *solarisSmfService) Preflight() error {
+	tools := []string{"svccfg", "svcadm", "svcs"}
+	cp, err := s.configPath()
+	if err != nil {
+		return preflight(tools, nil, strings.TrimSuffix(err.Error(), "."))
+	}
+	return preflight(tools, []string{cp})
+}
+
+func (s *solarisSmfService) Uninstall() error {
+	cp, err := s.configPath()
+	if err != nil {
+		return err
+	}
+	imported, err := commandSucceeds(s.commandTimeout(), "svcs", "-H", s.instance())
+	if err != nil {
+		return err
+	}
+	if imported {
+		if err = stopBeforeUninstall(s, s.Config); err != nil {
+			return err
+		}
+		if err = runTimeout(s.commandTimeout(), "svccfg", "delete", "-f", s.service()); err != nil {
+			return err
+		}
+	}
+	found, err := remove(cp)
+	if err != nil {
+		return err
+	}
+	if !imported && !found {
+		return ErrServiceIsNotInstalled
+	}
+	return nil
+}
+
+func (s *solarisSmfService) Diff() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return diffFile(cp, s.definition)
+}
+
+func (s *solarisSmfService) Render() (string, error) {
+	return renderDefinition(s.definition)
+}
+
+func (s *solarisSmfService) WaitFor(ctx context.Context, desired Status) error {
+	return waitFor(ctx, s, desired)
+}
+
+func (s *solarisSmfService) Health() (HealthStatus, error) {
+	return health(s, s.Config)
+}
+
+func (s *solarisSmfService) SelfTest(ctx context.Context) error {
+	return selfTest(ctx, s, s.Config)
+}
+
+func (s *solarisSmfService) Reconcile(desired ReconcileSpec) (bool, error) {
+	return reconcile(s, desired)
+}
+
+func (s *solarisSmfService) Reinstall() error {
+	return reinstall(s)
+}
+
+func (s *solarisSmfService) Describe() ([]byte, error) {
+	return describe(s, s.Config)
+}
+
+func (s *solarisSmfService) AppliedOptions() ([]string, error) {
+	return appliedOptions(s.Config, func(c *Config) ([]byte, error) {
+		return (&solarisSmfService{Config: c}).definition()
+	})
+}
+
+func (s *solarisSmfService) RunOnce(timeout time.Duration) (int, error) {
+	return runOnce(s.Config, timeout)
+}
+
+func (s *solarisSmfService) PathDrift() (installed, current string, drifted bool, err error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", "", false, err
+	}
+	return filePathDrift(s.Config, cp, "'", `exec="exec '`)
+}
+
+func (s *solarisSmfService) DefinitionChecksum() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return fileChecksum(cp)
+}
+
+func (s *solarisSmfService) Logger(errs chan<- error) (Logger, error) {
+	if system.Interactive() {
+		return ConsoleLogger, nil
+	}
+	return s.SystemLogger(errs)
+}
+func (s *solarisSmfService) SystemLogger(errs chan<- error) (Logger, error) {
+	if address := s.Option.string(optionLogSocket, ""); len(address) != 0 {
+		return newSocketLogger(s.Name, address, errs), nil
+	}
+	return newSysLogger(s.Name, errs)
+}
+
+func (s *solarisSmfService) Run() error {
+	return serve(s, s.i, s.Config, defaultSignalMap, s.runtimeMax())
+}
+
+// Start enables the instance, which also starts it at boot, and waits for it
+// to come online.
+func (s *solarisSmfService) Start() error {
+	if err := verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	return runStart(s.Config, "svcadm", "enable", "-s", s.instance())
+}
+
+// Stop disables the instance until the next boot, or Start.
+func (s *solarisSmfService) Stop() error {
+	return run("svcadm", "disable", "-s", "-t", s.instance())
+}
+
+func (s *solarisSmfService) Status() error {
+	return checkStatus("svcs", []string{"-H", "-o", "state", s.instance()}, "online", "doesn't match")
+}
+
+func (s *solarisSmfService) Installed() (bool, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	return fileExists(cp)
+}
+
+// SetStartType returns ErrNotSupported. SMF starts an instance once it is
+// enabled and stops it once disabled, so whether it starts at boot can't be
+// set apart from Start and Stop.
+func (s *solarisSmfService) SetStartType(startType StartType) error {
+	return ErrNotSupported
+}
+
+func (s *solarisSmfService) ResourceUsage() (ResourceUsage, error) {
+	pid, err := s.PID()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	return psUsage(pid)
+}
+
+// PID returns the first process svcs lists in the contract of the instance.
+func (s *solarisSmfService) PID() (int, error) {
+	if err := s.Status(); err != nil {
+		return 0, err
+	}
+	out, err := runWithOutput("svcs", "-H", "-p", s.instance())
+	if err != nil {
+		return 0, fmt.Errorf("\"svcs\" failed: %v, %s", err, out)
+	}
+	return parseSvcsPID(out)
+}
+
+// parseSvcsPID returns the pid from svcs -H -p output, which follows the
+// line of the instance with one line of start time, pid and command name
+// for each of its processes.
+func parseSvcsPID(out []byte) (int, error) {
+	lines := strings.Split(string(out), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[1]); err == nil {
+			return pid, nil
+		}
+	}
+	return 0, ErrServiceIsNotRunning
+}
+
+func (s *solarisSmfService) NetworkStats() (in, out uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
+
+func (s *solarisSmfService) Restart() error {
+	if err := verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	return runStart(s.Config, "svcadm", "restart", s.instance())
+}
+
+// The start method execs the program, so svc.startd runs it as the child
+// it watches. The stop method has svc.startd send SIGTERM to the processes
+// of the contract and SIGKILL once its timeout expires.
+const smfManifest = `<?xml version="1.0"?>
+<!DOCTYPE service_bundle SYSTEM "/usr/share/lib/xml/dtd/service_bundle.dtd.1">
+<service_bundle type="manifest" name="{{.Name|xml}}">
+  <service name="application/{{.Name|xml}}" type="service" version="1">
+    <create_default_instance enabled="false"/>
+    <single_instance/>
+    <dependency name="network" grouping="require_all" restart_on="error" type="service">
+      <service_fmri value="svc:/milestone/network:default"/>
+    </dependency>
+    <dependency name="filesystem" grouping="require_all" restart_on="error" type="service">
+      <service_fmri value="svc:/system/filesystem/local"/>
+    </dependency>
+{{range $i, $d := .FMRIs}}    <dependency name="dependency{{$i}}" grouping="require_all" restart_on="none" type="service">
+      <service_fmri value="{{$d|xml}}"/>
+    </dependency>
+{{end}}    <method_context{{if .WorkingDirectory}} working_directory="{{.WorkingDirectory|xml}}"{{end}}>
+{{if .RunAsUserName}}      <method_credential user="{{.RunAsUserName|xml}}"{{if .GroupName}} group="{{.GroupName|xml}}"{{end}}/>
+{{end}}{{if .Env}}      <method_environment>
+{{range .Env}}        <envvar name="{{.Name}}" value="{{.Value|xml}}"/>
+{{end}}      </method_environment>
+{{end}}    </method_context>
+    <exec_method type="method" name="start" timeout_seconds="{{.StartTimeout}}"
+      exec="{{.Exec|xml}}"/>
+    <exec_method type="method" name="stop" exec=":kill" timeout_seconds="{{.StopTimeout}}"/>
+    <property_group name="startd" type="framework">
+      <propval name="duration" type="astring" value="{{.Duration}}"/>
+    </property_group>
+    <stability value="Unstable"/>
+{{if .Description}}    <template>
+      <common_name>
+        <loctext xml:lang="C">{{.Description|xml}}</loctext>
+      </common_name>
+    </template>
+{{end}}  </service>
+</service_bundle>
+`
@@ -0,0 +1,77 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSMFDefinition(t *testing.T) {
+	s := &solarisSmfService{Config: &Config{
+		Name:             "web",
+		Description:      "Web & API server",
+		Executable:       "/opt/web/bin/web",
+		Arguments:        []string{"-config", "/etc/web/it's.conf", "-format", "%s"},
+		UserName:         "webservd",
+		WorkingDirectory: "/var/web",
+		Dependencies:     []string{"postgresql", "svc:/network/ssh:default"},
+		EnvVars:          map[string]string{"GREETING": `say "hi"`},
+		Option:           KeyValue{"GroupName": "webservd", "StdOutPath": "/var/log/web.log"},
+	}}
+	b, err := s.definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`<service name="application/web" type="service" version="1">`,
+		`<service_fmri value="svc:/application/postgresql"/>`,
+		`<service_fmri value="svc:/network/ssh:default"/>`,
+		`<method_context working_directory="/var/web">`,
+		`<method_credential user="webservd" group="webservd"/>`,
+		`<envvar name="GREETING" value="say &quot;hi&quot;"/>`,
+		`exec="exec '/opt/web/bin/web' '-config' '/etc/web/it'\''s.conf' '-format' '%%s' &gt;&gt;'/var/log/web.log'"/>`,
+		`<propval name="duration" type="astring" value="child"/>`,
+		`<loctext xml:lang="C">Web &amp; API server</loctext>`,
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in manifest:\n%s", line, b)
+		}
+	}
+	if installed := recordedPath(b, "'", `exec="exec '`); installed != "/opt/web/bin/web" {
+		t.Errorf("recorded path %q", installed)
+	}
+
+	s = &solarisSmfService{Config: &Config{Name: "web", Executable: "/opt/web/bin/web", Option: KeyValue{"OneShot": true}}}
+	if b, err = s.definition(); err != nil || !strings.Contains(string(b), `value="transient"`) || strings.Contains(string(b), "<method_credential") {
+		t.Errorf("OneShot manifest %v:\n%s", err, b)
+	}
+
+	s = &solarisSmfService{Config: &Config{Name: "web", Executable: "/opt/web/bin/web", Option: KeyValue{"GroupName": "webservd"}}}
+	if b, err = s.definition(); err != nil || !strings.Contains(string(b), `<method_credential user="root" group="webservd"/>`) {
+		t.Errorf("GroupName only manifest %v:\n%s", err, b)
+	}
+
+	for _, c := range []*Config{
+		{Name: "1web", Executable: "/opt/web/bin/web"},
+		{Name: "web", Executable: "/opt/web/bin/web", Option: KeyValue{"Restart": "on-failure"}},
+		{Name: "web", Executable: "/opt/web/bin/web", ChRoot: "/var/jail"},
+		{Name: "web", Executable: "/opt/web/bin/web", Dependencies: []string{"net; reboot"}},
+	} {
+		if _, err := (&solarisSmfService{Config: c}).definition(); err == nil {
+			t.Errorf("%s %v %v accepted", c.Name, c.Option, c.Dependencies)
+		}
+	}
+}
+
+func TestParseSvcsPID(t *testing.T) {
+	pid, err := parseSvcsPID([]byte("online         10:42:17 svc:/application/web:default\n               10:42:17     1234 web\n"))
+	if pid != 1234 || err != nil {
+		t.Errorf("pid %d %v", pid, err)
+	}
+	if _, err = parseSvcsPID([]byte("online         10:42:17 svc:/application/web:default\n")); err != ErrServiceIsNotRunning {
+		t.Errorf("without processes: %v", err)
+	}
+}
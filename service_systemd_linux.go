@@ -5,12 +5,20 @@
 package service
 
 import (
-	"errors"
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
-	"os/signal"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
 	"text/template"
+	"time"
 )
 
 func isSystemd() bool {
@@ -41,22 +49,601 @@ func (s *systemd) String() string {
 	return s.Name
 }
 
-// Systemd services should be supported, but are not currently.
-var errNoUserServiceSystemd = errors.New("User services are not supported on systemd.")
+func (s *systemd) userService() bool {
+	return s.Option.bool(optionUserService, optionUserServiceDefault)
+}
 
 func (s *systemd) configPath() (cp string, err error) {
-	if s.Option.bool(optionUserService, optionUserServiceDefault) {
-		err = errNoUserServiceSystemd
-		return
+	dir, err := s.unitDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, s.Config.Name+".service"), nil
+}
+
+// unitDir returns the directory Install writes units to, in the home
+// directory of the current user for a UserService.
+func (s *systemd) unitDir() (string, error) {
+	if !s.userService() {
+		return "/etc/systemd/system", nil
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); len(dir) != 0 {
+		return filepath.Join(dir, "systemd", "user"), nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, ".config", "systemd", "user"), nil
+}
+
+// logDir returns the directory LogOutput appends the output to, the state
+// directory of the current user for a UserService.
+func (s *systemd) logDir() (string, error) {
+	if !s.userService() {
+		return "/var/log", nil
 	}
-	cp = "/etc/systemd/system/" + s.Config.Name + ".service"
-	return
+	if dir := os.Getenv("XDG_STATE_HOME"); len(dir) != 0 {
+		return dir, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, ".local", "state"), nil
+}
+
+// unitPath returns where Install writes unit.
+func (s *systemd) unitPath(unit string) string {
+	dir, _ := s.unitDir()
+	return filepath.Join(dir, unit)
+}
+
+// defaultTarget is the target services are wanted by unless set otherwise.
+func (s *systemd) defaultTarget() string {
+	if s.userService() {
+		return "default.target"
+	}
+	return "multi-user.target"
+}
+
+// userBus returns an error saying what is missing if systemctl --user can't
+// reach the user manager, as in rootless containers or over ssh without a
+// login session.
+var userBus = func() error {
+	if len(os.Getenv("DBUS_SESSION_BUS_ADDRESS")) != 0 {
+		return nil
+	}
+	uid := strconv.Itoa(os.Getuid())
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if len(dir) == 0 {
+		if _, err := os.Stat("/run/user/" + uid + "/bus"); err == nil {
+			return fmt.Errorf("The systemd user manager runs but XDG_RUNTIME_DIR is not set, try export XDG_RUNTIME_DIR=/run/user/%s.", uid)
+		}
+	} else {
+		for _, name := range []string{"bus", "systemd/private"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("No systemd user manager runs for uid %s. User services need a login session, or lingering enabled with loginctl enable-linger to start the manager at boot.", uid)
+}
+
+// systemctl returns the arguments for systemctl, addressing the user manager
+// for a UserService. That fails early if the user manager can't be reached.
+func (s *systemd) systemctl(args ...string) ([]string, error) {
+	if !s.userService() {
+		return args, nil
+	}
+	if err := userBus(); err != nil {
+		return nil, err
+	}
+	return append([]string{"--user"}, args...), nil
+}
+
+// runSystemctl runs systemctl with the arguments returned by systemctl.
+func (s *systemd) runSystemctl(timeout time.Duration, args ...string) error {
+	args, err := s.systemctl(args...)
+	if err != nil {
+		return err
+	}
+	return runTimeout(timeout, "systemctl", args...)
+}
+
+// withNewline returns s ending in a newline, "" if s is empty.
+func withNewline(s string) string {
+	if len(s) == 0 || strings.HasSuffix(s, "\n") {
+		return s
+	}
+	return s + "\n"
 }
 func (s *systemd) template() *template.Template {
 	return template.Must(template.New("").Funcs(tf).Parse(systemdScript))
 }
 
+// definition renders the unit file for the service.
+func (s *systemd) definition() ([]byte, error) {
+	if err := s.checkLaunchdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkDirectories(); err != nil {
+		return nil, err
+	}
+	path, err := s.execPath()
+	if err != nil {
+		return nil, err
+	}
+	// systemd refuses to run such an executable however it is escaped.
+	if strings.ContainsAny(path, `"'\`) {
+		return nil, fmt.Errorf("systemd can't run an executable with quotes or backslashes in its path: %q", path)
+	}
+
+	var to = &struct {
+		*Config
+		Path            string
+		ReloadSignal    string
+		PIDFile         string
+		OneShot         bool
+		RemainAfterExit bool
+		Notify          bool
+		IPAccounting    bool
+		WatchdogSec     int
+		RuntimeMaxSec   int
+		Group           string
+
+		After, Before, Conflicts, WantedBy []string
+		PartOf, BindsTo, Requires          []string
+		DefaultDependencies                bool
+
+		ExecStartPre  string
+		ExecStartPost []string
+
+		Restart                                                          string
+		RestartSec, RestartSteps, RestartMaxDelaySec, StartLimitInterval int
+
+		BindPaths, BindReadOnlyPaths []string
+
+		StateDirectory, StateDirectoryMode string
+
+		MemoryMax, MemoryLow, MemoryHigh, MemorySwapMax, MemoryZSwapMax string
+
+		LimitNOFILE, Nice, OOMScoreAdjust int
+		CPUQuota                          string
+
+		StandardOutput, StandardError string
+		SyslogIdentifier, SyslogLevel string
+		SyslogLevelPrefix             string
+
+		PrivateUsers, PrivateMounts, ProtectProc, ProcSubset string
+
+		CgroupV1    bool
+		Unsupported []string
+
+		Env []envVar
+
+		ServiceExtra, Sections string
+	}{
+		Config:          s.Config,
+		Path:            path,
+		ReloadSignal:    s.Option.string(optionReloadSignal, ""),
+		PIDFile:         s.Option.string(optionPIDFile, ""),
+		OneShot:         s.Option.bool(optionOneShot, optionOneShotDefault),
+		RemainAfterExit: s.Option.bool(optionRemainAfterExit, false),
+		Notify:          s.Option.bool(optionNotify, false),
+		IPAccounting:    s.Option.bool(optionIPAccounting, false),
+		WatchdogSec:     seconds(s.Option.duration(optionWatchdogSec, 0)),
+		RuntimeMaxSec:   seconds(s.Option.duration(optionRuntimeMaxSec, 0)),
+
+		After:               s.Option.strings(optionAfter, nil),
+		Before:              s.Option.strings(optionBefore, nil),
+		Conflicts:           s.Option.strings(optionConflicts, nil),
+		WantedBy:            s.Option.strings(optionWantedBy, []string{s.defaultTarget()}),
+		PartOf:              s.Option.strings(optionPartOf, nil),
+		BindsTo:             s.Option.strings(optionBindsTo, nil),
+		DefaultDependencies: s.Option.bool(optionDefaultDependencies, optionDefaultDependenciesDefault),
+
+		ExecStartPost: s.Option.strings(optionExecStartPost, nil),
+
+		RestartSec:         seconds(s.Option.duration(optionRestartSec, 2*time.Minute)),
+		StartLimitInterval: 5,
+
+		BindPaths:         s.Option.strings(optionBindPaths, nil),
+		BindReadOnlyPaths: s.Option.strings(optionBindReadOnlyPaths, nil),
+
+		StandardOutput:   s.Option.string(optionStandardOutput, ""),
+		StandardError:    s.Option.string(optionStandardError, ""),
+		SyslogIdentifier: s.Option.string(optionSyslogIdentifier, ""),
+		SyslogLevel:      s.Option.string(optionSyslogLevel, ""),
+
+		CgroupV1: !cgroupV2(),
+
+		ServiceExtra: withNewline(s.Option.string(optionSystemdUnitExtra, "")),
+		Sections:     withNewline(s.Option.string(optionSystemdUnitSection, "")),
+	}
+	sockets, target, err := s.bundle()
+	if err != nil {
+		return nil, err
+	}
+	if len(sockets) != 0 || len(s.Dependencies) != 0 {
+		to.After = append([]string(nil), to.After...)
+	}
+	for _, socket := range sockets {
+		to.Requires = append(to.Requires, socket.Unit)
+		to.After = append(to.After, socket.Unit)
+	}
+	for _, d := range s.Dependencies {
+		unit := d
+		if !unitName.MatchString(unit) {
+			unit += ".service"
+		}
+		if !unitName.MatchString(unit) {
+			return nil, fmt.Errorf("Dependencies entry is not a unit name such as db.service: %q", d)
+		}
+		to.Requires = append(to.Requires, unit)
+		to.After = append(to.After, unit)
+	}
+	if len(target) != 0 {
+		to.PartOf = append(append([]string(nil), to.PartOf...), target)
+		if _, ok := s.Option[optionWantedBy]; !ok {
+			to.WantedBy = []string{target}
+		}
+	}
+	if s.Option.bool(optionCreateWorkingDirectory, false) {
+		// systemd creates a StateDirectory, which lives in /var/lib, before each start.
+		if dir := filepath.Clean(s.WorkingDirectory); strings.HasPrefix(dir, "/var/lib/") {
+			to.StateDirectory = strings.TrimPrefix(dir, "/var/lib/")
+			to.StateDirectoryMode = fmt.Sprintf("%04o", s.Option.int(optionWorkingDirectoryMode, 0755))
+		}
+	}
+	if !to.DefaultDependencies && len(to.After) == 0 && len(to.Before) == 0 {
+		return nil, fmt.Errorf("Option %s off requires explicit ordering with %s or %s.", optionDefaultDependencies, optionAfter, optionBefore)
+	}
+	if err := validateUnits(optionPartOf, to.PartOf); err != nil {
+		return nil, err
+	}
+	if err := validateUnits(optionBindsTo, to.BindsTo); err != nil {
+		return nil, err
+	}
+	if to.OneShot && to.Notify {
+		return nil, fmt.Errorf("Option %s can't be combined with %s.", optionNotify, optionOneShot)
+	}
+	if err := validateOutput(optionStandardOutput, to.StandardOutput); err != nil {
+		return nil, err
+	}
+	if err := validateOutput(optionStandardError, to.StandardError); err != nil {
+		return nil, err
+	}
+	logDir, err := s.logDir()
+	if err != nil {
+		return nil, err
+	}
+	stdout, stderr, err := s.logPaths(logDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range []struct {
+		key, pathKey, path string
+		output             *string
+	}{
+		{optionStandardOutput, optionStdOutPath, stdout, &to.StandardOutput},
+		{optionStandardError, optionStdErrPath, stderr, &to.StandardError},
+	} {
+		if len(o.path) == 0 {
+			continue
+		}
+		if len(*o.output) != 0 {
+			return nil, fmt.Errorf("Option %s can't be combined with %s or %s.", o.key, optionLogOutput, o.pathKey)
+		}
+		*o.output = "append:" + o.path
+	}
+	if strings.ContainsAny(to.SyslogIdentifier, " \t\n") {
+		return nil, fmt.Errorf("Option %s must not contain white space: %q", optionSyslogIdentifier, to.SyslogIdentifier)
+	}
+	if len(to.SyslogLevel) != 0 && !syslogLevels[to.SyslogLevel] {
+		return nil, fmt.Errorf("Option %s must be emerg, alert, crit, err, warning, notice, info or debug: %q", optionSyslogLevel, to.SyslogLevel)
+	}
+	if _, ok := s.Option[optionSyslogLevelPrefix]; ok {
+		to.SyslogLevelPrefix = "no"
+		if s.Option.bool(optionSyslogLevelPrefix, true) {
+			to.SyslogLevelPrefix = "yes"
+		}
+	}
+	for _, n := range []struct {
+		key, choices string
+		setting      *string
+		boolean      bool
+		values       []string
+	}{
+		{optionPrivateUsers, "a bool, self, identity or full", &to.PrivateUsers, true, []string{"self", "identity", "full"}},
+		{optionPrivateMounts, "a bool", &to.PrivateMounts, true, nil},
+		{optionProtectProc, "noaccess, invisible, ptraceable or default", &to.ProtectProc, false, []string{"noaccess", "invisible", "ptraceable", "default"}},
+		{optionProcSubset, "pid or all", &to.ProcSubset, false, []string{"pid", "all"}},
+	} {
+		var ok bool
+		if *n.setting, ok = namespaceSetting(s.Option, n.key, n.boolean, n.values...); !ok {
+			return nil, fmt.Errorf("Option %s must be %s: %#v", n.key, n.choices, s.Option[n.key])
+		}
+	}
+	if err := validateBindPaths(optionBindPaths, to.BindPaths); err != nil {
+		return nil, err
+	}
+	if err := validateBindPaths(optionBindReadOnlyPaths, to.BindReadOnlyPaths); err != nil {
+		return nil, err
+	}
+	if to.Restart, err = s.restart("always"); err != nil {
+		return nil, err
+	}
+	if to.RuntimeMaxSec > 0 && to.Restart == "no" {
+		return nil, fmt.Errorf("Option %s needs Restart always or on-failure to start the service again.", optionRuntimeMaxSec)
+	}
+	if backoff := s.Option.duration(optionRestartBackoff, 0); backoff > 0 {
+		if _, ok := s.Option[optionRestartSec]; ok {
+			return nil, fmt.Errorf("Option %s can't be combined with %s.", optionRestartSec, optionRestartBackoff)
+		}
+		to.RestartSec = seconds(backoff)
+		to.RestartSteps = maxBackoffSteps
+		to.RestartMaxDelaySec = seconds(backoffDelay(backoff, maxBackoffSteps))
+		// Leave room for the full backoff sequence before hitting the limit.
+		to.StartLimitInterval = seconds(backoffDelay(backoff, maxBackoffSteps+1))
+	}
+	for _, m := range []struct {
+		key  string
+		size *string
+	}{
+		{optionMemoryMax, &to.MemoryMax},
+		{optionMemoryLow, &to.MemoryLow},
+		{optionMemoryHigh, &to.MemoryHigh},
+		{optionMemorySwapMax, &to.MemorySwapMax},
+		{optionMemoryZSwapMax, &to.MemoryZSwapMax},
+	} {
+		if *m.size, err = s.memorySize(m.key); err != nil {
+			return nil, err
+		}
+		if to.CgroupV1 && m.key != optionMemoryMax && len(*m.size) != 0 {
+			to.Unsupported = append(to.Unsupported, m.key)
+			*m.size = ""
+		}
+	}
+	if _, ok := s.Option[optionMemoryLimit]; ok {
+		if len(to.MemoryMax) != 0 {
+			return nil, fmt.Errorf("Option %s can't be combined with %s.", optionMemoryLimit, optionMemoryMax)
+		}
+		if to.MemoryMax, err = s.memorySize(optionMemoryLimit); err != nil {
+			return nil, err
+		}
+	}
+	if to.LimitNOFILE, err = s.limitNOFILE(); err != nil {
+		return nil, err
+	}
+	if to.Nice, to.OOMScoreAdjust, err = s.priorities(); err != nil {
+		return nil, err
+	}
+	if to.Group, err = s.groupName(); err != nil {
+		return nil, err
+	}
+	if to.CPUQuota, err = s.cpuQuota(); err != nil {
+		return nil, err
+	}
+	if to.Env, err = s.environment(); err != nil {
+		return nil, err
+	}
+	w, err := s.restartWindow()
+	if err != nil {
+		return nil, err
+	}
+	if w != nil {
+		to.ExecStartPre = windowCheck(*w)
+	}
+	for _, c := range to.ExecStartPost {
+		if !strings.HasPrefix(strings.TrimLeft(c, "-@+!:"), "/") {
+			return nil, fmt.Errorf("ExecStartPost command must start with an absolute path: %q", c)
+		}
+	}
+
+	var b bytes.Buffer
+	err = s.template().Execute(&b, to)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// unitName matches a systemd unit name with its type suffix.
+var unitName = regexp.MustCompile(`^[a-zA-Z0-9:_.\\@-]+\.(service|socket|device|mount|automount|swap|target|path|timer|slice|scope)$`)
+
+// validateUnits returns an error if one of the units of option name is not a
+// valid unit name.
+func validateUnits(name string, units []string) error {
+	for _, u := range units {
+		if !unitName.MatchString(u) {
+			return fmt.Errorf("Option %s entry is not a unit name such as app.target: %q", name, u)
+		}
+	}
+	return nil
+}
+
+// namespaceSetting returns the unit setting of the option name: yes or no for
+// a bool if boolean, or one of values for a string. It is empty if not set
+// and not ok for any other value.
+func namespaceSetting(kv KeyValue, name string, boolean bool, values ...string) (string, bool) {
+	v, found := kv[name]
+	if !found {
+		return "", true
+	}
+	if b, is := v.(bool); is && boolean {
+		if b {
+			return "yes", true
+		}
+		return "no", true
+	}
+	if str, is := v.(string); is {
+		for _, value := range values {
+			if str == value {
+				return str, true
+			}
+		}
+	}
+	return "", false
+}
+
+// syslogLevels are the levels accepted by SyslogLevel=.
+var syslogLevels = map[string]bool{
+	"emerg": true, "alert": true, "crit": true, "err": true,
+	"warning": true, "notice": true, "info": true, "debug": true,
+}
+
+// validateOutput checks a StandardOutput= or StandardError= setting: journal,
+// null, inherit or file:, append: or truncate: followed by an absolute path.
+func validateOutput(name, output string) error {
+	switch output {
+	case "", "journal", "null", "inherit":
+		return nil
+	}
+	for _, prefix := range []string{"file:", "append:", "truncate:"} {
+		if path := strings.TrimPrefix(output, prefix); path != output && strings.HasPrefix(path, "/") && !strings.ContainsAny(path, " \t\n") {
+			return nil
+		}
+	}
+	return fmt.Errorf("Option %s must be journal, null, inherit or file:, append: or truncate: with an absolute path: %q", name, output)
+}
+
+// validateBindPaths checks entries of the form [-]src[:dst[:options]] with
+// absolute paths, as accepted by BindPaths= and BindReadOnlyPaths=.
+func validateBindPaths(name string, paths []string) error {
+	for _, p := range paths {
+		parts := strings.Split(strings.TrimPrefix(p, "-"), ":")
+		valid := len(parts) <= 3 && !strings.ContainsAny(p, " \t\n")
+		for i, part := range parts {
+			if i < 2 && !strings.HasPrefix(part, "/") {
+				valid = false
+			}
+			if i == 2 && part != "rbind" && part != "norbind" {
+				valid = false
+			}
+		}
+		if !valid {
+			return fmt.Errorf("Option %s entry must be src[:dst[:rbind|norbind]] with absolute paths: %q", name, p)
+		}
+	}
+	return nil
+}
+
+// cpuQuota returns the CPUQuota option as a percentage, given as a string
+// or an int. It returns "" if the option is not set.
+func (s *systemd) cpuQuota() (string, error) {
+	var v string
+	switch quota := s.Option[optionCPUQuota].(type) {
+	case nil:
+		return "", nil
+	case int:
+		v = strconv.Itoa(quota) + "%"
+	case string:
+		v = strings.TrimSpace(quota)
+	}
+	if p, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64); err != nil || !strings.HasSuffix(v, "%") || p <= 0 {
+		return "", fmt.Errorf("Option %s must be a percentage of one CPU such as 50%% or 200%%: %#v", optionCPUQuota, s.Option[optionCPUQuota])
+	}
+	return v, nil
+}
+
+// cgroupV2 reports whether the unified cgroup v2 hierarchy is mounted, as
+// opposed to cgroup v1 or the hybrid layout using v1 for resource control.
+var cgroupV2 = func() bool {
+	_, err := os.Stat("/sys/fs/cgroup/cgroup.controllers")
+	return err == nil
+}
+
+// windowCheck returns a shell command that fails outside of w, with %% and
+// $$ escaped for the unit file.
+func windowCheck(w window) string {
+	return fmt.Sprintf(`/bin/sh -c 't=$$(date +%%%%H%%%%M); %s || { echo "Outside of restart window %v." >&2; exit 1; }'`,
+		strings.Replace(windowCondition(w), "$", "$$", -1), w)
+}
+
+// windowCondition returns a shell condition that is true while the time of
+// day in $t, as printed by date +%H%M, is inside of w.
+func windowCondition(w window) string {
+	op := "&&"
+	if w.start > w.end {
+		op = "||"
+	}
+	return fmt.Sprintf("[ $t -ge %d ] %s [ $t -lt %d ]", w.start/60*100+w.start%60, op, w.end/60*100+w.end%60)
+}
+
+// socketUnit is a socket unit installed for the ListenStream option.
+type socketUnit struct {
+	Unit, FileDescriptorName string
+	ListenStream             []string
+}
+
+// fdName matches a FileDescriptorName, which may not contain colons as they
+// separate the names in LISTEN_FDNAMES.
+var fdName = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,255}$`)
+
+// bundle returns the socket and target units installed with the service,
+// empty if the ListenStream or Target option is not set. Unnamed ListenStream
+// entries share the name.socket unit, each name gets a name-fdname.socket.
+func (s *systemd) bundle() (sockets []socketUnit, target string, err error) {
+	for _, l := range s.Option.strings(optionListenStream, nil) {
+		name, address := "", l
+		if i := strings.Index(l, "="); i >= 0 {
+			name, address = l[:i], l[i+1:]
+			if !fdName.MatchString(name) {
+				return nil, "", fmt.Errorf("Option ListenStream entry name must be letters, digits, _, . or -: %q", l)
+			}
+		}
+		if len(address) == 0 || strings.ContainsAny(address, " \t\n") {
+			return nil, "", fmt.Errorf("Option ListenStream entry must be an address or path: %q", l)
+		}
+		unit := s.Name + ".socket"
+		if len(name) != 0 {
+			unit = s.Name + "-" + name + ".socket"
+		}
+		found := false
+		for i := range sockets {
+			if sockets[i].Unit == unit {
+				sockets[i].ListenStream = append(sockets[i].ListenStream, address)
+				found = true
+			}
+		}
+		if !found {
+			sockets = append(sockets, socketUnit{unit, name, []string{address}})
+		}
+	}
+	target = s.Option.string(optionTarget, "")
+	if len(target) != 0 {
+		if err = validateUnits(optionTarget, []string{target}); err != nil || !strings.HasSuffix(target, ".target") {
+			return nil, "", fmt.Errorf("Option Target must be a target unit such as app.target: %q", target)
+		}
+	}
+	return sockets, target, nil
+}
+
+// socketDefinition renders a socket unit returned by bundle.
+func (s *systemd) socketDefinition(socket socketUnit, target string) ([]byte, error) {
+	var b bytes.Buffer
+	err := template.Must(template.New("").Parse(systemdSocket)).Execute(&b, &struct {
+		*Config
+		socketUnit
+		Target string
+	}{s.Config, socket, target})
+	return b.Bytes(), err
+}
+
+// checkNixOS returns an error for a system service on NixOS, where the units
+// in /etc/systemd/system are generated from configuration.nix and read-only.
+func (s *systemd) checkNixOS() error {
+	if s.userService() || !isNixOS() {
+		return nil
+	}
+	return fmt.Errorf("NixOS generates the read-only /etc/systemd/system from its configuration, declare the service as systemd.services.%s in configuration.nix or set the %s option.", s.Name, optionUserService)
+}
+
 func (s *systemd) Install() error {
+	if err := s.checkNixOS(); err != nil {
+		return err
+	}
 	confPath, err := s.configPath()
 	if err != nil {
 		return err
@@ -65,56 +652,352 @@ func (s *systemd) Install() error {
 	if err == nil {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
+	if s.userService() {
+		if err = userBus(); err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(confPath), 0755); err != nil {
+			return err
+		}
+	}
 
-	f, err := os.Create(confPath)
+	definition, err := s.definition()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	path, err := s.execPath()
+	logrotate, err := s.logrotateConfig()
 	if err != nil {
 		return err
 	}
+	if err = createWorkingDirectory(s.Config); err != nil {
+		return err
+	}
+	sockets, target, err := s.bundle()
+	if err != nil {
+		return err
+	}
+	units := []string{s.Name + ".service"}
+	contents := [][]byte{definition}
+	for _, socket := range sockets {
+		b, err := s.socketDefinition(socket, target)
+		if err != nil {
+			return err
+		}
+		units = append(units, socket.Unit)
+		contents = append(contents, b)
+	}
+	if len(target) != 0 {
+		if _, err := os.Stat(s.unitPath(target)); os.IsNotExist(err) {
+			units = append(units, target)
+			contents = append(contents, []byte(strings.Replace(systemdTarget, "multi-user.target", s.defaultTarget(), 1)))
+		}
+	}
 
-	var to = &struct {
-		*Config
-		Path string
-		ReloadSignal string
-		PIDFile string
-	}{
-		s.Config,
-		path,
-		s.Option.string(optionReloadSignal, ""),
-		s.Option.string(optionPIDFile, ""),
+	// Write and enable all units or none of them.
+	var written []string
+	rollback := func(err error, enabled bool) error {
+		if enabled {
+			s.runSystemctl(s.commandTimeout(), append([]string{"disable"}, written...)...)
+		}
+		for _, unit := range written {
+			os.Remove(s.unitPath(unit))
+		}
+		return err
+	}
+	for i, unit := range units {
+		if _, err := os.Stat(s.unitPath(unit)); err == nil {
+			return rollback(fmt.Errorf("Init already exists: %s", s.unitPath(unit)), false)
+		}
+		if err := ioutil.WriteFile(s.unitPath(unit), contents[i], 0644); err != nil {
+			return rollback(err, false)
+		}
+		written = append(written, unit)
+	}
+	paths := make([]string, len(written))
+	for i, unit := range written {
+		paths[i] = s.unitPath(unit)
+	}
+	if err := restoreContext(s.Config, paths...); err != nil {
+		return rollback(err, false)
+	}
+	if len(target) != 0 && units[len(units)-1] != target {
+		// A target that already existed is enabled too, but left alone
+		// on rollback as other services use it.
+		units = append(units, target)
 	}
 
-	err = s.template().Execute(f, to)
+	err = s.runSystemctl(s.commandTimeout(), append([]string{"enable"}, units...)...)
 	if err != nil {
-		return err
+		return rollback(err, true)
 	}
+	err = s.runSystemctl(s.commandTimeout(), "daemon-reload")
+	if err != nil {
+		return rollback(err, true)
+	}
+	if err = installAppArmor(s.Config); err != nil {
+		return rollback(err, true)
+	}
+	if logrotate != nil {
+		if err = ioutil.WriteFile(logrotatePath(s.Name), logrotate, 0644); err != nil {
+			removeAppArmor(s.Config)
+			return rollback(err, true)
+		}
+	}
+	s.notifyChecksum(definition)
+	return nil
+}
 
-	err = run("systemctl", "enable", s.Name+".service")
+// logrotatePath returns the logrotate configuration of the LogRotate option.
+func logrotatePath(name string) string {
+	return "/etc/logrotate.d/" + name
+}
+
+// logrotateConfig returns the logrotate configuration of the LogRotate
+// option, or nil without it. The output systemd appends to is copied and
+// truncated, as only systemd could reopen it. The LogRotatePaths are moved
+// and the program is sent the signal Run reopens the logs on.
+func (s *systemd) logrotateConfig() ([]byte, error) {
+	if !s.Option.bool(optionLogRotate, false) {
+		return nil, nil
+	}
+	if s.userService() {
+		return nil, fmt.Errorf("Option %s is not supported for user services.", optionLogRotate)
+	}
+	logDir, err := s.logDir()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return run("systemctl", "daemon-reload")
+	stdout, stderr, err := s.logPaths(logDir)
+	if err != nil {
+		return nil, err
+	}
+	paths := s.Option.strings(optionLogRotatePaths, nil)
+	for _, p := range paths {
+		if !filepath.IsAbs(p) || strings.ContainsAny(p, "\n\"'`$\\") {
+			return nil, fmt.Errorf("Option %s entry must be an absolute path without quotes or $: %q", optionLogRotatePaths, p)
+		}
+	}
+	var output []string
+	for _, p := range []string{stdout, stderr} {
+		if len(p) != 0 && (len(output) == 0 || output[0] != p) {
+			output = append(output, p)
+		}
+	}
+	if len(output) == 0 && len(paths) == 0 {
+		return nil, fmt.Errorf("Option %s needs LogOutput, StdOutPath, StdErrPath or %s.", optionLogRotate, optionLogRotatePaths)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# logrotate configuration of the %s service, written by Install.\n", s.Name)
+	for _, files := range []struct {
+		paths []string
+		extra string
+	}{
+		{output, "    copytruncate\n"},
+		{paths, fmt.Sprintf("    sharedscripts\n    postrotate\n        systemctl kill --kill-who=main --signal=%d %s.service\n    endscript\n", s.reopenSignal(), s.Name)},
+	} {
+		if len(files.paths) == 0 {
+			continue
+		}
+		for _, p := range files.paths {
+			fmt.Fprintf(&b, "%q ", p)
+		}
+		b.WriteString("{\n    weekly\n    rotate 4\n    compress\n    delaycompress\n    missingok\n    notifempty\n" + files.extra + "}\n")
+	}
+	return b.Bytes(), nil
 }
 
-func (s *systemd) Uninstall() error {
-	err := run("systemctl", "disable", s.Name+".service")
+// reopenSignal returns the number of the signal Run reopens the logs on.
+func (c *Config) reopenSignal() int {
+	for sig, action := range c.signalMap(nil) {
+		if s, ok := sig.(syscall.Signal); ok && action == ActionReopenLogs {
+			return int(s)
+		}
+	}
+	return int(syscall.SIGUSR1)
+}
+
+func (s *systemd) Preflight() error {
+	cp, err := s.configPath()
 	if err != nil {
+		return preflight([]string{"systemctl"}, nil, strings.TrimSuffix(err.Error(), "."))
+	}
+	tools := installTools(s.Config, "systemctl")
+	if err = s.checkNixOS(); err != nil {
+		return preflight(tools, nil, strings.TrimSuffix(err.Error(), "."))
+	}
+	if s.userService() {
+		if err = userBus(); err != nil {
+			return preflight(tools, []string{cp}, strings.TrimSuffix(err.Error(), "."))
+		}
+	}
+	return preflight(tools, []string{cp})
+}
+
+func (s *systemd) Uninstall() error {
+	if err := s.checkNixOS(); err != nil {
 		return err
 	}
 	cp, err := s.configPath()
 	if err != nil {
 		return err
 	}
-	if err := os.Remove(cp); err != nil {
+	if _, err = os.Stat(cp); os.IsNotExist(err) {
+		return ErrServiceIsNotInstalled
+	}
+	if err = stopBeforeUninstall(s, s.Config); err != nil {
 		return err
 	}
-	return nil
+	sockets, target, err := s.bundle()
+	if err != nil {
+		return err
+	}
+	units := []string{s.Name + ".service"}
+	for _, socket := range sockets {
+		units = append(units, socket.Unit)
+	}
+	err = s.runSystemctl(s.commandTimeout(), append([]string{"disable"}, units...)...)
+	if err != nil {
+		return err
+	}
+	if len(target) != 0 {
+		// Keep the target while other services still use it.
+		if members, _ := ioutil.ReadDir(s.unitPath(target) + ".wants"); len(members) == 0 {
+			err = s.runSystemctl(s.commandTimeout(), "disable", target)
+			if err != nil {
+				return err
+			}
+			units = append(units, target)
+		}
+	}
+	for _, unit := range units {
+		if _, err := remove(s.unitPath(unit)); err != nil {
+			return err
+		}
+	}
+	if err = removeAppArmor(s.Config); err != nil {
+		return err
+	}
+	if s.Option.bool(optionLogRotate, false) {
+		if _, err = remove(logrotatePath(s.Name)); err != nil {
+			return err
+		}
+	}
+	return s.runSystemctl(s.commandTimeout(), "daemon-reload")
+}
+
+func (s *systemd) Diff() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return diffFile(cp, s.definition)
 }
+
+func (s *systemd) Render() (string, error) {
+	return renderDefinition(s.definition)
+}
+
+func (s *systemd) WaitFor(ctx context.Context, desired Status) error {
+	return waitFor(ctx, s, desired)
+}
+
+func (s *systemd) Health() (HealthStatus, error) {
+	return health(s, s.Config)
+}
+
+func (s *systemd) SelfTest(ctx context.Context) error {
+	return selfTest(ctx, s, s.Config)
+}
+
+func (s *systemd) Reconcile(desired ReconcileSpec) (bool, error) {
+	return reconcile(s, desired)
+}
+
+func (s *systemd) Reinstall() error {
+	return reinstall(s)
+}
+
+func (s *systemd) Describe() ([]byte, error) {
+	return describe(s, s.Config)
+}
+
+func (s *systemd) AppliedOptions() ([]string, error) {
+	return appliedOptions(s.Config, func(c *Config) ([]byte, error) {
+		return (&systemd{Config: c}).definition()
+	})
+}
+
+// RunOnce runs the executable as a transient unit named after the service
+// with a "-once" suffix, which systemd collects once it exits.
+func (s *systemd) RunOnce(timeout time.Duration) (int, error) {
+	if timeout <= 0 {
+		return -1, errRunOnceTimeout
+	}
+	path, err := s.execPath()
+	if err != nil {
+		return -1, err
+	}
+	env, err := s.environment()
+	if err != nil {
+		return -1, err
+	}
+	args := []string{"--wait", "--collect", "--unit=" + s.Name + "-once",
+		"--property=RuntimeMaxSec=" + strconv.Itoa(seconds(timeout))}
+	if len(s.UserName) != 0 {
+		args = append(args, "--uid="+s.UserName)
+	}
+	group, err := s.groupName()
+	if err != nil {
+		return -1, err
+	}
+	if len(group) != 0 {
+		args = append(args, "--gid="+group)
+	}
+	if len(s.WorkingDirectory) != 0 {
+		args = append(args, "--property=WorkingDirectory="+s.WorkingDirectory)
+	}
+	for _, e := range env {
+		args = append(args, "--setenv="+e.Name+"="+e.Value)
+	}
+	// systemd-run addresses the user manager with --user as systemctl does.
+	if args, err = s.systemctl(args...); err != nil {
+		return -1, err
+	}
+	args = append(append(args, "--", path), s.Arguments...)
+
+	// systemd enforces the timeout, allow for setting up and collecting the unit.
+	out, err := runWithOutputTimeout(timeout+s.commandTimeout(), "systemd-run", args...)
+	if strings.Contains(string(out), "Finished with result: timeout") {
+		return -1, &timeoutError{path, timeout}
+	}
+	return exitCode(err)
+}
+
+func (s *systemd) PathDrift() (installed, current string, drifted bool, err error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", "", false, err
+	}
+	b, err := ioutil.ReadFile(cp)
+	if os.IsNotExist(err) {
+		return "", "", false, ErrServiceIsNotInstalled
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+	// ExecStart has the path escaped by cmdEscape.
+	return pathDrift(s.Config, cmdUnescaper.Replace(recordedPath(b, " ", "ExecStart=")))
+}
+
+func (s *systemd) DefinitionChecksum() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return fileChecksum(cp)
+}
+
 func (s *systemd) Logger(errs chan<- error) (Logger, error) {
 	if system.Interactive() {
 		return ConsoleLogger, nil
@@ -122,56 +1005,238 @@ func (s *systemd) Logger(errs chan<- error) (Logger, error) {
 	return s.SystemLogger(errs)
 }
 func (s *systemd) SystemLogger(errs chan<- error) (Logger, error) {
+	if address := s.Option.string(optionLogSocket, ""); len(address) != 0 {
+		return newSocketLogger(s.Name, address, errs), nil
+	}
 	return newSysLogger(s.Name, errs)
 }
 
-func (s *systemd) Run() (err error) {
-	err = s.i.Start(s)
+func (s *systemd) Run() error {
+	// systemd enforces RuntimeMaxSec itself.
+	return serve(s, s.i, s.Config, defaultSignalMap, 0)
+}
+
+func (s *systemd) Start() error {
+	if err := verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	args, err := s.systemctl("start", s.Name+".service")
 	if err != nil {
 		return err
 	}
+	return runStart(s.Config, "systemctl", args...)
+}
 
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
+func (s *systemd) Stop() error {
+	return s.runSystemctl(defaultCommandTimeout, "stop", s.Name+".service")
+}
+func (s *systemd) Status() error {
+	args, err := s.systemctl("status", s.Name+".service")
+	if err != nil {
+		return err
+	}
+	return checkStatus("systemctl", args, "active (running)", "not-found")
+}
 
-	return s.i.Stop(s)
+func (s *systemd) Installed() (bool, error) {
+	args, err := s.systemctl("cat", s.Name+".service")
+	if err != nil {
+		return false, err
+	}
+	return commandSucceeds(s.commandTimeout(), "systemctl", args...)
 }
 
-func (s *systemd) Start() error {
-	return run("systemctl", "start", s.Name+".service")
+// SetStartType enables or disables the service and its sockets. A disabled
+// unit can still be started, so StartDisabled is StartManual.
+func (s *systemd) SetStartType(startType StartType) error {
+	if err := s.checkNixOS(); err != nil {
+		return err
+	}
+	if err := checkStartType(s, startType); err != nil {
+		return err
+	}
+	sockets, _, err := s.bundle()
+	if err != nil {
+		return err
+	}
+	units := []string{s.Name + ".service"}
+	for _, socket := range sockets {
+		units = append(units, socket.Unit)
+	}
+	command := "disable"
+	if startType == StartAutomatic {
+		command = "enable"
+	}
+	return s.runSystemctl(s.commandTimeout(), append([]string{command}, units...)...)
 }
 
-func (s *systemd) Stop() error {
-	return run("systemctl", "stop", s.Name+".service")
+// show returns the requested properties of the unit as reported by systemctl.
+func (s *systemd) show(properties ...string) (map[string]string, error) {
+	args := []string{"show", s.Name + ".service"}
+	for _, p := range properties {
+		args = append(args, "-p", p)
+	}
+	args, err := s.systemctl(args...)
+	if err != nil {
+		return nil, err
+	}
+	out, err := runWithOutput("systemctl", args...)
+	if err != nil {
+		return nil, fmt.Errorf("\"systemctl\" failed: %v, %s", err, out)
+	}
+	values := make(map[string]string, len(properties))
+	for _, line := range strings.Split(string(out), "\n") {
+		if i := strings.Index(line, "="); i > 0 {
+			values[line[:i]] = line[i+1:]
+		}
+	}
+	return values, nil
 }
-func (s *systemd) Status() error {
-	return checkStatus("systemctl", []string{"status", s.Name + ".service"}, "active (running)", "not-found")
+
+func (s *systemd) NetworkStats() (in, out uint64, err error) {
+	values, err := s.show("IPIngressBytes", "IPEgressBytes")
+	if err != nil {
+		return 0, 0, err
+	}
+	in, err = strconv.ParseUint(values["IPIngressBytes"], 10, 64)
+	if err == nil {
+		out, err = strconv.ParseUint(values["IPEgressBytes"], 10, 64)
+	}
+	// Without IPAccounting systemd reports "[no data]" or the maximum value.
+	if err != nil || in == math.MaxUint64 || out == math.MaxUint64 {
+		return 0, 0, fmt.Errorf("No network statistics for %s, is IPAccounting enabled?", s.Name)
+	}
+	return in, out, nil
+}
+
+func (s *systemd) ResourceUsage() (ResourceUsage, error) {
+	if err := s.Status(); err != nil {
+		return ResourceUsage{}, err
+	}
+	values, err := s.show("MainPID", "CPUUsageNSec", "MemoryCurrent")
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	usage := ResourceUsage{OpenFiles: -1}
+	if pid, _ := strconv.Atoi(values["MainPID"]); pid > 0 {
+		if usage, err = procUsage(pid); err != nil {
+			return ResourceUsage{}, err
+		}
+	}
+	// Without CPUAccounting or MemoryAccounting systemd reports "[not set]"
+	// or the maximum value, the main process and its children are used then.
+	if n, err := strconv.ParseUint(values["CPUUsageNSec"], 10, 64); err == nil && n != math.MaxUint64 {
+		usage.CPUTime = time.Duration(n)
+	}
+	if n, err := strconv.ParseUint(values["MemoryCurrent"], 10, 64); err == nil && n != math.MaxUint64 {
+		usage.Memory = n
+	}
+	return usage, nil
+}
+
+// PID returns the MainPID of the unit, which is 0 for a oneshot unit that
+// remains active after its process exited.
+func (s *systemd) PID() (int, error) {
+	if err := s.Status(); err != nil {
+		return 0, err
+	}
+	values, err := s.show("MainPID")
+	if err != nil {
+		return 0, err
+	}
+	pid, _ := strconv.Atoi(values["MainPID"])
+	if pid <= 0 {
+		return 0, fmt.Errorf("Unit %s.service has no main process: %q", s.Name, values["MainPID"])
+	}
+	return pid, nil
 }
 
 func (s *systemd) Restart() error {
-	return run("systemctl", "restart", s.Name+".service")
+	args, err := s.systemctl("restart", s.Name+".service")
+	if err != nil {
+		return err
+	}
+	return runStart(s.Config, "systemctl", args...)
 }
 
+const systemdSocket = `[Unit]
+Description={{.Description}}
+{{if .Target}}PartOf={{.Target}}{{end}}
+
+[Socket]
+{{range .ListenStream}}ListenStream={{.}}
+{{end}}{{if .FileDescriptorName}}FileDescriptorName={{.FileDescriptorName}}
+Service={{.Name}}.service
+{{end}}
+[Install]
+WantedBy={{if .Target}}{{.Target}}{{else}}sockets.target{{end}}
+`
+
+const systemdTarget = `[Unit]
+Description=Group of services, see systemctl list-dependencies
+
+[Install]
+WantedBy=multi-user.target
+`
+
 const systemdScript = `[Unit]
 Description={{.Description}}
-After=syslog.target network.target
-ConditionFileIsExecutable={{.Path}}
+{{if not .DefaultDependencies}}DefaultDependencies=no{{end}}
+After=syslog.target network.target{{range .After}} {{.}}{{end}}
+{{if .Before}}Before={{join .Before " "}}{{end}}
+{{if .Conflicts}}Conflicts={{join .Conflicts " "}}{{end}}
+{{if .PartOf}}PartOf={{join .PartOf " "}}{{end}}
+{{if .BindsTo}}BindsTo={{join .BindsTo " "}}{{end}}
+{{if .Requires}}Requires={{join .Requires " "}}{{end}}
+ConditionFileIsExecutable={{.Path|specifierEscape}}
 
 [Service]
-StartLimitInterval=5
+{{if .OneShot}}Type=oneshot
+{{if .RemainAfterExit}}RemainAfterExit=yes{{end}}{{else if .Notify}}Type=notify{{end}}
+StartLimitInterval={{.StartLimitInterval}}
 StartLimitBurst=10
-ExecStart={{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}
-{{if .ChRoot}}RootDirectory={{.ChRoot|cmd}}{{end}}
-{{if .WorkingDirectory}}WorkingDirectory={{.WorkingDirectory|cmd}}{{end}}
+{{if .ExecStartPre}}ExecStartPre={{.ExecStartPre}}{{end}}
+ExecStart={{.Path|cmdEscape}}{{range .Arguments}} {{.|cmd}}{{end}}
+{{range .ExecStartPost}}ExecStartPost={{.|specifierEscape}}
+{{end}}{{if .ChRoot}}RootDirectory={{.ChRoot|specifierEscape}}{{end}}
+{{if .WorkingDirectory}}WorkingDirectory={{.WorkingDirectory|specifierEscape}}{{end}}
+{{if .StateDirectory}}StateDirectory={{.StateDirectory}}
+StateDirectoryMode={{.StateDirectoryMode}}{{end}}
 {{if .UserName}}User={{.UserName}}{{end}}
-{{if .ReloadSignal}}ExecReload=/bin/kill -{{.ReloadSignal}} "$MAINPID"{{end}}
+{{if .Group}}Group={{.Group}}{{end}}
+{{range .Env}}Environment={{printf "%s=%s" .Name .Value|unitQuote}}
+{{end}}{{if .ReloadSignal}}ExecReload=/bin/kill -{{.ReloadSignal}} "$MAINPID"{{end}}
 {{if .PIDFile}}PIDFile={{.PIDFile|cmd}}{{end}}
-Restart=always
-RestartSec=120
-
+{{if .IPAccounting}}IPAccounting=yes{{end}}
+{{if .WatchdogSec}}WatchdogSec={{.WatchdogSec}}{{end}}
+{{if .RuntimeMaxSec}}RuntimeMaxSec={{.RuntimeMaxSec}}{{end}}
+{{if .StandardOutput}}StandardOutput={{.StandardOutput}}{{end}}
+{{if .StandardError}}StandardError={{.StandardError}}{{end}}
+{{if .SyslogIdentifier}}SyslogIdentifier={{.SyslogIdentifier}}{{end}}
+{{if .SyslogLevel}}SyslogLevel={{.SyslogLevel}}{{end}}
+{{if .SyslogLevelPrefix}}SyslogLevelPrefix={{.SyslogLevelPrefix}}{{end}}
+{{if .PrivateUsers}}PrivateUsers={{.PrivateUsers}}{{end}}
+{{if .PrivateMounts}}PrivateMounts={{.PrivateMounts}}{{end}}
+{{if .ProtectProc}}ProtectProc={{.ProtectProc}}{{end}}
+{{if .ProcSubset}}ProcSubset={{.ProcSubset}}{{end}}
+{{if .BindPaths}}BindPaths={{join .BindPaths " "}}{{end}}
+{{if .BindReadOnlyPaths}}BindReadOnlyPaths={{join .BindReadOnlyPaths " "}}{{end}}
+{{if .MemoryMax}}{{if .CgroupV1}}MemoryLimit{{else}}MemoryMax{{end}}={{.MemoryMax}}{{end}}
+{{if .MemoryLow}}MemoryLow={{.MemoryLow}}{{end}}
+{{if .MemoryHigh}}MemoryHigh={{.MemoryHigh}}{{end}}
+{{if .MemorySwapMax}}MemorySwapMax={{.MemorySwapMax}}{{end}}
+{{if .MemoryZSwapMax}}MemoryZSwapMax={{.MemoryZSwapMax}}{{end}}
+{{range .Unsupported}}# {{.}} left out, cgroup v1 can't honor it.
+{{end}}{{if .LimitNOFILE}}LimitNOFILE={{.LimitNOFILE}}
+{{end}}{{if .Nice}}Nice={{.Nice}}
+{{end}}{{if .OOMScoreAdjust}}OOMScoreAdjust={{.OOMScoreAdjust}}
+{{end}}{{if .CPUQuota}}CPUQuota={{.CPUQuota}}
+{{end}}{{if ne .Restart "no"}}Restart={{.Restart}}
+RestartSec={{.RestartSec}}
+{{if .RestartSteps}}RestartSteps={{.RestartSteps}}
+RestartMaxDelaySec={{.RestartMaxDelaySec}}{{end}}{{end}}
+{{.ServiceExtra}}
 [Install]
-WantedBy=multi-user.target
-`
+WantedBy={{join .WantedBy " "}}
+{{if .Sections}}
+{{.Sections}}{{end}}`
@@ -0,0 +1,1222 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// definitionLines renders the unit for c and returns its non-empty lines.
+func definitionLines(t *testing.T, c *Config) map[string]bool {
+	s, err := newSystemdService(nil, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.(*systemd).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		if len(line) != 0 {
+			lines[line] = true
+		}
+	}
+	return lines
+}
+
+func expectLines(t *testing.T, lines map[string]bool, expected ...string) {
+	for _, line := range expected {
+		if !lines[line] {
+			t.Errorf("missing %q in unit", line)
+		}
+	}
+}
+
+func TestSystemdShutdownFlush(t *testing.T) {
+	lines := definitionLines(t, &Config{
+		Name:       "flush",
+		Executable: "/usr/bin/flush",
+		Option: KeyValue{
+			"OneShot":             true,
+			"RemainAfterExit":     true,
+			"DefaultDependencies": false,
+			"Before":              []string{"shutdown.target"},
+			"Conflicts":           []string{"reboot.target", "shutdown.target"},
+		},
+	})
+	expectLines(t, lines,
+		"DefaultDependencies=no",
+		"Before=shutdown.target",
+		"Conflicts=reboot.target shutdown.target",
+		"Type=oneshot",
+		"RemainAfterExit=yes",
+		"WantedBy=multi-user.target",
+	)
+	if lines["Restart=always"] {
+		t.Error("oneshot unit must not restart")
+	}
+
+	s, _ := newSystemdService(nil, &Config{
+		Name:       "unlock",
+		Executable: "/usr/bin/unlock",
+		Option:     KeyValue{"DefaultDependencies": false},
+	})
+	if _, err := s.(*systemd).definition(); err == nil {
+		t.Error("DefaultDependencies off accepted without ordering")
+	}
+}
+
+func TestSystemdExecStartPost(t *testing.T) {
+	lines := definitionLines(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option: KeyValue{
+			"ExecStartPost": []string{
+				WaitTCPCommand("[::1]:8080", 10*time.Second),
+				WaitHTTPCommand("http://localhost:8080/health?a=1&b=%20", 10*time.Second),
+			},
+		},
+	})
+	expectLines(t, lines,
+		`ExecStartPost=/bin/bash -c 'for i in $(seq 11); do (exec 3<>"/dev/tcp/$1/$2") 2>/dev/null && exit 0; sleep 1; done; exit 1' wait '::1' '8080'`,
+		`ExecStartPost=/usr/bin/curl -sf -o /dev/null --retry 11 --retry-delay 1 --retry-connrefused 'http://localhost:8080/health?a=1&b=%%20'`,
+	)
+
+	s, _ := newSystemdService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"ExecStartPost": []string{"curl localhost"}},
+	})
+	if _, err := s.(*systemd).definition(); err == nil {
+		t.Fatal("expected relative ExecStartPost to fail")
+	}
+}
+
+func TestSystemdRestartWindow(t *testing.T) {
+	lines := definitionLines(t, &Config{
+		Name:       "batch",
+		Executable: "/usr/bin/batch",
+		Option:     KeyValue{"RestartWindow": "22:00-06:30"},
+	})
+	expectLines(t, lines,
+		`ExecStartPre=/bin/sh -c 't=$$(date +%%H%%M); [ $$t -ge 2200 ] || [ $$t -lt 630 ] || { echo "Outside of restart window 22:00-06:30." >&2; exit 1; }'`,
+	)
+}
+
+func TestSystemdPartOf(t *testing.T) {
+	lines := definitionLines(t, &Config{
+		Name:       "app-web",
+		Executable: "/usr/bin/web",
+		Option: KeyValue{
+			"PartOf":  []string{"app.target"},
+			"BindsTo": []string{"app-db.service", "app@1.socket"},
+		},
+	})
+	expectLines(t, lines,
+		"PartOf=app.target",
+		"BindsTo=app-db.service app@1.socket",
+	)
+
+	for _, unit := range []string{"app", "app db.service", "app.unknown"} {
+		s, _ := newSystemdService(nil, &Config{
+			Name:       "app-web",
+			Executable: "/usr/bin/web",
+			Option:     KeyValue{"PartOf": []string{unit}},
+		})
+		if _, err := s.(*systemd).definition(); err == nil {
+			t.Errorf("PartOf %q accepted", unit)
+		}
+	}
+}
+
+func TestSystemdBundle(t *testing.T) {
+	c := &Config{
+		Name:        "app-web",
+		Description: "App web server",
+		Executable:  "/usr/bin/web",
+		Option: KeyValue{
+			"ListenStream": []string{"0.0.0.0:80", "/run/app.sock", "metrics=:9100"},
+			"Target":       "app.target",
+		},
+	}
+	expectLines(t, definitionLines(t, c),
+		"After=syslog.target network.target app-web.socket app-web-metrics.socket",
+		"Requires=app-web.socket app-web-metrics.socket",
+		"PartOf=app.target",
+		"WantedBy=app.target",
+	)
+
+	s, _ := newSystemdService(nil, c)
+	sockets, _, err := s.(*systemd).bundle()
+	if err != nil || len(sockets) != 2 {
+		t.Fatal(sockets, err)
+	}
+	socket, err := s.(*systemd).socketDefinition(sockets[0], "app.target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"\nPartOf=app.target\n", "\nListenStream=0.0.0.0:80\nListenStream=/run/app.sock\n", "\nWantedBy=app.target\n"} {
+		if !strings.Contains(string(socket), line) {
+			t.Errorf("missing %q in socket unit", line)
+		}
+	}
+	if strings.Contains(string(socket), "FileDescriptorName") {
+		t.Error("unnamed socket unit sets FileDescriptorName")
+	}
+	socket, err = s.(*systemd).socketDefinition(sockets[1], "app.target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(socket), "\nListenStream=:9100\nFileDescriptorName=metrics\nService=app-web.service\n") {
+		t.Errorf("unexpected named socket unit:\n%s", socket)
+	}
+
+	c.Option["ListenStream"] = []string{"a:b=:80"}
+	if _, err := s.(*systemd).definition(); err == nil {
+		t.Error("name with a colon accepted")
+	}
+	c.Option["ListenStream"] = []string{"0.0.0.0:80"}
+
+	c.Option["Target"] = "app.service"
+	if _, err := s.(*systemd).definition(); err == nil {
+		t.Error("non target accepted as Target")
+	}
+}
+
+func TestSystemdPassEnv(t *testing.T) {
+	os.Setenv("APP_REGION", `eu "west" 100%`)
+	os.Unsetenv("APP_UNSET")
+	defer os.Unsetenv("APP_REGION")
+
+	lines := definitionLines(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"PassEnv": []string{"APP_REGION", "APP_UNSET"}},
+	})
+	expectLines(t, lines, `Environment="APP_REGION=eu \"west\" 100%%"`)
+	for line := range lines {
+		if strings.Contains(line, "APP_UNSET") {
+			t.Errorf("unset variable in unit: %q", line)
+		}
+	}
+}
+
+func TestSystemdEnvVars(t *testing.T) {
+	c := &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		EnvVars:    map[string]string{"B": "two words", "A": `say "hi"`, "C": "100%"},
+	}
+	s, _ := newSystemdService(nil, c)
+	b, err := s.(*systemd).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `Environment="A=say \"hi\""
+Environment="B=two words"
+Environment="C=100%%"
+`) {
+		t.Errorf("missing sorted Environment in unit:\n%s", b)
+	}
+}
+
+func TestSystemdJournalOutput(t *testing.T) {
+	lines := definitionLines(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option: KeyValue{
+			"StandardOutput":    "journal",
+			"StandardError":     "append:/var/log/web.err",
+			"SyslogIdentifier":  "web-api",
+			"SyslogLevel":       "notice",
+			"SyslogLevelPrefix": false,
+		},
+	})
+	expectLines(t, lines,
+		"StandardOutput=journal",
+		"StandardError=append:/var/log/web.err",
+		"SyslogIdentifier=web-api",
+		"SyslogLevel=notice",
+		"SyslogLevelPrefix=no",
+	)
+
+	for _, option := range []KeyValue{
+		{"StandardOutput": "syslog"},
+		{"StandardError": "file:web.err"},
+		{"SyslogIdentifier": "web api"},
+		{"SyslogLevel": "warn"},
+	} {
+		s, _ := newSystemdService(nil, &Config{Name: "web", Executable: "/usr/bin/web", Option: option})
+		if _, err := s.(*systemd).definition(); err == nil {
+			t.Errorf("%v accepted", option)
+		}
+	}
+}
+
+func TestSystemdMemory(t *testing.T) {
+	defer func(previous func() bool) { cgroupV2 = previous }(cgroupV2)
+	cgroupV2 = func() bool { return true }
+
+	c := &Config{
+		Name:       "edge",
+		Executable: "/usr/bin/edge",
+		Option: KeyValue{
+			"MemoryMax":      "4G",
+			"MemoryLow":      "512M",
+			"MemoryHigh":     "2G",
+			"MemorySwapMax":  0,
+			"MemoryZSwapMax": "10%",
+		},
+	}
+	expectLines(t, definitionLines(t, c),
+		"MemoryMax=4294967296",
+		"MemoryLow=536870912",
+		"MemoryHigh=2147483648",
+		"MemorySwapMax=0",
+		"MemoryZSwapMax=10%",
+	)
+
+	cgroupV2 = func() bool { return false }
+	lines := definitionLines(t, c)
+	expectLines(t, lines,
+		"MemoryLimit=4294967296",
+		"# MemoryLow left out, cgroup v1 can't honor it.",
+		"# MemoryZSwapMax left out, cgroup v1 can't honor it.",
+	)
+	if lines["MemoryHigh=2147483648"] || lines["MemoryMax=4294967296"] {
+		t.Error("cgroup v2 directive on cgroup v1")
+	}
+
+	for _, size := range []interface{}{"2GB", "-1", "150%", 1.5} {
+		s, _ := newSystemdService(nil, &Config{
+			Name:       "edge",
+			Executable: "/usr/bin/edge",
+			Option:     KeyValue{"MemoryHigh": size},
+		})
+		if _, err := s.(*systemd).definition(); err == nil {
+			t.Errorf("MemoryHigh %v accepted", size)
+		}
+	}
+}
+
+func TestSystemdGroup(t *testing.T) {
+	expectLines(t, definitionLines(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		UserName:   "www",
+		Option:     KeyValue{"GroupName": "www-data"},
+	}), "User=www", "Group=www-data")
+
+	s, _ := newSystemdService(nil, &Config{Name: "web", Executable: "/usr/bin/web", Option: KeyValue{"GroupName": "www\nUser=root"}})
+	if _, err := s.(*systemd).definition(); err == nil {
+		t.Error("invalid group accepted")
+	}
+}
+
+func TestSystemdWorkingDirectory(t *testing.T) {
+	expectLines(t, definitionLines(t, &Config{
+		Name:             "web",
+		Executable:       "/usr/bin/web",
+		WorkingDirectory: "/srv/web",
+	}), `WorkingDirectory=/srv/web`)
+
+	// systemd takes these paths literally apart from % specifiers.
+	expectLines(t, definitionLines(t, &Config{
+		Name:             "web",
+		Executable:       "/usr/bin/web",
+		WorkingDirectory: "/srv/my web/100%",
+		ChRoot:           "/var/my jail",
+	}), `WorkingDirectory=/srv/my web/100%%`, `RootDirectory=/var/my jail`)
+
+	for _, dir := range []string{"srv/web", "./web", "~"} {
+		s, _ := newSystemdService(nil, &Config{Name: "web", Executable: "/usr/bin/web", WorkingDirectory: dir})
+		if _, err := s.(*systemd).definition(); err == nil {
+			t.Errorf("relative WorkingDirectory %q accepted", dir)
+		}
+	}
+}
+
+func TestSystemdNotify(t *testing.T) {
+	expectLines(t, definitionLines(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"Notify": true},
+	}), "Type=notify")
+	for line := range definitionLines(t, &Config{Name: "web", Executable: "/usr/bin/web"}) {
+		if strings.HasPrefix(line, "Type=") {
+			t.Errorf("unexpected %q by default", line)
+		}
+	}
+
+	s, _ := newSystemdService(nil, &Config{Name: "web", Executable: "/usr/bin/web", Option: KeyValue{"Notify": true, "OneShot": true}})
+	if _, err := s.(*systemd).definition(); err == nil {
+		t.Error("Notify accepted with OneShot")
+	}
+}
+
+func TestSystemdLogOutput(t *testing.T) {
+	expectLines(t, definitionLines(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"LogOutput": true, "StdErrPath": "/srv/web/error.log"},
+	}), "StandardOutput=append:/var/log/web.out", "StandardError=append:/srv/web/error.log")
+
+	for _, option := range []KeyValue{
+		{"StdOutPath": "web.log"},
+		{"StdOutPath": "/var/log/$HOME.log"},
+		{"LogOutput": true, "StandardOutput": "journal"},
+	} {
+		s, _ := newSystemdService(nil, &Config{Name: "web", Executable: "/usr/bin/web", Option: option})
+		if _, err := s.(*systemd).definition(); err == nil {
+			t.Errorf("%v accepted", option)
+		}
+	}
+}
+
+func TestSystemdLimits(t *testing.T) {
+	defer func(previous func() bool) { cgroupV2 = previous }(cgroupV2)
+	cgroupV2 = func() bool { return true }
+
+	expectLines(t, definitionLines(t, &Config{
+		Name:       "edge",
+		Executable: "/usr/bin/edge",
+		Option:     KeyValue{"LimitNOFILE": "65536", "MemoryLimit": "1G", "CPUQuota": 150, "Nice": -5, "OOMScoreAdjust": 1000},
+	}),
+		"LimitNOFILE=65536",
+		"MemoryMax=1073741824",
+		"CPUQuota=150%",
+		"Nice=-5",
+		"OOMScoreAdjust=1000",
+	)
+
+	for _, option := range []KeyValue{
+		{"LimitNOFILE": "many"},
+		{"LimitNOFILE": 0},
+		{"CPUQuota": "50"},
+		{"CPUQuota": "-5%"},
+		{"MemoryLimit": "1G", "MemoryMax": "2G"},
+		{"Nice": -21},
+		{"OOMScoreAdjust": "2000"},
+	} {
+		s, _ := newSystemdService(nil, &Config{Name: "edge", Executable: "/usr/bin/edge", Option: option})
+		if _, err := s.(*systemd).definition(); err == nil {
+			t.Errorf("%v accepted", option)
+		}
+	}
+}
+
+func TestSystemdUnitExtra(t *testing.T) {
+	s, _ := newSystemdService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option: KeyValue{
+			"SystemdUnitExtra":   "ProtectSystem=full\nPrivateTmp=yes",
+			"SystemdUnitSection": "[X-Backup]\nPaths=/srv/web\n",
+		},
+	})
+	b, err := s.(*systemd).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := string(b)
+	service, install := strings.Index(unit, "\n[Service]\n"), strings.Index(unit, "\n[Install]\n")
+	extra, section := strings.Index(unit, "\nProtectSystem=full\nPrivateTmp=yes\n"), strings.Index(unit, "\n[X-Backup]\nPaths=/srv/web\n")
+	if service < 0 || extra < service || install < extra || section < install || !strings.HasSuffix(unit, "Paths=/srv/web\n") {
+		t.Errorf("extra directives misplaced:\n%s", unit)
+	}
+}
+
+func TestSystemdAppliedOptions(t *testing.T) {
+	s, _ := newSystemdService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option: KeyValue{
+			"IPAccounting":  true,
+			"KeepAlive":     false,
+			"PIDFile":       "/run/web.pid",
+			"StopKillDelay": "5s",
+		},
+	})
+	applied, err := s.AppliedOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(applied, ",") != "IPAccounting,PIDFile" {
+		t.Fatal("unexpected applied options", applied)
+	}
+}
+
+func TestSystemdBindPaths(t *testing.T) {
+	lines := definitionLines(t, &Config{
+		Name:       "myapp",
+		Executable: "/usr/bin/myapp",
+		Option: KeyValue{
+			"BindReadOnlyPaths": []string{"/etc/myapp"},
+			"BindPaths":         []string{"/var/lib/myapp:/data:norbind"},
+		},
+	})
+	expectLines(t, lines,
+		"BindReadOnlyPaths=/etc/myapp",
+		"BindPaths=/var/lib/myapp:/data:norbind",
+	)
+
+	for _, p := range []string{"etc/myapp", "/etc/myapp:data", "/a:/b:bind", "/my app"} {
+		if err := validateBindPaths("BindPaths", []string{p}); err == nil {
+			t.Errorf("expected %q to be rejected", p)
+		}
+	}
+}
+
+type recordingRunner struct {
+	commands []string
+}
+
+func (r *recordingRunner) Run(timeout time.Duration, command string, arguments ...string) ([]byte, error) {
+	r.commands = append(r.commands, strings.Join(append([]string{command}, arguments...), " "))
+	return nil, nil
+}
+
+func TestSystemdCommands(t *testing.T) {
+	r := &recordingRunner{}
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	Runner = r
+
+	s, _ := newSystemdService(nil, &Config{Name: "web"})
+	s.Start()
+	s.Restart()
+	s.Stop()
+	if strings.Join(r.commands, "; ") != "systemctl start web.service; systemctl restart web.service; systemctl stop web.service" {
+		t.Fatal("unexpected commands", r.commands)
+	}
+}
+
+func TestSystemdSetStartType(t *testing.T) {
+	r := &recordingRunner{}
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	Runner = r
+
+	s, _ := newSystemdService(nil, &Config{Name: "web", Option: KeyValue{"ListenStream": []string{"80"}}})
+	if err := s.SetStartType(StartManual); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetStartType(StartAutomatic); err != nil {
+		t.Fatal(err)
+	}
+	want := "systemctl cat web.service; systemctl disable web.service web.socket; systemctl cat web.service; systemctl enable web.service web.socket"
+	if strings.Join(r.commands, "; ") != want {
+		t.Fatal("unexpected commands", r.commands)
+	}
+}
+
+func TestSystemdLogrotate(t *testing.T) {
+	s := &systemd{Config: &Config{
+		Name:   "web",
+		Option: KeyValue{"LogRotate": true, "LogOutput": true, "LogRotatePaths": []string{"/var/log/web/app.log"}},
+	}}
+	b, err := s.logrotateConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"\n\"/var/log/web.out\" \"/var/log/web.err\" {\n",
+		"\n    copytruncate\n}\n\"/var/log/web/app.log\" {\n",
+		"\n        systemctl kill --kill-who=main --signal=10 web.service\n",
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in:\n%s", line, b)
+		}
+	}
+
+	s.Option = KeyValue{"LogRotate": true, "StdOutPath": "/var/log/web.log", "SignalMap": SignalMap{syscall.SIGHUP: ActionReopenLogs}}
+	if b, err = s.logrotateConfig(); err != nil || !strings.Contains(string(b), "\"/var/log/web.log\" {") || strings.Contains(string(b), "postrotate") {
+		t.Errorf("StdOutPath only %v:\n%s", err, b)
+	}
+	if s.reopenSignal() != int(syscall.SIGHUP) {
+		t.Errorf("reopen signal %d", s.reopenSignal())
+	}
+
+	for _, option := range []KeyValue{
+		{"LogRotate": true},
+		{"LogRotate": true, "LogRotatePaths": []string{"app.log"}},
+		{"LogRotate": true, "LogOutput": true, "UserService": true},
+	} {
+		if _, err := (&systemd{Config: &Config{Name: "web", Option: option}}).logrotateConfig(); err == nil {
+			t.Errorf("%v accepted", option)
+		}
+	}
+}
+
+func TestSystemdNixOS(t *testing.T) {
+	defer func(previous func() bool) { isNixOS = previous }(isNixOS)
+	isNixOS = func() bool { return true }
+
+	s, _ := newSystemdService(nil, &Config{Name: "web", Executable: "/usr/bin/web"})
+	for name, err := range map[string]error{
+		"Install":      s.Install(),
+		"Uninstall":    s.Uninstall(),
+		"SetStartType": s.SetStartType(StartManual),
+		"Preflight":    s.Preflight(),
+	} {
+		if err == nil || !strings.Contains(err.Error(), "systemd.services.web in configuration.nix") {
+			t.Errorf("%s on NixOS: %v", name, err)
+		}
+	}
+	s, _ = newSystemdService(nil, &Config{Name: "web", Option: KeyValue{"UserService": true}})
+	if err := s.(*systemd).checkNixOS(); err != nil {
+		t.Errorf("user service on NixOS: %v", err)
+	}
+}
+
+func TestSystemdRender(t *testing.T) {
+	r := &recordingRunner{}
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	Runner = r
+
+	c := &Config{Name: "web", Executable: "/usr/bin/web", Arguments: []string{"-port", "8080"}}
+	s, _ := newSystemdService(nil, c)
+	rendered, err := s.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rendered, "\nExecStart=/usr/bin/web \"-port\" \"8080\"\n") {
+		t.Errorf("unexpected unit:\n%s", rendered)
+	}
+	if len(r.commands) != 0 {
+		t.Errorf("Render ran %q", r.commands)
+	}
+	if _, err = (&systemd{Config: &Config{Name: "web", Executable: "/usr/bin/web", WorkingDirectory: "srv"}}).Render(); err == nil {
+		t.Error("rendered a relative WorkingDirectory")
+	}
+}
+
+func TestSystemdRestart(t *testing.T) {
+	lines := definitionLines(t, &Config{Name: "web", Executable: "/usr/bin/web"})
+	expectLines(t, lines, "Restart=always", "RestartSec=120")
+
+	lines = definitionLines(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"Restart": "on-failure", "RestartSec": 10 * time.Second},
+	})
+	expectLines(t, lines, "Restart=on-failure", "RestartSec=10")
+
+	lines = definitionLines(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"WatchdogSec": 30 * time.Second},
+	})
+	expectLines(t, lines, "WatchdogSec=30")
+
+	lines = definitionLines(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"RuntimeMaxSec": "24h"},
+	})
+	expectLines(t, lines, "RuntimeMaxSec=86400", "Restart=always")
+
+	lines = definitionLines(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"Restart": "no"},
+	})
+	for line := range lines {
+		if strings.HasPrefix(line, "Restart") {
+			t.Errorf("unexpected %q in unit", line)
+		}
+	}
+
+	for _, option := range []KeyValue{
+		{"Restart": "on-abort"},
+		{"RestartSec": time.Second, "RestartBackoff": 5 * time.Second},
+		{"RuntimeMaxSec": 24 * time.Hour, "Restart": "no"},
+	} {
+		s, _ := newSystemdService(nil, &Config{Name: "web", Executable: "/usr/bin/web", Option: option})
+		if _, err := s.(*systemd).definition(); err == nil {
+			t.Errorf("%v accepted", option)
+		}
+	}
+}
+
+func TestSystemdDependencies(t *testing.T) {
+	lines := definitionLines(t, &Config{
+		Name:         "web",
+		Executable:   "/usr/bin/web",
+		Dependencies: []string{"postgresql", "redis@main.service"},
+		Option:       KeyValue{"After": []string{"local-fs.target"}},
+	})
+	expectLines(t, lines,
+		"After=syslog.target network.target local-fs.target postgresql.service redis@main.service",
+		"Requires=postgresql.service redis@main.service",
+	)
+
+	s, _ := newSystemdService(nil, &Config{Name: "web", Executable: "/usr/bin/web", Dependencies: []string{"my db"}})
+	if _, err := s.(*systemd).definition(); err == nil {
+		t.Error("invalid dependency accepted")
+	}
+}
+
+func TestSystemdDescribe(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	Runner = &recordingRunner{}
+
+	s, _ := newSystemdService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		UserName:   "www",
+		Option:     KeyValue{"IPAccounting": true, "RunWait": func() {}},
+	})
+	b, err := s.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d map[string]interface{}
+	if err := json.Unmarshal(b, &d); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"name":           "web",
+		"executable":     "/usr/bin/web",
+		"arguments":      []interface{}{},
+		"userName":       "www",
+		"installed":      true,
+		"status":         "stopped",
+		"health":         "",
+		"appliedOptions": []interface{}{"IPAccounting"},
+	}
+	for key, value := range expected {
+		if !reflect.DeepEqual(d[key], value) {
+			t.Errorf("%s is %v, want %v", key, d[key], value)
+		}
+	}
+}
+
+// statusRunner answers systemctl status with running after a number of calls.
+type statusRunner struct {
+	calls, runningAfter int
+}
+
+func (r *statusRunner) Run(timeout time.Duration, command string, arguments ...string) ([]byte, error) {
+	r.calls++
+	if r.calls > r.runningAfter {
+		return []byte("Active: active (running)"), nil
+	}
+	return []byte("Active: inactive (dead)"), nil
+}
+
+func TestSystemdWaitFor(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &statusRunner{runningAfter: 2}
+	Runner = r
+
+	s, _ := newSystemdService(nil, &Config{Name: "web"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.WaitFor(ctx, StatusRunning); err != nil {
+		t.Fatal(err)
+	}
+	if r.calls != 3 {
+		t.Errorf("polled %d times", r.calls)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := s.WaitFor(ctx, StatusStopped)
+	if err == nil || !strings.Contains(err.Error(), "Service is running, not stopped") {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestDefinitionStable(t *testing.T) {
+	c := &Config{
+		Name:        "web",
+		Description: "Web server",
+		Executable:  "/usr/bin/web",
+		Arguments:   []string{"-port", "80"},
+		Option: KeyValue{
+			"After":          []string{"local-fs.target", "time-sync.target"},
+			"PartOf":         []string{"app.target"},
+			"MemoryLow":      "512M",
+			"MemoryHigh":     "2G",
+			"MemorySwapMax":  "0",
+			"MemoryZSwapMax": "1G",
+			"RestartBackoff": 5 * time.Second,
+			"RestartWindow":  "08:00-20:00",
+			"BindPaths":      []string{"/var/lib/web:/data"},
+			"ExecStartPost":  []string{"/bin/true"},
+			"StopKillDelay":  10 * time.Second,
+			"IPAccounting":   true,
+		},
+	}
+	sd, _ := newSystemdService(nil, c)
+	up, _ := newUpstartService(nil, &Config{Name: c.Name, Executable: c.Executable, Arguments: c.Arguments,
+		Option: KeyValue{"StopKillDelay": 10 * time.Second, "UpstartExpect": "fork"}})
+	for name, definition := range map[string]func() ([]byte, error){
+		"systemd": sd.(*systemd).definition,
+		"upstart": up.(*upstart).definition,
+	} {
+		first, err := definition()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for i := 0; i < 20; i++ {
+			again, err := definition()
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if string(again) != string(first) {
+				t.Fatalf("%s definition changed between renders:\n%s", name, diff(string(first), string(again)))
+			}
+		}
+	}
+}
+
+func TestRecordedPath(t *testing.T) {
+	c := &Config{Name: "web", Executable: "/usr/bin/web", Arguments: []string{"-port", "80"}, Option: KeyValue{"OneShot": true}}
+	sd, _ := newSystemdService(nil, c)
+	up, _ := newUpstartService(nil, c)
+	sv, _ := newSystemVService(nil, c)
+	for _, tc := range []struct {
+		definition  func() ([]byte, error)
+		terminators string
+		prefixes    []string
+	}{
+		{sd.(*systemd).definition, " ", []string{"ExecStart="}},
+		{up.(*upstart).definition, " ", []string{"test -x "}},
+		{sv.(*sysv).definition, ` "`, []string{"cmd=", "--exec "}},
+	} {
+		b, err := tc.definition()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path := recordedPath(b, tc.terminators, tc.prefixes...); path != "/usr/bin/web" {
+			t.Errorf("recorded path %q in:\n%s", path, b)
+		}
+	}
+
+	c = &Config{Name: "web", Executable: "/opt/my app/bin/web", Arguments: []string{"-port", "80"}}
+	sd, _ = newSystemdService(nil, c)
+	up, _ = newUpstartService(nil, c)
+	sv, _ = newSystemVService(nil, &Config{Name: "web", Executable: c.Executable, Option: KeyValue{"OneShot": true}})
+	for _, tc := range []struct {
+		definition func() ([]byte, error)
+		line       string
+		recorded   string
+	}{
+		{sd.(*systemd).definition, `ExecStart=/opt/my\x20app/bin/web "-port" "80"`, `/opt/my\x20app/bin/web`},
+		{up.(*upstart).definition, `test -x '/opt/my app/bin/web' ||`, "/opt/my app/bin/web"},
+		{sv.(*sysv).definition, `cmd='/opt/my app/bin/web'`, "/opt/my app/bin/web"},
+	} {
+		b, err := tc.definition()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), tc.line) {
+			t.Errorf("missing %q in:\n%s", tc.line, b)
+		}
+		if path := recordedPath(b, ` "`, "ExecStart=", "test -x ", "cmd="); path != tc.recorded {
+			t.Errorf("recorded path %q in:\n%s", path, b)
+		}
+	}
+	c.Executable = "/usr/bin/web"
+
+	if _, _, drifted, err := pathDrift(c, "/usr/bin/web"); drifted || err != nil {
+		t.Error("same path drifted", err)
+	}
+	if _, current, drifted, err := pathDrift(c, "/opt/web"); !drifted || current != "/usr/bin/web" || err != nil {
+		t.Error("moved path not drifted", current, err)
+	}
+}
+
+func TestSystemdExecutableEscape(t *testing.T) {
+	path := "/opt/100% my app/bin/web"
+	s, _ := newSystemdService(nil, &Config{Name: "web", Executable: path, Arguments: []string{"-v"}})
+	b, err := s.(*systemd).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"\nConditionFileIsExecutable=/opt/100%% my app/bin/web\n",
+		`ExecStart=/opt/100%%\x20my\x20app/bin/web "-v"`,
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in:\n%s", line, b)
+		}
+	}
+	if recorded := cmdUnescaper.Replace(recordedPath(b, " ", "ExecStart=")); recorded != path {
+		t.Errorf("recorded path %q", recorded)
+	}
+
+	s.(*systemd).Executable = `/opt/100% "my" app/bin/web`
+	if _, err := s.(*systemd).definition(); err == nil {
+		t.Error("path with quotes accepted")
+	}
+}
+
+func TestSystemdRunOnce(t *testing.T) {
+	r := &recordingRunner{}
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	Runner = r
+
+	s, _ := newSystemdService(nil, &Config{
+		Name:       "migrate",
+		Executable: "/usr/bin/migrate",
+		Arguments:  []string{"--all"},
+		UserName:   "app",
+	})
+	if code, err := s.RunOnce(90 * time.Second); code != 0 || err != nil {
+		t.Fatalf("exit code %d: %v", code, err)
+	}
+	want := "systemd-run --wait --collect --unit=migrate-once --property=RuntimeMaxSec=90 --uid=app -- /usr/bin/migrate --all"
+	if len(r.commands) != 1 || r.commands[0] != want {
+		t.Errorf("unexpected commands %q", r.commands)
+	}
+}
+
+func TestAppArmorProfile(t *testing.T) {
+	b, err := appArmorProfile(&Config{
+		Name:             "web",
+		Executable:       "/usr/bin/web",
+		WorkingDirectory: "/var/lib/web",
+		Option: KeyValue{
+			"BindPaths":         []string{"/srv/web:/data"},
+			"BindReadOnlyPaths": []string{"-/etc/web"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"\nprofile web \"/usr/bin/web\" {\n",
+		"\n  \"/usr/bin/web\" mr,\n",
+		"\n  \"/var/lib/web{,/,/**}\" rwk,\n",
+		"\n  \"/data{,/,/**}\" rwk,\n",
+		"\n  \"/etc/web{,/,/**}\" r,\n",
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in profile:\n%s", line, b)
+		}
+	}
+
+	defer func(previous func() bool) { appArmorEnabled = previous }(appArmorEnabled)
+	appArmorEnabled = func() bool { return false }
+	if err := installAppArmor(&Config{Name: "web", Option: KeyValue{"GenerateAppArmorProfile": true}}); err != nil {
+		t.Errorf("install without AppArmor: %v", err)
+	}
+}
+
+func TestRestoreContext(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &recordingRunner{}
+	Runner = r
+	defer func(previous func() bool) { seLinuxEnforcing = previous }(seLinuxEnforcing)
+
+	seLinuxEnforcing = func() bool { return true }
+	c := &Config{Name: "web", Option: KeyValue{}}
+	if err := restoreContext(c, "/etc/systemd/system/web.service", "/etc/systemd/system/web.socket"); err != nil {
+		t.Fatal(err)
+	}
+	c.Option["SkipRestorecon"] = true
+	restoreContext(c, "/etc/systemd/system/web.service")
+	seLinuxEnforcing = func() bool { return false }
+	restoreContext(&Config{Name: "web"}, "/etc/systemd/system/web.service")
+	if strings.Join(r.commands, "; ") != "restorecon /etc/systemd/system/web.service /etc/systemd/system/web.socket" {
+		t.Errorf("unexpected commands %q", r.commands)
+	}
+}
+
+func TestSystemdStateDirectory(t *testing.T) {
+	lines := definitionLines(t, &Config{
+		Name:             "web",
+		Executable:       "/usr/bin/web",
+		WorkingDirectory: "/var/lib/web/data",
+		UserName:         "web",
+		Option:           KeyValue{"CreateWorkingDirectory": true, "WorkingDirectoryMode": 0700},
+	})
+	expectLines(t, lines, "StateDirectory=web/data", "StateDirectoryMode=0700")
+}
+
+// unitRunner fakes systemctl for an installed unit, tracking whether it runs.
+type unitRunner struct {
+	running  bool
+	commands []string
+}
+
+func (r *unitRunner) Run(timeout time.Duration, command string, arguments ...string) ([]byte, error) {
+	r.commands = append(r.commands, arguments[0])
+	switch arguments[0] {
+	case "start":
+		r.running = true
+	case "stop":
+		r.running = false
+	case "status":
+		if r.running {
+			return []byte("Active: active (running)"), nil
+		}
+	}
+	return []byte("Active: inactive (dead)"), nil
+}
+
+func TestSystemdSelfTest(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &unitRunner{}
+	Runner = r
+
+	probed := false
+	s, _ := newSystemdService(nil, &Config{
+		Name: "web",
+		Option: KeyValue{"SelfTestProbe": func(ctx context.Context) error {
+			probed = true
+			return nil
+		}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.SelfTest(ctx); err != nil || !probed {
+		t.Fatal(err)
+	}
+	if r.running || strings.Join(r.commands, " ") != "status start status stop" {
+		t.Errorf("not left stopped: %q", r.commands)
+	}
+
+	s.(*systemd).Option["SelfTestProbe"] = func(ctx context.Context) error { return errors.New("HTTP 503") }
+	r.commands = nil
+	err := s.SelfTest(ctx)
+	if err == nil || !strings.Contains(err.Error(), "SelfTestProbe: HTTP 503") || r.running {
+		t.Errorf("failed probe: %v, commands %q", err, r.commands)
+	}
+}
+
+func TestSystemdUserService(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for _, env := range []string{"DBUS_SESSION_BUS_ADDRESS", "XDG_RUNTIME_DIR", "XDG_CONFIG_HOME"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Unsetenv("DBUS_SESSION_BUS_ADDRESS")
+	os.Setenv("XDG_RUNTIME_DIR", tmp)
+	os.Setenv("XDG_CONFIG_HOME", tmp)
+
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &recordingRunner{}
+	Runner = r
+
+	s, _ := newSystemdService(nil, &Config{Name: "web", Option: KeyValue{"UserService": true}})
+	err = s.Start()
+	if err == nil || !strings.Contains(err.Error(), "loginctl enable-linger") || len(r.commands) != 0 {
+		t.Fatalf("start without a user bus: %v, commands %q", err, r.commands)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "bus"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil || strings.Join(r.commands, "; ") != "systemctl --user start web.service" {
+		t.Errorf("start: %v, commands %q", err, r.commands)
+	}
+	if cp, _ := s.(*systemd).configPath(); cp != filepath.Join(tmp, "systemd", "user", "web.service") {
+		t.Errorf("unit installed to %s", cp)
+	}
+	expectLines(t, definitionLines(t, s.(*systemd).Config), "WantedBy=default.target")
+}
+
+func TestStopBeforeUninstall(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &unitRunner{running: true}
+	Runner = r
+
+	s, _ := newSystemdService(nil, &Config{Name: "web", Option: KeyValue{"StopOnUninstall": false}})
+	if err := stopBeforeUninstall(s, s.(*systemd).Config); err != nil || !r.running {
+		t.Errorf("stopped with StopOnUninstall false: %v", err)
+	}
+	delete(s.(*systemd).Option, "StopOnUninstall")
+	if err := stopBeforeUninstall(s, s.(*systemd).Config); err != nil || r.running {
+		t.Errorf("not stopped: %v", err)
+	}
+}
+
+// healthRunner runs the HealthCommand and fakes systemctl with unitRunner.
+type healthRunner struct {
+	unitRunner
+}
+
+func (r *healthRunner) Run(timeout time.Duration, command string, arguments ...string) ([]byte, error) {
+	if command == "systemctl" {
+		return r.unitRunner.Run(timeout, command, arguments...)
+	}
+	return execRunner{}.Run(timeout, command, arguments...)
+}
+
+func TestSystemdHealth(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &healthRunner{}
+	Runner = r
+
+	c := &Config{Name: "web", Option: KeyValue{}}
+	s, _ := newSystemdService(nil, c)
+	if h, err := s.Health(); err != ErrServiceIsNotRunning || h != HealthUnknown {
+		t.Fatal("stopped service", h, err)
+	}
+	r.running = true
+	if h, err := s.Health(); err != nil || h != Healthy {
+		t.Fatal("without HealthCommand", h, err)
+	}
+
+	c.Option["HealthExitCodes"] = HealthExitCodes{1: Degraded, 2: Starting}
+	for code, expected := range map[string]HealthStatus{"0": Healthy, "1": Degraded, "2": Starting, "3": Unhealthy} {
+		c.Option["HealthCommand"] = []string{"/bin/sh", "-c", "exit " + code}
+		if h, err := s.Health(); err != nil || h != expected {
+			t.Errorf("exit %s: %v %v, want %v", code, h, err, expected)
+		}
+	}
+
+	c.Option["HealthCommand"] = []string{"/no/such/probe"}
+	if _, err := s.Health(); err == nil || !strings.Contains(err.Error(), "HealthCommand") {
+		t.Error("missing probe", err)
+	}
+}
+
+// exitRunner records the commands and exits from each with code.
+type exitRunner struct {
+	code     int
+	commands []string
+}
+
+func (r *exitRunner) Run(timeout time.Duration, command string, arguments ...string) ([]byte, error) {
+	r.commands = append(r.commands, strings.Join(append([]string{command}, arguments...), " "))
+	return execRunner{}.Run(timeout, "/bin/sh", "-c", "exit "+strconv.Itoa(r.code))
+}
+
+func TestSystemdInstalled(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &exitRunner{}
+	Runner = r
+
+	s, _ := newSystemdService(nil, &Config{Name: "web"})
+	if installed, err := s.Installed(); !installed || err != nil {
+		t.Error("installed unit", installed, err)
+	}
+	r.code = 1
+	if installed, err := s.Installed(); installed || err != nil {
+		t.Error("missing unit", installed, err)
+	}
+	if r.commands[0] != "systemctl cat web.service" {
+		t.Errorf("unexpected commands %q", r.commands)
+	}
+}
+
+// usageRunner reports the test process as the main process of the unit.
+type usageRunner struct {
+	unitRunner
+	show string
+}
+
+func (r *usageRunner) Run(timeout time.Duration, command string, arguments ...string) ([]byte, error) {
+	if arguments[0] == "show" {
+		return []byte(r.show), nil
+	}
+	return r.unitRunner.Run(timeout, command, arguments...)
+}
+
+func TestSystemdResourceUsage(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &usageRunner{show: "MainPID=" + strconv.Itoa(os.Getpid()) + "\nCPUUsageNSec=1500000000\nMemoryCurrent=[not set]\n"}
+	Runner = r
+
+	s, _ := newSystemdService(nil, &Config{Name: "web"})
+	if _, err := s.ResourceUsage(); err != ErrServiceIsNotRunning {
+		t.Fatal("stopped service", err)
+	}
+	r.running = true
+	usage, err := s.ResourceUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The memory of the test process is used without MemoryAccounting.
+	if usage.CPUTime != 1500*time.Millisecond || usage.Memory == 0 || usage.OpenFiles < 3 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+
+	r.show = "MainPID=0\nCPUUsageNSec=[not set]\nMemoryCurrent=4096\n"
+	if usage, err = s.ResourceUsage(); err != nil || usage != (ResourceUsage{Memory: 4096, OpenFiles: -1}) {
+		t.Errorf("without main process: %+v %v", usage, err)
+	}
+}
+
+func TestProcUsage(t *testing.T) {
+	f, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := procUsage(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	after, err := procUsage(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.OpenFiles != after.OpenFiles+1 || before.Memory == 0 {
+		t.Errorf("unexpected usage %+v, then %+v", before, after)
+	}
+	if _, err = procUsage(0); err == nil {
+		t.Error("usage of pid 0")
+	}
+}
+
+func TestSystemdNamespaces(t *testing.T) {
+	expectLines(t, definitionLines(t, &Config{
+		Name:       "plugin",
+		Executable: "/usr/lib/app/plugin",
+		UserName:   "nobody",
+		Option: KeyValue{
+			"PrivateUsers":  true,
+			"PrivateMounts": true,
+			"ProtectProc":   "invisible",
+			"ProcSubset":    "pid",
+		},
+	}),
+		"PrivateUsers=yes",
+		"PrivateMounts=yes",
+		"ProtectProc=invisible",
+		"ProcSubset=pid",
+	)
+	expectLines(t, definitionLines(t, &Config{
+		Name:       "plugin",
+		Executable: "/usr/lib/app/plugin",
+		Option:     KeyValue{"PrivateUsers": "identity", "PrivateMounts": false},
+	}), "PrivateUsers=identity", "PrivateMounts=no")
+
+	for _, option := range []KeyValue{
+		{"PrivateUsers": "yes"},
+		{"PrivateMounts": "self"},
+		{"ProtectProc": true},
+		{"ProtectProc": "hidden"},
+		{"ProcSubset": "none"},
+	} {
+		s, _ := newSystemdService(nil, &Config{Name: "plugin", Executable: "/usr/lib/app/plugin", Option: option})
+		if _, err := s.(*systemd).definition(); err == nil {
+			t.Errorf("%v accepted", option)
+		}
+	}
+	s, _ := newSystemVService(nil, &Config{Name: "plugin", Executable: "/usr/lib/app/plugin", Option: KeyValue{"ProtectProc": "invisible"}})
+	if _, err := s.(*sysv).definition(); err == nil {
+		t.Error("SystemV accepted ProtectProc")
+	}
+}
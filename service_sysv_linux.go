@@ -5,15 +5,23 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
+	"strings"
 	"text/template"
 	"time"
 )
 
+const (
+	defaultStartLevels = "2345"
+	defaultStopLevels  = "016"
+)
+
 type sysv struct {
 	i Interface
 	*Config
@@ -63,71 +71,407 @@ func (s *sysv) configPath() (cp string, err error) {
 	return
 }
 
+// debian reports whether the service uses the Debian script, which starts
+// the program with start-stop-daemon.
+func (s *sysv) debian() bool {
+	return len(s.Option.string(optionSysVScript, "")) == 0 && !s.Option.bool(optionOneShot, optionOneShotDefault) && isDebianSysv()
+}
+
 func (s *sysv) template() (*template.Template, error) {
+	if custom := s.Option.string(optionSysVScript, ""); len(custom) != 0 {
+		t, err := template.New("").Funcs(tf).Parse(custom)
+		if err != nil {
+			return nil, fmt.Errorf("Option %s is not a valid template: %v", optionSysVScript, err)
+		}
+		return t, nil
+	}
+	// The generic script needs neither the Debian nor the Red Hat helpers.
 	script := sysvScript
-	if isDebianSysv() {
+	if s.Option.bool(optionOneShot, optionOneShotDefault) {
+		script = sysvOneShotScript
+	} else if isDebianSysv() {
 		script = sysvDebianScript
 	} else if isRedhatSysv() {
 		script = sysvRedhatScript
-	} else {
-		return nil, errors.New("Not supported system")
 	}
 	return template.Must(template.New("").Funcs(tf).Parse(script)), nil
 }
 
-func (s *sysv) Install() error {
-	confPath, err := s.configPath()
-	if err != nil {
-		return err
+// defaultRequired are the Required-Start and Required-Stop facilities of the
+// init script unless set by option.
+var defaultRequired = []string{"$local_fs", "$remote_fs", "$network", "$syslog"}
+
+// lsbFacilities are the system facilities defined by LSB.
+var lsbFacilities = map[string]bool{
+	"$local_fs": true, "$network": true, "$named": true, "$portmap": true,
+	"$remote_fs": true, "$syslog": true, "$time": true, "$all": true,
+}
+
+// validateFacilities returns an error if an entry of the LSB header option
+// name is neither a known facility, a local $x- facility nor a script name,
+// which the systemd sysv generator would not resolve.
+func validateFacilities(name string, services []string) error {
+	for _, f := range services {
+		if lsbFacilities[f] || strings.HasPrefix(f, "$x-") || scriptName.MatchString(f) {
+			continue
+		}
+		return fmt.Errorf("Option %s entry is not an LSB facility or script name: %q", name, f)
 	}
-	_, err = os.Stat(confPath)
-	if err == nil {
-		return fmt.Errorf("Init already exists: %s", confPath)
+	return nil
+}
+
+// lsbHeader returns the fields of the LSB header of an init script.
+func lsbHeader(script []byte) map[string]string {
+	header := make(map[string]string)
+	in := false
+	for _, line := range strings.Split(string(script), "\n") {
+		switch {
+		case strings.HasPrefix(line, "### BEGIN INIT INFO"):
+			in = true
+		case strings.HasPrefix(line, "### END INIT INFO"):
+			return header
+		case in && strings.HasPrefix(line, "# "):
+			if i := strings.Index(line, ":"); i > 0 {
+				header[strings.TrimSpace(line[2:i])] = strings.TrimSpace(line[i+1:])
+			}
+		}
 	}
+	return header
+}
 
-	f, err := os.Create(confPath)
-	if err != nil {
-		return err
+// runLevels returns v without spaces and whether it is a list of runlevels.
+func runLevels(v string) (string, bool) {
+	v = strings.Replace(v, " ", "", -1)
+	return v, len(v) != 0 && strings.Trim(v, "0123456S") == ""
+}
+
+// levels returns the start and stop runlevels from the Default-Start and
+// Default-Stop fields of header, or the SysVStartLevels and SysVStopLevels
+// options if they are missing.
+func (s *sysv) levels(header map[string]string) (start, stop string, err error) {
+	for _, l := range []struct {
+		field, key, def string
+		levels          *string
+	}{
+		{"Default-Start", optionSysVStartLevels, defaultStartLevels, &start},
+		{"Default-Stop", optionSysVStopLevels, defaultStopLevels, &stop},
+	} {
+		if v, ok := runLevels(header[l.field]); ok {
+			*l.levels = v
+			continue
+		}
+		option := s.Option.string(l.key, l.def)
+		v, ok := runLevels(option)
+		if !ok {
+			return "", "", fmt.Errorf("Option %s must be runlevels 0 to 6 or S such as %s: %q", l.key, l.def, option)
+		}
+		*l.levels = v
 	}
-	defer f.Close()
+	return start, stop, nil
+}
+
+// definition renders the init script for the service.
+func (s *sysv) definition() ([]byte, error) {
+	return s.render(nil)
+}
 
+// render renders the init script, taking the dependencies and runlevels from
+// the LSB header fields of an existing script if given.
+func (s *sysv) render(header map[string]string) ([]byte, error) {
+	if err := s.checkSystemdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkLaunchdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkDirectories(); err != nil {
+		return nil, err
+	}
 	path, err := s.execPath()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var to = &struct {
 		*Config
-		Path string
+		Path            string
+		StopKillDelay   int
+		RemainAfterExit bool
+		ExecStartPost   []string
+		Script          string
+		Restart         string
+		RestartSec      int
+		RestartWindow   string
+
+		RequiredStart, RequiredStop, ShouldStart []string
+		DefaultStart, DefaultStop                string
+
+		Env    []envVar
+		Ulimit []string
+		Group  string
+		Nice   int
+
+		StdOut, StdErr string
+
+		ChRootCommand string
 	}{
 		s.Config,
 		path,
+		seconds(s.Option.duration(optionStopKillDelay, 0)),
+		s.Option.bool(optionRemainAfterExit, false),
+		s.Option.strings(optionExecStartPost, nil),
+		"/etc/init.d/" + s.Name,
+		"",
+		seconds(s.Option.duration(optionRestartSec, 2*time.Minute)),
+		"",
+
+		s.Option.strings(optionRequiredStart, defaultRequired),
+		s.Option.strings(optionRequiredStop, defaultRequired),
+		s.Option.strings(optionShouldStart, nil),
+		"", "",
+
+		nil, nil, "", 0,
+
+		"", "",
+
+		"",
+	}
+	for _, h := range []struct {
+		key      string
+		services []string
+	}{
+		{optionRequiredStart, to.RequiredStart},
+		{optionRequiredStop, to.RequiredStop},
+		{optionShouldStart, to.ShouldStart},
+	} {
+		if err := validateFacilities(h.key, h.services); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.validateDependencies(); err != nil {
+		return nil, err
+	}
+	if len(s.Dependencies) != 0 {
+		to.RequiredStart = append(append([]string(nil), to.RequiredStart...), s.Dependencies...)
+		to.RequiredStop = append(append([]string(nil), to.RequiredStop...), s.Dependencies...)
+	}
+	for field, services := range map[string]*[]string{
+		"Required-Start": &to.RequiredStart,
+		"Required-Stop":  &to.RequiredStop,
+		"Should-Start":   &to.ShouldStart,
+	} {
+		if v, ok := header[field]; ok {
+			*services = strings.Fields(v)
+		}
+	}
+	start, stop, err := s.levels(header)
+	if err != nil {
+		return nil, err
+	}
+	if to.Restart, err = s.restart("no"); err != nil {
+		return nil, err
+	}
+	// The respawn loop waits for the window before each start, without it
+	// there is nothing to delay the start in.
+	w, err := s.restartWindow()
+	if err != nil {
+		return nil, err
+	}
+	if w != nil {
+		if to.Restart == "no" {
+			return nil, errors.New("RestartWindow needs Restart on SystemV.")
+		}
+		to.RestartWindow = windowCondition(*w)
+	}
+	to.DefaultStart = strings.Join(strings.Split(start, ""), " ")
+	to.DefaultStop = strings.Join(strings.Split(stop, ""), " ")
+
+	if to.Env, err = s.environment(); err != nil {
+		return nil, err
+	}
+	if to.Ulimit, err = s.ulimitCommands(); err != nil {
+		return nil, err
+	}
+	// The script sets the oom_score_adj of its own shell rather than writing
+	// the one of the program after starting it, which could race with the
+	// respawn loop starting the program.
+	var oomScoreAdjust int
+	if to.Nice, oomScoreAdjust, err = s.priorities(); err != nil {
+		return nil, err
+	}
+	if oomScoreAdjust != 0 {
+		to.Ulimit = append(to.Ulimit, "echo "+strconv.Itoa(oomScoreAdjust)+" > /proc/self/oom_score_adj")
+	}
+	if to.Group, err = s.groupName(); err != nil {
+		return nil, err
+	}
+	if to.StdOut, to.StdErr, err = s.logPaths("/var/log"); err != nil {
+		return nil, err
+	}
+	// Unless start-stop-daemon starts the program itself, the scripts run it
+	// with chroot(8), which switches to the user as the chroot needs root,
+	// and starts it in the new /.
+	if len(s.ChRoot) != 0 && (to.Restart != "no" || !s.debian()) {
+		if len(s.WorkingDirectory) != 0 && len(s.Option.string(optionSysVScript, "")) == 0 {
+			return nil, errors.New("ChRoot can't be combined with WorkingDirectory in this SystemV script.")
+		}
+		to.ChRootCommand = "chroot "
+		if len(s.UserName) != 0 {
+			to.ChRootCommand += "--userspec=" + shellQuote(s.UserName)
+			if len(to.Group) != 0 {
+				to.ChRootCommand += ":" + shellQuote(to.Group)
+			}
+			to.ChRootCommand += " "
+		}
+		to.ChRootCommand += shellQuote(s.ChRoot) + " "
 	}
 
 	template, err := s.template()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = template.Execute(f, to)
+	var b bytes.Buffer
+	err = template.Execute(&b, to)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (s *sysv) Install() error {
+	confPath, err := s.configPath()
 	if err != nil {
 		return err
 	}
+	// Check the template before PreserveLSBHeader touches the old script.
+	if _, err = s.template(); err != nil {
+		return err
+	}
+	var header map[string]string
+	if old, err := ioutil.ReadFile(confPath); err == nil {
+		if !s.Option.bool(optionPreserveLSB, false) {
+			return fmt.Errorf("Init already exists: %s", confPath)
+		}
+		header = lsbHeader(old)
+		if err = ioutil.WriteFile(confPath+".bak", old, 0644); err != nil {
+			return err
+		}
+		// The levels may change, so drop the links of the old script.
+		oldLinks, err := s.rcLinks(header)
+		if err != nil {
+			return err
+		}
+		for _, link := range oldLinks {
+			if _, err = remove(link); err != nil {
+				return err
+			}
+		}
+	}
 
+	definition, err := s.render(header)
+	if err != nil {
+		return err
+	}
+	links, err := s.rcLinks(header)
+	if err != nil {
+		return err
+	}
+	if err = createWorkingDirectory(s.Config); err != nil {
+		return err
+	}
+	err = writeFileSync(confPath, definition, 0755)
+	if err != nil {
+		return err
+	}
 	if err = os.Chmod(confPath, 0755); err != nil {
 		return err
 	}
-	for _, i := range [...]string{"2", "3", "4", "5"} {
-		if err = os.Symlink(confPath, "/etc/rc"+i+".d/S50"+s.Name); err != nil {
-			continue
+	if err = restoreContext(s.Config, confPath); err != nil {
+		os.Remove(confPath)
+		return err
+	}
+	if err = installAppArmor(s.Config); err != nil {
+		os.Remove(confPath)
+		return err
+	}
+	if err = createLinks(confPath, links); err != nil {
+		removeAppArmor(s.Config)
+		os.Remove(confPath)
+		return err
+	}
+	s.notifyChecksum(definition)
+	return nil
+}
+
+// createLinks creates the symlinks links to target. Links that already point
+// at target are kept. If one fails, the links created so far are removed
+// again, so a failed Install leaves no partial runlevels behind.
+func createLinks(target string, links []string) error {
+	var created []string
+	for _, link := range links {
+		err := os.Symlink(target, link)
+		if os.IsExist(err) {
+			if existing, rerr := os.Readlink(link); rerr == nil && existing == target {
+				continue
+			}
 		}
+		if err != nil {
+			for _, c := range created {
+				os.Remove(c)
+			}
+			return err
+		}
+		created = append(created, link)
 	}
-	for _, i := range [...]string{"0", "1", "6"} {
-		if err = os.Symlink(confPath, "/etc/rc"+i+".d/K02"+s.Name); err != nil {
-			continue
+	return nil
+}
+
+// rcLinks lists the runlevel symlinks pointing at the init script for the
+// levels in header, named
+// by the Rc options.
+func (s *sysv) rcLinks(header map[string]string) ([]string, error) {
+	start, stop, err := s.levels(header)
+	if err != nil {
+		return nil, err
+	}
+	width := s.Option.int(optionRcPriorityWidth, 2)
+	if width < 1 || width > 3 {
+		return nil, fmt.Errorf("Option %s must be between 1 and 3: %d", optionRcPriorityWidth, width)
+	}
+	var links []string
+	for _, rc := range []struct {
+		levels, prefixKey, prefix, priorityKey string
+		priority                               int
+	}{
+		{start, optionRcStartPrefix, "S", optionRcStartPriority, 50},
+		{stop, optionRcStopPrefix, "K", optionRcStopPriority, 2},
+	} {
+		prefix := s.Option.string(rc.prefixKey, rc.prefix)
+		if len(prefix) == 0 || strings.ContainsAny(prefix, "/ \t\n0123456789") {
+			return nil, fmt.Errorf("Option %s must be letters such as %s: %q", rc.prefixKey, rc.prefix, prefix)
+		}
+		priority := s.Option.int(rc.priorityKey, rc.priority)
+		if priority < 0 || len(strconv.Itoa(priority)) > width {
+			return nil, fmt.Errorf("Option %s must have at most %d digits: %d", rc.priorityKey, width, priority)
+		}
+		for _, level := range rc.levels {
+			links = append(links, fmt.Sprintf("/etc/rc%c.d/%s%0*d%s", level, prefix, width, priority, s.Name))
 		}
 	}
+	return links, nil
+}
 
-	return nil
+func (s *sysv) Preflight() error {
+	cp, err := s.configPath()
+	if err != nil {
+		return preflight([]string{"service"}, nil, strings.TrimSuffix(err.Error(), "."))
+	}
+	tools := installTools(s.Config, "service")
+	links, err := s.rcLinks(nil)
+	if err != nil {
+		return preflight(tools, []string{cp}, err.Error())
+	}
+	return preflight(tools, append([]string{cp}, links...))
 }
 
 func (s *sysv) Uninstall() error {
@@ -135,12 +479,117 @@ func (s *sysv) Uninstall() error {
 	if err != nil {
 		return err
 	}
-	if err := os.Remove(cp); err != nil {
+	var header map[string]string
+	if b, err := ioutil.ReadFile(cp); err == nil {
+		header = lsbHeader(b)
+		if err = stopBeforeUninstall(s, s.Config); err != nil {
+			return err
+		}
+	}
+	links, err := s.rcLinks(header)
+	if err != nil {
+		return err
+	}
+	installed := false
+	for _, link := range links {
+		found, err := remove(link)
+		if err != nil {
+			return err
+		}
+		installed = installed || found
+	}
+	found, err := remove(cp)
+	if err != nil {
+		return err
+	}
+	if err = removeAppArmor(s.Config); err != nil {
 		return err
 	}
+	if !installed && !found {
+		return ErrServiceIsNotInstalled
+	}
 	return nil
 }
 
+func (s *sysv) Diff() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return diffFile(cp, s.preservedDefinition(cp))
+}
+
+// preservedDefinition returns the definition Install writes over the script
+// at cp, which keeps its LSB header with the PreserveLSBHeader option.
+func (s *sysv) preservedDefinition(cp string) func() ([]byte, error) {
+	if !s.Option.bool(optionPreserveLSB, false) {
+		return s.definition
+	}
+	return func() ([]byte, error) {
+		old, err := ioutil.ReadFile(cp)
+		if err != nil {
+			return nil, err
+		}
+		return s.render(lsbHeader(old))
+	}
+}
+
+func (s *sysv) Render() (string, error) {
+	return renderDefinition(s.definition)
+}
+
+func (s *sysv) WaitFor(ctx context.Context, desired Status) error {
+	return waitFor(ctx, s, desired)
+}
+
+func (s *sysv) Health() (HealthStatus, error) {
+	return health(s, s.Config)
+}
+
+func (s *sysv) SelfTest(ctx context.Context) error {
+	return selfTest(ctx, s, s.Config)
+}
+
+func (s *sysv) Reconcile(desired ReconcileSpec) (bool, error) {
+	return reconcile(s, desired)
+}
+
+func (s *sysv) Reinstall() error {
+	return reinstall(s)
+}
+
+func (s *sysv) Describe() ([]byte, error) {
+	return describe(s, s.Config)
+}
+
+func (s *sysv) AppliedOptions() ([]string, error) {
+	return appliedOptions(s.Config, func(c *Config) ([]byte, error) {
+		return (&sysv{Config: c}).definition()
+	})
+}
+
+func (s *sysv) RunOnce(timeout time.Duration) (int, error) {
+	return runOnce(s.Config, timeout)
+}
+
+func (s *sysv) PathDrift() (installed, current string, drifted bool, err error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", "", false, err
+	}
+	// The Debian script passes the path to start-stop-daemon, the others
+	// keep it in cmd.
+	return filePathDrift(s.Config, cp, ` "`, "cmd=", "--exec ")
+}
+
+func (s *sysv) DefinitionChecksum() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return fileChecksum(cp)
+}
+
 func (s *sysv) Logger(errs chan<- error) (Logger, error) {
 	if system.Interactive() {
 		return ConsoleLogger, nil
@@ -148,26 +597,21 @@ func (s *sysv) Logger(errs chan<- error) (Logger, error) {
 	return s.SystemLogger(errs)
 }
 func (s *sysv) SystemLogger(errs chan<- error) (Logger, error) {
+	if address := s.Option.string(optionLogSocket, ""); len(address) != 0 {
+		return newSocketLogger(s.Name, address, errs), nil
+	}
 	return newSysLogger(s.Name, errs)
 }
 
-func (s *sysv) Run() (err error) {
-	err = s.i.Start(s)
-	if err != nil {
-		return err
-	}
-
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
-
-	return s.i.Stop(s)
+func (s *sysv) Run() error {
+	return serve(s, s.i, s.Config, defaultSignalMap, s.runtimeMax())
 }
 
 func (s *sysv) Start() error {
-	return run("service", s.Name, "start")
+	if err := verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	return runStart(s.Config, "service", s.Name, "start")
 }
 
 func (s *sysv) Stop() error {
@@ -178,13 +622,64 @@ func (s *sysv) Status() error {
 	return checkStatus("service", []string{s.Name, "status"}, "is running", "unrecognized service")
 }
 
-func (s *sysv) Restart() error {
-	err := s.Stop()
+func (s *sysv) Installed() (bool, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	return fileExists(cp)
+}
+
+// SetStartType creates the start links of the runlevels for StartAutomatic
+// and removes them otherwise, keeping the stop links as update-rc.d disable
+// does.
+func (s *sysv) SetStartType(startType StartType) error {
+	if err := checkStartType(s, startType); err != nil {
+		return err
+	}
+	cp, err := s.configPath()
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(cp)
+	if err != nil {
+		return err
+	}
+	header := lsbHeader(b)
+	start, _, err := s.levels(header)
 	if err != nil {
 		return err
 	}
-	time.Sleep(50 * time.Millisecond)
-	return s.Start()
+	links, err := s.rcLinks(header)
+	if err != nil {
+		return err
+	}
+	links = links[:len(start)]
+	if startType == StartAutomatic {
+		return createLinks(cp, links)
+	}
+	for _, link := range links {
+		if _, err = remove(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sysv) ResourceUsage() (ResourceUsage, error) {
+	return pidFileUsage(s, "/var/run/"+s.Name+".pid")
+}
+
+func (s *sysv) PID() (int, error) {
+	return readPIDFile(s, "/var/run/"+s.Name+".pid")
+}
+
+func (s *sysv) NetworkStats() (in, out uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
+
+func (s *sysv) Restart() error {
+	return stopThenStart(s, s.Config)
 }
 
 const sysvScript = `#!/bin/sh
@@ -195,20 +690,24 @@ const sysvScript = `#!/bin/sh
 
 ### BEGIN INIT INFO
 # Provides:          {{.Path}}
-# Required-Start:    $local_fs $remote_fs $network $syslog
-# Required-Stop:     $local_fs $remote_fs $network $syslog
-# Default-Start:     2 3 4 5
-# Default-Stop:      0 1 6
+# Required-Start:    {{join .RequiredStart " "}}
+# Required-Stop:     {{join .RequiredStop " "}}
+{{if .ShouldStart}}# Should-Start:      {{join .ShouldStart " "}}
+{{end}}# Default-Start:     {{.DefaultStart}}
+# Default-Stop:      {{.DefaultStop}}
 # Short-Description: {{.DisplayName}}
 # Description:       {{.Description}}
 ### END INIT INFO
 
-cmd="{{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}"
+{{range .Env}}export {{.Name}}={{.Value|shellQuote}}
+{{end}}{{range .Ulimit}}{{.}}
+{{end}}cmd={{.Path|shellWord}}
+args="{{range .Arguments}} {{.|cmd}}{{end}}"
 
 name="{{.Name}}"
 pid_file="/var/run/$name.pid"
-stdout_log="/var/log/$name.log"
-stderr_log="/var/log/$name.err"
+stdout_log="{{or .StdOut "/var/log/$name.log"}}"
+stderr_log="{{or .StdErr "/var/log/$name.err"}}"
 
 get_pid() {
     cat "$pid_file"
@@ -224,28 +723,38 @@ case "$1" in
             echo "Already started"
         else
             echo "Starting $name"
-            {{if .WorkingDirectory}}cd '{{.WorkingDirectory}}'{{end}}
-            $cmd >> "$stdout_log" 2>> "$stderr_log" &
+            {{if .WorkingDirectory}}cd {{.WorkingDirectory|shellQuote}} || exit 1{{end}}
+            {{if .Nice}}nice -n {{.Nice}} {{end}}{{if ne .Restart "no"}}"{{.Script}}" respawn{{else}}{{.ChRootCommand}}"$cmd" $args{{end}} >> "$stdout_log" 2>> "$stderr_log" &
             echo $! > "$pid_file"
             if ! is_running; then
                 echo "Unable to start, see $stdout_log and $stderr_log"
                 exit 1
             fi
+            {{range .ExecStartPost}}if ! {{.}}; then
+                echo "Post-start command failed"
+                exit 1
+            fi
+            {{end}}
         fi
     ;;
     stop)
         if is_running; then
-            echo -n "Stopping $name.."
+            printf "Stopping %s.." "$name"
             kill $(get_pid)
-            for i in {1..10}
+            for i in $(seq 1 {{or .StopKillDelay 10}})
             do
                 if ! is_running; then
                     break
                 fi
-                echo -n "."
+                printf "."
                 sleep 1
             done
             echo
+            {{if .StopKillDelay}}if is_running; then
+                echo "Not stopped after {{.StopKillDelay}}s, sending SIGKILL"
+                kill -9 $(get_pid)
+                sleep 1
+            fi{{end}}
             if is_running; then
                 echo "Not stopped; may still be shutting down or shutdown may have failed"
                 exit 1
@@ -275,6 +784,80 @@ case "$1" in
             exit 1
         fi
     ;;
+    {{if ne .Restart "no"}}respawn)
+        # Runs the program and again {{.RestartSec}}s after it exited{{if eq .Restart "on-failure"}} with an error{{end}}.
+        trap 'kill $child 2> /dev/null; exit 0' TERM INT
+        while :; do
+            {{if .RestartWindow}}until t=$(date +%H%M); {{.RestartWindow}}; do
+                sleep 60 &
+                wait $!
+            done
+            {{end}}{{.ChRootCommand}}"$cmd" $args &
+            child=$!
+            wait $child
+            status=$?
+            child=
+            {{if eq .Restart "on-failure"}}[ $status -eq 0 ] && exit 0
+            {{end}}sleep {{.RestartSec}} &
+            wait $!
+        done
+    ;;
+    {{end}}*)
+    echo "Usage: $0 {start|stop|restart|status}"
+    exit 1
+    ;;
+esac
+exit 0
+`
+
+// The one-shot script runs the task in the foreground on start. With
+// RemainAfterExit the service reports running until it is stopped.
+const sysvOneShotScript = `#!/bin/sh
+
+### BEGIN INIT INFO
+# Provides:          {{.Path}}
+# Required-Start:    {{join .RequiredStart " "}}
+# Required-Stop:     {{join .RequiredStop " "}}
+{{if .ShouldStart}}# Should-Start:      {{join .ShouldStart " "}}
+{{end}}# Default-Start:     {{.DefaultStart}}
+# Default-Stop:      {{.DefaultStop}}
+# Short-Description: {{.DisplayName}}
+# Description:       {{.Description}}
+### END INIT INFO
+
+{{range .Env}}export {{.Name}}={{.Value|shellQuote}}
+{{end}}{{range .Ulimit}}{{.}}
+{{end}}cmd={{.Path|shellWord}}
+args="{{range .Arguments}} {{.|cmd}}{{end}}"
+
+name="{{.Name}}"
+done_file="/var/run/$name.done"
+
+case "$1" in
+    start)
+        echo "Running $name"
+        {{if .WorkingDirectory}}cd {{.WorkingDirectory|shellQuote}} || exit 1{{end}}
+        if ! {{if .Nice}}nice -n {{.Nice}} {{end}}{{.ChRootCommand}}"$cmd" $args{{if .StdOut}} >> "{{.StdOut}}"{{end}}{{if .StdErr}} 2>> "{{.StdErr}}"{{end}}; then
+            echo "$name failed"
+            exit 1
+        fi
+        {{if .RemainAfterExit}}touch "$done_file"{{end}}
+    ;;
+    stop)
+        rm -f "$done_file"
+    ;;
+    restart)
+        $0 stop
+        $0 start
+    ;;
+    status)
+        if [ -f "$done_file" ]; then
+            echo "$name is running"
+        else
+            echo "$name is stopped"
+            exit 3
+        fi
+    ;;
     *)
     echo "Usage: $0 {start|stop|restart|status}"
     exit 1
@@ -287,15 +870,18 @@ const sysvDebianScript = `#! /bin/bash
 
 ### BEGIN INIT INFO
 # Provides:          {{.Path}}
-# Required-Start:    $local_fs $remote_fs $network $syslog
-# Required-Stop:     $local_fs $remote_fs $network $syslog
-# Default-Start:     2 3 4 5
-# Default-Stop:      0 1 6
+# Required-Start:    {{join .RequiredStart " "}}
+# Required-Stop:     {{join .RequiredStop " "}}
+{{if .ShouldStart}}# Should-Start:      {{join .ShouldStart " "}}
+{{end}}# Default-Start:     {{.DefaultStart}}
+# Default-Stop:      {{.DefaultStop}}
 # Short-Description: {{.DisplayName}}
 # Description:       {{.Description}}
 ### END INIT INFO
 
-DESC="{{.Description}}"
+{{range .Env}}export {{.Name}}={{.Value|shellQuote}}
+{{end}}{{range .Ulimit}}{{.}}
+{{end}}DESC="{{.Description}}"
 USER="{{.UserName}}"
 NAME="{{.Name}}"
 PIDFILE="/var/run/$NAME.pid"
@@ -307,34 +893,47 @@ PIDFILE="/var/run/$NAME.pid"
 . /lib/lsb/init-functions
 
 ## Check to see if we are running as root first.
-if [ "$(id -u)" != "0" ]; then
+if {{if ne .Restart "no"}}[ "$1" != "respawn" ] && {{end}}[ "$(id -u)" != "0" ]; then
     echo "This script must be run as root"
     exit 1
 fi
 
 do_start() {
   start-stop-daemon --start \
-    {{if .ChRoot}}--chroot {{.ChRoot|cmd}}{{end}} \
+    {{if and .ChRoot (not .ChRootCommand)}}--chroot {{.ChRoot|cmd}}{{end}} \
     {{if .WorkingDirectory}}--chdir {{.WorkingDirectory|cmd}}{{end}} \
-    {{if .UserName}} --chuid {{.UserName|cmd}}{{end}} \
+    {{if .ChRootCommand}}{{else if .UserName}} --chuid {{.UserName|cmd}}{{if .Group}}:{{.Group}}{{end}}{{else if .Group}} --group {{.Group}}{{end}} \
+    {{if .Nice}}--nicelevel {{.Nice}}{{end}} \
     --pidfile "$PIDFILE" \
     --background \
     --make-pidfile \
-    --exec {{.Path}} -- {{range .Arguments}} {{.|cmd}}{{end}}
+    {{if or .StdOut .StdErr}}--no-close{{end}} \
+    {{if ne .Restart "no"}}--startas {{.Script}} -- respawn{{else}}--exec {{.Path|shellWord}} -- {{range .Arguments}} {{.|cmd}}{{end}}{{end}}{{if or .StdOut .StdErr}} \
+    >> "{{or .StdOut "/dev/null"}}" 2>> "{{or .StdErr "/dev/null"}}"{{end}}
 }
 
 do_stop() {
   start-stop-daemon --stop \
     {{if .UserName}} --chuid {{.UserName|cmd}}{{end}} \
+    {{if .StopKillDelay}}--retry TERM/{{.StopKillDelay}}{{end}} \
     --pidfile "$PIDFILE" \
     --quiet
+  {{if .StopKillDelay}}retval=$?
+  if [ $retval -eq 2 ]; then
+    log_warning_msg "Not stopped after {{.StopKillDelay}}s, sending SIGKILL"
+    start-stop-daemon --stop --signal KILL --retry 5 --pidfile "$PIDFILE" --quiet
+    retval=$?
+  fi
+  return $retval{{end}}
 }
 
 case "$1" in
   start)
     log_daemon_msg "Starting $DESC"
     do_start
-    log_end_msg $?
+    retval=$?
+    {{range .ExecStartPost}}[ $retval -eq 0 ] && { {{.}} || retval=1; }
+    {{end}}log_end_msg $retval
     ;;
   stop)
     log_daemon_msg "Stopping $DESC"
@@ -348,7 +947,25 @@ case "$1" in
   status)
     status_of_proc -p "$PIDFILE" "$DAEMON" "$DESC"
     ;;
-  *)
+  {{if ne .Restart "no"}}respawn)
+    # Runs the program and again {{.RestartSec}}s after it exited{{if eq .Restart "on-failure"}} with an error{{end}}.
+    trap 'kill $child 2> /dev/null; exit 0' TERM INT
+    while :; do
+      {{if .RestartWindow}}until t=$(date +%H%M); {{.RestartWindow}}; do
+        sleep 60 &
+        wait $!
+      done
+      {{end}}{{.ChRootCommand}}{{.Path|shellWord}}{{range .Arguments}} {{.|cmd}}{{end}} &
+      child=$!
+      wait $child
+      status=$?
+      child=
+      {{if eq .Restart "on-failure"}}[ $status -eq 0 ] && exit 0
+      {{end}}sleep {{.RestartSec}} &
+      wait $!
+    done
+    ;;
+  {{end}}*)
     echo "Usage: sudo service $0 {start|stop|restart|status}" >&2
     exit 1
     ;;
@@ -365,11 +982,13 @@ const sysvRedhatScript = `#!/bin/sh
  
 # Source function library.
 . /etc/rc.d/init.d/functions
-
+{{range .Env}}export {{.Name}}={{.Value|shellQuote}}
+{{end}}{{range .Ulimit}}{{.}}
+{{end}}
 name="{{.Name}}"
 desc="{{.Description}}"
 user="{{.UserName}}"
-cmd={{.Path}}
+cmd={{.Path|shellWord}}
 args="{{range .Arguments}} {{.|cmd}}{{end}}"
 lockfile=/var/lock/subsys/$name
 pidfile=/var/run/$name.pid
@@ -379,19 +998,21 @@ pidfile=/var/run/$name.pid
  
 start() {
     echo -n $"Starting $desc: "
+    {{if .WorkingDirectory}}cd {{.WorkingDirectory|shellQuote}} || return 1{{end}}
     daemon \
-        {{if .UserName}}--user=$user{{end}} \
-        {{if .WorkingDirectory}}--chdir={{.WorkingDirectory|cmd}}{{end}} \
-        "$cmd $args </dev/null >/dev/null 2>/dev/null & echo \$! > $pidfile"
+        {{if and .UserName (not .ChRootCommand)}}--user=$user{{end}} \
+        {{if .Nice}}{{printf "%+d" .Nice}}{{end}} \
+        "{{if ne .Restart "no"}}{{.Script}} respawn{{else}}{{.ChRootCommand}}\"$cmd\" $args{{end}} </dev/null {{if .StdOut}}>>\"{{.StdOut}}\"{{else}}>/dev/null{{end}} {{if .StdErr}}2>>\"{{.StdErr}}\"{{else}}2>/dev/null{{end}} & echo \$! > $pidfile"
     retval=$?
-    [ $retval -eq 0 ] && touch $lockfile
+    {{range .ExecStartPost}}[ $retval -eq 0 ] && { {{.}} || retval=1; }
+    {{end}}[ $retval -eq 0 ] && touch $lockfile
     echo
     return $retval
 }
  
 stop() {
     echo -n $"Stopping $desc: "
-    killproc -p $pidfile $cmd -TERM
+    {{if .StopKillDelay}}killproc -p $pidfile -d {{.StopKillDelay}} "$cmd"{{else}}killproc -p $pidfile "$cmd" -TERM{{end}}
     retval=$?
     [ $retval -eq 0 ] && rm -f $lockfile
     rm -f $pidfile
@@ -406,7 +1027,7 @@ restart() {
  
 reload() {
     echo -n $"Reloading $desc: "
-    killproc -p $pidfile $cmd -HUP
+    killproc -p $pidfile "$cmd" -HUP
     RETVAL=$?
     echo
 }
@@ -416,7 +1037,7 @@ force_reload() {
 }
  
 rh_status() {
-    status -p $pidfile $cmd
+    status -p $pidfile "$cmd"
 }
  
 rh_status_q() {
@@ -448,7 +1069,25 @@ case "$1" in
     condrestart|try-restart)
         rh_status_q || exit 0
         ;;
-    *)
+    {{if ne .Restart "no"}}respawn)
+        # Runs the program and again {{.RestartSec}}s after it exited{{if eq .Restart "on-failure"}} with an error{{end}}.
+        trap 'kill $child 2> /dev/null; exit 0' TERM INT
+        while :; do
+            {{if .RestartWindow}}until t=$(date +%H%M); {{.RestartWindow}}; do
+                sleep 60 &
+                wait $!
+            done
+            {{end}}{{.ChRootCommand}}"$cmd" $args &
+            child=$!
+            wait $child
+            status=$?
+            child=
+            {{if eq .Restart "on-failure"}}[ $status -eq 0 ] && exit 0
+            {{end}}sleep {{.RestartSec}} &
+            wait $!
+        done
+        ;;
+    {{end}}*)
         echo $"Usage: $0 {start|stop|status|restart|condrestart|try-restart|reload|force-reload}"
         exit 2
 esac
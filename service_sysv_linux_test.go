@@ -0,0 +1,522 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSysvLSBHeader(t *testing.T) {
+	// OneShot selects the same script on every distribution.
+	c := &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option: KeyValue{
+			"OneShot":       true,
+			"RequiredStart": []string{"$local_fs", "$network", "postgresql"},
+			"ShouldStart":   []string{"$time", "$x-display-manager"},
+		},
+	}
+	s, _ := newSystemVService(nil, c)
+	b, err := s.(*sysv).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"\n# Required-Start:    $local_fs $network postgresql\n",
+		"\n# Required-Stop:     $local_fs $remote_fs $network $syslog\n",
+		"\n# Should-Start:      $time $x-display-manager\n",
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in script", line)
+		}
+	}
+
+	c.Dependencies = []string{"redis"}
+	if b, err = s.(*sysv).definition(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"\n# Required-Start:    $local_fs $network postgresql redis\n",
+		"\n# Required-Stop:     $local_fs $remote_fs $network $syslog redis\n",
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in script", line)
+		}
+	}
+
+	c.Option["RequiredStop"] = []string{"$netwrk"}
+	if _, err := s.(*sysv).definition(); err == nil {
+		t.Error("unknown facility accepted")
+	}
+}
+
+func TestSysvPassEnv(t *testing.T) {
+	os.Setenv("HTTP_PROXY", "http://proxy:3128/?a='b'")
+	defer os.Unsetenv("HTTP_PROXY")
+
+	s, _ := newSystemVService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"OneShot": true, "PassEnv": []string{"HTTP_PROXY"}},
+	})
+	b, err := s.(*sysv).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `
+export HTTP_PROXY='http://proxy:3128/?a='\''b'\'''
+`) {
+		t.Errorf("missing export in script:\n%s", b)
+	}
+
+	s, _ = newSystemVService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"OneShot": true, "PassEnv": []string{"HTTP-PROXY"}},
+	})
+	if _, err := s.(*sysv).definition(); err == nil {
+		t.Error("invalid variable name accepted")
+	}
+}
+
+func TestSysvEnvVars(t *testing.T) {
+	os.Setenv("HTTP_PROXY", "http://proxy:3128")
+	defer os.Unsetenv("HTTP_PROXY")
+
+	s, _ := newSystemVService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		EnvVars:    map[string]string{"HTTP_PROXY": "", "APP_NAME": `my "app" isn't`, "APP_DEBUG": "1"},
+		Option:     KeyValue{"OneShot": true, "PassEnv": []string{"HTTP_PROXY"}},
+	})
+	b, err := s.(*sysv).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `
+export APP_DEBUG='1'
+export APP_NAME='my "app" isn'\''t'
+export HTTP_PROXY=''
+cmd=`) {
+		t.Errorf("missing sorted exports in script:\n%s", b)
+	}
+
+	s, _ = newSystemVService(nil, &Config{Name: "web", Executable: "/usr/bin/web", EnvVars: map[string]string{"APP NAME": "x"}})
+	if _, err := s.(*sysv).definition(); err == nil {
+		t.Error("invalid variable name accepted")
+	}
+}
+
+func TestSysvLogOutput(t *testing.T) {
+	s, _ := newSystemVService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"OneShot": true, "StdOutPath": "/var/log/web.log"},
+	})
+	b, err := s.(*sysv).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `if ! "$cmd" $args >> "/var/log/web.log"; then`) {
+		t.Errorf("output not redirected:\n%s", b)
+	}
+}
+
+func TestSysvWorkingDirectory(t *testing.T) {
+	c := &Config{
+		Name:             "web",
+		Executable:       "/usr/bin/web",
+		WorkingDirectory: "/srv/web",
+		Option:           KeyValue{"OneShot": true},
+	}
+	s, _ := newSystemVService(nil, c)
+	b, err := s.(*sysv).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "cd '/srv/web' || exit 1") {
+		t.Errorf("missing cd in script:\n%s", b)
+	}
+
+	c.WorkingDirectory = "/srv/web's"
+	for _, test := range []struct {
+		script, line string
+	}{
+		{sysvScript, `cd '/srv/web'\''s' || exit 1`},
+		{sysvRedhatScript, `cd '/srv/web'\''s' || return 1`},
+	} {
+		c.Option = KeyValue{"SysVScript": test.script}
+		b, err := s.(*sysv).definition()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), test.line) {
+			t.Errorf("missing %q in script:\n%s", test.line, b)
+		}
+	}
+
+	c.WorkingDirectory = "srv/web"
+	if _, err = s.(*sysv).definition(); err == nil {
+		t.Error("relative WorkingDirectory accepted")
+	}
+}
+
+func TestSysvScript(t *testing.T) {
+	s, _ := newSystemVService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Arguments:  []string{"-port", "80"},
+		Option: KeyValue{"SysVScript": `#!/bin/sh
+# Provides: {{.Name}}
+exec {{.Path|cmd}}{{range .Arguments}} {{.|cmd}}{{end}}
+`},
+	})
+	b, err := s.(*sysv).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "#!/bin/sh\n# Provides: web\nexec \"/usr/bin/web\" \"-port\" \"80\"\n" {
+		t.Errorf("unexpected script:\n%s", b)
+	}
+
+	s, _ = newSystemVService(nil, &Config{Name: "web", Executable: "/usr/bin/web", Option: KeyValue{"SysVScript": "{{if .Name}}"}})
+	if err := s.Install(); err == nil || !strings.Contains(err.Error(), "SysVScript") {
+		t.Errorf("invalid template: %v", err)
+	}
+}
+
+func TestSysvUlimit(t *testing.T) {
+	s, _ := newSystemVService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"OneShot": true, "LimitNOFILE": 65536, "MemoryLimit": "512M", "CPUQuota": "50%"},
+	})
+	b, err := s.(*sysv).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "\nulimit -n 65536\nulimit -v 524288\ncmd=") {
+		t.Errorf("missing ulimit in script:\n%s", b)
+	}
+}
+
+func TestSysvPriorities(t *testing.T) {
+	for _, test := range []struct {
+		script string
+		lines  []string
+	}{
+		{sysvOneShotScript, []string{"\necho 500 > /proc/self/oom_score_adj\ncmd=", `if ! nice -n 10 "$cmd" $args;`}},
+		{sysvDebianScript, []string{"\n    --nicelevel 10 \\\n"}},
+		{sysvRedhatScript, []string{"\n        +10 \\\n"}},
+	} {
+		s, _ := newSystemVService(nil, &Config{
+			Name:       "batch",
+			Executable: "/usr/bin/batch",
+			Option:     KeyValue{"OneShot": true, "Nice": 10, "OOMScoreAdjust": "500", "SysVScript": test.script},
+		})
+		b, err := s.(*sysv).definition()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range test.lines {
+			if !strings.Contains(string(b), line) {
+				t.Errorf("missing %q in script:\n%s", line, b)
+			}
+		}
+	}
+
+	for _, option := range []KeyValue{
+		{"Nice": 20},
+		{"Nice": "low"},
+		{"Nice": 1.5},
+		{"OOMScoreAdjust": -1001},
+	} {
+		s, _ := newSystemVService(nil, &Config{Name: "batch", Executable: "/usr/bin/batch", Option: option})
+		if _, err := s.(*sysv).definition(); err == nil {
+			t.Errorf("%v accepted", option)
+		}
+	}
+}
+
+func TestSysvChRoot(t *testing.T) {
+	chroot := `chroot --userspec='web':'www' '/var/jail' `
+	for _, test := range []struct {
+		script string
+		lines  []string
+	}{
+		{sysvScript, []string{chroot + `"$cmd" $args &`}},
+		{sysvOneShotScript, []string{`if ! ` + chroot + `"$cmd" $args;`}},
+		{sysvDebianScript, []string{"      " + chroot + "/usr/bin/web &"}},
+		{sysvRedhatScript, []string{"            " + chroot + `"$cmd" $args &`}},
+	} {
+		s, _ := newSystemVService(nil, &Config{
+			Name:       "web",
+			Executable: "/usr/bin/web",
+			UserName:   "web",
+			ChRoot:     "/var/jail",
+			Option:     KeyValue{"Restart": "always", "GroupName": "www", "SysVScript": test.script},
+		})
+		b, err := s.(*sysv).definition()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range test.lines {
+			if !strings.Contains(string(b), line) {
+				t.Errorf("missing %q in script:\n%s", line, b)
+			}
+		}
+		if strings.Contains(string(b), "--chroot") || strings.Contains(string(b), `--chuid "web":`) || strings.Contains(string(b), "--user=") {
+			t.Errorf("start-stop-daemon switches root or user:\n%s", b)
+		}
+	}
+
+	for _, c := range []*Config{
+		{Name: "web", Executable: "/usr/bin/web", ChRoot: "var/jail"},
+		{Name: "web", Executable: "/usr/bin/web", ChRoot: "/var/jail", WorkingDirectory: "/srv", Option: KeyValue{"OneShot": true}},
+	} {
+		s, _ := newSystemVService(nil, c)
+		if _, err := s.(*sysv).definition(); err == nil {
+			t.Errorf("%q %q accepted", c.ChRoot, c.WorkingDirectory)
+		}
+	}
+}
+
+func TestSysvRestartWindow(t *testing.T) {
+	for _, script := range []string{sysvScript, sysvDebianScript, sysvRedhatScript} {
+		s, _ := newSystemVService(nil, &Config{
+			Name:       "batch",
+			Executable: "/usr/bin/batch",
+			Option:     KeyValue{"Restart": "always", "RestartWindow": "22:00-06:30", "SysVScript": script},
+		})
+		b, err := s.(*sysv).definition()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), `until t=$(date +%H%M); [ $t -ge 2200 ] || [ $t -lt 630 ]; do`) {
+			t.Errorf("respawn loop doesn't wait for the window:\n%s", b)
+		}
+	}
+
+	s, _ := newSystemVService(nil, &Config{Name: "batch", Executable: "/usr/bin/batch", Option: KeyValue{"RestartWindow": "22:00-06:30"}})
+	if _, err := s.(*sysv).definition(); err == nil {
+		t.Error("RestartWindow accepted without Restart")
+	}
+}
+
+func TestSysvRcLinks(t *testing.T) {
+	s, _ := newSystemVService(nil, &Config{Name: "web"})
+	links, err := s.(*sysv).rcLinks(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links[0] != "/etc/rc2.d/S50web" || links[len(links)-1] != "/etc/rc6.d/K02web" {
+		t.Errorf("unexpected default links %v", links)
+	}
+
+	s, _ = newSystemVService(nil, &Config{Name: "web", Option: KeyValue{
+		"RcPriorityWidth": 1,
+		"RcStartPriority": 9,
+		"RcStopPriority":  1,
+		"RcStartPrefix":   "start",
+	}})
+	links, err = s.(*sysv).rcLinks(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links[0] != "/etc/rc2.d/start9web" || links[len(links)-1] != "/etc/rc6.d/K1web" {
+		t.Errorf("unexpected links %v", links)
+	}
+
+	for _, option := range []KeyValue{
+		{"RcPriorityWidth": 1, "RcStartPriority": 50},
+		{"RcPriorityWidth": 4},
+		{"RcStopPrefix": "K/"},
+		{"SysVStartLevels": "35x"},
+		{"SysVStopLevels": ""},
+	} {
+		s, _ = newSystemVService(nil, &Config{Name: "web", Option: option})
+		if _, err := s.(*sysv).rcLinks(nil); err == nil {
+			t.Errorf("%v accepted", option)
+		}
+	}
+}
+
+func TestCreateLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "web")
+	existing := filepath.Join(dir, "K02web")
+	if err = os.Symlink(target, existing); err != nil {
+		t.Fatal(err)
+	}
+
+	links := []string{filepath.Join(dir, "S50web"), existing, filepath.Join(dir, "rc9.d", "S50web")}
+	if err = createLinks(target, links); err == nil {
+		t.Fatal("link in a missing directory created")
+	}
+	if _, err = os.Lstat(links[0]); !os.IsNotExist(err) {
+		t.Error("created link left behind", err)
+	}
+	if _, err = os.Lstat(existing); err != nil {
+		t.Error("existing link removed", err)
+	}
+
+	if err = createLinks(target, links[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err = createLinks(filepath.Join(dir, "other"), links[:1]); err == nil {
+		t.Error("link to another script replaced")
+	}
+}
+
+func TestSysvLevels(t *testing.T) {
+	c := &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"OneShot": true, "SysVStartLevels": "3 5", "SysVStopLevels": "0126"},
+	}
+	s, _ := newSystemVService(nil, c)
+	b, err := s.(*sysv).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"\n# Default-Start:     3 5\n",
+		"\n# Default-Stop:      0 1 2 6\n",
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in script", line)
+		}
+	}
+	links, err := s.(*sysv).rcLinks(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(links, " ") != "/etc/rc3.d/S50web /etc/rc5.d/S50web /etc/rc0.d/K02web /etc/rc1.d/K02web /etc/rc2.d/K02web /etc/rc6.d/K02web" {
+		t.Errorf("unexpected links %v", links)
+	}
+
+	// A preserved header wins over the options.
+	links, err = s.(*sysv).rcLinks(map[string]string{"Default-Start": "2 3 4 5"})
+	if err != nil || links[0] != "/etc/rc2.d/S50web" || len(links) != 8 {
+		t.Errorf("unexpected links %v %v", links, err)
+	}
+}
+
+func TestSysvPreserveLSBHeader(t *testing.T) {
+	s, _ := newSystemVService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"OneShot": true},
+	})
+	old, err := s.(*sysv).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := strings.NewReplacer(
+		"# Required-Start:    $local_fs", "# Required-Start:    postgresql $local_fs",
+		"# Default-Start:     2 3 4 5", "# Default-Start:     3 5",
+	).Replace(string(old))
+	header := lsbHeader([]byte(edited))
+	if header["Required-Start"] != "postgresql $local_fs $remote_fs $network $syslog" {
+		t.Errorf("Required-Start parsed as %q", header["Required-Start"])
+	}
+
+	s.(*sysv).Executable = "/opt/web/bin/web"
+	b, err := s.(*sysv).render(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"\n# Required-Start:    postgresql $local_fs $remote_fs $network $syslog\n",
+		"\n# Default-Start:     3 5\n",
+		"/opt/web/bin/web",
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in script", line)
+		}
+	}
+	links, err := s.(*sysv).rcLinks(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(links, " ") != "/etc/rc3.d/S50web /etc/rc5.d/S50web /etc/rc0.d/K02web /etc/rc1.d/K02web /etc/rc6.d/K02web" {
+		t.Errorf("unexpected links %q", links)
+	}
+}
+
+func TestSysvDiffPreserveLSBHeader(t *testing.T) {
+	s, _ := newSystemVService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"OneShot": true, "PreserveLSBHeader": true},
+	})
+	old, err := s.(*sysv).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	installed, err := s.(*sysv).render(lsbHeader([]byte(strings.Replace(string(old),
+		"# Required-Start:    $local_fs", "# Required-Start:    postgresql $local_fs", 1))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(installed)
+	f.Close()
+
+	if d, err := diffFile(f.Name(), s.(*sysv).preservedDefinition(f.Name())); d != "" || err != nil {
+		t.Errorf("preserved header reported as drift: %q %v", d, err)
+	}
+	s.(*sysv).Executable = "/opt/web/bin/web"
+	if d, _ := diffFile(f.Name(), s.(*sysv).preservedDefinition(f.Name())); !strings.Contains(d, "/opt/web/bin/web") {
+		t.Errorf("changed executable not reported: %q", d)
+	}
+}
+
+// bindRunner fails a number of times as if the port were still bound.
+type bindRunner struct {
+	failures, calls int
+}
+
+func (r *bindRunner) Run(timeout time.Duration, command string, arguments ...string) ([]byte, error) {
+	r.calls++
+	if r.calls <= r.failures {
+		return []byte("listen tcp :80: bind: address already in use\n"), errors.New("exit status 1")
+	}
+	return nil, nil
+}
+
+func TestSysvStartRetries(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &bindRunner{failures: 2}
+	Runner = r
+
+	s, _ := newSystemVService(nil, &Config{
+		Name:   "web",
+		Option: KeyValue{"StartRetries": 2, "StartRetryDelay": time.Millisecond},
+	})
+	if err := s.Start(); err != nil || r.calls != 3 {
+		t.Errorf("start after %d calls: %v", r.calls, err)
+	}
+
+	r.failures, r.calls = 5, 0
+	if err := s.Start(); err == nil || r.calls != 3 {
+		t.Errorf("start after %d calls: %v", r.calls, err)
+	}
+}
@@ -5,10 +5,14 @@
 package service
 
 import (
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 const runAsServiceArg = "RunThisAsService"
@@ -87,6 +91,16 @@ func TestInstallRunRestartStopRemove(t *testing.T) {
 	}
 }
 
+func TestDiff(t *testing.T) {
+	if d := diff("a\nb\nc\n", "a\nb\nc\n"); d != "" {
+		t.Fatalf("identical definitions differ: %q", d)
+	}
+	d := diff("a\nb\nc\n", "a\nB\nc\nd\n")
+	if d != "-b\n+B\n+d\n" {
+		t.Fatalf("unexpected diff %q", d)
+	}
+}
+
 func runService() {
 	p := &program{}
 	s, err := New(p, sc)
@@ -111,3 +125,251 @@ func (p *program) run() {
 func (p *program) Stop(s Service) error {
 	return nil
 }
+
+func TestRestartWindow(t *testing.T) {
+	at := func(h, m int) time.Time {
+		return time.Date(2016, 1, 1, h, m, 0, 0, time.Local)
+	}
+	for _, tc := range []struct {
+		window string
+		t      time.Time
+		wait   time.Duration
+	}{
+		{"08:00-20:00", at(12, 0), 0},
+		{"08:00-20:00", at(20, 0), 12 * time.Hour},
+		{"08:00-20:00", at(7, 30), 30 * time.Minute},
+		{"22:00-06:00", at(23, 0), 0},
+		{"22:00-06:00", at(5, 59), 0},
+		{"22:00-06:00", at(6, 0), 16 * time.Hour},
+	} {
+		c := &Config{Option: KeyValue{"RestartWindow": tc.window}}
+		w, err := c.restartWindow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait := w.wait(tc.t); wait != tc.wait {
+			t.Errorf("%s at %s: wait %v, want %v", tc.window, tc.t.Format("15:04"), wait, tc.wait)
+		}
+	}
+	for _, v := range []string{"8-20", "08:00-24:00", "08:00-08:00"} {
+		c := &Config{Option: KeyValue{"RestartWindow": v}}
+		if _, err := c.restartWindow(); err == nil {
+			t.Errorf("%q accepted", v)
+		}
+	}
+}
+
+func TestResolveExecutable(t *testing.T) {
+	path, err := resolveExecutable()
+	if err != nil || !filepath.IsAbs(path) {
+		t.Fatalf("resolved %q: %v", path, err)
+	}
+
+	defer func(previous func() (string, error)) { ResolveExecutable = previous }(ResolveExecutable)
+	ResolveExecutable = func() (string, error) { return "/opt/app/current/app", nil }
+	if path, _ := (&Config{}).execPath(); path != "/opt/app/current/app" {
+		t.Errorf("execPath ignored ResolveExecutable: %q", path)
+	}
+}
+
+// fakeService records the calls Reconcile makes and tracks the state they
+// would leave behind.
+type fakeService struct {
+	Service
+	installed, running bool
+	diff               string
+	calls              []string
+}
+
+func (s *fakeService) Installed() (bool, error) { return s.installed, nil }
+func (s *fakeService) Diff() (string, error)    { return s.diff, nil }
+
+func (s *fakeService) Logger(errs chan<- error) (Logger, error) { return ConsoleLogger, nil }
+
+func (s *fakeService) Status() error {
+	if !s.installed {
+		return ErrServiceIsNotInstalled
+	}
+	if !s.running {
+		return ErrServiceIsNotRunning
+	}
+	return nil
+}
+
+func (s *fakeService) Install() error {
+	s.calls = append(s.calls, "install")
+	s.installed, s.diff = true, ""
+	return nil
+}
+
+func (s *fakeService) Uninstall() error {
+	s.calls = append(s.calls, "uninstall")
+	s.installed, s.running = false, false
+	return nil
+}
+
+func (s *fakeService) Start() error {
+	s.calls = append(s.calls, "start")
+	s.running = true
+	return nil
+}
+
+func (s *fakeService) Stop() error {
+	s.calls = append(s.calls, "stop")
+	s.running = false
+	return nil
+}
+
+func TestCheckStartType(t *testing.T) {
+	s := &fakeService{installed: true}
+	for _, startType := range []StartType{StartAutomatic, StartManual, StartDisabled} {
+		if err := checkStartType(s, startType); err != nil {
+			t.Errorf("%s: %v", startType, err)
+		}
+	}
+	if err := checkStartType(s, "boot"); err == nil {
+		t.Error("boot accepted")
+	}
+	s.installed = false
+	if err := checkStartType(s, StartManual); err != ErrServiceIsNotInstalled {
+		t.Errorf("not installed: %v", err)
+	}
+}
+
+func TestFileLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	l, err := NewFileLogger("web", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var tee StructuredLogger = TeeLogger{l, ConsoleLogger}
+	if err = tee.Infof("first %d", 1); err != nil {
+		t.Fatal(err)
+	}
+	// As logrotate does before the postrotate script.
+	if err = os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tee.(TeeLogger).ReopenLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tee.Log(LevelError, "second", "status", 500); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{path + ".1": " web I: first 1\n", path: " web E: second status=500\n"} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil || !strings.HasSuffix(string(b), want) || strings.Count(string(b), "\n") != 1 {
+			t.Errorf("%s: %q %v, want a line ending in %q", file, b, err, want)
+		}
+	}
+}
+
+func TestFormatFields(t *testing.T) {
+	for _, test := range []struct {
+		kv   []interface{}
+		line string
+	}{
+		{nil, "request failed"},
+		{[]interface{}{"path", "/login", "status", 500}, "request failed path=/login status=500"},
+		{[]interface{}{"err", `open "a b": denied`}, `request failed err="open \"a b\": denied"`},
+		{[]interface{}{"user"}, "request failed user="},
+	} {
+		if line := formatFields("request failed", test.kv); line != test.line {
+			t.Errorf("%v: %q, want %q", test.kv, line, test.line)
+		}
+	}
+	var _ StructuredLogger = ConsoleLogger
+}
+
+func TestReinstall(t *testing.T) {
+	for _, test := range []struct {
+		name               string
+		installed, running bool
+		calls              string
+	}{
+		{"missing", false, false, "install"},
+		{"stopped", true, false, "uninstall install"},
+		{"running", true, true, "uninstall install start"},
+	} {
+		s := &fakeService{installed: test.installed, running: test.running}
+		if err := reinstall(s); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if calls := strings.Join(s.calls, " "); calls != test.calls || !s.installed || s.running != test.running {
+			t.Errorf("%s: calls %q, want %q", test.name, calls, test.calls)
+		}
+	}
+}
+
+// slowStop is a fakeService whose process exits a few Status calls after Stop.
+type slowStop struct {
+	*fakeService
+	polls int
+}
+
+func (s *slowStop) Stop() error {
+	s.calls = append(s.calls, "stop")
+	return nil
+}
+
+func (s *slowStop) Status() error {
+	if s.polls--; s.polls == 0 {
+		s.running = false
+	}
+	return s.fakeService.Status()
+}
+
+func TestStopThenStart(t *testing.T) {
+	s := &slowStop{&fakeService{installed: true, running: true}, 3}
+	if err := stopThenStart(s, &Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if calls := strings.Join(s.calls, " "); calls != "stop start" || !s.running {
+		t.Errorf("calls %q after restart", calls)
+	}
+
+	s = &slowStop{&fakeService{installed: true, running: true}, -1}
+	c := &Config{Option: KeyValue{"RestartStopTimeout": 100 * time.Millisecond}}
+	if err := stopThenStart(s, c); err == nil {
+		t.Error("restarted a service that did not stop")
+	}
+	if calls := strings.Join(s.calls, " "); calls != "stop" {
+		t.Errorf("calls %q after failed restart", calls)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	for _, test := range []struct {
+		name               string
+		installed, running bool
+		diff               string
+		desired            ReconcileSpec
+		calls              string
+		changed            bool
+	}{
+		{"missing", false, false, "", ReconcileSpec{Installed: true, Running: true}, "install start", true},
+		{"unchanged", true, true, "", ReconcileSpec{Installed: true, Running: true}, "", false},
+		{"drifted", true, true, "-old\n+new\n", ReconcileSpec{Installed: true, Running: true}, "uninstall install start", true},
+		{"drifted stopped", true, false, "-old\n+new\n", ReconcileSpec{Installed: true}, "uninstall install", true},
+		{"stop", true, true, "", ReconcileSpec{Installed: true}, "stop", true},
+		{"start", true, false, "", ReconcileSpec{Installed: true, Running: true}, "start", true},
+		{"remove", true, true, "", ReconcileSpec{}, "uninstall", true},
+		{"absent", false, false, "", ReconcileSpec{Running: true}, "", false},
+	} {
+		s := &fakeService{installed: test.installed, running: test.running, diff: test.diff}
+		changed, err := reconcile(s, test.desired)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if calls := strings.Join(s.calls, " "); calls != test.calls || changed != test.changed {
+			t.Errorf("%s: calls %q changed %v, want %q %v", test.name, calls, changed, test.calls, test.changed)
+		}
+	}
+}
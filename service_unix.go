@@ -2,15 +2,28 @@
 // Use of this source code is governed by a zlib-style
 // license that can be found in the LICENSE file.
 
-// +build linux darwin
+// +build linux darwin freebsd aix solaris
 
 package service
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log/syslog"
+	"net"
+	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func newSysLogger(name string, errs chan<- error) (Logger, error) {
@@ -51,19 +64,72 @@ func (s sysLogger) Warningf(format string, a ...interface{}) error {
 func (s sysLogger) Infof(format string, a ...interface{}) error {
 	return s.send(s.Writer.Info(fmt.Sprintf(format, a...)))
 }
+func (s sysLogger) Log(level Level, msg string, kv ...interface{}) error {
+	m := formatFields(msg, kv)
+	switch level {
+	case LevelDebug:
+		return s.send(s.Writer.Debug(m))
+	case LevelWarning:
+		return s.send(s.Writer.Warning(m))
+	case LevelError:
+		return s.send(s.Writer.Err(m))
+	}
+	return s.send(s.Writer.Info(m))
+}
+
+// dialLog connects to the Unix socket a socketLogger writes to.
+func dialLog(address string) (io.WriteCloser, error) {
+	return net.Dial("unix", address)
+}
+
+// killGroupOnCancel runs cmd in its own process group and kills the whole
+// group when its context is done, so processes it forked go with it.
+func killGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
 
 func run(command string, arguments ...string) error {
-	cmd := exec.Command(command, arguments...)
-	out, err := cmd.CombinedOutput()
+	return runTimeout(defaultCommandTimeout, command, arguments...)
+}
+
+// addressInUse matches command output saying a port is still bound.
+var addressInUse = regexp.MustCompile(`(?i)address already in use|EADDRINUSE`)
+
+// runStart runs the command starting the service, retrying it as set by the
+// StartRetries and StartRetryDelay options while the address is in use.
+func runStart(c *Config, command string, arguments ...string) error {
+	retries := c.Option.int(optionStartRetries, 0)
+	delay := c.Option.duration(optionStartRetryDelay, time.Second)
+	for attempt := 0; ; attempt++ {
+		err := run(command, arguments...)
+		if err == nil || attempt >= retries || !addressInUse.MatchString(err.Error()) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func runTimeout(timeout time.Duration, command string, arguments ...string) error {
+	out, err := runWithOutputTimeout(timeout, command, arguments...)
 	if err != nil {
+		if _, is := err.(*timeoutError); is {
+			return err
+		}
 		return fmt.Errorf("%q failed: %v, %s", command, err, out)
 	}
 	return nil
 }
 
 func runWithOutput(command string, arguments ...string) ([]byte, error) {
-	cmd := exec.Command(command, arguments...)
-	return cmd.CombinedOutput()
+	return runWithOutputTimeout(defaultCommandTimeout, command, arguments...)
+}
+
+func runWithOutputTimeout(timeout time.Duration, command string, arguments ...string) ([]byte, error) {
+	return Runner.Run(timeout, command, arguments...)
 }
 
 func checkStatus(command string, arguments []string, running, unrecognized string) error {
@@ -76,3 +142,663 @@ func checkStatus(command string, arguments []string, running, unrecognized strin
 		return ErrServiceIsNotRunning
 	}
 }
+
+// writeFileSync writes data to the named file like ioutil.WriteFile and
+// flushes the file and its directory to storage, so that the tools run next
+// see the file even on slow or networked storage.
+func writeFileSync(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	// Not all file systems can sync a directory, the file is written anyway.
+	dir.Sync()
+	return nil
+}
+
+// fileExists implements Installed for service systems keeping the
+// definition in the file at path.
+func fileExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// commandSucceeds runs the command and reports whether it exited with 0. The
+// error is set only if the command did not run to completion.
+func commandSucceeds(timeout time.Duration, command string, arguments ...string) (bool, error) {
+	_, err := Runner.Run(timeout, command, arguments...)
+	code, err := exitCode(err)
+	return code == 0, err
+}
+
+// preflight implements Preflight for the tools a service system runs and
+// the files Install writes. problems are prerequisites already known to be
+// missing.
+func preflight(tools, files []string, problems ...string) error {
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			problems = append(problems, fmt.Sprintf("%s not found in PATH", tool))
+		}
+	}
+	checked := make(map[string]bool)
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		// Install creates missing directories, so check the closest parent.
+		for dir != filepath.Dir(dir) {
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+		if checked[dir] {
+			continue
+		}
+		checked[dir] = true
+		f, err := ioutil.TempFile(dir, ".preflight")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s is not writable", dir))
+			continue
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Install prerequisites missing: %s.", strings.Join(problems, "; "))
+}
+
+// runOnce implements RunOnce for the service systems without transient
+// jobs by running the executable directly, with the credentials of the
+// UserName if set. On timeout its whole process group is killed.
+func runOnce(c *Config, timeout time.Duration) (int, error) {
+	if timeout <= 0 {
+		return -1, errRunOnceTimeout
+	}
+	path, err := c.execPath()
+	if err != nil {
+		return -1, err
+	}
+	env, err := c.environment()
+	if err != nil {
+		return -1, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, c.Arguments...)
+	cmd.Dir = c.WorkingDirectory
+	for _, e := range env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+	killGroupOnCancel(cmd)
+	cmd.WaitDelay = time.Second
+	if len(c.UserName) != 0 {
+		u, err := user.Lookup(c.UserName)
+		if err != nil {
+			return -1, err
+		}
+		credential, err := userCredential(u)
+		if err != nil {
+			return -1, err
+		}
+		cmd.SysProcAttr.Credential = credential
+		cmd.Env = append([]string{"HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username}, cmd.Env...)
+	}
+	if cmd.Env != nil {
+		cmd.Env = append(os.Environ(), cmd.Env...)
+	}
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return -1, &timeoutError{strings.Join(append([]string{path}, c.Arguments...), " "), timeout}
+	}
+	return exitCode(err)
+}
+
+// userCredential returns the credential to run a process as u, with its
+// supplementary groups.
+func userCredential(u *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groups, err := u.GroupIds()
+	if err != nil {
+		return credential, nil
+	}
+	for _, group := range groups {
+		if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+			credential.Groups = append(credential.Groups, uint32(id))
+		}
+	}
+	return credential, nil
+}
+
+// createWorkingDirectory creates the WorkingDirectory if it is missing and
+// the CreateWorkingDirectory option is set.
+func createWorkingDirectory(c *Config) error {
+	dir := c.WorkingDirectory
+	if len(dir) == 0 || !c.Option.bool(optionCreateWorkingDirectory, false) {
+		return nil
+	}
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("WorkingDirectory must be absolute to be created: %q", dir)
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	mode := os.FileMode(c.Option.int(optionWorkingDirectoryMode, 0755))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Failed to create WorkingDirectory: %v", err)
+	}
+	// MkdirAll applies the umask.
+	if err := os.Chmod(dir, mode); err != nil {
+		return fmt.Errorf("Failed to create WorkingDirectory: %v", err)
+	}
+	owner := c.Option.string(optionWorkingDirectoryOwner, c.UserName)
+	if len(owner) == 0 {
+		return nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return fmt.Errorf("Failed to create WorkingDirectory: %v", err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if err = os.Chown(dir, uid, gid); err != nil {
+		return fmt.Errorf("Failed to create WorkingDirectory: %v", err)
+	}
+	return nil
+}
+
+// filePathDrift implements PathDrift for the definition installed at path,
+// where the executable follows one of prefixes.
+func filePathDrift(c *Config, path, terminators string, prefixes ...string) (string, string, bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", "", false, ErrServiceIsNotInstalled
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+	return pathDrift(c, recordedPath(b, terminators, prefixes...))
+}
+
+// seconds rounds a duration up to whole seconds for use in service definitions.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// remove deletes the named file and reports whether it was present.
+// A missing file is not an error so an interrupted Uninstall can be retried.
+func remove(name string) (bool, error) {
+	err := os.Remove(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, err
+}
+
+// diffFile compares the definition installed at path to the desired one.
+func diffFile(path string, definition func() ([]byte, error)) (string, error) {
+	installed, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrServiceIsNotInstalled
+		}
+		return "", err
+	}
+	desired, err := definition()
+	if err != nil {
+		return "", err
+	}
+	return diff(string(installed), string(desired)), nil
+}
+
+// renderDefinition implements Render with the definition of a service system.
+func renderDefinition(definition func() ([]byte, error)) (string, error) {
+	b, err := definition()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// validateDependencies returns an error if one of the Dependencies is not
+// the name of a service.
+func (c *Config) validateDependencies() error {
+	for _, d := range c.Dependencies {
+		if !scriptName.MatchString(d) {
+			return fmt.Errorf("Dependencies entry is not a service name: %q", d)
+		}
+	}
+	return nil
+}
+
+// scriptName matches the name another init script provides.
+var scriptName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._+-]*$`)
+
+// readPIDFile returns the pid in the pid file path of s, or the Status error
+// if s is not running.
+func readPIDFile(s Service, path string) (int, error) {
+	if err := s.Status(); err != nil {
+		return 0, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("Invalid pid file %s: %q", path, b)
+	}
+	return pid, nil
+}
+
+// psUsage adds up the resource usage of process pid and its children, as
+// listed by ps. lsof counts the open files, which are unknown without it.
+func psUsage(pid int) (ResourceUsage, error) {
+	out, err := runWithOutput("ps", "-A", "-o", "pid=,ppid=,rss=,time=")
+	if err != nil {
+		return ResourceUsage{}, fmt.Errorf("\"ps\" failed: %v, %s", err, out)
+	}
+	type process struct {
+		ppid   int
+		rss    uint64
+		cpu    time.Duration
+		parsed bool
+	}
+	processes := map[int]process{}
+	for _, line := range strings.Split(string(out), "\n") {
+		var p process
+		var id int
+		var cpu string
+		if _, err := fmt.Sscan(line, &id, &p.ppid, &p.rss, &cpu); err != nil {
+			continue
+		}
+		if p.cpu, err = parseCPUTime(cpu); err == nil {
+			p.parsed = true
+			processes[id] = p
+		}
+	}
+	if !processes[pid].parsed {
+		return ResourceUsage{}, fmt.Errorf("No process %d in ps output.", pid)
+	}
+	var usage ResourceUsage
+	var pids []string
+	for tree := []int{pid}; len(tree) > 0; tree = tree[1:] {
+		p := processes[tree[0]]
+		usage.CPUTime += p.cpu
+		usage.Memory += p.rss * 1024
+		pids = append(pids, strconv.Itoa(tree[0]))
+		for id, child := range processes {
+			if child.ppid == tree[0] && id != tree[0] {
+				tree = append(tree, id)
+			}
+		}
+	}
+
+	// lsof lists one f field per file, numbered ones are descriptors.
+	usage.OpenFiles = -1
+	if out, err = runWithOutput("lsof", "-n", "-P", "-F", "f", "-p", strings.Join(pids, ",")); err == nil {
+		usage.OpenFiles = 0
+		for _, line := range strings.Split(string(out), "\n") {
+			if len(line) > 1 && line[0] == 'f' && line[1] >= '0' && line[1] <= '9' {
+				usage.OpenFiles++
+			}
+		}
+	}
+	return usage, nil
+}
+
+// parseCPUTime parses the time column of ps, such as "1:02.50" or
+// "1-02:03:04".
+func parseCPUTime(v string) (time.Duration, error) {
+	var days int
+	if i := strings.Index(v, "-"); i >= 0 {
+		var err error
+		if days, err = strconv.Atoi(v[:i]); err != nil {
+			return 0, err
+		}
+		v = v[i+1:]
+	}
+	var d time.Duration
+	parts := strings.Split(v, ":")
+	for i, part := range parts {
+		if i == len(parts)-1 {
+			seconds, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return 0, err
+			}
+			d = d*60 + time.Duration(seconds*float64(time.Second))
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, err
+		}
+		d = d*60 + time.Duration(n)*time.Second
+	}
+	return time.Duration(days)*24*time.Hour + d, nil
+}
+
+var activated struct {
+	once      sync.Once
+	files     []*os.File
+	listeners map[string][]net.Listener
+	ordered   []net.Listener
+	err       error
+}
+
+// Listeners returns the listening sockets passed by systemd socket activation,
+// keyed by their FileDescriptorName: the fdname of a ListenStream entry, or
+// the name of the socket unit by default. The map is empty if no sockets
+// were passed. The descriptors stay open so ReExec can pass them on.
+func Listeners() (map[string][]net.Listener, error) {
+	activated.once.Do(func() {
+		activated.listeners = make(map[string][]net.Listener)
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < n; i++ {
+			name := "unknown"
+			if i < len(names) && len(names[i]) != 0 {
+				name = names[i]
+			}
+			// Inherited descriptors start at 3. Keep the files referenced,
+			// their finalizers would close the descriptors.
+			f := os.NewFile(uintptr(3+i), name)
+			l, err := net.FileListener(f)
+			if err != nil {
+				activated.err = fmt.Errorf("Socket %s on fd %d is not a listener: %v", name, 3+i, err)
+				return
+			}
+			activated.files = append(activated.files, f)
+			activated.listeners[name] = append(activated.listeners[name], l)
+			activated.ordered = append(activated.ordered, l)
+		}
+	})
+	return activated.listeners, activated.err
+}
+
+// ListenFDs returns the listening sockets passed by systemd socket activation
+// in the order of their descriptors, as sd_listen_fds numbers them from 3. The
+// slice is empty if no sockets were passed, as outside of systemd.
+func ListenFDs() ([]net.Listener, error) {
+	if _, err := Listeners(); err != nil {
+		return nil, err
+	}
+	return append([]net.Listener{}, activated.ordered...), nil
+}
+
+// ReExec replaces the running process with a fresh start of its executable,
+// typically after the binary was upgraded in place. It is intended to be
+// called from a SIGUSR2 handler installed by the program.
+//
+// The process ID, the environment and the arguments the service manager
+// started the program with are kept, so the service manager keeps tracking
+// the process. Listeners passed by socket activation (LISTEN_FDS) stay open
+// and valid for the new image. ReExec only returns on failure.
+func ReExec() error {
+	path, err := ResolveExecutable()
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err == nil {
+		// Inherited descriptors start at 3. Clear close-on-exec, which is
+		// set once the runtime wraps them in a net.Listener.
+		for fd := 3; fd < 3+n; fd++ {
+			_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_SETFD, 0)
+			if errno != 0 {
+				return fmt.Errorf("Failed to keep listener fd %d: %v", fd, errno)
+			}
+		}
+	}
+	return syscall.Exec(path, os.Args, os.Environ())
+}
+
+// defaultSignalMap stops the service on SIGTERM and interrupt.
+var defaultSignalMap = SignalMap{
+	syscall.SIGTERM: ActionStop,
+	os.Interrupt:    ActionStop,
+}
+
+// waitRestartWindow sleeps until the RestartWindow opens if it is closed,
+// logging a warning first.
+func waitRestartWindow(s Service, c *Config) error {
+	w, err := c.restartWindow()
+	if err != nil || w == nil {
+		return err
+	}
+	if d := w.wait(time.Now()); d > 0 {
+		if l, err := s.Logger(nil); err == nil {
+			l.Warningf("Outside of restart window %v, starting in %v.", w, d)
+		}
+		time.Sleep(d)
+	}
+	return nil
+}
+
+// programSignals adds the signals for the optional program interfaces to
+// defaults: SIGHUP, SIGUSR1 and SIGUSR2 go to a SignalHandler, and SIGUSR1
+// reopens logs instead if the program implements LogReopener.
+func programSignals(i Interface, defaults SignalMap) SignalMap {
+	_, handler := i.(SignalHandler)
+	_, reopener := i.(LogReopener)
+	if !handler && !reopener {
+		return defaults
+	}
+	signals := SignalMap{}
+	if handler {
+		signals[syscall.SIGHUP] = ActionCustom
+		signals[syscall.SIGUSR1] = ActionCustom
+		signals[syscall.SIGUSR2] = ActionCustom
+	}
+	if reopener {
+		signals[syscall.SIGUSR1] = ActionReopenLogs
+	}
+	for sig, action := range defaults {
+		signals[sig] = action
+	}
+	return signals
+}
+
+// runtimeMax returns the RuntimeMaxSec option for Run to enforce, or zero if
+// the program was not started by the service system.
+func (c *Config) runtimeMax() time.Duration {
+	if system.Interactive() {
+		return 0
+	}
+	return c.Option.duration(optionRuntimeMaxSec, 0)
+}
+
+// serve implements Run for the unix service systems. It starts the
+// program, handles signals until one asks it to stop, then stops the program.
+// After runtimeMax, if not zero, it stops the program and re-executes it.
+func serve(s Service, i Interface, c *Config, defaults SignalMap, runtimeMax time.Duration) error {
+	err := i.Start(s)
+	if err != nil {
+		return err
+	}
+
+	action := ActionStop
+	if !c.Option.bool(optionOneShot, optionOneShotDefault) {
+		c.Option.funcSingle(optionRunWait, func() {
+			action = waitSignals(s, i, c.signalMap(programSignals(i, defaults)), runtimeMax)
+		})()
+	}
+
+	err = stopWithin(s, i, c.Option.duration(optionStopTimeout, 30*time.Second))
+	if err == nil && action == ActionUpgrade {
+		return ReExec()
+	}
+	return err
+}
+
+// stopWithin calls i.Stop, giving up after timeout so that a Stop which hangs
+// does not keep the process running until the service manager kills it.
+func stopWithin(s Service, i Interface, timeout time.Duration) error {
+	if timeout <= 0 {
+		return i.Stop(s)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- i.Stop(s)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+	}
+	err := fmt.Errorf("Stop did not return within StopTimeout %v.", timeout)
+	if l, lerr := s.Logger(nil); lerr == nil {
+		l.Errorf("%v Exiting anyway.", err)
+	}
+	return err
+}
+
+// waitSignals runs the actions of received signals until one of them is
+// ActionStop or ActionUpgrade, which is returned. ActionUpgrade is also
+// returned once runtimeMax has passed, if not zero.
+func waitSignals(s Service, i Interface, signals SignalMap, runtimeMax time.Duration) Action {
+	var sigChan = make(chan os.Signal, 3)
+	for sig := range signals {
+		signal.Notify(sigChan, sig)
+	}
+	defer signal.Stop(sigChan)
+
+	var expired <-chan time.Time
+	if runtimeMax > 0 {
+		timer := time.NewTimer(runtimeMax)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		var sig os.Signal
+		select {
+		case sig = <-sigChan:
+		case <-expired:
+			if l, err := s.Logger(nil); err == nil {
+				l.Infof("Restarting after RuntimeMaxSec %v.", runtimeMax)
+			}
+			return ActionUpgrade
+		}
+		var err error
+		switch action := signals[sig]; action {
+		case ActionStop, ActionUpgrade:
+			return action
+		case ActionReload:
+			if r, ok := i.(Reloader); ok {
+				err = r.Reload(s)
+			}
+		case ActionReopenLogs:
+			if r, ok := i.(LogReopener); ok {
+				err = r.ReopenLogs(s)
+			}
+		case ActionCustom:
+			if h, ok := i.(SignalHandler); ok {
+				err = h.Signal(s, sig)
+			}
+		}
+		if err != nil {
+			if l, lerr := s.Logger(nil); lerr == nil {
+				l.Errorf("Failed to handle signal %v: %v", sig, err)
+			}
+		}
+	}
+}
+
+// Kinds of the ancestors LaunchContext looks at, besides the Launchers.
+const (
+	byOther Launcher = -1 - iota
+	byShellProcess
+)
+
+// parentLauncher classifies a launcher by the command name of an ancestor
+// process.
+func parentLauncher(name string) Launcher {
+	switch strings.ToLower(filepath.Base(strings.TrimSpace(name))) {
+	case "sh", "bash", "dash", "zsh", "ksh", "fish", "csh", "tcsh":
+		return byShellProcess
+	case "cron", "crond", "anacron", "atd":
+		return ByCron
+	case "sudo", "su", "login", "sshd", "tmux", "tmux: server", "screen":
+		return ByShell
+	case "init", "systemd", "launchd", "upstart", "start-stop-daemon", "supervise-daemon", "runsv", "s6-supervise", "supervise", "daemon", "srcmstr", "svc.startd":
+		return ByServiceManager
+	}
+	return byOther
+}
+
+// ancestorLauncher classifies the launcher of a process with parent pid by
+// its ancestors, found with process. Shells are skipped, as cron and
+// service managers may run a program through one, and a program started by
+// a shell of an unknown ancestor, such as a terminal, counts as ByShell. A
+// process whose ancestors end at init was orphaned, not started by it.
+func ancestorLauncher(pid int, process func(pid int) (ppid int, name string, err error)) Launcher {
+	shell := false
+	// Bound the walk in case the process table changes under it.
+	for i := 0; i < 64 && pid > 1; i++ {
+		ppid, name, err := process(pid)
+		if err != nil {
+			return ByUnknown
+		}
+		switch l := parentLauncher(name); l {
+		case byShellProcess:
+			shell = true
+			pid = ppid
+			continue
+		case byOther:
+			if shell {
+				return ByShell
+			}
+			return ByUnknown
+		default:
+			return l
+		}
+	}
+	return ByUnknown
+}
+
+// psProcess returns the parent and the command name of process pid as
+// listed by ps.
+func psProcess(pid int) (int, string, error) {
+	out, err := runWithOutput("ps", "-o", "ppid=,comm=", "-p", strconv.Itoa(pid))
+	if err != nil {
+		return 0, "", err
+	}
+	line := strings.TrimSpace(string(out))
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return 0, "", fmt.Errorf("Unexpected ps output: %q", out)
+	}
+	ppid, err := strconv.Atoi(f[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("Unexpected ps output: %q", out)
+	}
+	return ppid, strings.TrimSpace(line[len(f[0]):]), nil
+}
@@ -0,0 +1,375 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin freebsd aix solaris
+
+package service
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type reloadProgram struct {
+	program
+	reloads int
+}
+
+func (p *reloadProgram) Reload(s Service) error {
+	p.reloads++
+	return nil
+}
+
+// hangingProgram is a program whose Stop does not return until released.
+type hangingProgram struct {
+	program
+	release chan struct{}
+}
+
+func (p *hangingProgram) Stop(s Service) error {
+	<-p.release
+	return nil
+}
+
+func TestStopWithin(t *testing.T) {
+	s := &fakeService{installed: true, running: true}
+	if err := stopWithin(s, &program{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	p := &hangingProgram{release: make(chan struct{})}
+	defer close(p.release)
+	start := time.Now()
+	if err := stopWithin(s, p, 50*time.Millisecond); err == nil {
+		t.Error("hanging Stop returned no error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("stopWithin waited", elapsed)
+	}
+}
+
+func TestWaitSignals(t *testing.T) {
+	p := &reloadProgram{}
+	signals := SignalMap{
+		syscall.SIGHUP:  ActionReload,
+		syscall.SIGUSR2: ActionUpgrade,
+	}
+	done := make(chan Action)
+	go func() {
+		done <- waitSignals(nil, p, signals, 0)
+	}()
+
+	// Give signal.Notify a moment to register before raising.
+	time.Sleep(50 * time.Millisecond)
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	time.Sleep(50 * time.Millisecond)
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR2)
+
+	select {
+	case action := <-done:
+		if action != ActionUpgrade {
+			t.Fatal("unexpected action", action)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waitSignals did not return")
+	}
+	if p.reloads != 1 {
+		t.Fatal("expected one reload, got", p.reloads)
+	}
+}
+
+func TestWaitSignalsRuntimeMax(t *testing.T) {
+	s, err := New(&program{}, &Config{Name: "runtime"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if action := waitSignals(s, &program{}, SignalMap{syscall.SIGUSR2: ActionStop}, 50*time.Millisecond); action != ActionUpgrade {
+		t.Fatal("unexpected action", action)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Error("returned before RuntimeMaxSec", d)
+	}
+}
+
+type reopenProgram struct {
+	program
+}
+
+func (p *reopenProgram) ReopenLogs(s Service) error {
+	return nil
+}
+
+type signalProgram struct {
+	reopenProgram
+	received []os.Signal
+}
+
+func (p *signalProgram) Signal(s Service, sig os.Signal) error {
+	p.received = append(p.received, sig)
+	return nil
+}
+
+func TestProgramSignals(t *testing.T) {
+	if _, ok := programSignals(&program{}, defaultSignalMap)[syscall.SIGUSR1]; ok {
+		t.Error("SIGUSR1 handled without LogReopener")
+	}
+	signals := programSignals(&reopenProgram{}, defaultSignalMap)
+	if signals[syscall.SIGUSR1] != ActionReopenLogs || signals[syscall.SIGTERM] != ActionStop {
+		t.Errorf("unexpected signals %v", signals)
+	}
+	signals = programSignals(&signalProgram{}, defaultSignalMap)
+	if signals[syscall.SIGHUP] != ActionCustom || signals[syscall.SIGUSR2] != ActionCustom ||
+		signals[syscall.SIGUSR1] != ActionReopenLogs || signals[os.Interrupt] != ActionStop {
+		t.Errorf("unexpected signals %v", signals)
+	}
+	if len(defaultSignalMap) != 2 {
+		t.Error("defaults modified")
+	}
+}
+
+func TestWaitSignalsCustom(t *testing.T) {
+	p := &signalProgram{}
+	signals := programSignals(p, SignalMap{syscall.SIGTERM: ActionStop})
+	done := make(chan Action)
+	go func() {
+		done <- waitSignals(nil, p, signals, 0)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	time.Sleep(50 * time.Millisecond)
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+
+	select {
+	case action := <-done:
+		if action != ActionStop {
+			t.Fatal("unexpected action", action)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waitSignals did not return")
+	}
+	if len(p.received) != 1 || p.received[0] != syscall.SIGHUP {
+		t.Fatal("unexpected signals received", p.received)
+	}
+}
+
+func TestSocketLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socketlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Messages logged before the socket exists are kept until it does.
+	socket := filepath.Join(dir, "log.sock")
+	l := newSocketLogger("test", socket, nil)
+	if err := l.Info("first"); err != nil {
+		t.Fatal("transient failure reported", err)
+	}
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := l.Errorf("second %d", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"test I: first\n", "test E: second 2\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want {
+			t.Errorf("got %q, want %q", line, want)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := preflight([]string{"sh"}, []string{filepath.Join(dir, "missing", "app.conf")}); err != nil {
+		t.Fatal(err)
+	}
+	err = preflight([]string{"sh", "no-such-tool", "no-other-tool"}, nil, "user services unsupported")
+	if err == nil || err.Error() != "Install prerequisites missing: user services unsupported; no-such-tool not found in PATH; no-other-tool not found in PATH." {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	c := &Config{Name: "task", Executable: "/bin/sh", Arguments: []string{"-c", "exit 3"}}
+	if code, err := runOnce(c, time.Second); code != 3 || err != nil {
+		t.Errorf("exit code %d: %v", code, err)
+	}
+	c.Arguments = []string{"-c", "exec sleep 5"}
+	code, err := runOnce(c, 100*time.Millisecond)
+	if _, is := err.(*timeoutError); code != -1 || !is {
+		t.Errorf("exit code %d after timeout: %v", code, err)
+	}
+	if _, err := runOnce(c, 0); err != errRunOnceTimeout {
+		t.Errorf("zero timeout: %v", err)
+	}
+}
+
+func TestRunOnceUserName(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to switch users")
+	}
+	c := &Config{Name: "task", Executable: "/bin/sh", UserName: "nobody", Arguments: []string{"-c", `test "$(id -un)" = nobody || exit 4; sleep 5 & wait`}}
+	start := time.Now()
+	code, err := runOnce(c, 500*time.Millisecond)
+	if _, is := err.(*timeoutError); code != -1 || !is {
+		t.Errorf("exit code %d after timeout: %v", code, err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("returned after %v", d)
+	}
+}
+
+func TestRunnerTimeoutForkedChild(t *testing.T) {
+	start := time.Now()
+	_, err := execRunner{}.Run(500*time.Millisecond, "/bin/sh", "-c", "sleep 3; :")
+	if _, is := err.(*timeoutError); !is {
+		t.Errorf("want timeout, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("returned after %v", d)
+	}
+}
+
+func TestAncestorLauncher(t *testing.T) {
+	type process struct {
+		ppid int
+		name string
+	}
+	table := map[int]process{
+		10: {1, "cron"},
+		11: {10, "cron"},
+		12: {11, "sh"},
+		20: {1, "sshd"},
+		21: {20, "bash"},
+		30: {1, "gnome-terminal-server"},
+		31: {30, "zsh"},
+		32: {31, "bash"},
+		40: {1, "runsv"},
+		50: {1, "sh"},
+		60: {1, "python3"},
+	}
+	lookup := func(pid int) (int, string, error) {
+		p, ok := table[pid]
+		if !ok {
+			return 0, "", errors.New("no such process")
+		}
+		return p.ppid, p.name, nil
+	}
+	for _, test := range []struct {
+		ppid int
+		want Launcher
+	}{
+		{12, ByCron},
+		{21, ByShell},
+		{32, ByShell},
+		{40, ByServiceManager},
+		{50, ByUnknown},
+		{1, ByUnknown},
+		{60, ByUnknown},
+		{99, ByUnknown},
+	} {
+		if l := ancestorLauncher(test.ppid, lookup); l != test.want {
+			t.Errorf("parent %d: got %v, want %v", test.ppid, l, test.want)
+		}
+	}
+}
+
+func TestCreateWorkingDirectory(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "workdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		WorkingDirectory: filepath.Join(tmp, "var", "app"),
+		Option:           KeyValue{"CreateWorkingDirectory": true, "WorkingDirectoryMode": 0750, "WorkingDirectoryOwner": u.Username},
+	}
+	if err := createWorkingDirectory(c); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(c.WorkingDirectory)
+	if err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("created %v: %v", fi.Mode(), err)
+	}
+
+	c.WorkingDirectory = "var/app"
+	if err := createWorkingDirectory(c); err == nil {
+		t.Error("relative WorkingDirectory accepted")
+	}
+}
+
+func TestWriteFileSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "web")
+	if err := writeFileSync(name, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(name); err != nil || string(b) != "#!/bin/sh\n" {
+		t.Error("unexpected content", string(b), err)
+	}
+}
+
+func TestReadPIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "web.pid")
+	if err = ioutil.WriteFile(path, []byte("4242\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := readPIDFile(&fakeService{installed: true, running: true}, path); err != nil || pid != 4242 {
+		t.Errorf("pid %d, %v", pid, err)
+	}
+	if _, err := readPIDFile(&fakeService{installed: true}, path); err != ErrServiceIsNotRunning {
+		t.Errorf("stopped service: %v", err)
+	}
+	if err = ioutil.WriteFile(path, []byte("\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPIDFile(&fakeService{installed: true, running: true}, path); err == nil {
+		t.Error("empty pid file accepted")
+	}
+}
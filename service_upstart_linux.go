@@ -5,10 +5,14 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/signal"
+	"strings"
+	"syscall"
 	"text/template"
 	"time"
 )
@@ -54,10 +58,87 @@ func (s *upstart) configPath() (cp string, err error) {
 	cp = "/etc/init/" + s.Config.Name + ".conf"
 	return
 }
+
+// overridePath returns the override file SetStartType writes next to the job.
+func (s *upstart) overridePath() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(cp, ".conf") + ".override", nil
+}
 func (s *upstart) template() *template.Template {
 	return template.Must(template.New("").Funcs(tf).Parse(upstartScript))
 }
 
+// definition renders the job file for the service.
+func (s *upstart) definition() ([]byte, error) {
+	if err := s.checkSystemdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkLaunchdOnly(); err != nil {
+		return nil, err
+	}
+	if err := s.checkDirectories(); err != nil {
+		return nil, err
+	}
+	path, err := s.execPath()
+	if err != nil {
+		return nil, err
+	}
+
+	var to = &struct {
+		*Config
+		Path        string
+		Expect      string
+		KillSignal  string
+		KillTimeout int
+		OneShot     bool
+		Restart     string
+		Env         []envVar
+		LimitNOFILE int
+		LimitAS     uint64
+		Group       string
+	}{
+		s.Config,
+		path,
+		s.Option.string(optionUpstartExpect, "none"),
+		s.killSignal(),
+		seconds(s.Option.duration(optionStopKillDelay, 0)),
+		s.Option.bool(optionOneShot, optionOneShotDefault),
+		"",
+		nil,
+		0, 0, "",
+	}
+	if err = s.validateDependencies(); err != nil {
+		return nil, err
+	}
+	if to.Env, err = s.environment(); err != nil {
+		return nil, err
+	}
+	if to.LimitNOFILE, to.LimitAS, err = s.ulimits(); err != nil {
+		return nil, err
+	}
+	if to.Group, err = s.groupName(); err != nil {
+		return nil, err
+	}
+	if to.Restart, err = s.restart("always"); err != nil {
+		return nil, err
+	}
+	switch to.Expect {
+	case "none", "fork", "daemon", "stop":
+	default:
+		return nil, fmt.Errorf("Option UpstartExpect must be none, fork, daemon or stop: %q", to.Expect)
+	}
+
+	var b bytes.Buffer
+	err = s.template().Execute(&b, to)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
 func (s *upstart) Install() error {
 	confPath, err := s.configPath()
 	if err != nil {
@@ -68,26 +149,35 @@ func (s *upstart) Install() error {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
 
-	f, err := os.Create(confPath)
+	definition, err := s.definition()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	path, err := s.execPath()
+	if err = createWorkingDirectory(s.Config); err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(confPath, definition, 0644)
 	if err != nil {
 		return err
 	}
-
-	var to = &struct {
-		*Config
-		Path string
-	}{
-		s.Config,
-		path,
+	if err = restoreContext(s.Config, confPath); err != nil {
+		os.Remove(confPath)
+		return err
 	}
+	if err = installAppArmor(s.Config); err != nil {
+		os.Remove(confPath)
+		return err
+	}
+	s.notifyChecksum(definition)
+	return nil
+}
 
-	return s.template().Execute(f, to)
+func (s *upstart) Preflight() error {
+	cp, err := s.configPath()
+	if err != nil {
+		return preflight([]string{"initctl"}, nil, strings.TrimSuffix(err.Error(), "."))
+	}
+	return preflight(installTools(s.Config, "initctl"), []string{cp})
 }
 
 func (s *upstart) Uninstall() error {
@@ -95,12 +185,89 @@ func (s *upstart) Uninstall() error {
 	if err != nil {
 		return err
 	}
-	if err := os.Remove(cp); err != nil {
+	if _, err = os.Stat(cp); err == nil {
+		if err = stopBeforeUninstall(s, s.Config); err != nil {
+			return err
+		}
+	}
+	found, err := remove(cp)
+	if err != nil {
+		return err
+	}
+	if _, err = remove(strings.TrimSuffix(cp, ".conf") + ".override"); err != nil {
+		return err
+	}
+	if err = removeAppArmor(s.Config); err != nil {
 		return err
 	}
+	if !found {
+		return ErrServiceIsNotInstalled
+	}
 	return nil
 }
 
+func (s *upstart) Diff() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return diffFile(cp, s.definition)
+}
+
+func (s *upstart) Render() (string, error) {
+	return renderDefinition(s.definition)
+}
+
+func (s *upstart) WaitFor(ctx context.Context, desired Status) error {
+	return waitFor(ctx, s, desired)
+}
+
+func (s *upstart) Health() (HealthStatus, error) {
+	return health(s, s.Config)
+}
+
+func (s *upstart) SelfTest(ctx context.Context) error {
+	return selfTest(ctx, s, s.Config)
+}
+
+func (s *upstart) Reconcile(desired ReconcileSpec) (bool, error) {
+	return reconcile(s, desired)
+}
+
+func (s *upstart) Reinstall() error {
+	return reinstall(s)
+}
+
+func (s *upstart) Describe() ([]byte, error) {
+	return describe(s, s.Config)
+}
+
+func (s *upstart) AppliedOptions() ([]string, error) {
+	return appliedOptions(s.Config, func(c *Config) ([]byte, error) {
+		return (&upstart{Config: c}).definition()
+	})
+}
+
+func (s *upstart) RunOnce(timeout time.Duration) (int, error) {
+	return runOnce(s.Config, timeout)
+}
+
+func (s *upstart) PathDrift() (installed, current string, drifted bool, err error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", "", false, err
+	}
+	return filePathDrift(s.Config, cp, " ", "test -x ")
+}
+
+func (s *upstart) DefinitionChecksum() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return fileChecksum(cp)
+}
+
 func (s *upstart) Logger(errs chan<- error) (Logger, error) {
 	if system.Interactive() {
 		return ConsoleLogger, nil
@@ -108,26 +275,26 @@ func (s *upstart) Logger(errs chan<- error) (Logger, error) {
 	return s.SystemLogger(errs)
 }
 func (s *upstart) SystemLogger(errs chan<- error) (Logger, error) {
+	if address := s.Option.string(optionLogSocket, ""); len(address) != 0 {
+		return newSocketLogger(s.Name, address, errs), nil
+	}
 	return newSysLogger(s.Name, errs)
 }
 
-func (s *upstart) Run() (err error) {
-	err = s.i.Start(s)
-	if err != nil {
-		return err
+func (s *upstart) Run() error {
+	if !system.Interactive() {
+		if err := waitRestartWindow(s, s.Config); err != nil {
+			return err
+		}
 	}
-
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, os.Interrupt, os.Kill)
-		<-sigChan
-	})()
-
-	return s.i.Stop(s)
+	return serve(s, s.i, s.Config, upstartSignalMap, s.runtimeMax())
 }
 
 func (s *upstart) Start() error {
-	return run("initctl", "start", s.Name)
+	if err := verifyDefinition(s, s.Config); err != nil {
+		return err
+	}
+	return runStart(s.Config, "initctl", "start", s.Name)
 }
 
 func (s *upstart) Stop() error {
@@ -138,13 +305,93 @@ func (s *upstart) Status() error {
 	return checkStatus("initctl", []string{"status", s.Name}, "start/running", "Unknown job")
 }
 
-func (s *upstart) Restart() error {
-	err := s.Stop()
+func (s *upstart) Installed() (bool, error) {
+	cp, err := s.configPath()
 	if err != nil {
+		return false, err
+	}
+	return fileExists(cp)
+}
+
+// SetStartType writes an override file with the manual stanza, which makes
+// Upstart ignore the start on condition of the job, or removes it for
+// StartAutomatic.
+func (s *upstart) SetStartType(startType StartType) error {
+	if err := checkStartType(s, startType); err != nil {
+		return err
+	}
+	op, err := s.overridePath()
+	if err != nil {
+		return err
+	}
+	if startType == StartAutomatic {
+		_, err = remove(op)
 		return err
 	}
-	time.Sleep(50 * time.Millisecond)
-	return s.Start()
+	return ioutil.WriteFile(op, []byte("manual\n"), 0644)
+}
+
+// ResourceUsage reads the pid from initctl status, which prints
+// "name start/running, process 1234".
+func (s *upstart) ResourceUsage() (ResourceUsage, error) {
+	pid, err := s.PID()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	return procUsage(pid)
+}
+
+func (s *upstart) PID() (int, error) {
+	if err := s.Status(); err != nil {
+		return 0, err
+	}
+	out, err := runWithOutput("initctl", "status", s.Name)
+	if err != nil {
+		return 0, fmt.Errorf("\"initctl\" failed: %v, %s", err, out)
+	}
+	var pid int
+	i := strings.Index(string(out), "process ")
+	if i < 0 {
+		return 0, fmt.Errorf("No process in initctl status: %q", out)
+	}
+	if _, err = fmt.Sscanf(string(out[i:]), "process %d", &pid); err != nil {
+		return 0, fmt.Errorf("No process in initctl status: %q", out)
+	}
+	return pid, nil
+}
+
+func (s *upstart) NetworkStats() (in, out uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
+
+func (s *upstart) Restart() error {
+	return stopThenStart(s, s.Config)
+}
+
+// killSignal returns the name of the first signal the SignalMap stops on,
+// trying the usual stop signals in order. Run then stops on Upstart's kill.
+func (s *upstart) killSignal() string {
+	signals := s.signalMap(upstartSignalMap)
+	for _, sig := range []struct {
+		signal os.Signal
+		name   string
+	}{
+		{os.Interrupt, "INT"},
+		{syscall.SIGTERM, "TERM"},
+		{syscall.SIGQUIT, "QUIT"},
+		{syscall.SIGHUP, "HUP"},
+	} {
+		if action, ok := signals[sig.signal]; ok && action == ActionStop {
+			return sig.name
+		}
+	}
+	return "INT"
+}
+
+// upstartSignalMap stops on INT, which the job uses as its kill signal.
+var upstartSignalMap = SignalMap{
+	os.Interrupt: ActionStop,
+	os.Kill:      ActionStop,
 }
 
 // The upstart script should stop with an INT or the Go runtime will terminate
@@ -153,26 +400,33 @@ const upstartScript = `# {{.Description}}
 
  {{if .DisplayName}}description    "{{.DisplayName}}"{{end}}
 
-kill signal INT
+kill signal {{.KillSignal}}
+{{if .KillTimeout}}kill timeout {{.KillTimeout}}{{end}}
+{{if ne .Expect "none"}}expect {{.Expect}}{{end}}
 {{if .ChRoot}}chroot {{.ChRoot}}{{end}}
 {{if .WorkingDirectory}}chdir {{.WorkingDirectory}}{{end}}
-start on filesystem or runlevel [2345]
-stop on runlevel [!2345]
+start on {{if .Dependencies}}(filesystem or runlevel [2345]){{range .Dependencies}} and started {{.}}{{end}}{{else}}filesystem or runlevel [2345]{{end}}
+stop on runlevel [!2345]{{range .Dependencies}} or stopping {{.}}{{end}}
 
 #setuid username
 
-respawn
+{{if .OneShot}}task
+{{end}}{{if ne .Restart "no"}}respawn
 respawn limit 10 5
-umask 022
-
+{{if eq .Restart "on-failure"}}normal exit 0
+{{end}}{{end}}umask 022
+{{if .LimitNOFILE}}limit nofile {{.LimitNOFILE}} {{.LimitNOFILE}}
+{{end}}{{if .LimitAS}}limit as {{.LimitAS}} {{.LimitAS}}
+{{end}}{{range .Env}}env {{.Name}}={{.Value|cmd}}
+{{end}}
 console log
 
 pre-start script
-    test -x {{.Path}} || { stop; exit 0; }
+    test -x {{.Path|shellWord}} || { stop; exit 0; }
 end script
 
 # Start
 # Due to bug in Precise Upstart this is the only way to inherit user groups
 # http://upstart.ubuntu.com/cookbook/#changing-user
-exec start-stop-daemon --start {{if .UserName}}--user {{.UserName|cmd}} -c {{.UserName|cmd}}{{else}}--user root{{end}} {{if .WorkingDirectory}}-d {{.WorkingDirectory|cmd}}{{end}} --exec {{.Path}} -- {{range .Arguments}} {{.|cmd}}{{end}}
+exec start-stop-daemon --start {{if .UserName}}--user {{.UserName|cmd}} -c {{.UserName|cmd}}{{if .Group}}:{{.Group}}{{end}}{{else}}--user root{{if .Group}} -g {{.Group}}{{end}}{{end}} {{if .WorkingDirectory}}-d {{.WorkingDirectory|cmd}}{{end}} --exec {{.Path|shellWord}} -- {{range .Arguments}} {{.|cmd}}{{end}}
 `
@@ -0,0 +1,95 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func upstartDefinition(t *testing.T, c *Config) string {
+	s, err := newUpstartService(nil, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.(*upstart).definition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestUpstartDefinition(t *testing.T) {
+	job := upstartDefinition(t, &Config{Name: "web", Executable: "/usr/bin/web"})
+	for _, line := range []string{"\nkill signal INT\n", "\nrespawn\n"} {
+		if !strings.Contains(job, line) {
+			t.Errorf("missing %q in job", line)
+		}
+	}
+	if strings.Contains(job, "expect") || strings.Contains(job, "kill timeout") {
+		t.Error("unexpected stanza in default job")
+	}
+
+	job = upstartDefinition(t, &Config{
+		Name:       "batch",
+		Executable: "/usr/bin/batch",
+		Option: KeyValue{
+			"UpstartExpect": "fork",
+			"StopKillDelay": 30 * time.Second,
+			"OneShot":       true,
+			"SignalMap":     SignalMap{syscall.SIGTERM: ActionStop},
+		},
+	})
+	for _, line := range []string{"\nkill signal TERM\n", "\nkill timeout 30\n", "\nexpect fork\n", "\ntask\n"} {
+		if !strings.Contains(job, line) {
+			t.Errorf("missing %q in job", line)
+		}
+	}
+	if strings.Contains(job, "respawn") {
+		t.Error("one shot job respawns")
+	}
+
+	job = upstartDefinition(t, &Config{
+		Name:         "web",
+		Executable:   "/usr/bin/web",
+		Dependencies: []string{"postgresql", "redis"},
+	})
+	for _, line := range []string{
+		"\nstart on (filesystem or runlevel [2345]) and started postgresql and started redis\n",
+		"\nstop on runlevel [!2345] or stopping postgresql or stopping redis\n",
+	} {
+		if !strings.Contains(job, line) {
+			t.Errorf("missing %q in job", line)
+		}
+	}
+
+	job = upstartDefinition(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"Restart": "on-failure"},
+	})
+	if !strings.Contains(job, "\nrespawn\nrespawn limit 10 5\nnormal exit 0\n") {
+		t.Error("on-failure job does not respawn on failures only")
+	}
+	job = upstartDefinition(t, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"Restart": "no"},
+	})
+	if strings.Contains(job, "respawn") {
+		t.Error("job respawns without Restart")
+	}
+
+	s, _ := newUpstartService(nil, &Config{
+		Name:       "web",
+		Executable: "/usr/bin/web",
+		Option:     KeyValue{"UpstartExpect": "forks"},
+	})
+	if _, err := s.(*upstart).definition(); err == nil {
+		t.Fatal("invalid UpstartExpect accepted")
+	}
+}
@@ -5,21 +5,29 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/exec"
 	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unsafe"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/eventlog"
 	"golang.org/x/sys/windows/svc/mgr"
 )
 
-const version = "windows-service"
-
 type windowsService struct {
 	i Interface
 	*Config
@@ -37,7 +45,7 @@ type WindowsLogger struct {
 type windowsSystem struct{}
 
 func (windowsSystem) String() string {
-	return version
+	return PlatformWindows
 }
 func (windowsSystem) Detect() bool {
 	return true
@@ -97,6 +105,21 @@ func (l WindowsLogger) Infof(format string, a ...interface{}) error {
 	return l.send(l.ev.Info(1, fmt.Sprintf(format, a...)))
 }
 
+// Log logs a message with key value pairs, see StructuredLogger. The event
+// IDs are those of the other methods, and 4 for LevelDebug.
+func (l WindowsLogger) Log(level Level, msg string, kv ...interface{}) error {
+	m := formatFields(msg, kv)
+	switch level {
+	case LevelDebug:
+		return l.send(l.ev.Info(4, m))
+	case LevelWarning:
+		return l.send(l.ev.Warning(2, m))
+	case LevelError:
+		return l.send(l.ev.Error(3, m))
+	}
+	return l.send(l.ev.Info(1, m))
+}
+
 // NError logs an error message and an event ID.
 func (l WindowsLogger) NError(eventID uint32, v ...interface{}) error {
 	return l.send(l.ev.Error(eventID, fmt.Sprint(v...)))
@@ -129,12 +152,21 @@ func (l WindowsLogger) NInfof(eventID uint32, format string, a ...interface{}) e
 
 var interactive = false
 
+// interactiveErr is the error of the session check. Run returns it rather
+// than the package panicking on import.
+var interactiveErr error
+
 func init() {
-	var err error
-	interactive, err = svc.IsAnInteractiveSession()
-	if err != nil {
-		panic(err)
+	interactive, interactiveErr = svc.IsAnInteractiveSession()
+}
+
+// launchContext can only tell the SCM from an interactive session, which
+// includes tasks run by the Task Scheduler in a user session.
+func launchContext() Launcher {
+	if !interactive {
+		return ByServiceManager
 	}
+	return ByShell
 }
 
 func (ws *windowsService) String() string {
@@ -156,7 +188,7 @@ func (ws *windowsService) getError() error {
 }
 
 func (ws *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
+	cmdsAccepted := svc.AcceptStop | svc.AcceptShutdown
 	changes <- svc.Status{State: svc.StartPending}
 
 	if err := ws.i.Start(ws); err != nil {
@@ -164,6 +196,21 @@ func (ws *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, cha
 		return true, 1
 	}
 
+	var logon chan struct{}
+	if command := ws.Option.strings(optionRunInUserSession, nil); len(command) != 0 {
+		cmdsAccepted |= svc.AcceptSessionChange
+		logon = make(chan struct{}, 1)
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			ws.superviseUserSession(command, logon, stop)
+			close(done)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 loop:
 	for {
@@ -171,9 +218,15 @@ loop:
 		switch c.Cmd {
 		case svc.Interrogate:
 			changes <- c.CurrentStatus
+		case svc.SessionChange:
+			if c.EventType == windows.WTS_SESSION_LOGON || c.EventType == windows.WTS_CONSOLE_CONNECT {
+				select {
+				case logon <- struct{}{}:
+				default:
+				}
+			}
 		case svc.Stop, svc.Shutdown:
-			changes <- svc.Status{State: svc.StopPending}
-			if err := ws.i.Stop(ws); err != nil {
+			if err := ws.stopPending(changes); err != nil {
 				ws.setError(err)
 				return true, 2
 			}
@@ -186,6 +239,314 @@ loop:
 	return false, 0
 }
 
+// stopPending calls the program's Stop. Until it returns the SCM is told
+// every second that stopping is still in progress, so a graceful stop is not
+// taken for a hung service.
+func (ws *windowsService) stopPending(changes chan<- svc.Status) error {
+	const waitHint = 3 * time.Second
+	changes <- svc.Status{State: svc.StopPending, WaitHint: uint32(waitHint / time.Millisecond)}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ws.i.Stop(ws)
+	}()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for checkPoint := uint32(1); ; checkPoint++ {
+		select {
+		case err := <-done:
+			return err
+		case <-tick.C:
+			changes <- svc.Status{State: svc.StopPending, CheckPoint: checkPoint, WaitHint: uint32(waitHint / time.Millisecond)}
+		}
+	}
+}
+
+// userSessionRestartDelay is how long superviseUserSession waits before it
+// starts the RunInUserSession command again after it exited.
+const userSessionRestartDelay = 5 * time.Second
+
+// superviseUserSession keeps command running in the console session until
+// stop is closed. Without a user logged on to the console, as at boot, it
+// waits for a signal on logon. On one it also moves a running command to
+// the console session if that changed, as with fast user switching.
+func (ws *windowsService) superviseUserSession(command []string, logon, stop <-chan struct{}) {
+	for {
+		session := windows.WTSGetActiveConsoleSessionId()
+		p, err := startInUserSession(session, command)
+		var exited chan struct{}
+		if err == nil {
+			exited = make(chan struct{})
+			go func() {
+				p.Wait()
+				close(exited)
+			}()
+		} else if err != errNoConsoleUser {
+			if l, lerr := ws.Logger(nil); lerr == nil {
+				l.Warningf("Failed to start %q in the user session: %v", command[0], err)
+			}
+		}
+	wait:
+		for {
+			select {
+			case <-stop:
+				if exited != nil {
+					p.Kill()
+					<-exited
+				}
+				return
+			case <-logon:
+				if exited == nil {
+					break wait
+				}
+				if windows.WTSGetActiveConsoleSessionId() != session {
+					p.Kill()
+					<-exited
+					break wait
+				}
+			case <-exited:
+				select {
+				case <-stop:
+					return
+				case <-logon:
+				case <-time.After(userSessionRestartDelay):
+				}
+				break wait
+			}
+		}
+	}
+}
+
+// errNoConsoleUser is returned by startInUserSession while no user is logged
+// on to the console.
+var errNoConsoleUser = errors.New("No user is logged on to the console.")
+
+// startInUserSession starts command on the default desktop of session, the
+// one of the user logged on to the console. Obtaining the user token
+// requires the service to run as LocalSystem.
+func startInUserSession(session uint32, command []string) (*os.Process, error) {
+	if session == 0xFFFFFFFF {
+		return nil, errNoConsoleUser
+	}
+	var token windows.Token
+	if err := windows.WTSQueryUserToken(session, &token); err == windows.ERROR_NO_TOKEN {
+		// The console shows the logon screen.
+		return nil, errNoConsoleUser
+	} else if err != nil {
+		return nil, fmt.Errorf("WTSQueryUserToken() failed: %s", err)
+	}
+	defer token.Close()
+
+	var env *uint16
+	if err := windows.CreateEnvironmentBlock(&env, token, false); err != nil {
+		return nil, fmt.Errorf("CreateEnvironmentBlock() failed: %s", err)
+	}
+	defer windows.DestroyEnvironmentBlock(env)
+
+	commandLine, err := windows.UTF16PtrFromString(windows.ComposeCommandLine(command))
+	if err != nil {
+		return nil, err
+	}
+	desktop, err := windows.UTF16PtrFromString(`winsta0\default`)
+	if err != nil {
+		return nil, err
+	}
+	si := &windows.StartupInfo{Desktop: desktop}
+	si.Cb = uint32(unsafe.Sizeof(*si))
+	var pi windows.ProcessInformation
+	err = windows.CreateProcessAsUser(token, nil, commandLine, nil, nil, false, windows.CREATE_UNICODE_ENVIRONMENT, env, nil, si, &pi)
+	if err != nil {
+		return nil, fmt.Errorf("CreateProcessAsUser() failed: %s", err)
+	}
+	defer windows.CloseHandle(pi.Thread)
+	defer windows.CloseHandle(pi.Process)
+	return os.FindProcess(int(pi.ProcessId))
+}
+
+// indirectString matches the "@path,-id" form the SCM resolves to a localized
+// string resource.
+var indirectString = regexp.MustCompile(`^@[^,]+,-[0-9]+$`)
+
+// resourceString returns the indirect string set in the named option,
+// falling back to the literal value when the option is not set.
+func (ws *windowsService) resourceString(name, literal string) (string, error) {
+	v := ws.Option.string(name, "")
+	if len(v) == 0 {
+		return literal, nil
+	}
+	if !indirectString.MatchString(v) {
+		return "", fmt.Errorf("Option %s must have the form @path,-id, got %q", name, v)
+	}
+	return v, nil
+}
+
+// config returns the SCM configuration Install creates for the service.
+func (ws *windowsService) config(exepath string) (mgr.Config, error) {
+	if err := ws.checkSystemdOnly(); err != nil {
+		return mgr.Config{}, err
+	}
+	if len(ws.ChRoot) != 0 {
+		return mgr.Config{}, errors.New("ChRoot is not supported on Windows.")
+	}
+	if err := ws.checkLaunchdOnly(); err != nil {
+		return mgr.Config{}, err
+	}
+	displayName, err := ws.resourceString(optionDisplayNameResource, ws.DisplayName)
+	if err != nil {
+		return mgr.Config{}, err
+	}
+	description, err := ws.resourceString(optionDescriptionResource, ws.Description)
+	if err != nil {
+		return mgr.Config{}, err
+	}
+	startType, err := ws.startType()
+	if err != nil {
+		return mgr.Config{}, err
+	}
+	delayed := ws.Option.bool(optionDelayedAutoStart, false)
+	if delayed && startType != mgr.StartAutomatic {
+		return mgr.Config{}, fmt.Errorf("Option %s requires StartType automatic.", optionDelayedAutoStart)
+	}
+	return mgr.Config{
+		BinaryPathName:   binaryPathName(exepath, ws.Arguments),
+		DisplayName:      displayName,
+		Description:      description,
+		StartType:        startType,
+		DelayedAutoStart: delayed,
+		ServiceStartName: ws.UserName,
+		Dependencies:     ws.Dependencies,
+	}, nil
+}
+
+// recoveryActions returns the failure actions of the Restart and RestartSec
+// options and the reset period in seconds, or nil actions for Restart no.
+func (ws *windowsService) recoveryActions() ([]mgr.RecoveryAction, uint32, error) {
+	restart, err := ws.restart("no")
+	if err != nil || restart == "no" {
+		return nil, 0, err
+	}
+	delay := ws.Option.duration(optionRestartSec, 2*time.Minute)
+	reset := ws.Option.duration(optionFailureResetPeriod, 24*time.Hour)
+	if delay < 0 || reset < 0 {
+		return nil, 0, fmt.Errorf("Options %s and %s can't be negative.", optionRestartSec, optionFailureResetPeriod)
+	}
+	actions := make([]mgr.RecoveryAction, 3)
+	for i := range actions {
+		actions[i] = mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: delay}
+	}
+	return actions, uint32(reset / time.Second), nil
+}
+
+// setRecoveryActions configures the SCM to restart the service after it
+// fails. A stop with an error, as when the program's Start fails, counts as
+// a failure too, not only a crash.
+func (ws *windowsService) setRecoveryActions(s *mgr.Service) error {
+	actions, reset, err := ws.recoveryActions()
+	if err != nil || actions == nil {
+		return err
+	}
+	if err = s.SetRecoveryActions(actions, reset); err != nil {
+		return err
+	}
+	return s.SetRecoveryActionsOnNonCrashFailures(true)
+}
+
+// scmStartTypes are the SCM start types of the StartType values.
+var scmStartTypes = map[StartType]uint32{
+	StartAutomatic: mgr.StartAutomatic,
+	StartManual:    mgr.StartManual,
+	StartDisabled:  mgr.StartDisabled,
+}
+
+// startType returns the SCM start type of the StartType option.
+func (ws *windowsService) startType() (uint32, error) {
+	v := ws.Option.string(optionStartType, string(StartAutomatic))
+	if t, ok := scmStartTypes[StartType(v)]; ok {
+		return t, nil
+	}
+	return 0, fmt.Errorf("Option %s must be automatic, manual or disabled: %q", optionStartType, v)
+}
+
+// binaryPathName returns the ImagePath command line for the service. The
+// executable is always quoted, otherwise the SCM may run a different program
+// for a path with spaces, such as C:\Program.exe for C:\Program Files\...
+func binaryPathName(exepath string, args []string) string {
+	binaryPath := `"` + exepath + `"`
+	for _, arg := range args {
+		binaryPath += " " + syscall.EscapeArg(arg)
+	}
+	return binaryPath
+}
+
+// parseImagePath splits an ImagePath, as written by binaryPathName, back into
+// the executable and its arguments. An unquoted executable, as installed by
+// other tools, may contain spaces and ends at ".exe" instead.
+func parseImagePath(imagePath string) (exepath string, args []string) {
+	imagePath = strings.TrimLeft(imagePath, " \t")
+	var rest string
+	if strings.HasPrefix(imagePath, `"`) {
+		end := strings.Index(imagePath[1:], `"`)
+		if end < 0 {
+			return imagePath[1:], nil
+		}
+		exepath, rest = imagePath[1:1+end], imagePath[2+end:]
+	} else {
+		end := strings.IndexAny(imagePath, " \t")
+		if i := strings.Index(strings.ToLower(imagePath), ".exe"); i >= 0 && (i+4 == len(imagePath) || imagePath[i+4] == ' ' || imagePath[i+4] == '\t') {
+			end = i + 4
+		}
+		if end < 0 {
+			return imagePath, nil
+		}
+		exepath, rest = imagePath[:end], imagePath[end:]
+	}
+	return exepath, splitArgs(rest)
+}
+
+// splitArgs reverses syscall.EscapeArg for a list of arguments, following the
+// rules of CommandLineToArgvW: backslashes are literal unless they precede a
+// quote, where each pair yields one backslash and an odd one escapes the quote.
+func splitArgs(s string) []string {
+	var args []string
+	var arg []byte
+	inArg, quoted, backslashes := false, false, 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			backslashes++
+			inArg = true
+			continue
+		case c == '"':
+			arg = append(arg, strings.Repeat(`\`, backslashes/2)...)
+			if backslashes%2 == 1 {
+				arg = append(arg, '"')
+			} else {
+				quoted = !quoted
+			}
+			backslashes = 0
+			inArg = true
+			continue
+		}
+		arg = append(arg, strings.Repeat(`\`, backslashes)...)
+		backslashes = 0
+		if (c == ' ' || c == '\t') && !quoted {
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = arg[:0], false
+			}
+			continue
+		}
+		arg = append(arg, c)
+		inArg = true
+	}
+	arg = append(arg, strings.Repeat(`\`, backslashes)...)
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
 func (ws *windowsService) Install() error {
 	exepath, err := ws.execPath()
 	if err != nil {
@@ -202,26 +563,271 @@ func (ws *windowsService) Install() error {
 		s.Close()
 		return fmt.Errorf("service %s already exists", ws.Name)
 	}
-	s, err = m.CreateService(ws.Name, exepath, mgr.Config{
-		DisplayName:      ws.DisplayName,
-		Description:      ws.Description,
-		StartType:        mgr.StartAutomatic,
-		ServiceStartName: ws.UserName,
-		Password:         ws.Option.string("Password", ""),
-		Dependencies:     ws.Dependencies,
-	}, ws.Arguments...)
+	c, err := ws.config(exepath)
+	if err != nil {
+		return err
+	}
+	if _, _, err = ws.recoveryActions(); err != nil {
+		return err
+	}
+	c.Password = ws.Option.string("Password", "")
+	s, err = m.CreateService(ws.Name, exepath, c, ws.Arguments...)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
+	// CreateService quotes the path only if it contains spaces. UpdateConfig
+	// also sets the delayed start with ChangeServiceConfig2.
+	err = s.UpdateConfig(c)
+	if err != nil {
+		s.Delete()
+		return err
+	}
+	if err = ws.setRecoveryActions(s); err != nil {
+		s.Delete()
+		return err
+	}
+	if err = ws.setEnvironment(); err != nil {
+		s.Delete()
+		return err
+	}
 	err = eventlog.InstallAsEventCreate(ws.Name, eventlog.Error|eventlog.Warning|eventlog.Info)
 	if err != nil {
 		s.Delete()
 		return fmt.Errorf("InstallAsEventCreate() failed: %s", err)
 	}
+	if c, err := s.Config(); err == nil {
+		ws.notifyChecksum(scmDefinition(c))
+	}
 	return nil
 }
 
+// setEnvironment writes the EnvVars and PassEnv variables to the Environment
+// value of the service key, which the service control manager adds to the
+// environment of the service process.
+func (ws *windowsService) setEnvironment() error {
+	env, err := ws.environment()
+	if err != nil || len(env) == 0 {
+		return err
+	}
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+ws.Name, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+	values := make([]string, len(env))
+	for i, e := range env {
+		values[i] = e.Name + "=" + e.Value
+	}
+	return key.SetStringsValue("Environment", values)
+}
+
+// scmDefinition serializes the parts of the SCM configuration set by Install.
+// Windows keeps the service definition in the registry rather than a file,
+// so this stands in for the file contents on other platforms.
+func scmDefinition(c mgr.Config) []byte {
+	definition := fmt.Sprintf("BinaryPathName=%s\nDisplayName=%s\nDescription=%s\nStartType=%d\nServiceStartName=%s\nDependencies=%s\n",
+		c.BinaryPathName, c.DisplayName, c.Description, c.StartType, c.ServiceStartName, strings.Join(c.Dependencies, ","))
+	// Only set when true, so the checksums of earlier installs still match.
+	if c.DelayedAutoStart {
+		definition += "DelayedAutoStart=true\n"
+	}
+	return []byte(definition)
+}
+
+func (ws *windowsService) Diff() (string, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return "", err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		return "", openError(err)
+	}
+	defer s.Close()
+
+	installed, err := s.Config()
+	if err != nil {
+		return "", err
+	}
+	desired, err := ws.Render()
+	if err != nil {
+		return "", err
+	}
+	return diff(string(scmDefinition(installed)), desired), nil
+}
+
+// Render returns the configuration Install passes to the service control
+// manager as the key=value lines Diff compares.
+func (ws *windowsService) Render() (string, error) {
+	exepath, err := ws.execPath()
+	if err != nil {
+		return "", err
+	}
+	c, err := ws.config(exepath)
+	if err != nil {
+		return "", err
+	}
+	if len(c.ServiceStartName) == 0 {
+		// The SCM records the default account by name.
+		c.ServiceStartName = "LocalSystem"
+	}
+	return string(scmDefinition(c)), nil
+}
+
+func (ws *windowsService) WaitFor(ctx context.Context, desired Status) error {
+	return waitFor(ctx, ws, desired)
+}
+
+func (ws *windowsService) Health() (HealthStatus, error) {
+	return health(ws, ws.Config)
+}
+
+func (ws *windowsService) SelfTest(ctx context.Context) error {
+	return selfTest(ctx, ws, ws.Config)
+}
+
+func (ws *windowsService) Reconcile(desired ReconcileSpec) (bool, error) {
+	return reconcile(ws, desired)
+}
+
+func (ws *windowsService) Reinstall() error {
+	return reinstall(ws)
+}
+
+func (ws *windowsService) Describe() ([]byte, error) {
+	return describe(ws, ws.Config)
+}
+
+func (ws *windowsService) AppliedOptions() ([]string, error) {
+	exepath, err := ws.execPath()
+	if err != nil {
+		return nil, err
+	}
+	return appliedOptions(ws.Config, func(c *Config) ([]byte, error) {
+		mc, err := (&windowsService{Config: c}).config(exepath)
+		if err != nil {
+			return nil, err
+		}
+		return scmDefinition(mc), nil
+	})
+}
+
+// RunOnce runs the executable in a job object that kills the processes it
+// starts along with it on timeout. The service control manager can only
+// supervise installed services, so the run does not go through it.
+func (ws *windowsService) RunOnce(timeout time.Duration) (int, error) {
+	if timeout <= 0 {
+		return -1, errRunOnceTimeout
+	}
+	exepath, err := ws.execPath()
+	if err != nil {
+		return -1, err
+	}
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer windows.CloseHandle(job)
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+		BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
+			LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+		},
+	}
+	_, err = windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if err != nil {
+		return -1, err
+	}
+
+	env, err := ws.environment()
+	if err != nil {
+		return -1, err
+	}
+	cmd := exec.Command(exepath, ws.Arguments...)
+	cmd.Dir = ws.WorkingDirectory
+	for _, e := range env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+	if cmd.Env != nil {
+		cmd.Env = append(os.Environ(), cmd.Env...)
+	}
+	if err = cmd.Start(); err != nil {
+		return -1, err
+	}
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid))
+	if err == nil {
+		err = windows.AssignProcessToJobObject(job, process)
+		windows.CloseHandle(process)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return -1, err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+		return exitCode(err)
+	case <-time.After(timeout):
+		windows.TerminateJobObject(job, 1)
+		<-done
+		return -1, &timeoutError{exepath, timeout}
+	}
+}
+
+func (ws *windowsService) PathDrift() (installed, current string, drifted bool, err error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return "", "", false, err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		return "", "", false, openError(err)
+	}
+	defer s.Close()
+	c, err := s.Config()
+	if err != nil {
+		return "", "", false, err
+	}
+	installed, _ = parseImagePath(c.BinaryPathName)
+	return pathDrift(ws.Config, installed)
+}
+
+func (ws *windowsService) DefinitionChecksum() (string, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return "", err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		return "", openError(err)
+	}
+	defer s.Close()
+
+	c, err := s.Config()
+	if err != nil {
+		return "", err
+	}
+	return checksum(scmDefinition(c)), nil
+}
+
+// Preflight checks the service control manager can be changed, which
+// requires running as an administrator. No external tools are used.
+func (ws *windowsService) Preflight() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Install prerequisites missing: service control manager not accessible, run as administrator: %v.", err)
+	}
+	return m.Disconnect()
+}
+
 func (ws *windowsService) Uninstall() error {
 	m, err := mgr.Connect()
 	if err != nil {
@@ -229,10 +835,19 @@ func (ws *windowsService) Uninstall() error {
 	}
 	defer m.Disconnect()
 	s, err := m.OpenService(ws.Name)
+	if err == windows.ERROR_SERVICE_DOES_NOT_EXIST {
+		// Clean up an event source left behind by an interrupted Uninstall.
+		eventlog.Remove(ws.Name)
+		return ErrServiceIsNotInstalled
+	}
 	if err != nil {
-		return fmt.Errorf("service %s is not installed", ws.Name)
+		return err
 	}
 	defer s.Close()
+	// The SCM deletes a running service only once it stopped.
+	if err = stopBeforeUninstall(ws, ws.Config); err != nil {
+		return err
+	}
 	err = s.Delete()
 	if err != nil {
 		return err
@@ -245,6 +860,9 @@ func (ws *windowsService) Uninstall() error {
 }
 
 func (ws *windowsService) Run() error {
+	if interactiveErr != nil {
+		return fmt.Errorf("Failed to tell a service from an interactive session: %v", interactiveErr)
+	}
 	ws.setError(nil)
 	if !interactive {
 		// Return error messages from start and stop routines
@@ -276,6 +894,9 @@ func (ws *windowsService) Run() error {
 }
 
 func (ws *windowsService) Start() error {
+	if err := verifyDefinition(ws, ws.Config); err != nil {
+		return err
+	}
 	m, err := mgr.Connect()
 	if err != nil {
 		return err
@@ -287,7 +908,17 @@ func (ws *windowsService) Start() error {
 		return err
 	}
 	defer s.Close()
-	return s.Start()
+	return startService(s)
+}
+
+// startService starts s. As with systemd, starting a running service is not
+// an error.
+func startService(s *mgr.Service) error {
+	err := s.Start()
+	if err == windows.ERROR_SERVICE_ALREADY_RUNNING {
+		return nil
+	}
+	return err
 }
 
 func (ws *windowsService) Stop() error {
@@ -303,7 +934,12 @@ func (ws *windowsService) Stop() error {
 	}
 	defer s.Close()
 
-	return ws.stopWait(s)
+	preStopErr := ws.preStop()
+	err = ws.stopWait(s)
+	if err != nil {
+		return err
+	}
+	return preStopErr
 }
 
 func (ws *windowsService) Restart() error {
@@ -319,12 +955,99 @@ func (ws *windowsService) Restart() error {
 	}
 	defer s.Close()
 
+	preStopErr := ws.preStop()
 	err = ws.stopWait(s)
 	if err != nil {
 		return err
 	}
 
-	return s.Start()
+	err = startService(s)
+	if err != nil {
+		return err
+	}
+	return preStopErr
+}
+
+func (ws *windowsService) NetworkStats() (in, out uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
+
+// vmCounters is the VM_COUNTERS structure NtQueryInformationProcess returns
+// for ProcessVmCounters.
+type vmCounters struct {
+	PeakVirtualSize            uintptr
+	VirtualSize                uintptr
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+}
+
+// PID returns the process id the service manager reports for the service.
+func (ws *windowsService) PID() (int, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return 0, err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		return 0, openError(err)
+	}
+	defer s.Close()
+
+	status, err := s.Query()
+	if err != nil {
+		return 0, err
+	}
+	if status.State != svc.Running || status.ProcessId == 0 {
+		return 0, ErrServiceIsNotRunning
+	}
+	return int(status.ProcessId), nil
+}
+
+// ResourceUsage reports the service process only: the CPU time, the working
+// set as the memory and the open handles as the open files.
+func (ws *windowsService) ResourceUsage() (ResourceUsage, error) {
+	pid, err := ws.PID()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return ResourceUsage{}, fmt.Errorf("Failed to open process %d: %v", pid, err)
+	}
+	defer windows.CloseHandle(h)
+
+	var creation, exit, kernel, user windows.Filetime
+	if err = windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return ResourceUsage{}, err
+	}
+	// Filetime counts 100 nanoseconds, Nanoseconds assumes an epoch.
+	ticks := func(t windows.Filetime) time.Duration {
+		return time.Duration(uint64(t.HighDateTime)<<32|uint64(t.LowDateTime)) * 100
+	}
+	usage := ResourceUsage{CPUTime: ticks(kernel) + ticks(user), OpenFiles: -1}
+
+	var counters vmCounters
+	err = windows.NtQueryInformationProcess(h, windows.ProcessVmCounters, unsafe.Pointer(&counters), uint32(unsafe.Sizeof(counters)), nil)
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	usage.Memory = uint64(counters.WorkingSetSize)
+
+	var handles uint32
+	if windows.NtQueryInformationProcess(h, windows.ProcessHandleCount, unsafe.Pointer(&handles), uint32(unsafe.Sizeof(handles)), nil) == nil {
+		usage.OpenFiles = int(handles)
+	}
+	return usage, nil
 }
 
 func (ws *windowsService) Status() error {
@@ -336,7 +1059,7 @@ func (ws *windowsService) Status() error {
 
 	s, err := m.OpenService(ws.Name)
 	if err != nil {
-		return err
+		return openError(err)
 	}
 	defer s.Close()
 
@@ -352,10 +1075,90 @@ func (ws *windowsService) Status() error {
 	return nil
 }
 
+// openError returns ErrServiceIsNotInstalled if opening the service failed
+// because it doesn't exist, and the error otherwise, such as when access is
+// denied.
+func openError(err error) error {
+	if err == windows.ERROR_SERVICE_DOES_NOT_EXIST {
+		return ErrServiceIsNotInstalled
+	}
+	return err
+}
+
+// Installed opens the service control manager and the service with the least
+// access rights, unlike mgr, so that it works without administrator rights.
+func (ws *windowsService) Installed() (bool, error) {
+	m, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_CONNECT)
+	if err != nil {
+		return false, err
+	}
+	defer windows.CloseServiceHandle(m)
+
+	name, err := windows.UTF16PtrFromString(ws.Name)
+	if err != nil {
+		return false, err
+	}
+	s, err := windows.OpenService(m, name, windows.SERVICE_QUERY_STATUS)
+	if err == windows.ERROR_SERVICE_DOES_NOT_EXIST {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	windows.CloseServiceHandle(s)
+	return true, nil
+}
+
+// SetStartType changes the start type in the service control manager.
+// Delayed start only applies to StartAutomatic, which keeps the one set.
+func (ws *windowsService) SetStartType(startType StartType) error {
+	if err := checkStartType(ws, startType); err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c, err := s.Config()
+	if err != nil {
+		return err
+	}
+	c.StartType = scmStartTypes[startType]
+	if startType != StartAutomatic {
+		c.DelayedAutoStart = false
+	}
+	return s.UpdateConfig(c)
+}
+
+// preStop runs the PreStopCommand option, if set. The service is stopped
+// even if it fails.
+func (ws *windowsService) preStop() error {
+	command := ws.Option.strings(optionPreStopCommand, nil)
+	if len(command) == 0 {
+		return nil
+	}
+	out, err := Runner.Run(ws.commandTimeout(), command[0], command[1:]...)
+	if err != nil {
+		return fmt.Errorf("PreStopCommand %q failed: %v, %s", command[0], err, out)
+	}
+	return nil
+}
+
 func (ws *windowsService) stopWait(s *mgr.Service) error {
 	// First stop the service. Then wait for the service to
-	// actually stop before starting it.
+	// actually stop before starting it. As with systemd, stopping
+	// a stopped service is not an error.
 	status, err := s.Control(svc.Stop)
+	if err == windows.ERROR_SERVICE_NOT_ACTIVE {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -380,6 +1183,30 @@ func (ws *windowsService) stopWait(s *mgr.Service) error {
 	return nil
 }
 
+// killGroupOnCancel leaves cmd to be killed alone; the WaitDelay of the
+// runner stops waiting for the output of processes it started.
+func killGroupOnCancel(cmd *exec.Cmd) {}
+
+// dialLog opens the named pipe, such as \\.\pipe\logs, a socketLogger writes to.
+func dialLog(address string) (io.WriteCloser, error) {
+	return os.OpenFile(address, os.O_WRONLY, 0)
+}
+
+// Listeners is not supported on Windows, which has no socket activation.
+func Listeners() (map[string][]net.Listener, error) {
+	return nil, ErrNotSupported
+}
+
+// ListenFDs returns an empty slice on Windows, which has no socket activation.
+func ListenFDs() ([]net.Listener, error) {
+	return []net.Listener{}, nil
+}
+
+// ReExec is not supported on Windows, where a process cannot replace its own image.
+func ReExec() error {
+	return ErrNotSupported
+}
+
 // getStopTimeout fetches the time before windows will kill the service.
 func getStopTimeout() time.Duration {
 	// For default and paths see https://support.microsoft.com/en-us/kb/146092
@@ -406,6 +1233,9 @@ func (ws *windowsService) Logger(errs chan<- error) (Logger, error) {
 	return ws.SystemLogger(errs)
 }
 func (ws *windowsService) SystemLogger(errs chan<- error) (Logger, error) {
+	if address := ws.Option.string(optionLogSocket, ""); len(address) != 0 {
+		return newSocketLogger(ws.Name, address, errs), nil
+	}
 	el, err := eventlog.Open(ws.Name)
 	if err != nil {
 		return nil, err
@@ -5,10 +5,148 @@
 package service
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc/mgr"
 )
 
 func TestTimeout(t *testing.T) {
 	stopSpan := getStopTimeout()
 	t.Log("Max Stop Duration", stopSpan)
 }
+
+func TestResourceString(t *testing.T) {
+	ws := &windowsService{Config: &Config{
+		Option: KeyValue{
+			optionDisplayNameResource: `@%SystemRoot%\system32\app.dll,-101`,
+			optionDescriptionResource: "app.dll",
+		},
+	}}
+	v, err := ws.resourceString(optionDisplayNameResource, "literal")
+	if err != nil || v != `@%SystemRoot%\system32\app.dll,-101` {
+		t.Fatal("display name", v, err)
+	}
+	if _, err = ws.resourceString(optionDescriptionResource, "literal"); err == nil {
+		t.Fatal("expected invalid indirect string to fail")
+	}
+	ws.Option = nil
+	v, err = ws.resourceString(optionDisplayNameResource, "literal")
+	if err != nil || v != "literal" {
+		t.Fatal("fallback", v, err)
+	}
+}
+
+func TestBinaryPathName(t *testing.T) {
+	ws := &windowsService{Config: &Config{
+		Arguments: []string{"-config", `C:\My Data\app.conf`},
+	}}
+	c, err := ws.config(`C:\Program Files\My App\svc.exe`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.BinaryPathName != `"C:\Program Files\My App\svc.exe" -config "C:\My Data\app.conf"` {
+		t.Fatalf("ImagePath not quoted: %s", c.BinaryPathName)
+	}
+	if p := binaryPathName(`C:\app\svc.exe`, nil); p != `"C:\app\svc.exe"` {
+		t.Fatalf("ImagePath not quoted: %s", p)
+	}
+}
+
+func TestStartType(t *testing.T) {
+	ws := &windowsService{Config: &Config{}}
+	c, err := ws.config(`C:\app\svc.exe`)
+	if err != nil || c.StartType != mgr.StartAutomatic || c.DelayedAutoStart {
+		t.Fatal("default start type", c.StartType, c.DelayedAutoStart, err)
+	}
+	ws.Option = KeyValue{"DelayedAutoStart": true}
+	if c, err = ws.config(`C:\app\svc.exe`); err != nil || c.StartType != mgr.StartAutomatic || !c.DelayedAutoStart {
+		t.Fatal("delayed start", c.StartType, c.DelayedAutoStart, err)
+	}
+	ws.Option = KeyValue{"StartType": "manual"}
+	if c, err = ws.config(`C:\app\svc.exe`); err != nil || c.StartType != mgr.StartManual {
+		t.Fatal("manual start", c.StartType, err)
+	}
+	for _, option := range []KeyValue{
+		{"StartType": "boot"},
+		{"StartType": "disabled", "DelayedAutoStart": true},
+	} {
+		ws.Option = option
+		if _, err = ws.config(`C:\app\svc.exe`); err == nil {
+			t.Errorf("%v accepted", option)
+		}
+	}
+}
+
+func TestRecoveryActions(t *testing.T) {
+	ws := &windowsService{Config: &Config{}}
+	if actions, _, err := ws.recoveryActions(); actions != nil || err != nil {
+		t.Fatal("actions without Restart", actions, err)
+	}
+	ws.Option = KeyValue{"Restart": "on-failure", "RestartSec": 30 * time.Second}
+	actions, reset, err := ws.recoveryActions()
+	if err != nil || len(actions) != 3 || reset != 24*60*60 {
+		t.Fatal("restart actions", actions, reset, err)
+	}
+	for _, a := range actions {
+		if a.Type != mgr.ServiceRestart || a.Delay != 30*time.Second {
+			t.Errorf("unexpected action %+v", a)
+		}
+	}
+	ws.Option = KeyValue{"Restart": "always", "FailureResetPeriod": -time.Hour}
+	if _, _, err = ws.recoveryActions(); err == nil {
+		t.Error("negative reset period accepted")
+	}
+}
+
+type failingRunner struct {
+	command string
+}
+
+func (r *failingRunner) Run(timeout time.Duration, command string, arguments ...string) ([]byte, error) {
+	r.command = strings.Join(append([]string{command}, arguments...), " ")
+	return []byte("draining timed out"), errors.New("exit status 1")
+}
+
+func TestPreStop(t *testing.T) {
+	defer func(previous CommandRunner) { Runner = previous }(Runner)
+	r := &failingRunner{}
+	Runner = r
+
+	ws := &windowsService{Config: &Config{}}
+	if err := ws.preStop(); err != nil || r.command != "" {
+		t.Fatal("ran without PreStopCommand", r.command, err)
+	}
+	ws.Option = KeyValue{"PreStopCommand": []string{`C:\app\drain.exe`, "-wait"}}
+	err := ws.preStop()
+	if r.command != `C:\app\drain.exe -wait` || err == nil || !strings.Contains(err.Error(), "draining timed out") {
+		t.Fatal("unexpected pre-stop", r.command, err)
+	}
+}
+
+func TestParseImagePath(t *testing.T) {
+	for _, tc := range []struct {
+		imagePath, exepath string
+		args               []string
+	}{
+		{`"C:\Program Files\My App\svc.exe" -config "C:\My Data\app.conf"`, `C:\Program Files\My App\svc.exe`, []string{"-config", `C:\My Data\app.conf`}},
+		{`"C:\app\svc.exe"`, `C:\app\svc.exe`, nil},
+		{`C:\app\svc.exe -v`, `C:\app\svc.exe`, []string{"-v"}},
+		{`C:\Program Files\app\svc.EXE -v  run`, `C:\Program Files\app\svc.EXE`, []string{"-v", "run"}},
+		{`C:\app\svc -v`, `C:\app\svc`, []string{"-v"}},
+		{`"C:\app\svc.exe" "say \"hi\"" "C:\dir\\" ""`, `C:\app\svc.exe`, []string{`say "hi"`, `C:\dir\`, ""}},
+	} {
+		exepath, args := parseImagePath(tc.imagePath)
+		if exepath != tc.exepath || strings.Join(args, "|") != strings.Join(tc.args, "|") || len(args) != len(tc.args) {
+			t.Errorf("%s: parsed %q %q", tc.imagePath, exepath, args)
+		}
+	}
+
+	args := []string{`say "hi"`, `C:\dir\`, `a\\b`, "", `\"`}
+	exepath, parsed := parseImagePath(binaryPathName(`C:\Program Files\svc.exe`, args))
+	if exepath != `C:\Program Files\svc.exe` || strings.Join(parsed, "|") != strings.Join(args, "|") || len(parsed) != len(args) {
+		t.Errorf("round trip parsed %q %q", exepath, parsed)
+	}
+}
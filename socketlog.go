@@ -0,0 +1,107 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxPendingLogs is how many messages a socketLogger keeps while it cannot
+// reach the socket. Losing messages beyond that is reported as an error.
+const maxPendingLogs = 256
+
+// socketLogger writes log lines to a Unix socket or, on Windows, a named pipe,
+// such as one read by a log collecting sidecar. It reconnects on the next
+// message after a failure, keeping messages until the connection is back.
+type socketLogger struct {
+	name    string
+	address string
+	errs    chan<- error
+
+	mu      sync.Mutex
+	conn    io.WriteCloser
+	pending [][]byte
+}
+
+func newSocketLogger(name, address string, errs chan<- error) *socketLogger {
+	return &socketLogger{name: name, address: address, errs: errs}
+}
+
+func (l *socketLogger) send(err error) error {
+	if err != nil && l.errs != nil {
+		l.errs <- err
+	}
+	return err
+}
+
+func (l *socketLogger) write(level, message string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pending = append(l.pending, []byte(fmt.Sprintf("%s %s: %s\n", l.name, level, message)))
+	if l.conn == nil {
+		conn, err := dialLog(l.address)
+		if err != nil {
+			return l.send(l.overflow(err))
+		}
+		l.conn = conn
+	}
+	for len(l.pending) != 0 {
+		if _, err := l.conn.Write(l.pending[0]); err != nil {
+			l.conn.Close()
+			l.conn = nil
+			return l.send(l.overflow(err))
+		}
+		l.pending = l.pending[1:]
+	}
+	return nil
+}
+
+// overflow drops the oldest message once too many are pending and reports
+// err in that case only; until then the failure is considered transient.
+func (l *socketLogger) overflow(err error) error {
+	if len(l.pending) <= maxPendingLogs {
+		return nil
+	}
+	l.pending = l.pending[1:]
+	return fmt.Errorf("Failed to log to %s: %v", l.address, err)
+}
+
+func (l *socketLogger) Error(v ...interface{}) error {
+	return l.write("E", fmt.Sprint(v...))
+}
+func (l *socketLogger) Warning(v ...interface{}) error {
+	return l.write("W", fmt.Sprint(v...))
+}
+func (l *socketLogger) Info(v ...interface{}) error {
+	return l.write("I", fmt.Sprint(v...))
+}
+func (l *socketLogger) Errorf(format string, a ...interface{}) error {
+	return l.write("E", fmt.Sprintf(format, a...))
+}
+func (l *socketLogger) Warningf(format string, a ...interface{}) error {
+	return l.write("W", fmt.Sprintf(format, a...))
+}
+func (l *socketLogger) Infof(format string, a ...interface{}) error {
+	return l.write("I", fmt.Sprintf(format, a...))
+}
+func (l *socketLogger) Log(level Level, msg string, kv ...interface{}) error {
+	return l.write(levelLetter(level), formatFields(msg, kv))
+}
+
+// levelLetter returns the prefix of the log lines of level.
+func levelLetter(level Level) string {
+	switch level {
+	case LevelDebug:
+		return "D"
+	case LevelWarning:
+		return "W"
+	case LevelError:
+		return "E"
+	}
+	return "I"
+}